@@ -199,6 +199,31 @@ func ensureClientTrafficsSchema() error {
 		}
 	}
 
+	// 补充后续版本新增的列（公平使用限速相关）
+	newColumns := []struct {
+		name       string
+		definition string
+	}{
+		{"fair_use", "INTEGER NOT NULL DEFAULT 0"},
+		{"hard_cap", "INTEGER NOT NULL DEFAULT 0"},
+		{"throttled", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, column := range newColumns {
+		var columnCount int64
+		err = db.Raw("SELECT COUNT(*) FROM pragma_table_info('client_traffics') WHERE name = ?", column.name).Scan(&columnCount).Error
+		if err != nil {
+			return err
+		}
+		if columnCount == 0 {
+			log.Printf("Adding column %s to client_traffics...", column.name)
+			err = db.Exec("ALTER TABLE client_traffics ADD COLUMN " + column.name + " " + column.definition).Error
+			if err != nil {
+				log.Printf("Failed to add column %s: %v", column.name, err)
+				return err
+			}
+		}
+	}
+
 	// 检查联合唯一索引是否存在
 	var indexCount int64
 	err = db.Raw("SELECT COUNT(*) FROM sqlite_master WHERE type='index' AND name='idx_inbound_email'").Scan(&indexCount).Error
@@ -256,6 +281,15 @@ func initModels() error {
 		&model.OutboundTraffics{},
 		&model.Setting{},
 		&model.InboundClientIps{},
+		&model.ClientIpGeo{},
+		&model.SharingScore{},
+		&model.DeviceBan{},
+		&model.SubIdRotation{},
+		&model.SubAccessLog{},
+		&model.SubSource{},
+		&model.XrayTemplateVersion{},
+		&model.XrayCrash{},
+		&model.AccessStat{},
 		// &xray.ClientTraffic{}, // 手动处理，不使用 AutoMigrate
 		&model.HistoryOfSeeders{},
 		&LinkHistory{},      // 把 LinkHistory 表也迁移
@@ -371,7 +405,31 @@ func InitDB(dbPath string) error {
 	if err := initUser(); err != nil {
 		return err
 	}
-	return runSeeders(isUsersEmpty)
+	if err := runSeeders(isUsersEmpty); err != nil {
+		return err
+	}
+	return seedIPLimitBackend(isUsersEmpty)
+}
+
+// seedIPLimitBackend keeps fail2ban enforcing the IP limit of installs that
+// predate the ipLimitBackend setting. New installs use the default backend.
+func seedIPLimitBackend(isUsersEmpty bool) error {
+	var seeded int64
+	db.Model(&model.HistoryOfSeeders{}).Where("seeder_name = ?", "IPLimitBackend").Count(&seeded)
+	if seeded > 0 {
+		return nil
+	}
+	if !isUsersEmpty {
+		var count int64
+		db.Model(&model.Setting{}).Where("key = ?", "ipLimitBackend").Count(&count)
+		if count == 0 {
+			err := db.Create(&model.Setting{Key: "ipLimitBackend", Value: "fail2ban"}).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return db.Create(&model.HistoryOfSeeders{SeederName: "IPLimitBackend"}).Error
 }
 
 func CloseDB() error {
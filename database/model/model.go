@@ -1,6 +1,7 @@
 package model
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"x-ui/util/json_util"
@@ -41,6 +42,18 @@ type Inbound struct {
 	// gorm:"column:device_limit;default:0" 定义了数据库中的字段名和默认值。
 	DeviceLimit int `json:"deviceLimit" form:"deviceLimit" gorm:"column:device_limit;default:0"`
 
+	// 中文注释: 设备超限时的处理策略：swap（替换凭据，默认）、drop（只屏蔽超出的新IP）、warn（仅通知）、disable（暂停N分钟）。
+	// DeviceLimitGrace 为超限后的宽限秒数，DeviceLimitTTL 为IP多少秒未活跃后过期，DeviceLimitMinutes 为 drop/disable 的持续分钟数，0 均使用默认值。
+	DeviceLimitStrategy string `json:"deviceLimitStrategy" form:"deviceLimitStrategy"`
+	DeviceLimitGrace    int    `json:"deviceLimitGrace" form:"deviceLimitGrace" gorm:"default:0"`
+	DeviceLimitTTL      int    `json:"deviceLimitTtl" form:"deviceLimitTtl" gorm:"default:0"`
+	DeviceLimitMinutes  int    `json:"deviceLimitMinutes" form:"deviceLimitMinutes" gorm:"default:0"`
+
+	// 中文注释: 入站默认带宽限制（KB/s）与突发量（KB），未单独设置限速的客户端继承这些值。
+	UpLimit   int `json:"upLimit" form:"upLimit" gorm:"default:0"`
+	DownLimit int `json:"downLimit" form:"downLimit" gorm:"default:0"`
+	Burst     int `json:"burst" form:"burst" gorm:"default:0"`
+
 	ClientStats []xray.ClientTraffic `gorm:"foreignKey:InboundId;references:Id" json:"clientStats" form:"clientStats"`
 
 	// v2board integration fields
@@ -72,6 +85,141 @@ type InboundClientIps struct {
 	Ips         string `json:"ips" form:"ips"`
 }
 
+// ClientIpGeo is an IP a client was seen from, resolved to its country and
+// autonomous system.
+type ClientIpGeo struct {
+	Id          int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	ClientEmail string `json:"clientEmail" form:"clientEmail" gorm:"uniqueIndex:idx_client_ip_geo"`
+	Ip          string `json:"ip" form:"ip" gorm:"uniqueIndex:idx_client_ip_geo"`
+	Country     string `json:"country" form:"country" gorm:"index"`
+	Asn         uint   `json:"asn" form:"asn"`
+	AsnOrg      string `json:"asnOrg" form:"asnOrg"`
+	FirstSeen   int64  `json:"firstSeen" form:"firstSeen"`
+	LastSeen    int64  `json:"lastSeen" form:"lastSeen"`
+}
+
+// SharingScore is how likely it is that a client shares its account, with
+// the signals of the last day the score was made of and the actions taken.
+type SharingScore struct {
+	Id           int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Email        string `json:"email" form:"email" gorm:"uniqueIndex"`
+	Score        int    `json:"score" form:"score"`
+	Subnets      int    `json:"subnets" form:"subnets"`
+	Asns         int    `json:"asns" form:"asns"`
+	Countries    int    `json:"countries" form:"countries"`
+	Simultaneous int    `json:"simultaneous" form:"simultaneous"`
+	Travels      int    `json:"travels" form:"travels"`
+	Reasons      string `json:"reasons" form:"reasons"`
+	NotifiedAt   int64  `json:"notifiedAt" form:"notifiedAt"`
+	Tagged       bool   `json:"tagged" form:"tagged"`
+	Limited      bool   `json:"limited" form:"limited"`
+	UpdatedAt    int64  `json:"updatedAt" form:"updatedAt"`
+}
+
+// DeviceBan records a client that was online from more IPs than the device
+// limit of its inbound allows, and what was done about it in Xray: its
+// credential swapped out, its newest IPs (BlockedIps) dropped by routing rules
+// or the client removed until ExpiresAt.
+type DeviceBan struct {
+	Id         int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Email      string `json:"email" form:"email" gorm:"uniqueIndex"`
+	InboundId  int    `json:"inboundId" form:"inboundId"`
+	Tag        string `json:"tag" form:"tag"`
+	Protocol   string `json:"protocol" form:"protocol"`
+	Strategy   string `json:"strategy" form:"strategy"`
+	Reason     string `json:"reason" form:"reason"`
+	Ips        string `json:"ips" form:"ips"`
+	BlockedIps string `json:"blockedIps" form:"blockedIps"`
+	BannedAt   int64  `json:"bannedAt" form:"bannedAt"`
+	ExpiresAt  int64  `json:"expiresAt" form:"expiresAt"`
+}
+
+// SubIdRotation keeps a retired subscription ID working until ExpiryTime
+// so that clients can pick up the new one during the grace period.
+type SubIdRotation struct {
+	Id         int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	OldSubId   string `json:"oldSubId" form:"oldSubId" gorm:"uniqueIndex"`
+	NewSubId   string `json:"newSubId" form:"newSubId" gorm:"index"`
+	ExpiryTime int64  `json:"expiryTime" form:"expiryTime"`
+	CreatedAt  int64  `json:"createdAt" form:"createdAt"`
+}
+
+// SubAccessLog records a single fetch of a subscription endpoint.
+type SubAccessLog struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	SubId     string `json:"subId" form:"subId" gorm:"index"`
+	Ip        string `json:"ip" form:"ip" gorm:"index"`
+	Country   string `json:"country" form:"country"`
+	UserAgent string `json:"userAgent" form:"userAgent"`
+	Format    string `json:"format" form:"format"`
+	Status    int    `json:"status" form:"status"`
+	Size      int    `json:"size" form:"size"`
+	Time      int64  `json:"time" form:"time" gorm:"index"`
+}
+
+// SubSource is an upstream subscription whose nodes are appended to the
+// subscription of SubId, or to every subscription when SubId is empty.
+type SubSource struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Name      string `json:"name" form:"name"`
+	Url       string `json:"url" form:"url"`
+	SubId     string `json:"subId" form:"subId" gorm:"index"`
+	Prefix    string `json:"prefix" form:"prefix"`
+	Interval  int    `json:"interval" form:"interval"`
+	Enable    bool   `json:"enable" form:"enable"`
+	Format    string `json:"format" form:"format"`
+	ETag      string `json:"etag" form:"-"`
+	Nodes     string `json:"nodes" form:"-"`
+	NodeCount int    `json:"nodeCount" form:"-"`
+	LastFetch int64  `json:"lastFetch" form:"-"`
+	LastError string `json:"lastError" form:"-"`
+}
+
+// XrayTemplateVersion is a saved version of the Xray config template. The
+// latest version is the one in use. ConfigHash is the hash of the config
+// generated from it when Xray last started with it, at AppliedAt.
+type XrayTemplateVersion struct {
+	Id         int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Template   string `json:"template,omitempty" form:"-"`
+	Author     string `json:"author" form:"-"`
+	Comment    string `json:"comment" form:"comment"`
+	CreatedAt  int64  `json:"createdAt" form:"-" gorm:"index"`
+	Pinned     bool   `json:"pinned" form:"pinned"`
+	ConfigHash string `json:"configHash" form:"-"`
+	AppliedAt  int64  `json:"appliedAt" form:"-"`
+}
+
+// XrayCrash is an exit of Xray the panel did not ask for. LogLines are the
+// last lines Xray wrote, ConfigHash is the hash of the config it ran with.
+// CrashLoop is set on the crash that made the panel stop restarting it.
+type XrayCrash struct {
+	Id           int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	CreatedAt    int64  `json:"createdAt" gorm:"index"`
+	Version      string `json:"version"`
+	Embedded     bool   `json:"embedded"`
+	Uptime       uint64 `json:"uptime"`
+	ExitError    string `json:"exitError"`
+	ConfigHash   string `json:"configHash"`
+	LogLines     string `json:"logLines"`
+	RestartDelay int    `json:"restartDelay"`
+	CrashLoop    bool   `json:"crashLoop"`
+}
+
+// AccessStat counts the connections a client made to a destination through
+// an outbound within one hour, as read from the access log of Xray. Hour is
+// the unix time the hour starts at. Destination is the domain or IP, or only
+// its category when the privacy switch is on; Email is empty for connections
+// of no known client.
+type AccessStat struct {
+	Id          int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Hour        int64  `json:"hour" gorm:"uniqueIndex:idx_access_stat"`
+	Email       string `json:"email" gorm:"uniqueIndex:idx_access_stat"`
+	Destination string `json:"destination" gorm:"uniqueIndex:idx_access_stat"`
+	Outbound    string `json:"outbound" gorm:"uniqueIndex:idx_access_stat"`
+	Accepted    int64  `json:"accepted"`
+	Rejected    int64  `json:"rejected"`
+}
+
 type HistoryOfSeeders struct {
 	Id         int    `json:"id" gorm:"primaryKey;autoIncrement"`
 	SeederName string `json:"seederName"`
@@ -82,23 +230,85 @@ func (i *Inbound) GenXrayInboundConfig() *xray.InboundConfig {
 	if listen != "" {
 		listen = fmt.Sprintf("\"%v\"", listen)
 	}
+	settings := i.Settings
+	if i.Protocol == WireGuard {
+		settings = GenWireguardSettings(i.Settings, nil)
+	}
 	return &xray.InboundConfig{
 		Listen:         json_util.RawMessage(listen),
 		Port:           i.Port,
 		Protocol:       string(i.Protocol),
-		Settings:       json_util.RawMessage(i.Settings),
+		Settings:       json_util.RawMessage(settings),
 		StreamSettings: json_util.RawMessage(i.StreamSettings),
 		Tag:            i.Tag,
 		Sniffing:       json_util.RawMessage(i.Sniffing),
 	}
 }
 
+// GenWireguardSettings turns the clients of a wireguard inbound into Xray
+// peers next to the manually configured ones. Disabled clients, and clients
+// rejected by enabled when it is not nil, are left out.
+func GenWireguardSettings(rawSettings string, enabled func(email string) bool) string {
+	var settings map[string]any
+	if err := json.Unmarshal([]byte(rawSettings), &settings); err != nil {
+		return rawSettings
+	}
+	peers, _ := settings["peers"].([]any)
+	clients, _ := settings["clients"].([]any)
+	for _, client := range clients {
+		c, ok := client.(map[string]any)
+		if !ok {
+			continue
+		}
+		if enable, ok := c["enable"].(bool); ok && !enable {
+			continue
+		}
+		email, _ := c["email"].(string)
+		if enabled != nil && !enabled(email) {
+			continue
+		}
+		publicKey, _ := c["publicKey"].(string)
+		if publicKey == "" {
+			continue
+		}
+		peer := map[string]any{
+			"publicKey":  publicKey,
+			"allowedIPs": c["allowedIPs"],
+		}
+		if preSharedKey, ok := c["preSharedKey"].(string); ok && preSharedKey != "" {
+			peer["preSharedKey"] = preSharedKey
+		}
+		peers = append(peers, peer)
+	}
+	settings["peers"] = peers
+	delete(settings, "clients")
+	delete(settings, "addressPool")
+	delete(settings, "clientDns")
+
+	result, err := json.Marshal(settings)
+	if err != nil {
+		return rawSettings
+	}
+	return string(result)
+}
+
 type Setting struct {
 	Id    int    `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
 	Key   string `json:"key" form:"key"`
 	Value string `json:"value" form:"value"`
 }
 
+// RoutingPolicy is how the traffic of clients is routed: through a chosen
+// outbound, without some geosite categories or BitTorrent, and only to (or
+// not to) some destination countries.
+type RoutingPolicy struct {
+	Outbound        string   `json:"outbound,omitempty"`
+	BlockGeosite    []string `json:"blockGeosite,omitempty"`
+	BlockBittorrent bool     `json:"blockBittorrent,omitempty"`
+	AllowCountries  []string `json:"allowCountries,omitempty"`
+	DenyCountries   []string `json:"denyCountries,omitempty"`
+}
+
 type Client struct {
 	ID       string `json:"id"`
 	Security string `json:"security"`
@@ -107,6 +317,30 @@ type Client struct {
 	// 中文注释: 新增“限速”字段，单位 KB/s，0 表示不限速。
 	SpeedLimit int `json:"speedLimit" form:"speedLimit"`
 
+	// 中文注释: 分别限制上传/下载带宽，单位 KB/s，0 表示沿用 SpeedLimit 或入站默认值。
+	// Burst 为允许的突发量，单位 KB，0 表示自动计算。
+	UpLimit   int `json:"upLimit" form:"upLimit"`
+	DownLimit int `json:"downLimit" form:"downLimit"`
+	Burst     int `json:"burst" form:"burst"`
+
+	// 中文注释: 公平使用策略。FairUseSpeed > 0 时，流量用尽后不再禁用客户端，
+	// 而是降速到 FairUseSpeed（KB/s）直到本周期结束；HardCap > 0 时，总用量达到 HardCap（字节）仍会禁用。
+	FairUseSpeed int   `json:"fairUseSpeed" form:"fairUseSpeed"`
+	HardCap      int64 `json:"hardCap" form:"hardCap"`
+
+	// 中文注释: 单独为该客户端设置的设备数量限制及超限策略，为 0 或空时使用入站的设置。
+	DeviceLimit         int    `json:"deviceLimit,omitempty" form:"deviceLimit"`
+	DeviceLimitStrategy string `json:"deviceLimitStrategy,omitempty" form:"deviceLimitStrategy"`
+
+	// 中文注释: 单独为该客户端设置的路由策略，RoutingPlan 为面板设置中定义的路由套餐名称。
+	// 客户端自身的出站优先于套餐的出站，屏蔽列表与套餐的合并。
+	RoutingPlan     string   `json:"routingPlan,omitempty" form:"routingPlan"`
+	RoutingOutbound string   `json:"routingOutbound,omitempty" form:"routingOutbound"`
+	BlockGeosite    []string `json:"blockGeosite,omitempty" form:"blockGeosite"`
+	BlockBittorrent bool     `json:"blockBittorrent,omitempty" form:"blockBittorrent"`
+	AllowCountries  []string `json:"allowCountries,omitempty" form:"allowCountries"`
+	DenyCountries   []string `json:"denyCountries,omitempty" form:"denyCountries"`
+
 	Flow       string `json:"flow"`
 	Email      string `json:"email"`
 	LimitIP    int    `json:"limitIp"`
@@ -116,9 +350,18 @@ type Client struct {
 	TgID       int64  `json:"tgId" form:"tgId"`
 	SubID      string `json:"subId" form:"subId"`
 	Comment    string `json:"comment" form:"comment"`
+	Remark     string `json:"remark" form:"remark"`
+	Announce   string `json:"announce" form:"announce"`
 	Reset      int    `json:"reset" form:"reset"`
-	CreatedAt  int64  `json:"created_at,omitempty"`
-	UpdatedAt  int64  `json:"updated_at,omitempty"`
+
+	// WireGuard peer keys and tunnel addresses, only used by wireguard inbounds.
+	PrivateKey   string   `json:"privateKey,omitempty"`
+	PublicKey    string   `json:"publicKey,omitempty"`
+	PreSharedKey string   `json:"preSharedKey,omitempty"`
+	AllowedIPs   []string `json:"allowedIPs,omitempty"`
+
+	CreatedAt int64 `json:"created_at,omitempty"`
+	UpdatedAt int64 `json:"updated_at,omitempty"`
 }
 
 type VLESSSettings struct {
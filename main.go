@@ -24,7 +24,6 @@ import (
 	"x-ui/web/global"
 	"x-ui/web/job"
 	"x-ui/web/service"
-	"x-ui/xray"
 
 	"github.com/joho/godotenv"
 	"github.com/op/go-logging"
@@ -64,15 +63,6 @@ func runWebServer() {
 	inboundService := service.InboundService{}
 	lastStatus := service.Status{}
 
-	// 创建 Xray API 实例
-	xrayApi := xray.XrayAPI{}
-
-	// 注入到 XrayService 中
-	xrayService.SetXrayAPI(xrayApi)
-
-	// 注入到 InboundService 中
-	inboundService.SetXrayAPI(xrayApi)
-
 	// 〔中文注释〕: 2. 初始化 TG Bot 服务 (如果已启用)
 	tgEnable, err := settingService.GetTgbotEnabled()
 	if err != nil {
@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"x-ui/config"
 	"x-ui/logger"
@@ -82,6 +83,16 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 		RemarkModel = "-ieo"
 	}
 
+	RemarkTemplate, err := s.settingService.GetSubRemarkTemplate()
+	if err != nil {
+		RemarkTemplate = ""
+	}
+
+	SubCountry, err := s.settingService.GetSubCountry()
+	if err != nil {
+		SubCountry = ""
+	}
+
 	SubUpdates, err := s.settingService.GetSubUpdates()
 	if err != nil {
 		SubUpdates = "10"
@@ -112,11 +123,53 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 		SubTitle = ""
 	}
 
+	SubSign, err := s.settingService.GetSubSignEnable()
+	if err != nil {
+		SubSign = false
+	}
+
+	SubAccessLog, err := s.settingService.GetSubAccessLog()
+	if err != nil {
+		SubAccessLog = false
+	}
+
+	SubRateLimit, err := s.settingService.GetSubRateLimit()
+	if err != nil {
+		SubRateLimit = 0
+	}
+
+	SubIpRateLimit, err := s.settingService.GetSubIpRateLimit()
+	if err != nil {
+		SubIpRateLimit = 0
+	}
+
+	SubRateLimitAction, err := s.settingService.GetSubRateLimitAction()
+	if err != nil {
+		SubRateLimitAction = "429"
+	}
+
+	// Only the proxies in front of the subscription server may tell the IP
+	// of the client, anyone else could dodge the rate limit with a header.
+	SubTrustedProxies, err := s.settingService.GetSubTrustedProxies()
+	if err != nil {
+		SubTrustedProxies = "127.0.0.1,::1"
+	}
+	var trustedProxies []string
+	for _, proxy := range strings.Split(SubTrustedProxies, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			trustedProxies = append(trustedProxies, proxy)
+		}
+	}
+	if err := engine.SetTrustedProxies(trustedProxies); err != nil {
+		return nil, err
+	}
+
 	g := engine.Group("/")
 
 	s.sub = NewSUBController(
-		g, LinksPath, JsonPath, Encrypt, ShowInfo, RemarkModel, SubUpdates,
-		SubJsonFragment, SubJsonNoises, SubJsonMux, SubJsonRules, SubTitle)
+		g, LinksPath, JsonPath, Encrypt, ShowInfo, RemarkModel, RemarkTemplate, SubCountry, SubUpdates,
+		SubJsonFragment, SubJsonNoises, SubJsonMux, SubJsonRules, SubTitle, SubSign,
+		SubAccessLog, SubRateLimit, SubIpRateLimit, SubRateLimitAction)
 
 	return engine, nil
 }
@@ -2,10 +2,15 @@ package sub
 
 import (
 	"encoding/base64"
+	"fmt"
 	"net"
 	"strings"
 
+	"x-ui/database/model"
+	"x-ui/web/service"
+
 	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
 )
 
 type SUBController struct {
@@ -14,9 +19,16 @@ type SUBController struct {
 	subJsonPath    string
 	subEncrypt     bool
 	updateInterval string
+	subSign        bool
+	accessLog      bool
+	limitAction    string
+
+	subLimiter *rateLimiter
+	ipLimiter  *rateLimiter
 
-	subService     *SubService
-	subJsonService *SubJsonService
+	subService          *SubService
+	subJsonService      *SubJsonService
+	subscriptionService service.SubscriptionService
 }
 
 func NewSUBController(
@@ -26,20 +38,33 @@ func NewSUBController(
 	encrypt bool,
 	showInfo bool,
 	rModel string,
+	remarkTemplate string,
+	country string,
 	update string,
 	jsonFragment string,
 	jsonNoise string,
 	jsonMux string,
 	jsonRules string,
 	subTitle string,
+	subSign bool,
+	accessLog bool,
+	rateLimit int,
+	ipRateLimit int,
+	rateLimitAction string,
 ) *SUBController {
-	sub := NewSubService(showInfo, rModel)
+	sub := NewSubService(showInfo, rModel, remarkTemplate, country)
 	a := &SUBController{
 		subTitle:       subTitle,
 		subPath:        subPath,
 		subJsonPath:    jsonPath,
 		subEncrypt:     encrypt,
 		updateInterval: update,
+		subSign:        subSign,
+		accessLog:      accessLog,
+		limitAction:    rateLimitAction,
+
+		subLimiter: newRateLimiter(rateLimit),
+		ipLimiter:  newRateLimiter(ipRateLimit),
 
 		subService:     sub,
 		subJsonService: NewSubJsonService(jsonFragment, jsonNoise, jsonMux, jsonRules, sub),
@@ -53,28 +78,31 @@ func (a *SUBController) initRouter(g *gin.RouterGroup) {
 	gJson := g.Group(a.subJsonPath)
 
 	gLink.GET(":subid", a.subs)
+	gLink.GET(":subid/wireguard/:email", a.subWireguard)
 
 	gJson.GET(":subid", a.subJsons)
 }
 
 func (a *SUBController) subs(c *gin.Context) {
-	subId := c.Param("subid")
-	var host string
-	if h, err := getHostFromXFH(c.GetHeader("X-Forwarded-Host")); err == nil {
-		host = h
+	subId, ok := a.checkSubId(c)
+	if !ok {
+		a.logAccess(c, "links", 403, 0)
+		c.String(403, "Error!")
+		return
 	}
-	if host == "" {
-		host = c.GetHeader("X-Real-IP")
-	}
-	if host == "" {
-		var err error
-		host, _, err = net.SplitHostPort(c.Request.Host)
-		if err != nil {
-			host = c.Request.Host
+	if !a.checkRateLimit(c, subId) {
+		a.logAccess(c, "links", 429, 0)
+		if a.limitAction == "empty" {
+			c.String(200, "")
+		} else {
+			c.String(429, "Too Many Requests")
 		}
+		return
 	}
+	host := a.getHost(c)
 	subs, header, err := a.subService.GetSubs(subId, host)
 	if err != nil || len(subs) == 0 {
+		a.logAccess(c, "links", 400, 0)
 		c.String(400, "Error!")
 	} else {
 		result := ""
@@ -87,16 +115,77 @@ func (a *SUBController) subs(c *gin.Context) {
 		c.Writer.Header().Set("Profile-Update-Interval", a.updateInterval)
 		c.Writer.Header().Set("Profile-Title", "base64:"+base64.StdEncoding.EncodeToString([]byte(a.subTitle)))
 
+		if announce := a.subService.GetAnnounce(subId); announce != "" {
+			c.Writer.Header().Set("Announce", "base64:"+base64.StdEncoding.EncodeToString([]byte(announce)))
+			if a.subEncrypt {
+				result = a.subService.genInfoLink(announce) + "\n" + result
+			}
+		}
+
 		if a.subEncrypt {
-			c.String(200, base64.StdEncoding.EncodeToString([]byte(result)))
-		} else {
-			c.String(200, result)
+			result = base64.StdEncoding.EncodeToString([]byte(result))
 		}
+		a.logAccess(c, "links", 200, len(result))
+		c.String(200, result)
 	}
 }
 
-func (a *SUBController) subJsons(c *gin.Context) {
-	subId := c.Param("subid")
+// subWireguard exports a wireguard client as a .conf file (default), a QR code
+// of that file (format=qr) or a wireguard:// link (format=link).
+func (a *SUBController) subWireguard(c *gin.Context) {
+	subId, ok := a.checkSubId(c)
+	if !ok {
+		a.logAccess(c, "wireguard", 403, 0)
+		c.String(403, "Error!")
+		return
+	}
+	if !a.checkRateLimit(c, subId) {
+		a.logAccess(c, "wireguard", 429, 0)
+		c.String(429, "Too Many Requests")
+		return
+	}
+	email := c.Param("email")
+	host := a.getHost(c)
+
+	switch c.Query("format") {
+	case "link":
+		link, err := a.subService.GetWireguardLink(subId, email, host)
+		if err != nil {
+			a.logAccess(c, "wireguard", 400, 0)
+			c.String(400, "Error!")
+			return
+		}
+		a.logAccess(c, "wireguard", 200, len(link))
+		c.String(200, link)
+	case "qr":
+		conf, err := a.subService.GetWireguardConf(subId, email, host)
+		if err != nil {
+			a.logAccess(c, "wireguard", 400, 0)
+			c.String(400, "Error!")
+			return
+		}
+		png, err := qrcode.Encode(conf, qrcode.Medium, 512)
+		if err != nil {
+			a.logAccess(c, "wireguard", 500, 0)
+			c.String(500, "Error!")
+			return
+		}
+		a.logAccess(c, "wireguard", 200, len(png))
+		c.Data(200, "image/png", png)
+	default:
+		conf, err := a.subService.GetWireguardConf(subId, email, host)
+		if err != nil {
+			a.logAccess(c, "wireguard", 400, 0)
+			c.String(400, "Error!")
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", email+".conf"))
+		a.logAccess(c, "wireguard", 200, len(conf))
+		c.String(200, conf)
+	}
+}
+
+func (a *SUBController) getHost(c *gin.Context) string {
 	var host string
 	if h, err := getHostFromXFH(c.GetHeader("X-Forwarded-Host")); err == nil {
 		host = h
@@ -111,8 +200,29 @@ func (a *SUBController) subJsons(c *gin.Context) {
 			host = c.Request.Host
 		}
 	}
+	return host
+}
+
+func (a *SUBController) subJsons(c *gin.Context) {
+	subId, ok := a.checkSubId(c)
+	if !ok {
+		a.logAccess(c, "json", 403, 0)
+		c.String(403, "Error!")
+		return
+	}
+	if !a.checkRateLimit(c, subId) {
+		a.logAccess(c, "json", 429, 0)
+		if a.limitAction == "empty" {
+			c.String(200, "[]")
+		} else {
+			c.String(429, "Too Many Requests")
+		}
+		return
+	}
+	host := a.getHost(c)
 	jsonSub, header, err := a.subJsonService.GetJson(subId, host)
 	if err != nil || len(jsonSub) == 0 {
+		a.logAccess(c, "json", 400, 0)
 		c.String(400, "Error!")
 	} else {
 
@@ -120,11 +230,43 @@ func (a *SUBController) subJsons(c *gin.Context) {
 		c.Writer.Header().Set("Subscription-Userinfo", header)
 		c.Writer.Header().Set("Profile-Update-Interval", a.updateInterval)
 		c.Writer.Header().Set("Profile-Title", "base64:"+base64.StdEncoding.EncodeToString([]byte(a.subTitle)))
+		if announce := a.subService.GetAnnounce(subId); announce != "" {
+			c.Writer.Header().Set("Announce", "base64:"+base64.StdEncoding.EncodeToString([]byte(announce)))
+		}
 
+		a.logAccess(c, "json", 200, len(jsonSub))
 		c.String(200, jsonSub)
 	}
 }
 
+// checkSubId verifies the link signature when signing is enabled and maps a
+// rotated subId to its replacement.
+func (a *SUBController) checkSubId(c *gin.Context) (string, bool) {
+	subId := c.Param("subid")
+	if a.subSign && !a.subscriptionService.VerifySubSignature(subId, c.Query("exp"), c.Query("sig")) {
+		return "", false
+	}
+	return a.subscriptionService.ResolveSubId(subId), true
+}
+
+func (a *SUBController) checkRateLimit(c *gin.Context, subId string) bool {
+	return a.subLimiter.Allow(subId) && a.ipLimiter.Allow(c.ClientIP())
+}
+
+func (a *SUBController) logAccess(c *gin.Context, format string, status int, size int) {
+	if !a.accessLog {
+		return
+	}
+	a.subscriptionService.LogSubAccess(&model.SubAccessLog{
+		SubId:     c.Param("subid"),
+		Ip:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		Format:    format,
+		Status:    status,
+		Size:      size,
+	})
+}
+
 func getHostFromXFH(s string) (string, error) {
 	if strings.Contains(s, ":") {
 		realHost, _, err := net.SplitHostPort(s)
@@ -109,6 +109,10 @@ func (s *SubJsonService) GetJson(subId string, host string) (string, string, err
 		return "", "", nil
 	}
 
+	for _, config := range s.SubService.subSourceService.GetJsonConfigs(subId) {
+		configArray = append(configArray, json_util.RawMessage(config))
+	}
+
 	// Prepare statistics
 	for index, clientTraffic := range clientTraffics {
 		if index == 0 {
@@ -194,6 +198,10 @@ func (s *SubJsonService) getConfig(inbound *model.Inbound, client model.Client,
 				s.genVnext(inbound, streamSettings, client, vlessSettings.Encryption))
 		case "trojan", "shadowsocks":
 			newOutbounds = append(newOutbounds, s.genServer(inbound, streamSettings, client))
+		case "wireguard":
+			if outbound := s.genWireguard(inbound, client); outbound != nil {
+				newOutbounds = append(newOutbounds, outbound)
+			}
 		}
 
 		newOutbounds = append(newOutbounds, s.defaultOutbounds...)
@@ -0,0 +1,43 @@
+package sub
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter counts requests per key in fixed one-minute windows.
+type rateLimiter struct {
+	limit int
+
+	mu      sync.Mutex
+	window  int64
+	counter map[string]int
+}
+
+func newRateLimiter(limit int) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		counter: make(map[string]int),
+	}
+}
+
+// Allow reports whether another request for key fits in the current window.
+// A non-positive limit disables limiting.
+func (l *rateLimiter) Allow(key string) bool {
+	if l == nil || l.limit <= 0 {
+		return true
+	}
+	window := time.Now().Unix() / 60
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if window != l.window {
+		l.window = window
+		l.counter = make(map[string]int)
+	}
+	if l.counter[key] >= l.limit {
+		return false
+	}
+	l.counter[key]++
+	return true
+}
@@ -22,15 +22,20 @@ type SubService struct {
 	address        string
 	showInfo       bool
 	remarkModel    string
+	remarkTemplate string
+	country        string
 	datepicker     string
-	inboundService service.InboundService
-	settingService service.SettingService
+	inboundService   service.InboundService
+	settingService   service.SettingService
+	subSourceService service.SubSourceService
 }
 
-func NewSubService(showInfo bool, remarkModel string) *SubService {
+func NewSubService(showInfo bool, remarkModel string, remarkTemplate string, country string) *SubService {
 	return &SubService{
-		showInfo:    showInfo,
-		remarkModel: remarkModel,
+		showInfo:       showInfo,
+		remarkModel:    remarkModel,
+		remarkTemplate: remarkTemplate,
+		country:        country,
 	}
 }
 
@@ -78,6 +83,11 @@ func (s *SubService) GetSubs(subId string, host string) ([]string, string, error
 		}
 	}
 
+	// Upstream links are served only to a subscription with an enabled client.
+	if len(result) > 0 {
+		result = append(result, s.subSourceService.GetLinks(subId)...)
+	}
+
 	// Prepare statistics
 	for index, clientTraffic := range clientTraffics {
 		if index == 0 {
@@ -112,7 +122,7 @@ func (s *SubService) getInboundsBySubId(subId string) ([]*model.Inbound, error)
 		FROM inbounds,
 			JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client 
 		WHERE
-			protocol in ('vmess','vless','trojan','shadowsocks')
+			protocol in ('vmess','vless','trojan','shadowsocks','wireguard')
 			AND JSON_EXTRACT(client.value, '$.subId') = ? AND enable = ?
 	)`, subId, true).Find(&inbounds).Error
 	if err != nil {
@@ -163,6 +173,8 @@ func (s *SubService) getLink(inbound *model.Inbound, email string) string {
 		return s.genTrojanLink(inbound, email)
 	case "shadowsocks":
 		return s.genShadowsocksLink(inbound, email)
+	case "wireguard":
+		return s.genWireguardLink(inbound, email)
 	}
 	return ""
 }
@@ -878,6 +890,15 @@ func (s *SubService) genShadowsocksLink(inbound *model.Inbound, email string) st
 func (s *SubService) genRemark(inbound *model.Inbound, email string, extra string) string {
 	separationChar := string(s.remarkModel[0])
 	orderChars := s.remarkModel[1:]
+
+	template := s.remarkTemplate
+	if client := s.getClient(inbound, email); client != nil && client.Remark != "" {
+		template = client.Remark
+	}
+	if template != "" {
+		return s.renderRemark(template, inbound, email, extra, separationChar)
+	}
+
 	orders := map[byte]string{
 		'i': "",
 		'e': "",
@@ -960,6 +981,86 @@ func (s *SubService) genRemark(inbound *model.Inbound, email string, extra strin
 	return strings.Join(remark, separationChar)
 }
 
+// renderRemark expands the variables of a remark template. An external proxy
+// remark is appended when the template does not place {extra} itself.
+func (s *SubService) renderRemark(template string, inbound *model.Inbound, email string, extra string, separationChar string) string {
+	remaining, daysLeft := "∞", "∞"
+	for _, stats := range inbound.ClientStats {
+		if stats.Email != email {
+			continue
+		}
+		if stats.Total > 0 {
+			remaining = common.FormatTraffic(max(stats.Total-(stats.Up+stats.Down), 0))
+		}
+		switch exp := stats.ExpiryTime; {
+		case exp > 0:
+			days := (exp - time.Now().UnixMilli() + 86400000 - 1) / 86400000
+			daysLeft = fmt.Sprintf("%d", max(days, 0))
+		case exp < 0:
+			daysLeft = fmt.Sprintf("%d", exp/-86400000)
+		}
+		break
+	}
+
+	remark := strings.NewReplacer(
+		"{email}", email,
+		"{inbound}", inbound.Remark,
+		"{protocol}", string(inbound.Protocol),
+		"{remaining}", remaining,
+		"{days_left}", daysLeft,
+		"{country}", s.country,
+		"{extra}", extra,
+	).Replace(template)
+	if extra != "" && !strings.Contains(template, "{extra}") {
+		remark += separationChar + extra
+	}
+	return remark
+}
+
+func (s *SubService) getClient(inbound *model.Inbound, email string) *model.Client {
+	clients, err := s.inboundService.GetClients(inbound)
+	if err != nil {
+		return nil
+	}
+	for i := range clients {
+		if clients[i].Email == email {
+			return &clients[i]
+		}
+	}
+	return nil
+}
+
+// GetAnnounce returns the announcement of the first client of subId that has
+// one, falling back to the global announcement.
+func (s *SubService) GetAnnounce(subId string) string {
+	inbounds, err := s.getInboundsBySubId(subId)
+	if err == nil {
+		for _, inbound := range inbounds {
+			clients, err := s.inboundService.GetClients(inbound)
+			if err != nil {
+				continue
+			}
+			for _, client := range clients {
+				if client.SubID == subId && client.Announce != "" {
+					return client.Announce
+				}
+			}
+		}
+	}
+	announce, err := s.settingService.GetSubAnnounce()
+	if err != nil {
+		return ""
+	}
+	return announce
+}
+
+// genInfoLink builds a non-working node whose name carries text, so that apps
+// without announcement support still show it in the node list.
+func (s *SubService) genInfoLink(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	return fmt.Sprintf("vless://00000000-0000-0000-0000-000000000000@127.0.0.1:1?encryption=none&type=tcp#%s", url.PathEscape(text))
+}
+
 func searchKey(data any, key string) (any, bool) {
 	switch val := data.(type) {
 	case map[string]any:
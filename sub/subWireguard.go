@@ -0,0 +1,176 @@
+package sub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"x-ui/database/model"
+	"x-ui/util/common"
+	"x-ui/util/json_util"
+	"x-ui/web/service"
+)
+
+type wireguardPeer struct {
+	client    model.Client
+	serverKey string
+	mtu       int
+	dns       string
+}
+
+func (s *SubService) getWireguardPeer(inbound *model.Inbound, email string) (*wireguardPeer, error) {
+	if inbound.Protocol != model.WireGuard {
+		return nil, common.NewError("not a wireguard inbound:", inbound.Tag)
+	}
+	serverKey, err := service.WireguardServerPublicKey(inbound)
+	if err != nil {
+		return nil, err
+	}
+	var settings map[string]any
+	json.Unmarshal([]byte(inbound.Settings), &settings)
+
+	peer := &wireguardPeer{serverKey: serverKey, mtu: 1420, dns: "1.1.1.1"}
+	if mtu, ok := settings["mtu"].(float64); ok && mtu > 0 {
+		peer.mtu = int(mtu)
+	}
+	if dns, ok := settings["clientDns"].(string); ok {
+		peer.dns = dns
+	}
+
+	clients, _ := s.inboundService.GetClients(inbound)
+	for _, client := range clients {
+		if client.Email == email {
+			if client.PrivateKey == "" || len(client.AllowedIPs) == 0 {
+				return nil, common.NewError("wireguard client is not provisioned:", email)
+			}
+			peer.client = client
+			return peer, nil
+		}
+	}
+	return nil, common.NewError("client not found:", email)
+}
+
+func (s *SubService) genWireguardLink(inbound *model.Inbound, email string) string {
+	peer, err := s.getWireguardPeer(inbound, email)
+	if err != nil {
+		return ""
+	}
+	params := url.Values{}
+	params.Set("publickey", peer.serverKey)
+	params.Set("address", strings.Join(peer.client.AllowedIPs, ","))
+	params.Set("mtu", strconv.Itoa(peer.mtu))
+	if peer.client.PreSharedKey != "" {
+		params.Set("presharedkey", peer.client.PreSharedKey)
+	}
+
+	link := url.URL{
+		Scheme:   "wireguard",
+		User:     url.User(peer.client.PrivateKey),
+		Host:     net.JoinHostPort(s.address, strconv.Itoa(inbound.Port)),
+		RawQuery: params.Encode(),
+		Fragment: s.genRemark(inbound, email, ""),
+	}
+	return link.String()
+}
+
+// GetWireguardConf returns the wg-quick configuration of a wireguard client
+// belonging to subId.
+func (s *SubService) GetWireguardConf(subId string, email string, host string) (string, error) {
+	s.address = host
+	inbounds, err := s.getInboundsBySubId(subId)
+	if err != nil {
+		return "", err
+	}
+	for _, inbound := range inbounds {
+		if inbound.Protocol != model.WireGuard {
+			continue
+		}
+		clients, _ := s.inboundService.GetClients(inbound)
+		for _, client := range clients {
+			if client.Email != email || client.SubID != subId || !client.Enable {
+				continue
+			}
+			peer, err := s.getWireguardPeer(inbound, email)
+			if err != nil {
+				return "", err
+			}
+			return s.genWireguardConf(inbound, peer), nil
+		}
+	}
+	return "", common.NewError("wireguard client not found:", email)
+}
+
+// GetWireguardLink returns the wireguard:// link of a wireguard client
+// belonging to subId.
+func (s *SubService) GetWireguardLink(subId string, email string, host string) (string, error) {
+	s.address = host
+	inbounds, err := s.getInboundsBySubId(subId)
+	if err != nil {
+		return "", err
+	}
+	for _, inbound := range inbounds {
+		if inbound.Protocol != model.WireGuard {
+			continue
+		}
+		clients, _ := s.inboundService.GetClients(inbound)
+		for _, client := range clients {
+			if client.Email == email && client.SubID == subId && client.Enable {
+				if link := s.genWireguardLink(inbound, email); link != "" {
+					return link, nil
+				}
+			}
+		}
+	}
+	return "", common.NewError("wireguard client not found:", email)
+}
+
+func (s *SubService) genWireguardConf(inbound *model.Inbound, peer *wireguardPeer) string {
+	var conf strings.Builder
+	conf.WriteString("[Interface]\n")
+	fmt.Fprintf(&conf, "PrivateKey = %s\n", peer.client.PrivateKey)
+	fmt.Fprintf(&conf, "Address = %s\n", strings.Join(peer.client.AllowedIPs, ", "))
+	if peer.dns != "" {
+		fmt.Fprintf(&conf, "DNS = %s\n", peer.dns)
+	}
+	fmt.Fprintf(&conf, "MTU = %d\n", peer.mtu)
+	conf.WriteString("\n[Peer]\n")
+	fmt.Fprintf(&conf, "PublicKey = %s\n", peer.serverKey)
+	if peer.client.PreSharedKey != "" {
+		fmt.Fprintf(&conf, "PresharedKey = %s\n", peer.client.PreSharedKey)
+	}
+	conf.WriteString("AllowedIPs = 0.0.0.0/0, ::/0\n")
+	fmt.Fprintf(&conf, "Endpoint = %s\n", net.JoinHostPort(s.address, strconv.Itoa(inbound.Port)))
+	conf.WriteString("PersistentKeepalive = 25\n")
+	return conf.String()
+}
+
+func (s *SubJsonService) genWireguard(inbound *model.Inbound, client model.Client) json_util.RawMessage {
+	peer, err := s.SubService.getWireguardPeer(inbound, client.Email)
+	if err != nil {
+		return nil
+	}
+	serverPeer := map[string]any{
+		"publicKey":  peer.serverKey,
+		"endpoint":   net.JoinHostPort(inbound.Listen, strconv.Itoa(inbound.Port)),
+		"allowedIPs": []string{"0.0.0.0/0", "::/0"},
+		"keepAlive":  25,
+	}
+	if client.PreSharedKey != "" {
+		serverPeer["preSharedKey"] = client.PreSharedKey
+	}
+	outbound := map[string]any{
+		"protocol": "wireguard",
+		"tag":      "proxy",
+		"settings": map[string]any{
+			"secretKey": client.PrivateKey,
+			"address":   client.AllowedIPs,
+			"peers":     []any{serverPeer},
+			"mtu":       peer.mtu,
+		},
+	}
+	result, _ := json.MarshalIndent(outbound, "", "  ")
+	return result
+}
@@ -1,7 +1,11 @@
 package crypto
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/curve25519"
 )
 
 func HashPasswordAsBcrypt(password string) (string, error) {
@@ -13,3 +17,33 @@ func CheckPasswordHash(hash, password string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	return err == nil
 }
+
+// GenerateWireguardKeypair returns a base64 encoded Curve25519 private and public key.
+func GenerateWireguardKeypair() (string, string, error) {
+	privateKey := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(privateKey); err != nil {
+		return "", "", err
+	}
+	privateKey[0] &= 248
+	privateKey[31] = (privateKey[31] & 127) | 64
+
+	encoded := base64.StdEncoding.EncodeToString(privateKey)
+	publicKey, err := WireguardPublicKey(encoded)
+	if err != nil {
+		return "", "", err
+	}
+	return encoded, publicKey, nil
+}
+
+// WireguardPublicKey derives the public key of a base64 encoded private key.
+func WireguardPublicKey(privateKey string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil {
+		return "", err
+	}
+	publicKey, err := curve25519.X25519(key, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(publicKey), nil
+}
@@ -13,6 +13,15 @@ class DBInbound {
         
       // 新增：入站级设备限制（0 表示不限制）
         this.deviceLimit = 0;
+        // 设备超限策略：swap/drop/warn/disable，宽限秒数、IP过期秒数、封禁分钟数，0 表示默认值
+        this.deviceLimitStrategy = "swap";
+        this.deviceLimitGrace = 0;
+        this.deviceLimitTtl = 0;
+        this.deviceLimitMinutes = 0;
+        // 入站默认带宽限制（KB/s）与突发量（KB），0 表示不限制
+        this.upLimit = 0;
+        this.downLimit = 0;
+        this.burst = 0;
 
         this.listen = "";
         this.port = 0;
@@ -1807,7 +1807,22 @@ Inbound.VmessSettings.VMESS = class extends XrayCommonClass {
         comment = '',
         reset = 0,
         created_at = undefined,
-        updated_at = undefined
+        updated_at = undefined,
+        remark = '',
+        announce = '',
+        upLimit = 0,
+        downLimit = 0,
+        burst = 0,
+        fairUseSpeed = 0,
+        hardCap = 0,
+        deviceLimit = 0,
+        deviceLimitStrategy = '',
+        routingPlan = '',
+        routingOutbound = '',
+        blockGeosite = [],
+        blockBittorrent = false,
+        allowCountries = [],
+        denyCountries = [],
     ) {
         super();
         this.id = id;
@@ -1824,6 +1839,21 @@ Inbound.VmessSettings.VMESS = class extends XrayCommonClass {
         this.reset = reset;
         this.created_at = created_at;
         this.updated_at = updated_at;
+        this.remark = remark;
+        this.announce = announce;
+        this.upLimit = upLimit;
+        this.downLimit = downLimit;
+        this.burst = burst;
+        this.fairUseSpeed = fairUseSpeed;
+        this.hardCap = hardCap;
+        this.deviceLimit = deviceLimit;
+        this.deviceLimitStrategy = deviceLimitStrategy;
+        this.routingPlan = routingPlan;
+        this.routingOutbound = routingOutbound;
+        this.blockGeosite = blockGeosite;
+        this.blockBittorrent = blockBittorrent;
+        this.allowCountries = allowCountries;
+        this.denyCountries = denyCountries;
     }
     
     
@@ -1843,6 +1873,21 @@ Inbound.VmessSettings.VMESS = class extends XrayCommonClass {
             json.reset,
             json.created_at,
             json.updated_at,
+            json.remark ?? '',
+            json.announce ?? '',
+            json.upLimit ?? 0,
+            json.downLimit ?? 0,
+            json.burst ?? 0,
+            json.fairUseSpeed ?? 0,
+            json.hardCap ?? 0,
+            json.deviceLimit ?? 0,
+            json.deviceLimitStrategy ?? '',
+            json.routingPlan ?? '',
+            json.routingOutbound ?? '',
+            json.blockGeosite ?? [],
+            json.blockBittorrent ?? false,
+            json.allowCountries ?? [],
+            json.denyCountries ?? [],
         );
     }
     get _expiryTime() {
@@ -1870,6 +1915,14 @@ Inbound.VmessSettings.VMESS = class extends XrayCommonClass {
         this.totalGB = NumberFormatter.toFixed(gb * SizeFormatter.ONE_GB, 0);
     }
 
+    get _hardCap() {
+        return NumberFormatter.toFixed(this.hardCap / SizeFormatter.ONE_GB, 2);
+    }
+
+    set _hardCap(gb) {
+        this.hardCap = NumberFormatter.toFixed(gb * SizeFormatter.ONE_GB, 0);
+    }
+
 };
 
 Inbound.VLESSSettings = class extends Inbound.Settings {
@@ -1950,7 +2003,22 @@ Inbound.VLESSSettings.VLESS = class extends XrayCommonClass {
         comment = '',
         reset = 0,
         created_at = undefined,
-        updated_at = undefined
+        updated_at = undefined,
+        remark = '',
+        announce = '',
+        upLimit = 0,
+        downLimit = 0,
+        burst = 0,
+        fairUseSpeed = 0,
+        hardCap = 0,
+        deviceLimit = 0,
+        deviceLimitStrategy = '',
+        routingPlan = '',
+        routingOutbound = '',
+        blockGeosite = [],
+        blockBittorrent = false,
+        allowCountries = [],
+        denyCountries = [],
     ) {
         super();
         this.id = id;
@@ -1967,6 +2035,21 @@ Inbound.VLESSSettings.VLESS = class extends XrayCommonClass {
         this.reset = reset;
         this.created_at = created_at;
         this.updated_at = updated_at;
+        this.remark = remark;
+        this.announce = announce;
+        this.upLimit = upLimit;
+        this.downLimit = downLimit;
+        this.burst = burst;
+        this.fairUseSpeed = fairUseSpeed;
+        this.hardCap = hardCap;
+        this.deviceLimit = deviceLimit;
+        this.deviceLimitStrategy = deviceLimitStrategy;
+        this.routingPlan = routingPlan;
+        this.routingOutbound = routingOutbound;
+        this.blockGeosite = blockGeosite;
+        this.blockBittorrent = blockBittorrent;
+        this.allowCountries = allowCountries;
+        this.denyCountries = denyCountries;
     }
     
 
@@ -1986,6 +2069,21 @@ Inbound.VLESSSettings.VLESS = class extends XrayCommonClass {
             json.reset,
             json.created_at,
             json.updated_at,
+            json.remark ?? '',
+            json.announce ?? '',
+            json.upLimit ?? 0,
+            json.downLimit ?? 0,
+            json.burst ?? 0,
+            json.fairUseSpeed ?? 0,
+            json.hardCap ?? 0,
+            json.deviceLimit ?? 0,
+            json.deviceLimitStrategy ?? '',
+            json.routingPlan ?? '',
+            json.routingOutbound ?? '',
+            json.blockGeosite ?? [],
+            json.blockBittorrent ?? false,
+            json.allowCountries ?? [],
+            json.denyCountries ?? [],
         );
     }
 
@@ -2013,6 +2111,14 @@ Inbound.VLESSSettings.VLESS = class extends XrayCommonClass {
     set _totalGB(gb) {
         this.totalGB = NumberFormatter.toFixed(gb * SizeFormatter.ONE_GB, 0);
     }
+
+    get _hardCap() {
+        return NumberFormatter.toFixed(this.hardCap / SizeFormatter.ONE_GB, 2);
+    }
+
+    set _hardCap(gb) {
+        this.hardCap = NumberFormatter.toFixed(gb * SizeFormatter.ONE_GB, 0);
+    }
 };
 Inbound.VLESSSettings.Fallback = class extends XrayCommonClass {
     constructor(name = "", alpn = '', path = '', dest = '', xver = 0) {
@@ -2099,7 +2205,22 @@ Inbound.TrojanSettings.Trojan = class extends XrayCommonClass {
         comment = '',
         reset = 0,
         created_at = undefined,
-        updated_at = undefined
+        updated_at = undefined,
+        remark = '',
+        announce = '',
+        upLimit = 0,
+        downLimit = 0,
+        burst = 0,
+        fairUseSpeed = 0,
+        hardCap = 0,
+        deviceLimit = 0,
+        deviceLimitStrategy = '',
+        routingPlan = '',
+        routingOutbound = '',
+        blockGeosite = [],
+        blockBittorrent = false,
+        allowCountries = [],
+        denyCountries = [],
     ) {
         super();
         this.password = password;
@@ -2115,6 +2236,21 @@ Inbound.TrojanSettings.Trojan = class extends XrayCommonClass {
         this.reset = reset;
         this.created_at = created_at;
         this.updated_at = updated_at;
+        this.remark = remark;
+        this.announce = announce;
+        this.upLimit = upLimit;
+        this.downLimit = downLimit;
+        this.burst = burst;
+        this.fairUseSpeed = fairUseSpeed;
+        this.hardCap = hardCap;
+        this.deviceLimit = deviceLimit;
+        this.deviceLimitStrategy = deviceLimitStrategy;
+        this.routingPlan = routingPlan;
+        this.routingOutbound = routingOutbound;
+        this.blockGeosite = blockGeosite;
+        this.blockBittorrent = blockBittorrent;
+        this.allowCountries = allowCountries;
+        this.denyCountries = denyCountries;
     }
 
     toJson() {
@@ -2132,6 +2268,21 @@ Inbound.TrojanSettings.Trojan = class extends XrayCommonClass {
             reset: this.reset,
             created_at: this.created_at,
             updated_at: this.updated_at,
+            remark: this.remark,
+            announce: this.announce,
+            upLimit: this.upLimit,
+            downLimit: this.downLimit,
+            burst: this.burst,
+            fairUseSpeed: this.fairUseSpeed,
+            hardCap: this.hardCap,
+            deviceLimit: this.deviceLimit,
+            deviceLimitStrategy: this.deviceLimitStrategy,
+            routingPlan: this.routingPlan,
+            routingOutbound: this.routingOutbound,
+            blockGeosite: this.blockGeosite,
+            blockBittorrent: this.blockBittorrent,
+            allowCountries: this.allowCountries,
+            denyCountries: this.denyCountries,
         };
     }
 
@@ -2150,6 +2301,21 @@ Inbound.TrojanSettings.Trojan = class extends XrayCommonClass {
             json.reset,
             json.created_at,
             json.updated_at,
+            json.remark ?? '',
+            json.announce ?? '',
+            json.upLimit ?? 0,
+            json.downLimit ?? 0,
+            json.burst ?? 0,
+            json.fairUseSpeed ?? 0,
+            json.hardCap ?? 0,
+            json.deviceLimit ?? 0,
+            json.deviceLimitStrategy ?? '',
+            json.routingPlan ?? '',
+            json.routingOutbound ?? '',
+            json.blockGeosite ?? [],
+            json.blockBittorrent ?? false,
+            json.allowCountries ?? [],
+            json.denyCountries ?? [],
         );
     }
 
@@ -2178,6 +2344,14 @@ Inbound.TrojanSettings.Trojan = class extends XrayCommonClass {
         this.totalGB = NumberFormatter.toFixed(gb * SizeFormatter.ONE_GB, 0);
     }
 
+    get _hardCap() {
+        return NumberFormatter.toFixed(this.hardCap / SizeFormatter.ONE_GB, 2);
+    }
+
+    set _hardCap(gb) {
+        this.hardCap = NumberFormatter.toFixed(gb * SizeFormatter.ONE_GB, 0);
+    }
+
 };
 
 Inbound.TrojanSettings.Fallback = class extends XrayCommonClass {
@@ -2272,7 +2446,22 @@ Inbound.ShadowsocksSettings.Shadowsocks = class extends XrayCommonClass {
         comment = '',
         reset = 0,
         created_at = undefined,
-        updated_at = undefined
+        updated_at = undefined,
+        remark = '',
+        announce = '',
+        upLimit = 0,
+        downLimit = 0,
+        burst = 0,
+        fairUseSpeed = 0,
+        hardCap = 0,
+        deviceLimit = 0,
+        deviceLimitStrategy = '',
+        routingPlan = '',
+        routingOutbound = '',
+        blockGeosite = [],
+        blockBittorrent = false,
+        allowCountries = [],
+        denyCountries = [],
     ) {
         super();
         this.method = method;
@@ -2289,6 +2478,21 @@ Inbound.ShadowsocksSettings.Shadowsocks = class extends XrayCommonClass {
         this.reset = reset;
         this.created_at = created_at;
         this.updated_at = updated_at;
+        this.remark = remark;
+        this.announce = announce;
+        this.upLimit = upLimit;
+        this.downLimit = downLimit;
+        this.burst = burst;
+        this.fairUseSpeed = fairUseSpeed;
+        this.hardCap = hardCap;
+        this.deviceLimit = deviceLimit;
+        this.deviceLimitStrategy = deviceLimitStrategy;
+        this.routingPlan = routingPlan;
+        this.routingOutbound = routingOutbound;
+        this.blockGeosite = blockGeosite;
+        this.blockBittorrent = blockBittorrent;
+        this.allowCountries = allowCountries;
+        this.denyCountries = denyCountries;
     }
     
     toJson() {
@@ -2307,6 +2511,21 @@ Inbound.ShadowsocksSettings.Shadowsocks = class extends XrayCommonClass {
             reset: this.reset,
             created_at: this.created_at,
             updated_at: this.updated_at,
+            remark: this.remark,
+            announce: this.announce,
+            upLimit: this.upLimit,
+            downLimit: this.downLimit,
+            burst: this.burst,
+            fairUseSpeed: this.fairUseSpeed,
+            hardCap: this.hardCap,
+            deviceLimit: this.deviceLimit,
+            deviceLimitStrategy: this.deviceLimitStrategy,
+            routingPlan: this.routingPlan,
+            routingOutbound: this.routingOutbound,
+            blockGeosite: this.blockGeosite,
+            blockBittorrent: this.blockBittorrent,
+            allowCountries: this.allowCountries,
+            denyCountries: this.denyCountries,
         };
     }
 
@@ -2326,6 +2545,21 @@ Inbound.ShadowsocksSettings.Shadowsocks = class extends XrayCommonClass {
             json.reset,
             json.created_at,
             json.updated_at,
+            json.remark ?? '',
+            json.announce ?? '',
+            json.upLimit ?? 0,
+            json.downLimit ?? 0,
+            json.burst ?? 0,
+            json.fairUseSpeed ?? 0,
+            json.hardCap ?? 0,
+            json.deviceLimit ?? 0,
+            json.deviceLimitStrategy ?? '',
+            json.routingPlan ?? '',
+            json.routingOutbound ?? '',
+            json.blockGeosite ?? [],
+            json.blockBittorrent ?? false,
+            json.allowCountries ?? [],
+            json.denyCountries ?? [],
         );
     }
 
@@ -2354,6 +2588,14 @@ Inbound.ShadowsocksSettings.Shadowsocks = class extends XrayCommonClass {
         this.totalGB = NumberFormatter.toFixed(gb * SizeFormatter.ONE_GB, 0);
     }
 
+    get _hardCap() {
+        return NumberFormatter.toFixed(this.hardCap / SizeFormatter.ONE_GB, 2);
+    }
+
+    set _hardCap(gb) {
+        this.hardCap = NumberFormatter.toFixed(gb * SizeFormatter.ONE_GB, 0);
+    }
+
 };
 
 Inbound.TunnelSettings = class extends Inbound.Settings {
@@ -2502,7 +2744,10 @@ Inbound.WireguardSettings = class extends XrayCommonClass {
         mtu = 1420,
         secretKey = Wireguard.generateKeypair().privateKey,
         peers = [new Inbound.WireguardSettings.Peer()],
-        noKernelTun = false
+        noKernelTun = false,
+        clients = [],
+        addressPool = '10.0.0.0/24',
+        clientDns = '1.1.1.1',
     ) {
         super(protocol);
         this.mtu = mtu;
@@ -2510,6 +2755,10 @@ Inbound.WireguardSettings = class extends XrayCommonClass {
         this.pubKey = secretKey.length > 0 ? Wireguard.generateKeypair(secretKey).publicKey : '';
         this.peers = peers;
         this.noKernelTun = noKernelTun;
+        // Managed peers live in clients; they are kept as plain objects and edited through the client API.
+        this.clients = clients;
+        this.addressPool = addressPool;
+        this.clientDns = clientDns;
     }
 
     addPeer() {
@@ -2525,8 +2774,11 @@ Inbound.WireguardSettings = class extends XrayCommonClass {
             Protocols.WIREGUARD,
             json.mtu,
             json.secretKey,
-            json.peers.map(peer => Inbound.WireguardSettings.Peer.fromJson(peer)),
+            (json.peers ?? []).map(peer => Inbound.WireguardSettings.Peer.fromJson(peer)),
             json.noKernelTun,
+            json.clients ?? [],
+            json.addressPool,
+            json.clientDns,
         );
     }
 
@@ -2536,6 +2788,9 @@ Inbound.WireguardSettings = class extends XrayCommonClass {
             secretKey: this.secretKey,
             peers: Inbound.WireguardSettings.Peer.toJsonArray(this.peers),
             noKernelTun: this.noKernelTun,
+            clients: this.clients.length > 0 ? this.clients : undefined,
+            addressPool: this.addressPool,
+            clientDns: this.clientDns,
         };
     }
 };
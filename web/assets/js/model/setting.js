@@ -13,6 +13,31 @@ class AllSetting {
         this.trafficDiff = 0;
         this.remarkModel = "-ieo";
         this.datepicker = "gregorian";
+        this.speedLimitLevels = "512,1024,2048,5120,10240,20480,51200";
+        this.speedLimitBackend = "off";
+        this.speedLimitInterface = "";
+        this.speedLimitDryRun = false;
+        this.ipLimitBackend = "xray";
+        this.ipLimitBanMinutes = 30;
+        this.geoipMmdbPath = "";
+        this.sharingDetect = false;
+        this.sharingMaxSubnets = 4;
+        this.sharingMaxAsns = 3;
+        this.sharingNotifyScore = 50;
+        this.sharingTagScore = 70;
+        this.sharingLimitScore = 0;
+        this.sharingDeviceLimit = 2;
+        this.routingPlans = "{}";
+        this.xrayCoreMode = "binary";
+        this.xrayCrashLoopCount = 5;
+        this.xrayCrashLoopMinutes = 10;
+        this.xrayCoreDownloadUrl = "https://github.com/XTLS/Xray-core/releases/download";
+        this.xrayCoreReleasesUrl = "https://api.github.com/repos/XTLS/Xray-core/releases";
+        this.xrayCoreVerifyChecksum = true;
+        this.accessStats = false;
+        this.accessStatsDays = 7;
+        this.accessStatsPrivacy = false;
+        this.accessStatsCategories = "category-ads-all,google,youtube,netflix,openai,telegram,facebook,twitter,tiktok,apple,microsoft,cn,geolocation-!cn";
         this.tgBotEnable = false;
         this.tgBotToken = "";
         this.tgBotProxy = "";
@@ -35,11 +60,26 @@ class AllSetting {
         this.subDomain = "";
         this.externalTrafficInformEnable = false;
         this.externalTrafficInformURI = "";
+        this.webhookUrl = "";
+        this.webhookSecret = "";
         this.subCertFile = "";
         this.subKeyFile = "";
         this.subUpdates = 12;
         this.subEncrypt = true;
         this.subShowInfo = true;
+        this.subSignEnable = false;
+        this.subSignTTL = 720;
+        this.subAccessLog = true;
+        this.subAccessLogDays = 30;
+        this.subRateLimit = 0;
+        this.subIpRateLimit = 0;
+        this.subRateLimitAction = "429";
+        this.subTrustedProxies = "127.0.0.1,::1";
+        this.subShareIpThreshold = 10;
+        this.subShareCountryThreshold = 3;
+        this.subAnnounce = "";
+        this.subRemarkTemplate = "";
+        this.subCountry = "";
         this.subURI = "";
         this.subJsonURI = "";
         this.subJsonFragment = "";
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"time"
 
 	"x-ui/database/model"
 	"x-ui/web/service"
@@ -13,8 +14,16 @@ import (
 )
 
 type InboundController struct {
-	inboundService service.InboundService
-	xrayService    service.XrayService
+	inboundService      service.InboundService
+	xrayService         service.XrayService
+	settingService      service.SettingService
+	subscriptionService service.SubscriptionService
+	subSourceService    service.SubSourceService
+	speedLimitService   service.SpeedLimitService
+	deviceLimitService  service.DeviceLimitService
+	ipLimitService      service.IPLimitService
+	geoIPService        service.GeoIPService
+	sharingService      service.SharingService
 }
 
 func NewInboundController(g *gin.RouterGroup) *InboundController {
@@ -34,6 +43,11 @@ func (a *InboundController) initRouter(g *gin.RouterGroup) {
 	g.POST("/update/:id", a.updateInbound)
 	g.POST("/clientIps/:email", a.getClientIps)
 	g.POST("/clearClientIps/:email", a.clearClientIps)
+	g.GET("/clientCountries/:email", a.getClientCountries)
+	g.GET("/countries/:id", a.getInboundCountries)
+	g.GET("/sharing", a.getSharingScores)
+	g.GET("/sharing/:email", a.getSharingScore)
+	g.POST("/sharing/reset/:email", a.resetSharingScore)
 	g.POST("/addClient", a.addInboundClient)
 	g.POST("/:id/delClient/:clientId", a.delInboundClient)
 	g.POST("/updateClient/:clientId", a.updateInboundClient)
@@ -45,6 +59,24 @@ func (a *InboundController) initRouter(g *gin.RouterGroup) {
 	g.POST("/onlines", a.onlines)
 	g.POST("/lastOnline", a.lastOnline)
 	g.POST("/updateClientTraffic/:email", a.updateClientTraffic)
+	g.POST("/rotateSubId", a.rotateSubId)
+	g.POST("/revokeSubId/:subId", a.revokeSubId)
+	g.POST("/signSubLink/:subId", a.signSubLink)
+	g.GET("/subIdRotations", a.getSubIdRotations)
+	g.GET("/subAccessLogs", a.getSubAccessLogs)
+	g.GET("/subShared", a.getSharedSubIds)
+	g.GET("/subSources", a.getSubSources)
+	g.POST("/subSources/add", a.addSubSource)
+	g.POST("/subSources/update/:id", a.updateSubSource)
+	g.POST("/subSources/del/:id", a.delSubSource)
+	g.POST("/subSources/fetch/:id", a.fetchSubSource)
+	g.GET("/speedLimits", a.getSpeedLimits)
+	g.GET("/speedLimitPlan", a.getSpeedLimitPlan)
+	g.POST("/applySpeedLimits", a.applySpeedLimits)
+	g.GET("/deviceBans", a.getDeviceBans)
+	g.POST("/deviceBans/unban/:email", a.unbanDevice)
+	g.GET("/ipBans", a.getIPBans)
+	g.POST("/ipBans/unban/:ip", a.unbanIP)
 }
 
 func (a *InboundController) getInbounds(c *gin.Context) {
@@ -158,7 +190,7 @@ func (a *InboundController) updateInbound(c *gin.Context) {
 	}
 	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.inboundUpdateSuccess"), inbound, nil)
 	if needRestart {
-		a.xrayService.SetToNeedRestart()
+		a.xrayService.ApplyXrayConfig()
 	}
 }
 
@@ -174,6 +206,50 @@ func (a *InboundController) getClientIps(c *gin.Context) {
 	jsonObj(c, ips, nil)
 }
 
+func (a *InboundController) getClientCountries(c *gin.Context) {
+	geo, err := a.geoIPService.GetClientGeo(c.Param("email"))
+	jsonObj(c, geo, err)
+}
+
+// getInboundCountries returns the countries the clients of an inbound were
+// seen from in the last ?days= days, 30 by default.
+func (a *InboundController) getInboundCountries(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	days, err := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if err != nil || days <= 0 {
+		days = 30
+	}
+	since := time.Now().AddDate(0, 0, -days).Unix()
+	countries, err := a.geoIPService.GetInboundCountries(id, since)
+	jsonObj(c, countries, err)
+}
+
+func (a *InboundController) getSharingScores(c *gin.Context) {
+	scores, err := a.sharingService.GetScores()
+	jsonObj(c, scores, err)
+}
+
+// getSharingScore works out the sharing score of a client right now.
+func (a *InboundController) getSharingScore(c *gin.Context) {
+	email := c.Param("email")
+	_, client, err := a.inboundService.GetClientByEmail(email)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	score, err := a.sharingService.Score(email, client.SubID)
+	jsonObj(c, score, err)
+}
+
+func (a *InboundController) resetSharingScore(c *gin.Context) {
+	err := a.sharingService.Reset(c.Param("email"))
+	jsonMsg(c, "Reset "+c.Param("email"), err)
+}
+
 func (a *InboundController) clearClientIps(c *gin.Context) {
 	email := c.Param("email")
 
@@ -373,3 +449,154 @@ func (a *InboundController) updateClientTraffic(c *gin.Context) {
 
 	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundClientUpdateSuccess"), nil)
 }
+
+func (a *InboundController) rotateSubId(c *gin.Context) {
+	type RotateRequest struct {
+		SubId    string `json:"subId" form:"subId"`
+		NewSubId string `json:"newSubId" form:"newSubId"`
+		Grace    int    `json:"grace" form:"grace"`
+	}
+
+	request := &RotateRequest{}
+	err := c.ShouldBind(request)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+
+	newSubId, err := a.subscriptionService.RotateSubId(request.SubId, request.NewSubId, request.Grace)
+	jsonObj(c, newSubId, err)
+}
+
+func (a *InboundController) revokeSubId(c *gin.Context) {
+	newSubId, err := a.subscriptionService.RevokeSubId(c.Param("subId"))
+	jsonObj(c, newSubId, err)
+}
+
+func (a *InboundController) signSubLink(c *gin.Context) {
+	subId := c.Param("subId")
+	hours, _ := strconv.Atoi(c.PostForm("hours"))
+
+	exp, sig, err := a.subscriptionService.SignSubId(subId, hours)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+
+	link := ""
+	if defaults, err := a.settingService.GetDefaultSettings(c.Request.Host); err == nil {
+		if subURI, ok := defaults.(map[string]any)["subURI"].(string); ok && subURI != "" {
+			link = fmt.Sprintf("%s%s?exp=%d&sig=%s", subURI, subId, exp, sig)
+		}
+	}
+
+	jsonObj(c, gin.H{"exp": exp, "sig": sig, "link": link}, nil)
+}
+
+func (a *InboundController) getSubIdRotations(c *gin.Context) {
+	rotations, err := a.subscriptionService.GetSubIdRotations()
+	jsonObj(c, rotations, err)
+}
+
+func (a *InboundController) getSubAccessLogs(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	logs, err := a.subscriptionService.GetSubAccessLogs(c.Query("subId"), c.Query("ip"), limit)
+	jsonObj(c, logs, err)
+}
+
+func (a *InboundController) getSharedSubIds(c *gin.Context) {
+	shared, err := a.subscriptionService.GetSharedSubIds()
+	jsonObj(c, shared, err)
+}
+
+func (a *InboundController) getSubSources(c *gin.Context) {
+	sources, err := a.subSourceService.GetSubSources()
+	jsonObj(c, sources, err)
+}
+
+func (a *InboundController) addSubSource(c *gin.Context) {
+	source := &model.SubSource{}
+	err := c.ShouldBind(source)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	err = a.subSourceService.AddSubSource(source)
+	jsonObj(c, source, err)
+}
+
+func (a *InboundController) updateSubSource(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	source := &model.SubSource{}
+	err = c.ShouldBind(source)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	source.Id = id
+	err = a.subSourceService.UpdateSubSource(source)
+	jsonObj(c, source, err)
+}
+
+func (a *InboundController) delSubSource(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	err = a.subSourceService.DelSubSource(id)
+	jsonObj(c, id, err)
+}
+
+func (a *InboundController) fetchSubSource(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	source, err := a.subSourceService.GetSubSource(id)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	err = a.subSourceService.FetchSubSource(source)
+	jsonObj(c, source, err)
+}
+
+func (a *InboundController) getSpeedLimits(c *gin.Context) {
+	limits, err := a.speedLimitService.GetSpeedLimits()
+	jsonObj(c, limits, err)
+}
+
+func (a *InboundController) getSpeedLimitPlan(c *gin.Context) {
+	plan, err := a.speedLimitService.GetSpeedLimitPlan()
+	jsonObj(c, plan, err)
+}
+
+func (a *InboundController) applySpeedLimits(c *gin.Context) {
+	err := a.speedLimitService.ApplySpeedLimits()
+	jsonMsg(c, "Apply speed limits", err)
+}
+
+func (a *InboundController) getDeviceBans(c *gin.Context) {
+	bans, err := a.deviceLimitService.GetBans()
+	jsonObj(c, bans, err)
+}
+
+func (a *InboundController) unbanDevice(c *gin.Context) {
+	err := a.deviceLimitService.Unban(c.Param("email"))
+	jsonMsg(c, "Unban "+c.Param("email"), err)
+}
+
+func (a *InboundController) getIPBans(c *gin.Context) {
+	jsonObj(c, a.ipLimitService.GetBans(), nil)
+}
+
+func (a *InboundController) unbanIP(c *gin.Context) {
+	err := a.ipLimitService.Unban(c.Param("ip"))
+	jsonMsg(c, "Unban "+c.Param("ip"), err)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	"strconv"
 	"time"
 
 	"x-ui/web/global"
@@ -17,8 +18,10 @@ var filenameRegex = regexp.MustCompile(`^[a-zA-Z0-9_\-.]+$`)
 type ServerController struct {
 	BaseController
 
-	serverService  service.ServerService
-	settingService service.SettingService
+	serverService      service.ServerService
+	settingService     service.SettingService
+	xrayService        service.XrayService
+	accessStatsService service.AccessStatsService
 
 	lastStatus        *service.Status
 	lastGetStatusTime time.Time
@@ -50,10 +53,23 @@ func (a *ServerController) initRouter(g *gin.RouterGroup) {
 	g.GET("/getNewmldsa65", a.getNewmldsa65)
 	g.GET("/getNewmlkem768", a.getNewmlkem768)
 	g.GET("/getNewVlessEnc", a.getNewVlessEnc)
+	g.GET("/crashes", a.getCrashes)
+	g.GET("/xrayLog", a.getXrayLog)
+	g.POST("/xrayLog", a.setXrayLog)
+	g.POST("/xrayLog/debug", a.debugXrayLog)
+	g.POST("/xrayLog/reset", a.resetXrayLog)
+	g.POST("/xrayLog/restart", a.restartXrayLogger)
+	g.GET("/accessStats", a.getAccessStats)
+	g.GET("/accessStats/clients", a.getAccessStatsClients)
 
 	g.POST("/stopXrayService", a.stopXrayService)
 	g.POST("/restartXrayService", a.restartXrayService)
 	g.POST("/installXray/:version", a.installXray)
+	g.GET("/xrayCores", a.getXrayCores)
+	g.POST("/switchXray/:version", a.switchXray)
+	g.POST("/pinXray/:version", a.pinXray)
+	g.POST("/unpinXray", a.unpinXray)
+	g.POST("/deleteXray/:version", a.deleteXray)
 	g.POST("/updateGeofile", a.updateGeofile)
 	g.POST("/updateGeofile/:fileName", a.updateGeofile)
 	g.POST("/logs/:count", a.getLogs)
@@ -113,6 +129,31 @@ func (a *ServerController) installXray(c *gin.Context) {
 	jsonMsg(c, I18nWeb(c, "pages.index.xraySwitchVersionPopover"), err)
 }
 
+func (a *ServerController) getXrayCores(c *gin.Context) {
+	cores, err := a.serverService.GetXrayCores()
+	jsonObj(c, cores, err)
+}
+
+func (a *ServerController) switchXray(c *gin.Context) {
+	err := a.serverService.SwitchXrayCore(c.Param("version"))
+	jsonMsg(c, I18nWeb(c, "pages.index.xraySwitchVersionPopover"), err)
+}
+
+func (a *ServerController) pinXray(c *gin.Context) {
+	err := a.serverService.PinXrayCore(c.Param("version"))
+	jsonMsg(c, I18nWeb(c, "pages.index.xrayPinPopover"), err)
+}
+
+func (a *ServerController) unpinXray(c *gin.Context) {
+	err := a.serverService.PinXrayCore("")
+	jsonMsg(c, I18nWeb(c, "pages.index.xrayUnpinPopover"), err)
+}
+
+func (a *ServerController) deleteXray(c *gin.Context) {
+	err := a.serverService.DeleteXrayCore(c.Param("version"))
+	jsonMsg(c, I18nWeb(c, "pages.index.xrayDeletePopover"), err)
+}
+
 func (a *ServerController) updateGeofile(c *gin.Context) {
 	fileName := c.Param("fileName")
 	err := a.serverService.UpdateGeofile(fileName)
@@ -285,6 +326,52 @@ func (a *ServerController) getNewVlessEnc(c *gin.Context) {
 	jsonObj(c, out, nil)
 }
 
+func (a *ServerController) getCrashes(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	crashes, err := a.xrayService.GetXrayCrashes(limit)
+	jsonObj(c, crashes, err)
+}
+
+func (a *ServerController) getXrayLog(c *gin.Context) {
+	jsonObj(c, a.xrayService.GetXrayLogStatus(), nil)
+}
+
+func (a *ServerController) setXrayLog(c *gin.Context) {
+	minutes, _ := strconv.Atoi(c.PostForm("minutes"))
+	restart := c.PostForm("restart") == "true"
+	err := a.xrayService.SetXrayLogOverride(c.PostForm("level"), c.PostForm("access"), minutes, restart)
+	jsonObj(c, a.xrayService.GetXrayLogStatus(), err)
+}
+
+func (a *ServerController) debugXrayLog(c *gin.Context) {
+	minutes, _ := strconv.Atoi(c.PostForm("minutes"))
+	err := a.xrayService.DebugXray(minutes)
+	jsonObj(c, a.xrayService.GetXrayLogStatus(), err)
+}
+
+func (a *ServerController) resetXrayLog(c *gin.Context) {
+	err := a.xrayService.ResetXrayLog(c.PostForm("restart") == "true")
+	jsonObj(c, a.xrayService.GetXrayLogStatus(), err)
+}
+
+func (a *ServerController) restartXrayLogger(c *gin.Context) {
+	err := a.xrayService.RestartXrayLogger()
+	jsonMsg(c, "restart Xray logger", err)
+}
+
+func (a *ServerController) getAccessStats(c *gin.Context) {
+	hours, _ := strconv.Atoi(c.Query("hours"))
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	destinations, err := a.accessStatsService.GetTopDestinations(c.Query("email"), hours, limit)
+	jsonObj(c, destinations, err)
+}
+
+func (a *ServerController) getAccessStatsClients(c *gin.Context) {
+	hours, _ := strconv.Atoi(c.Query("hours"))
+	clients, err := a.accessStatsService.GetDestinationClients(c.Query("destination"), hours)
+	jsonObj(c, clients, err)
+}
+
 func (a *ServerController) getNewUUID(c *gin.Context) {
 	uuidResp, err := a.serverService.GetNewUUID()
 	if err != nil {
@@ -1,18 +1,23 @@
 package controller
 
 import (
+	"strconv"
+
 	"x-ui/web/service"
+	"x-ui/web/session"
 
 	"github.com/gin-gonic/gin"
 )
 
 type XraySettingController struct {
-	XraySettingService service.XraySettingService
-	SettingService     service.SettingService
-	InboundService     service.InboundService
-	OutboundService    service.OutboundService
-	XrayService        service.XrayService
-	WarpService        service.WarpService
+	XraySettingService   service.XraySettingService
+	SettingService       service.SettingService
+	InboundService       service.InboundService
+	OutboundService      service.OutboundService
+	XrayService          service.XrayService
+	WarpService          service.WarpService
+	XrayHistoryService   service.XrayHistoryService
+	XrayReconcileService service.XrayReconcileService
 }
 
 func NewXraySettingController(g *gin.RouterGroup) *XraySettingController {
@@ -31,6 +36,14 @@ func (a *XraySettingController) initRouter(g *gin.RouterGroup) {
 	g.POST("/warp/:action", a.warp)
 	g.GET("/getOutboundsTraffic", a.getOutboundsTraffic)
 	g.POST("/resetOutboundsTraffic", a.resetOutboundsTraffic)
+	g.GET("/history", a.getHistory)
+	g.GET("/history/diff", a.getHistoryDiff)
+	g.GET("/history/:id", a.getHistoryVersion)
+	g.POST("/history/rollback/:id", a.rollbackHistory)
+	g.POST("/history/pin/:id", a.pinHistory)
+	g.GET("/reconcile", a.getReconcileReport)
+	g.POST("/reconcile", a.reconcile)
+	g.GET("/apiStatus", a.getApiStatus)
 }
 
 func (a *XraySettingController) getXraySetting(c *gin.Context) {
@@ -50,10 +63,98 @@ func (a *XraySettingController) getXraySetting(c *gin.Context) {
 
 func (a *XraySettingController) updateSetting(c *gin.Context) {
 	xraySetting := c.PostForm("xraySetting")
-	err := a.XraySettingService.SaveXraySetting(xraySetting)
+	err := a.XraySettingService.SaveXraySetting(xraySetting, loginUsername(c), c.PostForm("comment"))
 	jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
 }
 
+func loginUsername(c *gin.Context) string {
+	if user := session.GetLoginUser(c); user != nil {
+		return user.Username
+	}
+	return ""
+}
+
+func (a *XraySettingController) getHistory(c *gin.Context) {
+	versions, err := a.XrayHistoryService.GetVersions()
+	jsonObj(c, versions, err)
+}
+
+func (a *XraySettingController) getHistoryVersion(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	version, err := a.XrayHistoryService.GetVersion(id)
+	jsonObj(c, version, err)
+}
+
+// getHistoryDiff compares the versions from and to; version 0 is the template
+// the panel comes with.
+func (a *XraySettingController) getHistoryDiff(c *gin.Context) {
+	from, err := strconv.Atoi(c.Query("from"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	to, err := strconv.Atoi(c.Query("to"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	changes, err := a.XrayHistoryService.Diff(from, to)
+	jsonObj(c, changes, err)
+}
+
+// rollbackHistory makes a version the one in use and restarts Xray with it.
+func (a *XraySettingController) rollbackHistory(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
+		return
+	}
+	// The version is checked like a new config before it is used again.
+	version, err := a.XrayHistoryService.GetVersion(id)
+	if err == nil {
+		err = a.XrayService.TestXrayTemplate(version.Template)
+	}
+	if err == nil {
+		version, err = a.XrayHistoryService.Rollback(id, loginUsername(c))
+	}
+	if err == nil {
+		a.XrayService.SetToNeedRestart()
+	}
+	jsonObj(c, version, err)
+}
+
+func (a *XraySettingController) pinHistory(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
+		return
+	}
+	pinned := c.DefaultPostForm("pinned", "true") == "true"
+	err = a.XrayHistoryService.SetPinned(id, pinned)
+	jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
+}
+
+// getReconcileReport returns what the last reconciliation of the users of Xray
+// with the database found.
+func (a *XraySettingController) getReconcileReport(c *gin.Context) {
+	jsonObj(c, a.XrayReconcileService.GetLastReport(), nil)
+}
+
+func (a *XraySettingController) reconcile(c *gin.Context) {
+	report, err := a.XrayReconcileService.Reconcile()
+	jsonObj(c, report, err)
+}
+
+// getApiStatus returns the health of the connection to the Xray API and the
+// metrics of the calls made through it.
+func (a *XraySettingController) getApiStatus(c *gin.Context) {
+	jsonObj(c, a.XrayService.GetXrayAPIStatus(), nil)
+}
+
 func (a *XraySettingController) getDefaultXrayConfig(c *gin.Context) {
 	defaultJsonConfig, err := a.SettingService.GetDefaultXrayConfig()
 	if err != nil {
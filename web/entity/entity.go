@@ -2,11 +2,15 @@ package entity
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"math"
 	"net"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"x-ui/database/model"
 	"x-ui/util/common"
 )
 
@@ -52,6 +56,8 @@ type AllSetting struct {
 	SubUpdates                  int    `json:"subUpdates" form:"subUpdates"`
 	ExternalTrafficInformEnable bool   `json:"externalTrafficInformEnable" form:"externalTrafficInformEnable"`
 	ExternalTrafficInformURI    string `json:"externalTrafficInformURI" form:"externalTrafficInformURI"`
+	WebhookUrl                  string `json:"webhookUrl" form:"webhookUrl"`
+	WebhookSecret               string `json:"webhookSecret" form:"webhookSecret"`
 	SubEncrypt                  bool   `json:"subEncrypt" form:"subEncrypt"`
 	SubShowInfo                 bool   `json:"subShowInfo" form:"subShowInfo"`
 	SubURI                      string `json:"subURI" form:"subURI"`
@@ -61,7 +67,45 @@ type AllSetting struct {
 	SubJsonNoises               string `json:"subJsonNoises" form:"subJsonNoises"`
 	SubJsonMux                  string `json:"subJsonMux" form:"subJsonMux"`
 	SubJsonRules                string `json:"subJsonRules" form:"subJsonRules"`
+	SubSignEnable               bool   `json:"subSignEnable" form:"subSignEnable"`
+	SubSignTTL                  int    `json:"subSignTTL" form:"subSignTTL"`
+	SubAccessLog                bool   `json:"subAccessLog" form:"subAccessLog"`
+	SubAccessLogDays            int    `json:"subAccessLogDays" form:"subAccessLogDays"`
+	SubRateLimit                int    `json:"subRateLimit" form:"subRateLimit"`
+	SubIpRateLimit              int    `json:"subIpRateLimit" form:"subIpRateLimit"`
+	SubRateLimitAction          string `json:"subRateLimitAction" form:"subRateLimitAction"`
+	SubTrustedProxies           string `json:"subTrustedProxies" form:"subTrustedProxies"`
+	SubShareIpThreshold         int    `json:"subShareIpThreshold" form:"subShareIpThreshold"`
+	SubShareCountryThreshold    int    `json:"subShareCountryThreshold" form:"subShareCountryThreshold"`
+	SubAnnounce                 string `json:"subAnnounce" form:"subAnnounce"`
+	SubRemarkTemplate           string `json:"subRemarkTemplate" form:"subRemarkTemplate"`
+	SubCountry                  string `json:"subCountry" form:"subCountry"`
 	Datepicker                  string `json:"datepicker" form:"datepicker"`
+	SpeedLimitLevels            string `json:"speedLimitLevels" form:"speedLimitLevels"`
+	SpeedLimitBackend           string `json:"speedLimitBackend" form:"speedLimitBackend"`
+	SpeedLimitInterface         string `json:"speedLimitInterface" form:"speedLimitInterface"`
+	SpeedLimitDryRun            bool   `json:"speedLimitDryRun" form:"speedLimitDryRun"`
+	IPLimitBackend              string `json:"ipLimitBackend" form:"ipLimitBackend"`
+	IPLimitBanMinutes           int    `json:"ipLimitBanMinutes" form:"ipLimitBanMinutes"`
+	GeoipMmdbPath               string `json:"geoipMmdbPath" form:"geoipMmdbPath"`
+	SharingDetect               bool   `json:"sharingDetect" form:"sharingDetect"`
+	SharingMaxSubnets           int    `json:"sharingMaxSubnets" form:"sharingMaxSubnets"`
+	SharingMaxAsns              int    `json:"sharingMaxAsns" form:"sharingMaxAsns"`
+	SharingNotifyScore          int    `json:"sharingNotifyScore" form:"sharingNotifyScore"`
+	SharingTagScore             int    `json:"sharingTagScore" form:"sharingTagScore"`
+	SharingLimitScore           int    `json:"sharingLimitScore" form:"sharingLimitScore"`
+	SharingDeviceLimit          int    `json:"sharingDeviceLimit" form:"sharingDeviceLimit"`
+	RoutingPlans                string `json:"routingPlans" form:"routingPlans"`
+	XrayCoreMode                string `json:"xrayCoreMode" form:"xrayCoreMode"`
+	XrayCrashLoopCount          int    `json:"xrayCrashLoopCount" form:"xrayCrashLoopCount"`
+	XrayCrashLoopMinutes        int    `json:"xrayCrashLoopMinutes" form:"xrayCrashLoopMinutes"`
+	XrayCoreDownloadUrl         string `json:"xrayCoreDownloadUrl" form:"xrayCoreDownloadUrl"`
+	XrayCoreReleasesUrl         string `json:"xrayCoreReleasesUrl" form:"xrayCoreReleasesUrl"`
+	XrayCoreVerifyChecksum      bool   `json:"xrayCoreVerifyChecksum" form:"xrayCoreVerifyChecksum"`
+	AccessStats                 bool   `json:"accessStats" form:"accessStats"`
+	AccessStatsDays             int    `json:"accessStatsDays" form:"accessStatsDays"`
+	AccessStatsPrivacy          bool   `json:"accessStatsPrivacy" form:"accessStatsPrivacy"`
+	AccessStatsCategories       string `json:"accessStatsCategories" form:"accessStatsCategories"`
 	V2boardEnable               bool   `json:"v2boardEnable" form:"v2boardEnable"`
 	V2boardUrl                  string `json:"v2boardUrl" form:"v2boardUrl"`
 	V2boardToken                string `json:"v2boardToken" form:"v2boardToken"`
@@ -130,6 +174,89 @@ func (s *AllSetting) CheckValid() error {
 		s.SubJsonPath += "/"
 	}
 
+	if s.SubSignTTL <= 0 {
+		return common.NewError("Sub sign TTL must be positive:", s.SubSignTTL)
+	}
+
+	if s.SubAccessLogDays <= 0 {
+		return common.NewError("Sub access log retention must be positive:", s.SubAccessLogDays)
+	}
+
+	if s.SubRateLimit < 0 || s.SubIpRateLimit < 0 {
+		return common.NewError("Sub rate limit can not be negative")
+	}
+
+	if s.SubRateLimitAction != "429" && s.SubRateLimitAction != "empty" {
+		return common.NewError("Sub rate limit action is not valid:", s.SubRateLimitAction)
+	}
+	for _, proxy := range strings.Split(s.SubTrustedProxies, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return common.NewError("Sub trusted proxy is not valid:", proxy)
+		}
+	}
+
+	for _, level := range strings.Split(s.SpeedLimitLevels, ",") {
+		level = strings.TrimSpace(level)
+		if level == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(level); err != nil || n <= 0 {
+			return common.NewError("Speed limit level is not valid:", level)
+		}
+	}
+
+	if s.WebhookUrl != "" {
+		u, err := url.Parse(s.WebhookUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return common.NewError("Webhook URL is not valid:", s.WebhookUrl)
+		}
+	}
+
+	if s.SpeedLimitBackend != "tc" && s.SpeedLimitBackend != "off" {
+		return common.NewError("Speed limit backend is not valid:", s.SpeedLimitBackend)
+	}
+
+	if s.IPLimitBackend != "xray" && s.IPLimitBackend != "nftables" && s.IPLimitBackend != "fail2ban" {
+		return common.NewError("IP limit backend is not valid:", s.IPLimitBackend)
+	}
+
+	if s.XrayCoreMode != "binary" && s.XrayCoreMode != "embedded" {
+		return common.NewError("Xray core mode is not valid:", s.XrayCoreMode)
+	}
+	if s.XrayCrashLoopCount < 2 || s.XrayCrashLoopMinutes <= 0 {
+		return common.NewError("Xray crash loop detection is not valid:", s.XrayCrashLoopCount, s.XrayCrashLoopMinutes)
+	}
+	for _, rawUrl := range []string{s.XrayCoreDownloadUrl, s.XrayCoreReleasesUrl} {
+		u, err := url.Parse(rawUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return common.NewError("Xray download source is not valid:", rawUrl)
+		}
+	}
+	if s.AccessStatsDays <= 0 {
+		return common.NewError("access stats retention must be positive:", s.AccessStatsDays)
+	}
+	if s.IPLimitBanMinutes <= 0 {
+		return common.NewError("IP limit ban duration is not valid:", s.IPLimitBanMinutes)
+	}
+
+	if s.SharingMaxSubnets <= 0 || s.SharingMaxAsns <= 0 {
+		return common.NewError("sharing detection thresholds must be positive")
+	}
+	if s.SharingDeviceLimit <= 0 {
+		return common.NewError("sharing device limit is not valid:", s.SharingDeviceLimit)
+	}
+
+	if strings.TrimSpace(s.RoutingPlans) != "" {
+		plans := map[string]*model.RoutingPolicy{}
+		if err := json.Unmarshal([]byte(s.RoutingPlans), &plans); err != nil {
+			return common.NewError("routing plans are not valid:", err)
+		}
+	}
+
 	_, err := time.LoadLocation(s.TimeLocation)
 	if err != nil {
 		return common.NewError("time location not exist:", s.TimeLocation)
@@ -0,0 +1,23 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+// AccessStatsJob reads the new lines of the Xray access log into the hourly
+// destination statistics of the clients.
+type AccessStatsJob struct {
+	accessStatsService service.AccessStatsService
+}
+
+func NewAccessStatsJob() *AccessStatsJob {
+	return new(AccessStatsJob)
+}
+
+func (j *AccessStatsJob) Run() {
+	err := j.accessStatsService.Collect()
+	if err != nil {
+		logger.Warning("collect access stats failed:", err)
+	}
+}
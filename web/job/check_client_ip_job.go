@@ -9,6 +9,7 @@ import (
 	"os/exec"
 	"regexp"
 	"runtime"
+	"slices"
 	"sort"
 	"time"
 	"sync"
@@ -34,17 +35,30 @@ var activeClientsLock sync.RWMutex
 
 // ClientStatus 中文注释: 用于跟踪每个用户的状态（是否因为设备超限而被禁用）
 // 结构: map[用户email] -> 是否被禁用(true/false)
+// 封禁状态同时保存在数据库 (device_bans 表) 中，每次检查前都会从数据库重新加载。
 var ClientStatus = make(map[string]bool)
 var clientStatusLock sync.RWMutex
 
+
 // CheckDeviceLimitJob 中文注释: 这是我们的设备限制任务的结构体
 type CheckDeviceLimitJob struct {
-	inboundService service.InboundService
-	xrayService    *service.XrayService
-	// 中文注释: 新增 xrayApi 字段，用于持有 Xray API 客户端实例
-	xrayApi xray.XrayAPI
+	inboundService     service.InboundService
+	deviceLimitService service.DeviceLimitService
+	xrayService        *service.XrayService
+	// 中文注释: 本次运行使用的 Xray API 连接，由 XrayService 共享，不需要关闭
+	xrayApi *xray.XrayAPI
 	// lastPosition 中文注释: 用于记录上次读取 access.log 的位置，避免重复读取
 	lastPosition int64
+	// reconciled 中文注释: 启动后是否已核对过数据库中保存的封禁记录；lastGeneration 用于发现 Xray 被重启或其入站、路由规则被原地替换
+	reconciled     bool
+	lastGeneration uint64
+	// bans 中文注释: 数据库中的封禁记录，每次检查前重新加载
+	bans map[string]*model.DeviceBan
+	// firstSeen 中文注释: 每个IP第一次出现的时间，drop 策略据此找出“最新”的设备
+	firstSeen map[string]map[string]time.Time
+	// overLimitSince 中文注释: 用户开始超限的时间，用于宽限期判断；warned 记录已提醒过的用户
+	overLimitSince map[string]time.Time
+	warned         map[string]bool
                  // 〔中文注释〕: 注入 Telegram 服务用于发送通知，确保此行存在。
 	telegramService   service.TelegramService
 }
@@ -63,8 +77,10 @@ func RandomUUID() string {
 func NewCheckDeviceLimitJob(xrayService *service.XrayService, telegramService service.TelegramService) *CheckDeviceLimitJob {
 	return &CheckDeviceLimitJob{
 		xrayService: xrayService,
-		// 中文注释: 初始化 xrayApi 字段
-		xrayApi: xray.XrayAPI{},
+		bans:           make(map[string]*model.DeviceBan),
+		firstSeen:      make(map[string]map[string]time.Time),
+		overLimitSince: make(map[string]time.Time),
+		warned:         make(map[string]bool),
                                  // 〔中文注释〕: 将传入的 telegramService 赋值给结构体实例。
 		telegramService: telegramService,
 	}
@@ -77,38 +93,148 @@ func (j *CheckDeviceLimitJob) Run() {
 		return
 	}
 
-	// 1. 清理过期的IP
-	j.cleanupExpiredIPs()
+	// 中文注释: 与通过 API 或机器人手动解封互斥，避免同时修改封禁记录和 Xray 中的用户
+	service.DeviceBanLock.Lock()
+	defer service.DeviceBanLock.Unlock()
 
-	// 2. 解析新的日志并更新IP列表
-	j.parseAccessLog()
+	// 中文注释: 面板启动、Xray 重启或入站被原地替换后，先核对一次数据库中保存的封禁记录
+	generation := j.xrayService.GetXrayGeneration()
+	if generation != j.lastGeneration {
+		j.reconciled = false
+	}
+	j.lastGeneration = generation
+	if !j.reconciled {
+		j.reconciled = j.reconcileBans()
+	}
 
-	// 3. 检查所有用户的设备限制状态
+	// 1. 优先通过 Xray 统计 API 获取在线IP，API 不可用时才回退到解析日志
+	if !j.collectOnlineIPs() {
+		j.parseAccessLog()
+	}
+
+	// 2. 清理过期的IP，并检查所有用户的设备限制状态
 	j.checkAllClientsLimit()
 }
 
-// cleanupExpiredIPs 中文注释: 清理长时间不活跃的IP
-func (j *CheckDeviceLimitJob) cleanupExpiredIPs() {
-	activeClientsLock.Lock()
-	defer activeClientsLock.Unlock()
-
+// cleanupExpiredIPs 中文注释: 清理长时间不活跃的IP，调用方需持有 activeClientsLock。
+// 每个用户按其入站设置的 IP 过期时间清理，未受设备限制的用户使用默认的3分钟。
+func (j *CheckDeviceLimitJob) cleanupExpiredIPs(policies map[string]*service.DeviceLimitPolicy) {
 	now := time.Now()
-	// 中文注释: 活跃判断窗口(TTL): 近3分钟内出现过就算“活跃”
-	const activeTTL = 3 * time.Minute
 	for email, ips := range ActiveClientIPs {
+		ttl := 3 * time.Minute
+		if policy, ok := policies[email]; ok {
+			ttl = policy.TTL
+		}
 		for ip, lastSeen := range ips {
-			// 中文注释: 如果一个IP超过3分钟没有新的连接日志，我们就认为它已经下线
-			if now.Sub(lastSeen) > activeTTL {
+			// 中文注释: 如果一个IP超过过期时间没有新的连接，我们就认为它已经下线
+			if now.Sub(lastSeen) > ttl {
 				delete(ActiveClientIPs[email], ip)
+				delete(j.firstSeen[email], ip)
 			}
 		}
 		// 中文注释: 如果一个用户的所有IP都下线了，就从大Map中移除这个用户，节省内存
 		if len(ActiveClientIPs[email]) == 0 {
 			delete(ActiveClientIPs, email)
+			delete(j.firstSeen, email)
+			continue
+		}
+		if _, ok := j.firstSeen[email]; !ok {
+			j.firstSeen[email] = make(map[string]time.Time)
+		}
+		for ip := range ActiveClientIPs[email] {
+			if _, ok := j.firstSeen[email][ip]; !ok {
+				j.firstSeen[email][ip] = now
+			}
 		}
 	}
 }
 
+// newestIPs 中文注释: 返回用户超出设备限制的那些最新出现的IP。
+func (j *CheckDeviceLimitJob) newestIPs(email string, ips map[string]time.Time, limit int) []string {
+	list := make([]string, 0, len(ips))
+	for ip := range ips {
+		list = append(list, ip)
+	}
+	firstSeen := j.firstSeen[email]
+	sort.Slice(list, func(a, b int) bool {
+		if !firstSeen[list[a]].Equal(firstSeen[list[b]]) {
+			return firstSeen[list[a]].Before(firstSeen[list[b]])
+		}
+		return list[a] < list[b]
+	})
+	if len(list) <= limit {
+		return nil
+	}
+	return list[limit:]
+}
+
+// collectOnlineIPs 中文注释: 通过 Xray 统计 API 获取启用了设备限制的用户的在线IP。
+// 不需要 access log，也不用读取日志文件；API 不可用时返回 false，由调用方回退到解析日志。
+func (j *CheckDeviceLimitJob) collectOnlineIPs() bool {
+	inbounds := j.deviceLimitService.GetLimitedInbounds()
+	if len(inbounds) == 0 {
+		return true
+	}
+
+	var emails []string
+	for _, inbound := range inbounds {
+		clients, err := j.inboundService.GetClients(inbound)
+		if err != nil {
+			continue
+		}
+		for _, client := range clients {
+			if client.Email != "" {
+				emails = append(emails, client.Email)
+			}
+		}
+	}
+
+	onlineIPs, err := queryOnlineIPs(j.xrayService, emails)
+	if err != nil {
+		logger.Debug("〔设备限制〕无法通过 API 获取在线IP，改为解析日志:", err)
+		return false
+	}
+
+	activeClientsLock.Lock()
+	defer activeClientsLock.Unlock()
+	for email, ips := range onlineIPs {
+		if _, ok := ActiveClientIPs[email]; !ok {
+			ActiveClientIPs[email] = make(map[string]time.Time)
+		}
+		for ip, lastSeen := range ips {
+			ActiveClientIPs[email][ip] = lastSeen
+		}
+	}
+	return true
+}
+
+// queryOnlineIPs 中文注释: 从 Xray 统计 API 查询多个用户的在线IP及其最后活跃时间。
+// 依赖配置中的 statsUserOnline 策略，面板生成的配置默认已开启。
+func queryOnlineIPs(xrayService *service.XrayService, emails []string) (map[string]map[string]time.Time, error) {
+	api, err := xrayService.GetXrayAPI()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]map[string]time.Time)
+	for _, email := range emails {
+		ips, err := api.GetStatsOnlineIpList(email)
+		if err != nil {
+			return nil, err
+		}
+		for ip, lastSeen := range ips {
+			if ip == "127.0.0.1" || ip == "::1" {
+				continue
+			}
+			if _, ok := result[email]; !ok {
+				result[email] = make(map[string]time.Time)
+			}
+			result[email][ip] = time.Unix(lastSeen, 0)
+		}
+	}
+	return result, nil
+}
+
 // parseAccessLog 中文注释: 解析 xray access log 来获取最新的用户IP信息
 func (j *CheckDeviceLimitJob) parseAccessLog() {
 	logPath, err := xray.GetAccessLogPath()
@@ -168,100 +294,183 @@ func (j *CheckDeviceLimitJob) parseAccessLog() {
 
 // checkAllClientsLimit 中文注释: 核心功能，检查所有用户，对超限的执行封禁，对恢复的执行解封
 func (j *CheckDeviceLimitJob) checkAllClientsLimit() {
-	db := database.GetDB()
-	var inbounds []*model.Inbound
-	// 中文注释: 这里仅查询启用了设备限制(device_limit > 0)并且自身是开启状态的入站规则
-	db.Where("device_limit > 0 AND enable = ?", true).Find(&inbounds)
+	// 中文注释: 这里仅查询自身或其中的用户设置了设备限制，并且自身是开启状态的入站规则
+	inbounds := j.deviceLimitService.GetLimitedInbounds()
 
-	if len(inbounds) == 0 {
-		return
-	}
-
-	// 中文注释: 获取 API 端口。如果端口为0 (说明Xray未完全启动或有问题)，则直接返回
-	apiPort := j.xrayService.GetApiPort()
-	if apiPort == 0 {
+	// 中文注释: 即使没有启用设备限制的入站，也要继续执行，以便释放遗留的封禁记录
+	// 中文注释: 取得面板共享的 Xray API 连接。Xray 未完全启动或有问题时直接返回
+	xrayApi, err := j.xrayService.GetXrayAPI()
+	if err != nil {
 		return
 	}
-	// 中文注释: 使用获取到的端口号初始化 API 客户端
-	j.xrayApi.Init(apiPort)
-	defer j.xrayApi.Close()
+	j.xrayApi = xrayApi
 
-	// 中文注释: 优化 - 在一次循环中同时获取 tag 和 protocol
-	inboundInfoMap := make(map[int]struct {
-		Limit    int
-		Tag      string
-		Protocol model.Protocol
-	})
+	limitedInbounds := make(map[int]*model.Inbound, len(inbounds))
 	for _, inbound := range inbounds {
-		inboundInfoMap[inbound.Id] = struct {
-			Limit    int
-			Tag      string
-			Protocol model.Protocol
-		}{Limit: inbound.DeviceLimit, Tag: inbound.Tag, Protocol: inbound.Protocol}
+		limitedInbounds[inbound.Id] = inbound
+	}
+	// 中文注释: 查找用户所在入站的设备限制策略，用户不受设备限制时返回 nil
+	getPolicy := func(email string) (*service.DeviceLimitPolicy, *xray.ClientTraffic, *model.Client) {
+		traffic, client, err := j.inboundService.GetClientByEmail(email)
+		if err != nil || traffic == nil || client == nil {
+			return nil, nil, nil
+		}
+		inbound, ok := limitedInbounds[traffic.InboundId]
+		if !ok {
+			return nil, nil, nil
+		}
+		policy := service.GetDeviceLimitPolicy(inbound, client)
+		if policy.Limit <= 0 {
+			return nil, nil, nil
+		}
+		return policy, traffic, client
 	}
 
-	activeClientsLock.RLock()
+	activeClientsLock.Lock()
 	clientStatusLock.Lock()
-	defer activeClientsLock.RUnlock()
+	defer activeClientsLock.Unlock()
 	defer clientStatusLock.Unlock()
 
+	// 中文注释: 从数据库加载封禁状态，这样通过 API 或机器人手动解封的用户也能同步过来
+	j.loadClientStatus()
+
+	policies := make(map[string]*service.DeviceLimitPolicy)
+	for email := range ActiveClientIPs {
+		if policy, _, _ := getPolicy(email); policy != nil {
+			policies[email] = policy
+		}
+	}
+	j.cleanupExpiredIPs(policies)
+
+	now := time.Now()
 	// 第一步: 处理当前在线的用户
 	for email, ips := range ActiveClientIPs {
-		traffic, err := j.inboundService.GetClientTrafficByEmail(email)
-		if err != nil || traffic == nil {
+		policy, ok := policies[email]
+		if !ok {
 			continue
 		}
+		isBanned := ClientStatus[email]
+		activeIPCount := len(ips)
 
-		info, ok := inboundInfoMap[traffic.InboundId]
-		if !ok || info.Limit <= 0 {
+		if activeIPCount <= policy.Limit {
+			delete(j.overLimitSince, email)
+			delete(j.warned, email)
+			// 调用解封函数；drop/disable 的封禁到期后才解除
+			if isBanned && j.bans[email].Strategy == service.DeviceLimitSwap {
+				// 中文注释: 调用解封函数时，传入当前的IP数用于记录日志
+				j.unbanUser(email, activeIPCount, policy)
+			}
 			continue
 		}
 
-
-		isBanned := ClientStatus[email]
-		activeIPCount := len(ips)
-
-                                  // 调用封禁函数
-		if activeIPCount > info.Limit && !isBanned {
-			// 中文注释: 调用封禁函数时，传入当前的IP数用于记录日志
-			j.banUser(email, activeIPCount, &info)
+		if isBanned || j.warned[email] || service.IsDeviceLimitPardoned(email) {
+			continue
+		}
+		// 中文注释: 超限后先等待宽限期，短暂的IP切换 (如移动网络切换到 WiFi) 不会触发处理
+		since, ok := j.overLimitSince[email]
+		if !ok {
+			since = now
+			j.overLimitSince[email] = now
+		}
+		if now.Sub(since) < policy.Grace {
+			continue
 		}
 
-                                  // 调用解封函数
-		if activeIPCount <= info.Limit && isBanned {
-			// 中文注释: 调用解封函数时，传入当前的IP数用于记录日志
-			j.unbanUser(email, activeIPCount, &info)
+		switch policy.Strategy {
+		case service.DeviceLimitSwap:
+			// 调用封禁函数
+			j.banUser(email, ips, policy)
+		case service.DeviceLimitWarn:
+			_, client, err := j.inboundService.GetClientByEmail(email)
+			if err != nil || client == nil {
+				continue
+			}
+			logger.Infof("〔设备限制〕超限：用户 %s. 限制: %d, 当前活跃: %d. 仅发送提醒。", email, policy.Limit, activeIPCount)
+			j.deviceLimitService.Notify(email, client.TgID, policy, sortedIPs(ips))
+			j.warned[email] = true
+		default:
+			j.blockUser(email, ips, policy)
 		}
 	}
 
-	// 第二步: 专门处理那些“已被封禁”但“已不在线”的用户，为他们解封
-	for email, isBanned := range ClientStatus {
-		if !isBanned {
+	// 第二步: 处理已封禁的用户：swap 在用户完全下线后解封，drop/disable 在到期后解除
+	for email, ban := range j.bans {
+		policy, _, _ := getPolicy(email)
+		if policy == nil {
+			// 中文注释: 用户已被删除，或所在入站已关闭设备限制，直接释放封禁
+			j.releaseBan(email)
 			continue
 		}
-		if _, online := ActiveClientIPs[email]; !online {
-			traffic, err := j.inboundService.GetClientTrafficByEmail(email)
-			if err != nil || traffic == nil {
-				continue
-			}
-			info, ok := inboundInfoMap[traffic.InboundId]
-			if !ok {
-				continue
+		if ban.Strategy != service.DeviceLimitSwap {
+			if ban.ExpiresAt > 0 && now.Unix() >= ban.ExpiresAt {
+				logger.Infof("〔设备限制〕用户 %s 的封禁已到期，解除封禁。", email)
+				j.releaseBan(email)
 			}
+			continue
+		}
+		if _, online := ActiveClientIPs[email]; !online {
 			logger.Infof("已封禁用户 %s 已完全下线，执行解封操作。", email)
 
 			// 调用解封函数，这种情况下：活跃IP数为0，我们直接传入0用于记录日志
-			j.unbanUser(email, 0, &info)
+			j.unbanUser(email, 0, policy)
 		}
 	}
 }
 
+// blockUser 中文注释: 执行 drop 或 disable 策略：屏蔽超出限制的最新IP，或暂停该用户，到期后自动解除。
+func (j *CheckDeviceLimitJob) blockUser(email string, ips map[string]time.Time, policy *service.DeviceLimitPolicy) {
+	traffic, client, err := j.inboundService.GetClientByEmail(email)
+	if err != nil || client == nil {
+		return
+	}
+	now := time.Now()
+	ban := &model.DeviceBan{
+		Email:     email,
+		InboundId: traffic.InboundId,
+		Tag:       policy.Tag,
+		Protocol:  string(policy.Protocol),
+		Strategy:  policy.Strategy,
+		Reason:    fmt.Sprintf("online from %d IPs, device limit is %d", len(ips), policy.Limit),
+		BannedAt:  now.Unix(),
+		ExpiresAt: now.Add(policy.Duration).Unix(),
+	}
+	if policy.Strategy == service.DeviceLimitDrop {
+		blocked, _ := json.Marshal(j.newestIPs(email, ips, policy.Limit))
+		ban.BlockedIps = string(blocked)
+	}
+	err = j.deviceLimitService.ApplyBan(ban)
+	if err != nil {
+		logger.Warningf("〔设备限制〕对用户 %s 执行 %s 策略失败: %v", email, policy.Strategy, err)
+		return
+	}
+	// 中文注释: 屏蔽规则无法生效时会改为暂停该用户，通知中的策略随之更新
+	if ban.Strategy != policy.Strategy {
+		applied := *policy
+		applied.Strategy = ban.Strategy
+		policy = &applied
+	}
+	logger.Infof("〔设备限制〕超限：用户 %s. 限制: %d, 当前活跃: %d. 执行 %s 策略，持续 %v。", email, policy.Limit, len(ips), policy.Strategy, policy.Duration)
+	ClientStatus[email] = true
+	j.bans[email] = ban
+	if err := j.deviceLimitService.SaveBan(ban, sortedIPs(ips)); err != nil {
+		logger.Warningf("保存用户 %s 的封禁记录失败: %v", email, err)
+	}
+	j.deviceLimitService.Notify(email, client.TgID, policy, sortedIPs(ips))
+}
+
+// sortedIPs 中文注释: 把IP集合转换为排好序的列表。
+func sortedIPs(ips map[string]time.Time) []string {
+	list := make([]string, 0, len(ips))
+	for ip := range ips {
+		list = append(list, ip)
+	}
+	sort.Strings(list)
+	return list
+}
+
 // banUser 中文注释: 封装的封禁用户函数；IP数量超限，且用户当前未被封禁 -> 执行封禁 (UUID 替换)
-func (j *CheckDeviceLimitJob) banUser(email string, activeIPCount int, info *struct {
-	Limit    int
-	Tag      string
-	Protocol model.Protocol
-}) {
+func (j *CheckDeviceLimitJob) banUser(email string, ips map[string]time.Time, info *service.DeviceLimitPolicy) {
+	activeIPCount := len(ips)
     // =================================================================
     // 这一行代码是整个解封逻辑的灵魂！
     // GetClientByEmail 函数会去查询您的数据库 (x-ui.db)，
@@ -269,7 +478,7 @@ func (j *CheckDeviceLimitJob) banUser(email string, activeIPCount int, info *str
     // 读取出您最初设置的、最原始、最正确的用户信息（包括最原始的UUID），
     // 然后把它赋值给 `client` 这个变量；此时，`client` 变量就持有了那个“老链接”的正确原始 UUID。
     // =================================================================
-	_, client, err := j.inboundService.GetClientByEmail(email)
+	traffic, client, err := j.inboundService.GetClientByEmail(email)
 	if err != nil || client == nil {
 		return
 	}
@@ -300,8 +509,32 @@ func (j *CheckDeviceLimitJob) banUser(email string, activeIPCount int, info *str
 	}()
 
 
+	err = j.applyBan(client, info)
+	if err != nil {
+		logger.Warningf("通过API封禁用户 %s 失败: %v", email, err)
+		return
+	}
+	// 中文注释: 封禁成功后，在内存中标记该用户为“已封禁”状态，并把封禁记录保存到数据库。
+	ClientStatus[email] = true
+
+	ban := &model.DeviceBan{
+		Email:      email,
+		InboundId:  traffic.InboundId,
+		Tag:        info.Tag,
+		Protocol:   string(info.Protocol),
+		Strategy:   service.DeviceLimitSwap,
+		Reason:     fmt.Sprintf("online from %d IPs, device limit is %d", activeIPCount, info.Limit),
+	}
+	j.bans[email] = ban
+	if err := j.deviceLimitService.SaveBan(ban, sortedIPs(ips)); err != nil {
+		logger.Warningf("保存用户 %s 的封禁记录失败: %v", email, err)
+	}
+}
+
+// applyBan 中文注释: 在 Xray-Core 中把用户的 UUID/Password 替换为随机值，实现“掐网”。
+func (j *CheckDeviceLimitJob) applyBan(client *model.Client, info *service.DeviceLimitPolicy) error {
 	// 中文注释: 步骤一：先从 Xray-Core 中删除该用户。
-	j.xrayApi.RemoveUser(info.Tag, email)
+	j.xrayApi.RemoveUser(info.Tag, client.Email)
     
     // =================================================================
 	// 中文注释: 增加 5000 毫秒延时，解决竞态条件问题
@@ -323,23 +556,14 @@ func (j *CheckDeviceLimitJob) banUser(email string, activeIPCount int, info *str
 
                  // 中文注释: 步骤二：将这个带有错误UUID/Password的临时用户添加回去。
                  // 客户端持有的还是旧的UUID，自然就无法通过验证，从而达到了“封禁”的效果。
-	err = j.xrayApi.AddUser(string(info.Protocol), info.Tag, clientMap)
-	if err != nil {
-		logger.Warningf("通过API封禁用户 %s 失败: %v", email, err)
-	} else {
-	                 // 中文注释: 封禁成功后，在内存中标记该用户为“已封禁”状态。
-		ClientStatus[email] = true
-	}
+	return j.xrayApi.AddUser(string(info.Protocol), info.Tag, clientMap)
 }
 
 // unbanUser 中文注释: 封装的解封用户函数；IP数量已恢复正常，但用户处于封禁状态 -> 执行解封 (恢复原始 UUID)
-func (j *CheckDeviceLimitJob) unbanUser(email string, activeIPCount int, info *struct {
-	Limit    int
-	Tag      string
-	Protocol model.Protocol
-}) {
+func (j *CheckDeviceLimitJob) unbanUser(email string, activeIPCount int, info *service.DeviceLimitPolicy) {
 	_, client, err := j.inboundService.GetClientByEmail(email)
 	if err != nil || client == nil {
+		j.releaseBan(email)
 		return
 	}
 	logger.Infof("〔设备数量〕已恢复：用户 %s. 限制: %d, 当前活跃: %d. 执行解封/恢复用户。", email, info.Limit, activeIPCount)	
@@ -361,14 +585,108 @@ func (j *CheckDeviceLimitJob) unbanUser(email string, activeIPCount int, info *s
 	if err != nil {
 		logger.Warningf("通过API恢复用户 %s 失败: %v", email, err)
 	} else {
-                                  // 中文注释: 解封成功后，从内存中移除该用户的“已封禁”状态标记。
+                                  // 中文注释: 解封成功后，从内存和数据库中移除该用户的“已封禁”状态标记。
 		delete(ClientStatus, email)
+		if err := j.deviceLimitService.DeleteBan(email); err != nil {
+			logger.Warningf("删除用户 %s 的封禁记录失败: %v", email, err)
+		}
 	}
 }
 
+// releaseBan 中文注释: 解除一个用户的封禁：恢复原始凭据 (用户仍存在且启用时) 或移除屏蔽规则，并删除封禁记录。
+func (j *CheckDeviceLimitJob) releaseBan(email string) {
+	ban, err := j.deviceLimitService.GetBan(email)
+	if err == nil {
+		logger.Infof("〔设备限制〕解除用户 %s 的封禁并删除封禁记录。", email)
+		if err := j.deviceLimitService.LiftBan(ban); err != nil {
+			logger.Warningf("通过API恢复用户 %s 失败: %v", email, err)
+			return
+		}
+	}
+	delete(ClientStatus, email)
+	delete(j.bans, email)
+}
+
+// loadClientStatus 中文注释: 用数据库中的封禁记录刷新内存中的 ClientStatus，调用方需持有 clientStatusLock。
+func (j *CheckDeviceLimitJob) loadClientStatus() {
+	bans, err := j.deviceLimitService.GetBans()
+	if err != nil {
+		logger.Warning("读取设备限制封禁记录失败:", err)
+		return
+	}
+	ClientStatus = make(map[string]bool, len(bans))
+	j.bans = make(map[string]*model.DeviceBan, len(bans))
+	for _, ban := range bans {
+		// 中文注释: 旧版本的封禁记录没有策略字段，都是替换凭据
+		if ban.Strategy == "" {
+			ban.Strategy = service.DeviceLimitSwap
+		}
+		ClientStatus[ban.Email] = true
+		j.bans[ban.Email] = ban
+	}
+}
+
+// reconcileBans 中文注释: 面板启动或 Xray 重启后核对数据库中保存的封禁记录。
+// Xray 启动时会从数据库加载用户的原始凭据，且动态添加的路由规则都已丢失，所以仍在封禁中的用户要重新执行封禁；
+// 已到期、已被删除、禁用或不再受设备限制的用户则解除封禁并删除记录。
+// 返回 false 表示暂时无法核对，下次运行时再试。
+func (j *CheckDeviceLimitJob) reconcileBans() bool {
+	bans, err := j.deviceLimitService.GetBans()
+	if err != nil {
+		logger.Warning("读取设备限制封禁记录失败:", err)
+		return false
+	}
+	if len(bans) == 0 {
+		return true
+	}
+	xrayApi, err := j.xrayService.GetXrayAPI()
+	if err != nil {
+		return false
+	}
+	j.xrayApi = xrayApi
+
+	clientStatusLock.Lock()
+	defer clientStatusLock.Unlock()
+
+	for _, ban := range bans {
+		traffic, client, err := j.inboundService.GetClientByEmail(ban.Email)
+		var inbound *model.Inbound
+		if err == nil && client != nil {
+			inbound, err = j.inboundService.GetInbound(traffic.InboundId)
+		}
+		expired := ban.Strategy != "" && ban.Strategy != service.DeviceLimitSwap && time.Now().Unix() >= ban.ExpiresAt
+		if err != nil || client == nil || !client.Enable || !inbound.Enable || service.GetDeviceLimitPolicy(inbound, client).Limit <= 0 || expired {
+			j.releaseBan(ban.Email)
+			continue
+		}
+
+		if ban.Strategy == "" || ban.Strategy == service.DeviceLimitSwap {
+			err = j.applyBan(client, service.GetDeviceLimitPolicy(inbound, client))
+		} else {
+			err = j.deviceLimitService.ApplyBan(ban)
+		}
+		if err != nil {
+			logger.Warningf("通过API恢复用户 %s 的封禁状态失败: %v", ban.Email, err)
+			continue
+		}
+		ClientStatus[ban.Email] = true
+		logger.Infof("〔设备限制〕已恢复用户 %s 的封禁状态。", ban.Email)
+	}
+	return true
+}
+
 type CheckClientIpJob struct {
-	lastClear     int64
-	disAllowedIps []string
+	xrayService    service.XrayService
+	inboundService service.InboundService
+	ipLimitService service.IPLimitService
+	geoIPService   service.GeoIPService
+	sharingService service.SharingService
+	// 清空访问日志前先统计其中的新行，否则上次统计后写入的行会丢失
+	accessStatsService service.AccessStatsService
+	lastClear          int64
+	disAllowedIps      []string
+	// 中文注释: 在线 IP 首次出现的时间，email -> IP -> 时间，IP 离线后移除
+	ipFirstSeen map[string]map[string]time.Time
 }
 
 var job *CheckClientIpJob
@@ -385,27 +703,42 @@ func (j *CheckClientIpJob) Run() {
 
 	shouldClearAccessLog := false
 	iplimitActive := j.hasLimitIp()
-	f2bInstalled := j.checkFail2BanInstalled()
-	isAccessLogAvailable := j.checkAccessLogAvailable(iplimitActive)
-
-	if isAccessLogAvailable {
+	// The panel blocks the IPs itself unless the backend is fail2ban, which
+	// then has to be installed.
+	canEnforce := j.ipLimitService.IsInProcess() || j.checkFail2BanInstalled()
+
+	// Online IPs come from the Xray stats API, the access log is only parsed
+	// when the API can not be used. They are recorded for the GeoIP
+	// statistics even when no client has an IP limit.
+	onlineIpsAvailable := j.processOnlineIps()
+	isAccessLogAvailable := j.checkAccessLogAvailable(iplimitActive && !onlineIpsAvailable)
+
+	if isAccessLogAvailable && !onlineIpsAvailable {
+		logProcessed := false
 		if runtime.GOOS == "windows" {
 			if iplimitActive {
 				shouldClearAccessLog = j.processLogFile()
+				logProcessed = true
 			}
 		} else {
 			if iplimitActive {
-				if f2bInstalled {
+				if canEnforce {
 					shouldClearAccessLog = j.processLogFile()
+					logProcessed = true
 				} else {
-					if !f2bInstalled {
-						logger.Warning("[LimitIP] Fail2Ban is not installed, Please install Fail2Ban from the x-ui bash menu.")
-					}
+					logger.Warning("[LimitIP] Fail2Ban is not installed, Please install Fail2Ban from the x-ui bash menu or choose another IP limit backend.")
 				}
 			}
 		}
+		// The sharing detection needs the online clients as well.
+		if !logProcessed && j.sharingService.IsEnabled() {
+			j.processLogFile()
+		}
 	}
 
+	// Expired bans are lifted even when no client has an IP limit anymore.
+	j.ipLimitService.Enforce()
+
 	if shouldClearAccessLog || (isAccessLogAvailable && time.Now().Unix()-j.lastClear > 3600) {
 		j.clearAccessLog()
 	}
@@ -426,6 +759,10 @@ func (j *CheckClientIpJob) clearAccessLog() {
 	_, err = io.Copy(logAccessP, file)
 	j.checkError(err)
 
+	if err := j.accessStatsService.Collect(); err != nil {
+		logger.Warning("collect access stats failed:", err)
+	}
+
 	err = os.Truncate(accessLogPath, 0)
 	j.checkError(err)
 
@@ -461,10 +798,62 @@ func (j *CheckClientIpJob) hasLimitIp() bool {
 	return false
 }
 
+// processOnlineIps records the IPs of the online clients from the Xray stats
+// API. It returns false when the API can not be used.
+func (j *CheckClientIpJob) processOnlineIps() bool {
+	if !j.xrayService.IsXrayRunning() {
+		return false
+	}
+	onlineIps, err := queryOnlineIPs(&j.xrayService, j.inboundService.GetOnlineClients())
+	if err != nil {
+		logger.Debug("[LimitIP] failed to query online IPs, falling back to the access log:", err)
+		return false
+	}
+
+	// 中文注释: 按首次出现的时间排序，已在线的 IP 保持在前，超出限制的总是新出现的 IP
+	firstSeen := make(map[string]map[string]time.Time, len(onlineIps))
+	online := make(map[string][]string, len(onlineIps))
+	for email, lastSeen := range onlineIps {
+		seen := make(map[string]time.Time, len(lastSeen))
+		ips := make([]string, 0, len(lastSeen))
+		for ip, at := range lastSeen {
+			if first, ok := j.ipFirstSeen[email][ip]; ok {
+				at = first
+			}
+			seen[ip] = at
+			ips = append(ips, ip)
+		}
+		firstSeen[email] = seen
+		sort.Slice(ips, func(a, b int) bool {
+			if !seen[ips[a]].Equal(seen[ips[b]]) {
+				return seen[ips[a]].Before(seen[ips[b]])
+			}
+			return ips[a] < ips[b]
+		})
+
+		online[email] = ips
+		j.recordIpsGeo(email, ips)
+		clientIpsRecord, err := j.getInboundClientIps(email)
+		if err != nil {
+			j.addInboundClientIps(email, ips)
+			continue
+		}
+		j.updateInboundClientIps(clientIpsRecord, email, ips)
+	}
+	j.ipFirstSeen = firstSeen
+	j.sharingService.ObserveOnline(online)
+	return true
+}
+
 func (j *CheckClientIpJob) processLogFile() bool {
 
 	ipRegex := regexp.MustCompile(`from (?:tcp:|udp:)?\[?([0-9a-fA-F\.:]+)\]?:\d+ accepted`)
 	emailRegex := regexp.MustCompile(`email: (.+)$`)
+	timeRegex := regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2})`)
+	// Clients with a connection in the last minutes count as online for the
+	// sharing detection.
+	onlineSince := time.Now().Add(-3 * time.Minute)
+	online := make(map[string][]string)
 
 	accessLogPath, _ := xray.GetAccessLogPath()
 	file, _ := os.Open(accessLogPath)
@@ -497,7 +886,15 @@ func (j *CheckClientIpJob) processLogFile() bool {
 			inboundClientIps[email] = make(map[string]struct{})
 		}
 		inboundClientIps[email][ip] = struct{}{}
+
+		if timeMatches := timeRegex.FindStringSubmatch(line); len(timeMatches) == 2 {
+			at, err := time.ParseInLocation("2006/01/02 15:04:05", timeMatches[1], time.Local)
+			if err == nil && at.After(onlineSince) && !slices.Contains(online[email], ip) {
+				online[email] = append(online[email], ip)
+			}
+		}
 	}
+	j.sharingService.ObserveOnline(online)
 
 	shouldCleanLog := false
 	for email, uniqueIps := range inboundClientIps {
@@ -507,6 +904,7 @@ func (j *CheckClientIpJob) processLogFile() bool {
 			ips = append(ips, ip)
 		}
 		sort.Strings(ips)
+		j.recordIpsGeo(email, ips)
 
 		clientIpsRecord, err := j.getInboundClientIps(email)
 		if err != nil {
@@ -520,6 +918,12 @@ func (j *CheckClientIpJob) processLogFile() bool {
 	return shouldCleanLog
 }
 
+func (j *CheckClientIpJob) recordIpsGeo(email string, ips []string) {
+	if err := j.geoIPService.RecordIps(email, ips); err != nil {
+		logger.Warning("[LimitIP] failed to record the countries of IPs:", err)
+	}
+}
+
 func (j *CheckClientIpJob) checkFail2BanInstalled() bool {
 	cmd := "fail2ban-client"
 	args := []string{"-h"}
@@ -630,8 +1034,12 @@ func (j *CheckClientIpJob) updateInboundClientIps(inboundClientIps *model.Inboun
 
 				if limitIp < len(ips) {
 					j.disAllowedIps = append(j.disAllowedIps, ips[limitIp:]...)
+					inProcess := j.ipLimitService.IsInProcess()
 					for i := limitIp; i < len(ips); i++ {
 						log.Printf("[LIMIT_IP] Email = %s || SRC = %s", clientEmail, ips[i])
+						if inProcess {
+							j.ipLimitService.Ban(clientEmail, ips[i])
+						}
 					}
 				}
 			}
@@ -1,14 +1,13 @@
 package job
 
 import (
-	"x-ui/logger"
 	"x-ui/web/service"
 )
 
+// CheckXrayRunningJob restarts Xray when it crashed, backing off and giving
+// up on a crash loop.
 type CheckXrayRunningJob struct {
 	xrayService service.XrayService
-
-	checkTime int
 }
 
 func NewCheckXrayRunningJob() *CheckXrayRunningJob {
@@ -16,17 +15,5 @@ func NewCheckXrayRunningJob() *CheckXrayRunningJob {
 }
 
 func (j *CheckXrayRunningJob) Run() {
-	if !j.xrayService.DidXrayCrash() {
-		j.checkTime = 0
-	} else {
-		j.checkTime++
-		// only restart if it's down 2 times in a row
-		if j.checkTime > 1 {
-			err := j.xrayService.RestartXray(false)
-			j.checkTime = 0
-			if err != nil {
-				logger.Error("Restart xray failed:", err)
-			}
-		}
-	}
+	j.xrayService.SuperviseXray()
 }
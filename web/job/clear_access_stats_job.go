@@ -0,0 +1,21 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type ClearAccessStatsJob struct {
+	accessStatsService service.AccessStatsService
+}
+
+func NewClearAccessStatsJob() *ClearAccessStatsJob {
+	return new(ClearAccessStatsJob)
+}
+
+func (j *ClearAccessStatsJob) Run() {
+	err := j.accessStatsService.ClearAccessStats()
+	if err != nil {
+		logger.Warning("clear access stats failed:", err)
+	}
+}
@@ -0,0 +1,21 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+type ClearSubAccessLogJob struct {
+	subscriptionService service.SubscriptionService
+}
+
+func NewClearSubAccessLogJob() *ClearSubAccessLogJob {
+	return new(ClearSubAccessLogJob)
+}
+
+func (j *ClearSubAccessLogJob) Run() {
+	err := j.subscriptionService.ClearSubAccessLogs()
+	if err != nil {
+		logger.Warning("clear sub access logs failed:", err)
+	}
+}
@@ -0,0 +1,23 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+// SharingDetectJob scores the clients for account sharing and takes the
+// configured actions.
+type SharingDetectJob struct {
+	sharingService service.SharingService
+}
+
+func NewSharingDetectJob() *SharingDetectJob {
+	return new(SharingDetectJob)
+}
+
+func (j *SharingDetectJob) Run() {
+	err := j.sharingService.Detect()
+	if err != nil {
+		logger.Warning("sharing detection failed:", err)
+	}
+}
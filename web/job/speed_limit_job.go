@@ -0,0 +1,18 @@
+package job
+
+import (
+	"x-ui/web/service"
+)
+
+type SpeedLimitJob struct {
+	speedLimitService service.SpeedLimitService
+}
+
+func NewSpeedLimitJob() *SpeedLimitJob {
+	return new(SpeedLimitJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *SpeedLimitJob) Run() {
+	j.speedLimitService.ApplySpeedLimits()
+}
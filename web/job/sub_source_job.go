@@ -0,0 +1,18 @@
+package job
+
+import (
+	"x-ui/web/service"
+)
+
+type SubSourceJob struct {
+	subSourceService service.SubSourceService
+}
+
+func NewSubSourceJob() *SubSourceJob {
+	return new(SubSourceJob)
+}
+
+// Here Run is an interface method of the Job interface
+func (j *SubSourceJob) Run() {
+	j.subSourceService.RefreshSubSources()
+}
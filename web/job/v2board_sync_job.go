@@ -180,10 +180,13 @@ func (j *V2boardSyncJob) processUserInbound(user *service.User, allSetting *enti
 			return userErr
 		}
 		if configChanged {
-			_, _, err := j.inboundService.UpdateInbound(existingInbound)
+			_, needRestart, err := j.inboundService.UpdateInbound(existingInbound)
 			if err != nil {
 				return fmt.Errorf("failed to update inbound properties: %w", err)
 			}
+			if needRestart {
+				j.xrayService.ApplyXrayConfig()
+			}
 			logger.Info("updated inbound properties for user", user.Id, "tag:", config.InboundTag)
 		}
 		return nil
@@ -431,11 +434,14 @@ func (j *V2boardSyncJob) updateInboundClients(inbound *model.Inbound, clients []
 	inbound.Settings = string(updatedSettings)
 
 	// 更新数据库
-	_, _, err = j.inboundService.UpdateInbound(inbound)
+	_, needRestart, err := j.inboundService.UpdateInbound(inbound)
 	if err != nil {
 		logger.Error("failed to update inbound in DB for inbound", inbound.Tag, ":", err)
 		return fmt.Errorf("failed to update inbound: %w", err)
 	}
+	if needRestart {
+		j.xrayService.ApplyXrayConfig()
+	}
 
 	return nil
 }
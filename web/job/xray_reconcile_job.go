@@ -0,0 +1,22 @@
+package job
+
+import (
+	"x-ui/logger"
+	"x-ui/web/service"
+)
+
+// XrayReconcileJob brings the users of the running Xray back in line with the
+// database and reports the drift it found.
+type XrayReconcileJob struct {
+	xrayReconcileService service.XrayReconcileService
+}
+
+func NewXrayReconcileJob() *XrayReconcileJob {
+	return new(XrayReconcileJob)
+}
+
+func (j *XrayReconcileJob) Run() {
+	if _, err := j.xrayReconcileService.Reconcile(); err != nil {
+		logger.Debug("xray reconcile skipped:", err)
+	}
+}
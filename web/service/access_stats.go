@@ -0,0 +1,536 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+
+	"github.com/xtls/xray-core/app/router"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"gorm.io/gorm"
+)
+
+const (
+	// Destinations stored with the privacy switch on that are IPs, or domains
+	// in none of the categories.
+	accessCategoryIP    = "ip"
+	accessCategoryOther = "other"
+
+	accessStatsHours = 24
+	accessStatsLimit = 10
+)
+
+var (
+	accessLineRegex   = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2})\S* from \S+ (accepted|rejected)\s+(.*)$`)
+	accessTargetRegex = regexp.MustCompile(`^(?:tcp:|udp:)?(\[[0-9a-fA-F:.]+\]|[^\s:\[\]]+):\d+(?:\s|$)`)
+	accessRouteRegex  = regexp.MustCompile(`\[[^\[\]]*?(?:->|>>)\s*([^\[\]\s]*)\s*\]`)
+	accessEmailRegex  = regexp.MustCompile(`email: (\S+)`)
+)
+
+// AccessDestination is how often a destination was reached, by one client or
+// by all of them.
+type AccessDestination struct {
+	Destination string `json:"destination"`
+	Accepted    int64  `json:"accepted"`
+	Rejected    int64  `json:"rejected"`
+	Clients     int    `json:"clients"`
+	Outbounds   string `json:"outbounds"`
+	LastHour    int64  `json:"lastHour"`
+}
+
+// AccessClient is how often a client reached the destinations looked up, and
+// during which hours.
+type AccessClient struct {
+	Email        string `json:"email"`
+	Accepted     int64  `json:"accepted"`
+	Rejected     int64  `json:"rejected"`
+	Destinations string `json:"destinations"`
+	Outbounds    string `json:"outbounds"`
+	FirstHour    int64  `json:"firstHour"`
+	LastHour     int64  `json:"lastHour"`
+}
+
+type accessStatKey struct {
+	hour        int64
+	email       string
+	destination string
+	outbound    string
+}
+
+type accessStatCount struct {
+	accepted int64
+	rejected int64
+}
+
+// AccessStatsService counts from the access log of Xray which destinations
+// every client reached, per hour.
+type AccessStatsService struct {
+	settingService SettingService
+}
+
+var (
+	accessStatsLock sync.Mutex
+	accessTail      accessLogTail
+	accessCategory  accessCategories
+)
+
+// accessLogTail reads the lines appended to the access log since the last
+// read, the way CheckDeviceLimitJob.parseAccessLog does. The file stays open
+// between reads, so that after a rotation the rest of the old file is read
+// before the new one, which is read from its start; a truncated file is read
+// again from its start too. Only complete lines are read, a line still being
+// written is read the next time.
+type accessLogTail struct {
+	path     string
+	file     *os.File
+	position int64
+}
+
+func (t *accessLogTail) close() {
+	if t.file != nil {
+		t.file.Close()
+	}
+	*t = accessLogTail{}
+}
+
+// read calls handle for every new line. When the log is opened for the first
+// time, the lines already in it are skipped, so that a restart of the panel
+// does not count them twice.
+func (t *accessLogTail) read(path string, handle func(line string)) error {
+	if path != t.path {
+		t.close()
+	}
+	if t.file == nil {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			// Xray did not log anything yet.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		t.path, t.file = path, file
+		t.position = t.lastLineEnd(info.Size())
+		return nil
+	}
+
+	if err := t.readFile(handle); err != nil {
+		return err
+	}
+	opened, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+	current, err := os.Stat(path)
+	if err != nil {
+		// Rotated, and the new file is not created yet.
+		return nil
+	}
+	if os.SameFile(opened, current) {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	t.file.Close()
+	t.file, t.position = file, 0
+	return t.readFile(handle)
+}
+
+func (t *accessLogTail) readFile(handle func(line string)) error {
+	info, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < t.position || !t.atLineStart() {
+		t.position = 0
+	}
+	if _, err := t.file.Seek(t.position, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(t.file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		t.position += int64(len(line))
+		handle(strings.TrimRight(line, "\r\n"))
+	}
+}
+
+// lastLineEnd returns where the last complete line of the file ends, so that
+// a line still being written is read once it is complete.
+func (t *accessLogTail) lastLineEnd(size int64) int64 {
+	buf := make([]byte, 4096)
+	for end := size; end > 0; {
+		start := max(end-int64(len(buf)), 0)
+		n, err := t.file.ReadAt(buf[:end-start], start)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return size
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			return start + int64(i) + 1
+		}
+		end = start
+	}
+	return 0
+}
+
+// atLineStart tells whether the position is still right after the end of a
+// line, which it is not when the file was truncated and written up to past it
+// since the last read.
+func (t *accessLogTail) atLineStart() bool {
+	if t.position == 0 {
+		return true
+	}
+	last := make([]byte, 1)
+	_, err := t.file.ReadAt(last, t.position-1)
+	return err == nil && last[0] == '\n'
+}
+
+// Collect reads the new lines of the access log into the hourly statistics.
+func (s *AccessStatsService) Collect() error {
+	accessStatsLock.Lock()
+	defer accessStatsLock.Unlock()
+
+	enabled, err := s.settingService.GetAccessStats()
+	if err != nil || !enabled {
+		accessTail.close()
+		return err
+	}
+	logPath, err := xray.GetAccessLogPath()
+	if err != nil || logPath == "none" || logPath == "" {
+		accessTail.close()
+		return nil
+	}
+	privacy, err := s.settingService.GetAccessStatsPrivacy()
+	if err != nil {
+		return err
+	}
+	var categories *accessCategories
+	if privacy {
+		codes, err := s.settingService.GetAccessStatsCategories()
+		if err != nil {
+			return err
+		}
+		categories = accessCategory.load(xray.GetGeositePath(), codes)
+	}
+
+	counts := map[accessStatKey]*accessStatCount{}
+	now := time.Now()
+	err = accessTail.read(logPath, func(line string) {
+		key, accepted, ok := parseAccessLine(line, now)
+		if !ok {
+			return
+		}
+		if categories != nil {
+			key.destination = categories.categorize(key.destination)
+		}
+		count, ok := counts[key]
+		if !ok {
+			count = &accessStatCount{}
+			counts[key] = count
+		}
+		if accepted {
+			count.accepted++
+		} else {
+			count.rejected++
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return saveAccessStats(counts)
+}
+
+// parseAccessLine reads the hour, the client, the destination without its
+// port and the outbound of a line of the access log. Lines with neither a
+// client nor a destination are not of interest.
+func parseAccessLine(line string, now time.Time) (key accessStatKey, accepted bool, ok bool) {
+	match := accessLineRegex.FindStringSubmatch(line)
+	if match == nil {
+		return key, false, false
+	}
+	at, err := time.ParseInLocation("2006/01/02 15:04:05", match[1], time.Local)
+	if err != nil {
+		at = now
+	}
+	key.hour = at.Unix() - at.Unix()%3600
+	accepted = match[2] == "accepted"
+	rest := match[3]
+
+	if target := accessTargetRegex.FindStringSubmatch(rest); target != nil {
+		key.destination = strings.ToLower(strings.Trim(target[1], "[]"))
+	}
+	if route := accessRouteRegex.FindStringSubmatch(rest); route != nil {
+		key.outbound = route[1]
+	}
+	if email := accessEmailRegex.FindStringSubmatch(rest); email != nil {
+		key.email = email[1]
+	}
+	if key.email == "" && key.destination == "" {
+		return key, false, false
+	}
+	return key, accepted, true
+}
+
+func saveAccessStats(counts map[accessStatKey]*accessStatCount) error {
+	if len(counts) == 0 {
+		return nil
+	}
+	db := database.GetDB()
+	return db.Transaction(func(tx *gorm.DB) error {
+		for key, count := range counts {
+			result := tx.Model(model.AccessStat{}).
+				Where("hour = ? AND email = ? AND destination = ? AND outbound = ?", key.hour, key.email, key.destination, key.outbound).
+				Updates(map[string]any{
+					"accepted": gorm.Expr("accepted + ?", count.accepted),
+					"rejected": gorm.Expr("rejected + ?", count.rejected),
+				})
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected > 0 {
+				continue
+			}
+			stat := &model.AccessStat{
+				Hour:        key.hour,
+				Email:       key.email,
+				Destination: key.destination,
+				Outbound:    key.outbound,
+				Accepted:    count.accepted,
+				Rejected:    count.rejected,
+			}
+			if err := tx.Create(stat).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetTopDestinations returns the destinations reached most during the last
+// hours, by the client of the email or by all clients when it is empty.
+func (s *AccessStatsService) GetTopDestinations(email string, hours int, limit int) ([]*AccessDestination, error) {
+	if hours <= 0 {
+		hours = accessStatsHours
+	}
+	if limit <= 0 || limit > 100 {
+		limit = accessStatsLimit
+	}
+	db := database.GetDB()
+	query := db.Model(model.AccessStat{}).
+		Select("destination, SUM(accepted) AS accepted, SUM(rejected) AS rejected, COUNT(DISTINCT NULLIF(email, '')) AS clients, GROUP_CONCAT(DISTINCT NULLIF(outbound, '')) AS outbounds, MAX(hour) AS last_hour").
+		Where("hour >= ? AND destination != ''", accessStatsSince(hours))
+	if email != "" {
+		query = query.Where("email = ?", email)
+	}
+	destinations := make([]*AccessDestination, 0)
+	err := query.Group("destination").Order("SUM(accepted) + SUM(rejected) desc").Limit(limit).Scan(&destinations).Error
+	if err != nil {
+		return nil, err
+	}
+	return destinations, nil
+}
+
+// GetDestinationClients returns the clients that reached a destination during
+// the last hours, e.g. to answer an abuse report. A domain matches its
+// subdomains too. With the privacy switch on, only categories are stored, so
+// a domain is looked up by its category.
+func (s *AccessStatsService) GetDestinationClients(destination string, hours int) ([]*AccessClient, error) {
+	destination = strings.ToLower(strings.Trim(strings.TrimSpace(destination), "[]."))
+	if destination == "" {
+		return nil, common.NewError("destination is empty")
+	}
+	if hours <= 0 {
+		hours = accessStatsHours
+	}
+	destinations := []string{destination}
+	privacy, err := s.settingService.GetAccessStatsPrivacy()
+	if err != nil {
+		return nil, err
+	}
+	if privacy {
+		codes, err := s.settingService.GetAccessStatsCategories()
+		if err != nil {
+			return nil, err
+		}
+		accessStatsLock.Lock()
+		categories := accessCategory.load(xray.GetGeositePath(), codes)
+		accessStatsLock.Unlock()
+		destinations = append(destinations, categories.categorize(destination))
+	}
+
+	db := database.GetDB()
+	clients := make([]*AccessClient, 0)
+	err = db.Model(model.AccessStat{}).
+		Select("email, SUM(accepted) AS accepted, SUM(rejected) AS rejected, GROUP_CONCAT(DISTINCT destination) AS destinations, GROUP_CONCAT(DISTINCT NULLIF(outbound, '')) AS outbounds, MIN(hour) AS first_hour, MAX(hour) AS last_hour").
+		Where("hour >= ?", accessStatsSince(hours)).
+		Where("destination IN ? OR destination LIKE ?", destinations, "%."+destination).
+		Group("email").
+		Order("SUM(accepted) + SUM(rejected) desc").
+		Scan(&clients).Error
+	if err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func accessStatsSince(hours int) int64 {
+	since := time.Now().Add(-time.Duration(hours) * time.Hour).Unix()
+	return since - since%3600
+}
+
+// ClearAccessStats deletes the statistics older than the retention.
+func (s *AccessStatsService) ClearAccessStats() error {
+	days, err := s.settingService.GetAccessStatsDays()
+	if err != nil {
+		return err
+	}
+	if days <= 0 {
+		return nil
+	}
+	db := database.GetDB()
+	return db.Where("hour < ?", time.Now().AddDate(0, 0, -days).Unix()).Delete(model.AccessStat{}).Error
+}
+
+// accessCategories puts domains in the first of some geosite categories they
+// match, to store only those with the privacy switch on. The geosite lists
+// are read again when the file or the codes change.
+type accessCategories struct {
+	path     string
+	codes    string
+	modTime  time.Time
+	matchers []accessCategoryMatcher
+}
+
+type accessCategoryMatcher struct {
+	code    string
+	matcher *router.DomainMatcher
+}
+
+func (c *accessCategories) load(path string, codes string) *accessCategories {
+	stat, err := os.Stat(path)
+	if err != nil {
+		c.matchers = nil
+		return c
+	}
+	if c.path == path && c.codes == codes && c.modTime.Equal(stat.ModTime()) {
+		return c
+	}
+	c.path, c.codes, c.modTime, c.matchers = path, codes, stat.ModTime(), nil
+
+	wanted := []string{}
+	for _, code := range strings.Split(codes, ",") {
+		code = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(code), "geosite:"))
+		if code != "" {
+			wanted = append(wanted, code)
+		}
+	}
+	sites, err := readGeosites(path, wanted)
+	if err != nil {
+		logger.Warning("read geosite for access stats failed:", err)
+		return c
+	}
+	for _, code := range wanted {
+		site, ok := sites[code]
+		if !ok {
+			logger.Warning("geosite code of access stats not found:", code)
+			continue
+		}
+		matcher, err := router.NewMphMatcherGroup(site.Domain)
+		if err != nil {
+			logger.Warning("geosite code of access stats not usable:", code, err)
+			continue
+		}
+		c.matchers = append(c.matchers, accessCategoryMatcher{code: code, matcher: matcher})
+	}
+	return c
+}
+
+func (c *accessCategories) categorize(destination string) string {
+	if destination == "" {
+		return ""
+	}
+	if net.ParseIP(destination) != nil {
+		return accessCategoryIP
+	}
+	for _, category := range c.matchers {
+		if category.matcher.ApplyDomain(destination) {
+			return category.code
+		}
+	}
+	return accessCategoryOther
+}
+
+// readGeosites reads the lists of some codes from a geosite.dat, walking its
+// entries the way geodataCodes does so that only those are decoded.
+func readGeosites(path string, codes []string) (map[string]*router.GeoSite, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	wanted := map[string]bool{}
+	for _, code := range codes {
+		wanted[code] = true
+	}
+	sites := map[string]*router.GeoSite{}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+		if num != 1 || typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			data = data[n:]
+			continue
+		}
+		entry, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+		num, typ, n = protowire.ConsumeTag(entry)
+		if n <= 0 || num != 1 || typ != protowire.BytesType {
+			continue
+		}
+		code, m := protowire.ConsumeBytes(entry[n:])
+		if m < 0 || !wanted[strings.ToLower(string(code))] {
+			continue
+		}
+		site := &router.GeoSite{}
+		if err := proto.Unmarshal(entry, site); err != nil {
+			return nil, err
+		}
+		sites[strings.ToLower(string(code))] = site
+	}
+	return sites, nil
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAccessLogTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	write := func(flag int, data string) {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|flag, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if _, err := file.WriteString(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	appendLog := func(data string) { write(os.O_APPEND, data) }
+	truncateLog := func(data string) { write(os.O_TRUNC, data) }
+	rotateLog := func(data string) {
+		if err := os.Rename(path, path+".1"); err != nil {
+			t.Fatal(err)
+		}
+		write(os.O_EXCL, data)
+	}
+
+	// Every step changes the log, then reads it on the state the step before
+	// left.
+	steps := []struct {
+		name   string
+		change func()
+		want   []string
+	}{
+		{name: "lines before the first read are skipped", change: func() { appendLog("old 1\nold 2\n") }},
+		{name: "appended lines", change: func() { appendLog("a\nb\n") }, want: []string{"a", "b"}},
+		{name: "a line being written waits", change: func() { appendLog("c\nhalf") }, want: []string{"c"}},
+		{name: "the line once complete", change: func() { appendLog(" done\n") }, want: []string{"half done"}},
+		{name: "nothing new", change: func() {}},
+		{name: "truncated and shorter", change: func() { truncateLog("d\n") }, want: []string{"d"}},
+		{
+			name:   "truncated and written past the last position",
+			change: func() { truncateLog("e 1234567\nf\n") },
+			want:   []string{"e 1234567", "f"},
+		},
+		{name: "truncated and empty", change: func() { truncateLog("") }},
+		{name: "written after truncation", change: func() { appendLog("g\n") }, want: []string{"g"}},
+		{
+			name:   "rotated, the rest of the old file first",
+			change: func() { appendLog("h\n"); rotateLog("i\n") },
+			want:   []string{"h", "i"},
+		},
+	}
+
+	tail := &accessLogTail{}
+	defer tail.close()
+	for _, step := range steps {
+		step.change()
+		var got []string
+		err := tail.read(path, func(line string) {
+			got = append(got, line)
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if !reflect.DeepEqual(got, step.want) {
+			t.Fatalf("%s: read %q, want %q", step.name, got, step.want)
+		}
+	}
+}
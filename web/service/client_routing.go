@@ -0,0 +1,319 @@
+package service
+
+import (
+	"encoding/json"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/util/json_util"
+	"x-ui/xray"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ParseRoutingPlans parses the routing plans setting, a JSON object of plan
+// names to routing policies.
+func ParseRoutingPlans(str string) (map[string]*model.RoutingPolicy, error) {
+	plans := map[string]*model.RoutingPolicy{}
+	if strings.TrimSpace(str) == "" {
+		return plans, nil
+	}
+	if err := json.Unmarshal([]byte(str), &plans); err != nil {
+		return nil, common.NewError("routing plans are not valid:", err)
+	}
+	for name, plan := range plans {
+		if plan == nil {
+			return nil, common.NewError("routing plan is empty:", name)
+		}
+	}
+	return plans, nil
+}
+
+// clientRoutingPolicy merges the routing plan of a client with its own
+// options. The outbound of the client wins, the lists are joined.
+func clientRoutingPolicy(client *model.Client, plans map[string]*model.RoutingPolicy) *model.RoutingPolicy {
+	policy := &model.RoutingPolicy{}
+	if plan, ok := plans[client.RoutingPlan]; ok && client.RoutingPlan != "" {
+		*policy = *plan
+	}
+	if client.RoutingOutbound != "" {
+		policy.Outbound = client.RoutingOutbound
+	}
+	policy.BlockGeosite = geoCodes(policy.BlockGeosite, client.BlockGeosite)
+	policy.BlockBittorrent = policy.BlockBittorrent || client.BlockBittorrent
+	policy.AllowCountries = geoCodes(policy.AllowCountries, client.AllowCountries)
+	policy.DenyCountries = geoCodes(policy.DenyCountries, client.DenyCountries)
+	return policy
+}
+
+// geoCodes joins lists of geoip or geosite codes, lower case and sorted.
+func geoCodes(lists ...[]string) []string {
+	var codes []string
+	for _, list := range lists {
+		for _, code := range list {
+			code = strings.ToLower(strings.TrimSpace(code))
+			code = strings.TrimPrefix(strings.TrimPrefix(code, "geoip:"), "geosite:")
+			if code != "" && !slices.Contains(codes, code) {
+				codes = append(codes, code)
+			}
+		}
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+func isEmptyRoutingPolicy(policy *model.RoutingPolicy) bool {
+	return policy.Outbound == "" && len(policy.BlockGeosite) == 0 && !policy.BlockBittorrent &&
+		len(policy.AllowCountries) == 0 && len(policy.DenyCountries) == 0
+}
+
+// routingPolicyChanged reports whether two clients are routed differently,
+// which takes a restart of Xray.
+func routingPolicyChanged(a *model.Client, b *model.Client) bool {
+	if a.RoutingPlan != b.RoutingPlan {
+		return true
+	}
+	policyA, _ := json.Marshal(clientRoutingPolicy(a, nil))
+	policyB, _ := json.Marshal(clientRoutingPolicy(b, nil))
+	return string(policyA) != string(policyB)
+}
+
+// hasClientRouting reports whether adding a client takes a restart of Xray
+// for its routing.
+func hasClientRouting(client *model.Client) bool {
+	return client.RoutingPlan != "" || !isEmptyRoutingPolicy(clientRoutingPolicy(client, nil))
+}
+
+// addClientRouting compiles the routing policies of the clients into rules
+// matching their emails. Clients with the same policy share rules. The rules
+// blocking traffic go right after the api rule. The rules routing all traffic
+// of clients go after the rules of the template that block traffic, so that
+// clients can not route around them.
+func (s *XrayService) addClientRouting(xrayConfig *xray.Config, inbounds []*model.Inbound) {
+	plansStr, err := s.settingService.GetRoutingPlans()
+	if err != nil {
+		logger.Warning("client routing skipped:", err)
+		return
+	}
+	plans, err := ParseRoutingPlans(plansStr)
+	if err != nil {
+		logger.Warning("client routing skipped:", err)
+		return
+	}
+
+	var policies []*model.RoutingPolicy
+	emailsByPolicy := map[string][]string{}
+	for _, inbound := range inbounds {
+		// Xray does not know the users of wireguard inbounds.
+		if !inbound.Enable || inbound.Protocol == model.WireGuard {
+			continue
+		}
+		clients, err := s.inboundService.GetClients(inbound)
+		if err != nil {
+			continue
+		}
+		for _, client := range clients {
+			if !client.Enable || client.Email == "" {
+				continue
+			}
+			if _, ok := plans[client.RoutingPlan]; !ok && client.RoutingPlan != "" {
+				logger.Warningf("routing plan %s of client %s does not exist", client.RoutingPlan, client.Email)
+			}
+			policy := clientRoutingPolicy(&client, plans)
+			if isEmptyRoutingPolicy(policy) {
+				continue
+			}
+			key, _ := json.Marshal(policy)
+			if _, ok := emailsByPolicy[string(key)]; !ok {
+				policies = append(policies, policy)
+			}
+			emailsByPolicy[string(key)] = append(emailsByPolicy[string(key)], client.Email)
+		}
+	}
+	if len(policies) == 0 {
+		return
+	}
+
+	var outbounds []map[string]any
+	json.Unmarshal(xrayConfig.OutboundConfigs, &outbounds)
+	outboundTags := map[string]bool{}
+	defaultOutbound := ""
+	for i, outbound := range outbounds {
+		tag, _ := outbound["tag"].(string)
+		outboundTags[tag] = true
+		if i == 0 {
+			defaultOutbound = tag
+		}
+	}
+	blackhole, _ := blackholeTagOf(xrayConfig.OutboundConfigs)
+
+	routing := map[string]any{}
+	if len(xrayConfig.RouterConfig) > 0 {
+		if err := json.Unmarshal(xrayConfig.RouterConfig, &routing); err != nil {
+			logger.Warning("client routing skipped:", err)
+			return
+		}
+	}
+	if strategy, _ := routing["domainStrategy"].(string); strategy == "" || strategy == "AsIs" {
+		for _, policy := range policies {
+			if len(policy.AllowCountries) > 0 || len(policy.DenyCountries) > 0 {
+				logger.Warning("client routing: countries only match domains with a routing domainStrategy other than AsIs")
+				break
+			}
+		}
+	}
+
+	geoip := geodataCodes(xray.GetGeoipPath())
+	geosite := geodataCodes(xray.GetGeositePath())
+	var blockRules, routeRules []any
+	for _, policy := range policies {
+		key, _ := json.Marshal(policy)
+		emails := emailsByPolicy[string(key)]
+		rule := func(rules *[]any, fields map[string]any) {
+			fields["type"] = "field"
+			fields["user"] = emails
+			*rules = append(*rules, fields)
+		}
+
+		outbound := policy.Outbound
+		if outbound != "" && !outboundTags[outbound] {
+			logger.Warningf("client routing: outbound %s does not exist", outbound)
+			outbound = ""
+		}
+		if blackhole == "" && (len(policy.BlockGeosite) > 0 || policy.BlockBittorrent ||
+			len(policy.AllowCountries) > 0 || len(policy.DenyCountries) > 0) {
+			logger.Warning("client routing: no blackhole outbound to block traffic with")
+		} else {
+			if codes := knownCodes(policy.DenyCountries, geoip, "geoip:"); len(codes) > 0 {
+				rule(&blockRules, map[string]any{"ip": codes, "outboundTag": blackhole})
+			}
+			if codes := knownCodes(policy.BlockGeosite, geosite, "geosite:"); len(codes) > 0 {
+				rule(&blockRules, map[string]any{"domain": codes, "outboundTag": blackhole})
+			}
+			if policy.BlockBittorrent {
+				rule(&blockRules, map[string]any{"protocol": []string{"bittorrent"}, "outboundTag": blackhole})
+			}
+			if codes := knownCodes(policy.AllowCountries, geoip, "geoip:"); len(codes) > 0 {
+				allowed := outbound
+				if allowed == "" {
+					allowed = defaultOutbound
+				}
+				rule(&routeRules, map[string]any{"ip": codes, "outboundTag": allowed})
+				rule(&routeRules, map[string]any{"network": "tcp,udp", "outboundTag": blackhole})
+			}
+		}
+		if outbound != "" {
+			rule(&routeRules, map[string]any{"network": "tcp,udp", "outboundTag": outbound})
+		}
+	}
+
+	rules, _ := routing["rules"].([]any)
+	routing["rules"] = placeClientRules(rules, blockRules, routeRules, blackholeTagsOf(xrayConfig.OutboundConfigs))
+
+	newRouting, err := json.Marshal(routing)
+	if err != nil {
+		return
+	}
+	xrayConfig.RouterConfig = json_util.RawMessage(newRouting)
+}
+
+// placeClientRules puts the rules of the clients among the rules of the
+// template. The api rule stays first, the panel talks to Xray through it. The
+// blocking rules of the clients follow it, their routing rules follow the
+// last template rule that routes to the api or a blackhole.
+func placeClientRules(rules []any, blockRules []any, routeRules []any, blackholes map[string]bool) []any {
+	apiAt, blockedAt := 0, 0
+	for i, r := range rules {
+		ruleMap, ok := r.(map[string]any)
+		if !ok {
+			continue
+		}
+		tag, _ := ruleMap["outboundTag"].(string)
+		if tag == "api" {
+			apiAt = i + 1
+		}
+		if tag == "api" || blackholes[tag] {
+			blockedAt = i + 1
+		}
+	}
+	return slices.Concat(rules[:apiAt:apiAt], blockRules, rules[apiAt:blockedAt], routeRules, rules[blockedAt:])
+}
+
+// knownCodes prefixes the codes found in a geodata file. Unknown codes are
+// left out, Xray does not start with them.
+func knownCodes(codes []string, known map[string]bool, prefix string) []string {
+	var result []string
+	for _, code := range codes {
+		if known != nil && !known[code] {
+			logger.Warningf("client routing: %s%s is not in the geodata file", prefix, code)
+			continue
+		}
+		result = append(result, prefix+code)
+	}
+	return result
+}
+
+var (
+	geodataLock  sync.Mutex
+	geodataCache = map[string]*geodataFile{}
+)
+
+type geodataFile struct {
+	modTime time.Time
+	codes   map[string]bool
+}
+
+// geodataCodes returns the lower case codes of a geoip.dat or geosite.dat,
+// nil when it can not be read. Both are lists of entries whose first field
+// is the code, so only those are read.
+func geodataCodes(path string) map[string]bool {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	geodataLock.Lock()
+	defer geodataLock.Unlock()
+	if cached, ok := geodataCache[path]; ok && cached.modTime.Equal(stat.ModTime()) {
+		return cached.codes
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	codes := map[string]bool{}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil
+		}
+		data = data[n:]
+		if num != 1 || typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return nil
+			}
+			data = data[n:]
+			continue
+		}
+		entry, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return nil
+		}
+		data = data[n:]
+		if num, typ, n := protowire.ConsumeTag(entry); n > 0 && num == 1 && typ == protowire.BytesType {
+			if code, m := protowire.ConsumeBytes(entry[n:]); m > 0 {
+				codes[strings.ToLower(string(code))] = true
+			}
+		}
+	}
+	geodataCache[path] = &geodataFile{modTime: stat.ModTime(), codes: codes}
+	return codes
+}
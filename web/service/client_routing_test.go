@@ -0,0 +1,69 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlaceClientRules(t *testing.T) {
+	// Rules are named by their outbound, the ones of the clients by a prefix.
+	rule := func(outbound string) any {
+		return map[string]any{"type": "field", "outboundTag": outbound}
+	}
+	names := func(rules []any) []string {
+		var list []string
+		for _, r := range rules {
+			list = append(list, r.(map[string]any)["outboundTag"].(string))
+		}
+		return list
+	}
+	block := []any{rule("client-block")}
+	route := []any{rule("client-route")}
+	blackholes := map[string]bool{"blocked": true}
+
+	tests := []struct {
+		name  string
+		rules []string
+		want  []string
+	}{
+		{
+			name: "no template rules",
+			want: []string{"client-block", "client-route"},
+		},
+		{
+			name:  "api rule stays first",
+			rules: []string{"api", "direct"},
+			want:  []string{"api", "client-block", "client-route", "direct"},
+		},
+		{
+			name:  "template blocking rules stay ahead of client routes",
+			rules: []string{"api", "blocked", "direct", "blocked", "proxy"},
+			want:  []string{"api", "client-block", "blocked", "direct", "blocked", "client-route", "proxy"},
+		},
+		{
+			name:  "template blocking rules without an api rule",
+			rules: []string{"blocked", "direct"},
+			want:  []string{"client-block", "blocked", "client-route", "direct"},
+		},
+		{
+			name:  "template without blocking rules",
+			rules: []string{"direct", "proxy"},
+			want:  []string{"client-block", "client-route", "direct", "proxy"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var rules []any
+			for _, name := range test.rules {
+				rules = append(rules, rule(name))
+			}
+			got := names(placeClientRules(rules, block, route, blackholes))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("rules %q, want %q", got, test.want)
+			}
+			if !reflect.DeepEqual(names(rules), test.rules) {
+				t.Fatal("the rules of the template were changed")
+			}
+		})
+	}
+}
@@ -0,0 +1,406 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+)
+
+// Device limit strategies, what happens to a client online from more IPs than
+// the device limit allows.
+const (
+	// DeviceLimitSwap swaps the credential of the client in Xray, which cuts
+	// off all of its devices until it is back within the limit.
+	DeviceLimitSwap = "swap"
+	// DeviceLimitDrop blocks only the newest IPs beyond the limit.
+	DeviceLimitDrop = "drop"
+	// DeviceLimitWarn only notifies the admins, the webhook and the client.
+	DeviceLimitWarn = "warn"
+	// DeviceLimitDisable removes the client from Xray for a while.
+	DeviceLimitDisable = "disable"
+)
+
+const (
+	defaultDeviceLimitTTL     = 3 * time.Minute
+	defaultDeviceLimitMinutes = 10
+)
+
+// DeviceLimitPolicy is the device limit that applies to a client, with the
+// defaults filled in.
+type DeviceLimitPolicy struct {
+	Limit    int
+	Tag      string
+	Protocol model.Protocol
+	Strategy string
+	// Grace is how long a client may stay over the limit before the
+	// strategy is applied.
+	Grace time.Duration
+	// TTL is how long an IP counts as active after it was last seen.
+	TTL time.Duration
+	// Duration is how long the drop and disable strategies last.
+	Duration time.Duration
+}
+
+// GetDeviceLimitPolicy returns the device limit of a client of inbound. The
+// limit and the strategy of the client take precedence over those of the
+// inbound. A limit of 0 means the client is not limited.
+func GetDeviceLimitPolicy(inbound *model.Inbound, client *model.Client) *DeviceLimitPolicy {
+	policy := &DeviceLimitPolicy{
+		Limit:    inbound.DeviceLimit,
+		Tag:      inbound.Tag,
+		Protocol: inbound.Protocol,
+		Strategy: inbound.DeviceLimitStrategy,
+		Grace:    time.Duration(inbound.DeviceLimitGrace) * time.Second,
+		TTL:      time.Duration(inbound.DeviceLimitTTL) * time.Second,
+		Duration: time.Duration(inbound.DeviceLimitMinutes) * time.Minute,
+	}
+	if client != nil && client.DeviceLimit > 0 {
+		policy.Limit = client.DeviceLimit
+	}
+	if client != nil && isDeviceLimitStrategy(client.DeviceLimitStrategy) {
+		policy.Strategy = client.DeviceLimitStrategy
+	}
+	if !isDeviceLimitStrategy(policy.Strategy) {
+		policy.Strategy = DeviceLimitSwap
+	}
+	if policy.TTL <= 0 {
+		policy.TTL = defaultDeviceLimitTTL
+	}
+	if policy.Duration <= 0 {
+		policy.Duration = defaultDeviceLimitMinutes * time.Minute
+	}
+	return policy
+}
+
+func isDeviceLimitStrategy(strategy string) bool {
+	switch strategy {
+	case DeviceLimitSwap, DeviceLimitDrop, DeviceLimitWarn, DeviceLimitDisable:
+		return true
+	}
+	return false
+}
+
+// deviceLimitPardon is how long a client that was unbanned by hand is left
+// alone by the device limit, so that it is not banned again right away.
+const deviceLimitPardon = 10 * time.Minute
+
+var (
+	deviceLimitPardonLock sync.Mutex
+	deviceLimitPardons    = map[string]time.Time{}
+)
+
+// DeviceBanLock serializes changes to the device limit bans and to the clients
+// they cover in Xray. The device limit job holds it while it checks the
+// clients, so a ban lifted by hand does not race with it.
+var DeviceBanLock sync.Mutex
+
+// DeviceLimitService keeps the device-limit bans in the database, so that they
+// can be restored or lifted after the panel restarts.
+type DeviceLimitService struct {
+	inboundService InboundService
+}
+
+// GetLimitedInbounds returns the enabled inbounds with a device limit of their
+// own or of one of their clients.
+func (s *DeviceLimitService) GetLimitedInbounds() []*model.Inbound {
+	db := database.GetDB()
+	var inbounds []*model.Inbound
+	db.Where("enable = ?", true).Find(&inbounds)
+	var limited []*model.Inbound
+	for _, inbound := range inbounds {
+		if inbound.DeviceLimit > 0 {
+			limited = append(limited, inbound)
+			continue
+		}
+		clients, err := s.inboundService.GetClients(inbound)
+		if err != nil {
+			continue
+		}
+		for _, client := range clients {
+			if client.DeviceLimit > 0 {
+				limited = append(limited, inbound)
+				break
+			}
+		}
+	}
+	return limited
+}
+
+func (s *DeviceLimitService) GetBans() ([]*model.DeviceBan, error) {
+	db := database.GetDB()
+	var bans []*model.DeviceBan
+	err := db.Model(model.DeviceBan{}).Order("banned_at desc").Find(&bans).Error
+	if err != nil {
+		return nil, err
+	}
+	return bans, nil
+}
+
+func (s *DeviceLimitService) GetBan(email string) (*model.DeviceBan, error) {
+	db := database.GetDB()
+	ban := &model.DeviceBan{}
+	err := db.Model(model.DeviceBan{}).Where("email = ?", email).First(ban).Error
+	if err != nil {
+		return nil, err
+	}
+	return ban, nil
+}
+
+// SaveBan stores a ban, replacing an earlier one of the same client.
+func (s *DeviceLimitService) SaveBan(ban *model.DeviceBan, ips []string) error {
+	jsonIps, err := json.Marshal(ips)
+	if err != nil {
+		return err
+	}
+	ban.Ips = string(jsonIps)
+	if ban.BannedAt == 0 {
+		ban.BannedAt = time.Now().Unix()
+	}
+	if old, err := s.GetBan(ban.Email); err == nil {
+		ban.Id = old.Id
+	}
+	db := database.GetDB()
+	return db.Save(ban).Error
+}
+
+func (s *DeviceLimitService) DeleteBan(email string) error {
+	db := database.GetDB()
+	return db.Where("email = ?", email).Delete(model.DeviceBan{}).Error
+}
+
+// Unban lifts the ban of a client by hand. The client is then left alone by
+// the device limit for a while.
+func (s *DeviceLimitService) Unban(email string) error {
+	DeviceBanLock.Lock()
+	defer DeviceBanLock.Unlock()
+
+	ban, err := s.GetBan(email)
+	if err != nil {
+		return common.NewError("no device limit ban for", email)
+	}
+	err = s.LiftBan(ban)
+	if err != nil {
+		return err
+	}
+
+	deviceLimitPardonLock.Lock()
+	deviceLimitPardons[email] = time.Now().Add(deviceLimitPardon)
+	deviceLimitPardonLock.Unlock()
+	logger.Infof("device limit ban of %s lifted by hand", email)
+	return nil
+}
+
+// ApplyBan enforces a drop or disable ban in Xray. Swapped credentials are
+// handled by the device limit job.
+func (s *DeviceLimitService) ApplyBan(ban *model.DeviceBan) error {
+	xrayApi, err := getXrayAPI()
+	if err != nil {
+		return err
+	}
+	switch ban.Strategy {
+	case DeviceLimitDrop:
+		blackhole, err := blackholeOutboundTag()
+		if err != nil {
+			return err
+		}
+		// Xray can only append rules at runtime. Behind a rule that routes
+		// the traffic elsewhere the drop rules would never match, so the
+		// client is disabled instead.
+		if !appendedRulesMatch(p.GetConfig()) {
+			logger.Warningf("device limit: routing rules come before the drop rules of %s, disabling it instead", ban.Email)
+			ban.Strategy = DeviceLimitDisable
+			ban.BlockedIps = ""
+			if ban.Id > 0 {
+				if err := database.GetDB().Save(ban).Error; err != nil {
+					return err
+				}
+			}
+			return xrayApi.RemoveUser(ban.Tag, ban.Email)
+		}
+		var ips []string
+		json.Unmarshal([]byte(ban.BlockedIps), &ips)
+		for _, ip := range ips {
+			rule, _ := json.Marshal(map[string]any{
+				"type":        "field",
+				"ruleTag":     deviceLimitRuleTag(ban.Email, ip),
+				"inboundTag":  []string{ban.Tag},
+				"user":        []string{ban.Email},
+				"source":      []string{ip},
+				"outboundTag": blackhole,
+			})
+			err := xrayApi.AddRule(rule, true)
+			if err != nil && !strings.Contains(err.Error(), "duplicate ruleTag") {
+				return err
+			}
+		}
+	case DeviceLimitDisable:
+		return xrayApi.RemoveUser(ban.Tag, ban.Email)
+	}
+	return nil
+}
+
+// LiftBan undoes a ban in Xray and deletes it.
+func (s *DeviceLimitService) LiftBan(ban *model.DeviceBan) error {
+	if ban.Strategy == DeviceLimitDrop {
+		if xrayApi, err := getXrayAPI(); err == nil {
+			var ips []string
+			json.Unmarshal([]byte(ban.BlockedIps), &ips)
+			for _, ip := range ips {
+				// The rules are gone already when Xray restarted meanwhile.
+				xrayApi.RemoveRule(deviceLimitRuleTag(ban.Email, ip))
+			}
+		}
+	} else {
+		err := s.RestoreClient(ban)
+		if err != nil {
+			return err
+		}
+	}
+	return s.DeleteBan(ban.Email)
+}
+
+// Notify tells the admins, the webhook and the client itself that a client is
+// online from more IPs than its device limit allows.
+func (s *DeviceLimitService) Notify(email string, tgId int64, policy *DeviceLimitPolicy, ips []string) {
+	action := "仅提醒，未做限制"
+	switch policy.Strategy {
+	case DeviceLimitDrop:
+		action = fmt.Sprintf("最新连接的 %d 个IP已被屏蔽 %d 分钟", len(ips)-policy.Limit, int(policy.Duration.Minutes()))
+	case DeviceLimitDisable:
+		action = fmt.Sprintf("已暂停使用 %d 分钟", int(policy.Duration.Minutes()))
+	}
+	msg := fmt.Sprintf(
+		"<b>〔X-Panel面板〕设备超限提醒</b>\n\n"+
+			"  ------------------------------------\n"+
+			"  👤 用户 Email：%s\n"+
+			"  🖥️ 设备限制数量：%d\n"+
+			"  🌐 当前在线IP数：%d\n"+
+			"  ------------------------------------\n\n"+
+			"<b><i>⚠ %s</i></b>",
+		email, policy.Limit, len(ips), action,
+	)
+	notifyAdmins("client.deviceLimit", msg, map[string]any{
+		"email":    email,
+		"limit":    policy.Limit,
+		"ips":      ips,
+		"strategy": policy.Strategy,
+	})
+
+	tgBot := &Tgbot{}
+	if tgId > 0 && tgBot.IsRunning() {
+		clientMsg := fmt.Sprintf("⚠️ 您的账号 %s 当前在 %d 个IP上同时在线，超过了 %d 台设备的限制。\r\n%s。",
+			email, len(ips), policy.Limit, action)
+		go tgBot.SendMsgToTgbot(tgId, clientMsg)
+	}
+}
+
+func deviceLimitRuleTag(email string, ip string) string {
+	return "devicelimit-" + email + "-" + ip
+}
+
+// blackholeOutboundTag returns the tag of the outbound of the running Xray
+// that drops traffic.
+func blackholeOutboundTag() (string, error) {
+	if p == nil || p.GetConfig() == nil {
+		return "", common.NewError("xray is not running")
+	}
+	return blackholeTagOf(p.GetConfig().OutboundConfigs)
+}
+
+// appendedRulesMatch reports whether a rule appended to the routing of config
+// sees all the traffic of the clients, which holds when every rule but the
+// api rule drops what it matches.
+func appendedRulesMatch(config *xray.Config) bool {
+	blackholes := blackholeTagsOf(config.OutboundConfigs)
+	var routing struct {
+		Rules []map[string]any `json:"rules"`
+	}
+	if len(config.RouterConfig) > 0 {
+		if err := json.Unmarshal(config.RouterConfig, &routing); err != nil {
+			return false
+		}
+	}
+	for _, rule := range routing.Rules {
+		tag, _ := rule["outboundTag"].(string)
+		if tag != "api" && !blackholes[tag] {
+			return false
+		}
+	}
+	return true
+}
+
+// blackholeTagsOf returns the tags of all outbounds that drop traffic.
+func blackholeTagsOf(outboundConfigs []byte) map[string]bool {
+	var outbounds []map[string]any
+	json.Unmarshal(outboundConfigs, &outbounds)
+	blackholes := map[string]bool{}
+	for _, outbound := range outbounds {
+		if tag, _ := outbound["tag"].(string); outbound["protocol"] == "blackhole" && tag != "" {
+			blackholes[tag] = true
+		}
+	}
+	return blackholes
+}
+
+func blackholeTagOf(outboundConfigs []byte) (string, error) {
+	var outbounds []map[string]any
+	json.Unmarshal(outboundConfigs, &outbounds)
+	for _, outbound := range outbounds {
+		tag, _ := outbound["tag"].(string)
+		if outbound["protocol"] == "blackhole" && tag != "" && tag != "api" {
+			return tag, nil
+		}
+	}
+	return "", common.NewError("no blackhole outbound to block IPs with")
+}
+
+// RestoreClient puts the client of a ban back into Xray with the credential
+// from the database. Clients that were disabled, moved or deleted meanwhile are
+// only removed.
+func (s *DeviceLimitService) RestoreClient(ban *model.DeviceBan) error {
+	xrayApi, err := getXrayAPI()
+	if err != nil {
+		// Xray loads the clients from the database when it starts.
+		return nil
+	}
+
+	xrayApi.RemoveUser(ban.Tag, ban.Email)
+	_, inbound, err := s.inboundService.GetClientInboundByEmail(ban.Email)
+	if err != nil || inbound == nil || !inbound.Enable || inbound.Tag != ban.Tag {
+		return nil
+	}
+	_, client, err := s.inboundService.GetClientByEmail(ban.Email)
+	if err != nil || client == nil || !client.Enable {
+		return nil
+	}
+
+	var clientMap map[string]any
+	clientJson, _ := json.Marshal(client)
+	json.Unmarshal(clientJson, &clientMap)
+	if inbound.Protocol == model.Shadowsocks {
+		var settings map[string]any
+		json.Unmarshal([]byte(inbound.Settings), &settings)
+		clientMap["cipher"], _ = settings["method"].(string)
+	}
+	return xrayApi.AddUser(ban.Protocol, ban.Tag, clientMap)
+}
+
+// IsDeviceLimitPardoned reports whether a client was unbanned by hand recently.
+func IsDeviceLimitPardoned(email string) bool {
+	deviceLimitPardonLock.Lock()
+	defer deviceLimitPardonLock.Unlock()
+	until, ok := deviceLimitPardons[email]
+	if ok && time.Now().After(until) {
+		delete(deviceLimitPardons, email)
+		return false
+	}
+	return ok
+}
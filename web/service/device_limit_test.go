@@ -0,0 +1,68 @@
+package service
+
+import (
+	"testing"
+
+	"x-ui/database/model"
+)
+
+func TestDeviceBanReplacesEarlierBan(t *testing.T) {
+	initTestDB(t)
+	s := &DeviceLimitService{}
+	first := &model.DeviceBan{Email: "a", Tag: "in", Reason: "first", BannedAt: 100}
+	if err := s.SaveBan(first, []string{"1.1.1.1", "2.2.2.2"}); err != nil {
+		t.Fatal(err)
+	}
+	second := &model.DeviceBan{Email: "a", Tag: "in", Reason: "second"}
+	if err := s.SaveBan(second, []string{"3.3.3.3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveBan(&model.DeviceBan{Email: "b", Tag: "in"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	bans, err := s.GetBans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 2 {
+		t.Fatalf("%d bans, want one per client", len(bans))
+	}
+	ban, err := s.GetBan("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ban.Id != first.Id || ban.Reason != "second" || ban.Ips != `["3.3.3.3"]` || ban.BannedAt == 100 {
+		t.Fatalf("ban %+v, want the second one in place of the first", ban)
+	}
+}
+
+func TestUnbanPardonsTheClient(t *testing.T) {
+	initTestDB(t)
+	s := &DeviceLimitService{}
+	if err := s.Unban("a"); err == nil {
+		t.Fatal("lifted a ban that does not exist")
+	}
+
+	// Without a running Xray the client is put back when Xray starts.
+	if err := s.SaveBan(&model.DeviceBan{Email: "a", Tag: "in"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		deviceLimitPardonLock.Lock()
+		delete(deviceLimitPardons, "a")
+		deviceLimitPardonLock.Unlock()
+	})
+	if err := s.Unban("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetBan("a"); err == nil {
+		t.Fatal("the ban is still saved")
+	}
+	if !IsDeviceLimitPardoned("a") {
+		t.Fatal("the client is not pardoned")
+	}
+	if IsDeviceLimitPardoned("b") {
+		t.Fatal("a client that was not unbanned is pardoned")
+	}
+}
@@ -0,0 +1,378 @@
+package service
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/xray"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/xtls/xray-core/app/router"
+	"google.golang.org/protobuf/proto"
+)
+
+// clientIpGeoRetention is how long an IP is kept after it was last seen.
+const clientIpGeoRetention = 90 * 24 * time.Hour
+
+// clientIpGeoSeenInterval is how often the last-seen time of an IP that stays
+// online is written.
+const clientIpGeoSeenInterval = 5 * time.Minute
+
+// GeoInfo is what is known about where an IP is.
+type GeoInfo struct {
+	Country string `json:"country"`
+	Asn     uint   `json:"asn"`
+	AsnOrg  string `json:"asnOrg"`
+}
+
+// CountryCount is the number of clients and IPs seen from one country.
+type CountryCount struct {
+	Country  string `json:"country"`
+	Clients  int    `json:"clients"`
+	Ips      int    `json:"ips"`
+	LastSeen int64  `json:"lastSeen"`
+}
+
+// ClientGeo is where the IPs of a client were seen from.
+type ClientGeo struct {
+	Email     string               `json:"email"`
+	Countries []*CountryCount      `json:"countries"`
+	Ips       []*model.ClientIpGeo `json:"ips"`
+}
+
+// geoRange is a range of addresses of one country, both ends as 16 bytes.
+type geoRange struct {
+	start   [16]byte
+	end     [16]byte
+	country string
+}
+
+// geoDatabase resolves IPs with the geoip.dat of Xray, which only knows
+// countries, and with optional MMDB files, which may also know the ASN.
+type geoDatabase struct {
+	ranges  []geoRange
+	datTime time.Time
+	mmdbs   []*maxminddb.Reader
+	mmdbKey string
+}
+
+var (
+	geoDbLock sync.Mutex
+	geoDb     geoDatabase
+	// geoPruned is when IPs not seen for a long time were last removed.
+	geoPruned time.Time
+
+	geoSeenLock sync.Mutex
+	// geoSeen is when the IPs of clients were last written, by email and IP.
+	geoSeen = map[string]int64{}
+)
+
+type GeoIPService struct {
+	settingService SettingService
+}
+
+// Lookup resolves an IP. The MMDB files take precedence over geoip.dat.
+func (s *GeoIPService) Lookup(ip string) *GeoInfo {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return &GeoInfo{}
+	}
+	paths, _ := s.settingService.GetGeoipMmdbPath()
+
+	geoDbLock.Lock()
+	defer geoDbLock.Unlock()
+	geoDb.loadMmdbs(paths)
+	info := geoDb.lookupMmdbs(parsed)
+	if info.Country == "" {
+		geoDb.loadDat()
+		info.Country = geoDb.lookupDat(parsed)
+	}
+	return info
+}
+
+func (d *geoDatabase) loadMmdbs(paths string) {
+	if paths == d.mmdbKey {
+		return
+	}
+	for _, reader := range d.mmdbs {
+		reader.Close()
+	}
+	d.mmdbs = nil
+	d.mmdbKey = paths
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		reader, err := maxminddb.Open(path)
+		if err != nil {
+			logger.Warning("open GeoIP database failed:", err)
+			continue
+		}
+		d.mmdbs = append(d.mmdbs, reader)
+	}
+}
+
+// lookupMmdbs merges what the MMDB files know. Both the MaxMind layout and
+// the flat layout of ipinfo and others are understood.
+func (d *geoDatabase) lookupMmdbs(ip net.IP) *GeoInfo {
+	info := &GeoInfo{}
+	for _, reader := range d.mmdbs {
+		var record map[string]any
+		if reader.Lookup(ip, &record) != nil || record == nil {
+			continue
+		}
+		if info.Country == "" {
+			if country, ok := record["country"].(map[string]any); ok {
+				info.Country, _ = country["iso_code"].(string)
+			}
+			if code, ok := record["country_code"].(string); ok {
+				info.Country = code
+			}
+		}
+		if info.Asn == 0 {
+			switch asn := record["autonomous_system_number"].(type) {
+			case uint64:
+				info.Asn = uint(asn)
+			case uint32:
+				info.Asn = uint(asn)
+			}
+			if asn, ok := record["asn"].(string); ok {
+				number, _ := strconv.ParseUint(strings.TrimPrefix(asn, "AS"), 10, 32)
+				info.Asn = uint(number)
+			}
+		}
+		if info.AsnOrg == "" {
+			info.AsnOrg, _ = record["autonomous_system_organization"].(string)
+			if name, ok := record["as_name"].(string); ok {
+				info.AsnOrg = name
+			}
+		}
+	}
+	info.Country = strings.ToUpper(info.Country)
+	return info
+}
+
+// loadDat reads the country ranges of geoip.dat, again when the file changed.
+// Lists that are not countries, like private or telegram, are skipped.
+func (d *geoDatabase) loadDat() {
+	stat, err := os.Stat(xray.GetGeoipPath())
+	if err != nil || stat.ModTime().Equal(d.datTime) {
+		return
+	}
+	d.datTime = stat.ModTime()
+	d.ranges = nil
+
+	data, err := os.ReadFile(xray.GetGeoipPath())
+	if err != nil {
+		logger.Warning("read geoip.dat failed:", err)
+		return
+	}
+	var list router.GeoIPList
+	if err := proto.Unmarshal(data, &list); err != nil {
+		logger.Warning("parse geoip.dat failed:", err)
+		return
+	}
+	for _, geoip := range list.Entry {
+		code := strings.ToUpper(geoip.CountryCode)
+		if len(code) != 2 || geoip.ReverseMatch {
+			continue
+		}
+		for _, cidr := range geoip.Cidr {
+			if r, ok := cidrRange(cidr.Ip, int(cidr.Prefix), code); ok {
+				d.ranges = append(d.ranges, r)
+			}
+		}
+	}
+	sort.Slice(d.ranges, func(i, j int) bool {
+		return bytes.Compare(d.ranges[i].start[:], d.ranges[j].start[:]) < 0
+	})
+}
+
+func (d *geoDatabase) lookupDat(ip net.IP) string {
+	var addr [16]byte
+	copy(addr[:], ip.To16())
+	// The last range that starts at or before the address.
+	i := sort.Search(len(d.ranges), func(i int) bool {
+		return bytes.Compare(d.ranges[i].start[:], addr[:]) > 0
+	}) - 1
+	// Ranges of different lists may nest, so look back a few.
+	for j := i; j >= 0 && j > i-8; j-- {
+		if bytes.Compare(addr[:], d.ranges[j].end[:]) <= 0 {
+			return d.ranges[j].country
+		}
+	}
+	return ""
+}
+
+func cidrRange(ip []byte, prefix int, country string) (geoRange, bool) {
+	r := geoRange{country: country}
+	switch len(ip) {
+	case net.IPv4len:
+		copy(r.start[:], net.IP(ip).To16())
+		prefix += 96
+	case net.IPv6len:
+		copy(r.start[:], ip)
+	default:
+		return r, false
+	}
+	if prefix > 128 {
+		return r, false
+	}
+	mask := net.CIDRMask(prefix, 128)
+	for i := range r.start {
+		r.start[i] &= mask[i]
+		r.end[i] = r.start[i] | ^mask[i]
+	}
+	return r, true
+}
+
+// RecordIps stores where the IPs of a client are. IPs that are known already
+// only have their last-seen time updated, at most every
+// clientIpGeoSeenInterval.
+func (s *GeoIPService) RecordIps(email string, ips []string) error {
+	now := time.Now().Unix()
+	stale := s.staleIps(email, ips, now)
+	if len(stale) > 0 {
+		if err := s.saveIps(email, stale, now); err != nil {
+			return err
+		}
+		geoSeenLock.Lock()
+		for _, ip := range stale {
+			geoSeen[email+" "+ip] = now
+		}
+		geoSeenLock.Unlock()
+	}
+
+	if time.Since(geoPruned) > 24*time.Hour {
+		geoPruned = time.Now()
+		before := time.Now().Add(-clientIpGeoRetention).Unix()
+		return database.GetDB().Where("last_seen < ?", before).Delete(model.ClientIpGeo{}).Error
+	}
+	return nil
+}
+
+// staleIps returns the IPs of a client whose last-seen time was not written
+// for clientIpGeoSeenInterval.
+func (s *GeoIPService) staleIps(email string, ips []string, now int64) []string {
+	geoSeenLock.Lock()
+	defer geoSeenLock.Unlock()
+	interval := int64(clientIpGeoSeenInterval.Seconds())
+	for key, seen := range geoSeen {
+		if now-seen >= interval {
+			delete(geoSeen, key)
+		}
+	}
+	var stale []string
+	for _, ip := range ips {
+		if _, ok := geoSeen[email+" "+ip]; !ok {
+			stale = append(stale, ip)
+		}
+	}
+	return stale
+}
+
+// saveIps updates the last-seen time of the known IPs of a client and adds
+// the new ones, in one statement each.
+func (s *GeoIPService) saveIps(email string, ips []string, now int64) error {
+	db := database.GetDB()
+	var known []string
+	err := db.Model(model.ClientIpGeo{}).Where("client_email = ? AND ip IN ?", email, ips).Pluck("ip", &known).Error
+	if err != nil {
+		return err
+	}
+	if len(known) > 0 {
+		err = db.Model(model.ClientIpGeo{}).Where("client_email = ? AND ip IN ?", email, known).Update("last_seen", now).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	var records []*model.ClientIpGeo
+	for _, ip := range ips {
+		if slices.Contains(known, ip) {
+			continue
+		}
+		info := s.Lookup(ip)
+		records = append(records, &model.ClientIpGeo{
+			ClientEmail: email,
+			Ip:          ip,
+			Country:     info.Country,
+			Asn:         info.Asn,
+			AsnOrg:      info.AsnOrg,
+			FirstSeen:   now,
+			LastSeen:    now,
+		})
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	return db.Create(&records).Error
+}
+
+// GetClientGeo returns the IPs of a client with the countries they are in,
+// the most recently seen first.
+func (s *GeoIPService) GetClientGeo(email string) (*ClientGeo, error) {
+	db := database.GetDB()
+	result := &ClientGeo{Email: email}
+	err := db.Model(model.ClientIpGeo{}).Where("client_email = ?", email).Order("last_seen desc").Find(&result.Ips).Error
+	if err != nil {
+		return nil, err
+	}
+	err = db.Model(model.ClientIpGeo{}).
+		Select("country, COUNT(DISTINCT client_email) AS clients, COUNT(*) AS ips, MAX(last_seen) AS last_seen").
+		Where("client_email = ?", email).
+		Group("country").
+		Order("last_seen desc").
+		Scan(&result.Countries).Error
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetInboundCountries returns how the clients of an inbound are spread over
+// countries, counting the IPs seen since the given time.
+func (s *GeoIPService) GetInboundCountries(inboundId int, since int64) ([]*CountryCount, error) {
+	db := database.GetDB()
+	var countries []*CountryCount
+	err := db.Table("client_ip_geos").
+		Select("client_ip_geos.country AS country, COUNT(DISTINCT client_ip_geos.client_email) AS clients, COUNT(*) AS ips, MAX(client_ip_geos.last_seen) AS last_seen").
+		Joins("JOIN client_traffics ON client_traffics.email = client_ip_geos.client_email").
+		Where("client_traffics.inbound_id = ? AND client_ip_geos.last_seen >= ?", inboundId, since).
+		Group("client_ip_geos.country").
+		Order("clients desc, ips desc").
+		Scan(&countries).Error
+	if err != nil {
+		return nil, err
+	}
+	return countries, nil
+}
+
+func (s *GeoIPService) ClearClientGeo(email string) error {
+	db := database.GetDB()
+	return db.Where("client_email = ?", email).Delete(model.ClientIpGeo{}).Error
+}
+
+// FormatCountries lists countries like "US 3, DE 1", unknown ones as "??".
+func FormatCountries(countries []*CountryCount) string {
+	parts := make([]string, 0, len(countries))
+	for _, country := range countries {
+		code := country.Country
+		if code == "" {
+			code = "??"
+		}
+		parts = append(parts, code+" "+strconv.Itoa(country.Ips))
+	}
+	return strings.Join(parts, ", ")
+}
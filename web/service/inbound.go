@@ -18,15 +18,9 @@ import (
 )
 
 type InboundService struct {
-	xrayApi   xray.XrayAPI
 	tgService TelegramService
 }
 
-// 【新增方法】: 用于从外部注入 XrayAPI 实例
-func (s *InboundService) SetXrayAPI(api xray.XrayAPI) {
-	s.xrayApi = api
-}
-
 // 【新增方法】: 用于从外部注入 TelegramService 实例
 func (s *InboundService) SetTelegramService(tgService TelegramService) {
 	s.tgService = tgService
@@ -184,6 +178,14 @@ func (s *InboundService) AddInbound(inbound *model.Inbound) (*model.Inbound, boo
 		return inbound, false, common.NewError("Duplicate email:", existEmail)
 	}
 
+	// 中文注释：WireGuard 入站为用户生成密钥并分配隧道地址
+	if inbound.Protocol == model.WireGuard {
+		err = s.fillWireguardSettings(inbound)
+		if err != nil {
+			return inbound, false, err
+		}
+	}
+
 	// 中文注释：获取入站规则中的客户端信息
 	clients, err := s.GetClients(inbound)
 	if err != nil {
@@ -221,7 +223,7 @@ func (s *InboundService) AddInbound(inbound *model.Inbound) (*model.Inbound, boo
 			if client.Password == "" {
 				return inbound, false, common.NewError("empty client ID")
 			}
-		case "shadowsocks":
+		case "shadowsocks", "wireguard":
 			if client.Email == "" {
 				return inbound, false, common.NewError("empty client ID")
 			}
@@ -293,13 +295,15 @@ func (s *InboundService) AddInbound(inbound *model.Inbound) (*model.Inbound, boo
 	// 中文注释：如果入站规则是启用的，则尝试通过 API 热加载到 Xray-core
 	needRestart := false
 	if inbound.Enable {
-		s.xrayApi.Init(p.GetAPIPort())
 		inboundJson, err1 := json.MarshalIndent(inbound.GenXrayInboundConfig(), "", "  ")
 		if err1 != nil {
 			logger.Debug("Unable to marshal inbound config:", err1)
 		}
 
-		err1 = s.xrayApi.AddInbound(inboundJson)
+		xrayApi, err1 := getXrayAPI()
+		if err1 == nil {
+			err1 = xrayApi.AddInbound(inboundJson)
+		}
 		if err1 == nil {
 			logger.Debug("New inbound added by api:", inbound.Tag)
 		} else {
@@ -307,7 +311,6 @@ func (s *InboundService) AddInbound(inbound *model.Inbound) (*model.Inbound, boo
 			logger.Debug("Unable to add inbound by api:", err1)
 			needRestart = true
 		}
-		s.xrayApi.Close()
 	}
 
 	// 中文注释：返回创建好的入站对象、是否需要重启以及错误信息
@@ -321,15 +324,16 @@ func (s *InboundService) DelInbound(id int) (bool, error) {
 	needRestart := false
 	result := db.Model(model.Inbound{}).Select("tag").Where("id = ? and enable = ?", id, true).First(&tag)
 	if result.Error == nil {
-		s.xrayApi.Init(p.GetAPIPort())
-		err1 := s.xrayApi.DelInbound(tag)
+		xrayApi, err1 := getXrayAPI()
+		if err1 == nil {
+			err1 = xrayApi.DelInbound(tag)
+		}
 		if err1 == nil {
 			logger.Debug("Inbound deleted by api:", tag)
 		} else {
 			logger.Debug("Unable to delete inbound by api:", err1)
 			needRestart = true
 		}
-		s.xrayApi.Close()
 	} else {
 		logger.Debug("No enabled inbound founded to removing by api", tag)
 	}
@@ -381,6 +385,13 @@ func (s *InboundService) UpdateInbound(inbound *model.Inbound) (*model.Inbound,
 		return inbound, false, err
 	}
 
+	if inbound.Protocol == model.WireGuard {
+		err = s.fillWireguardSettings(inbound)
+		if err != nil {
+			return inbound, false, err
+		}
+	}
+
 	tag := oldInbound.Tag
 
 	db := database.GetDB()
@@ -458,6 +469,9 @@ func (s *InboundService) UpdateInbound(inbound *model.Inbound) (*model.Inbound,
 		}
 	}
 
+	oldXrayInbound := oldInbound.GenXrayInboundConfig()
+	oldEnable := oldInbound.Enable
+
 	oldInbound.Up = inbound.Up
 	oldInbound.Down = inbound.Down
 	oldInbound.Total = inbound.Total
@@ -466,6 +480,13 @@ func (s *InboundService) UpdateInbound(inbound *model.Inbound) (*model.Inbound,
 	oldInbound.ExpiryTime = inbound.ExpiryTime
 	// 中文注释：确保在更新数据时，将前端传来的 deviceLimit 值赋给从数据库中读出的旧对象。
 	oldInbound.DeviceLimit = inbound.DeviceLimit
+	oldInbound.DeviceLimitStrategy = inbound.DeviceLimitStrategy
+	oldInbound.DeviceLimitGrace = inbound.DeviceLimitGrace
+	oldInbound.DeviceLimitTTL = inbound.DeviceLimitTTL
+	oldInbound.DeviceLimitMinutes = inbound.DeviceLimitMinutes
+	oldInbound.UpLimit = inbound.UpLimit
+	oldInbound.DownLimit = inbound.DownLimit
+	oldInbound.Burst = inbound.Burst
 	oldInbound.Listen = inbound.Listen
 	oldInbound.Port = inbound.Port
 	oldInbound.Protocol = inbound.Protocol
@@ -481,27 +502,12 @@ func (s *InboundService) UpdateInbound(inbound *model.Inbound) (*model.Inbound,
 		oldInbound.Tag = fmt.Sprintf("inbound-%v:%v", inbound.Listen, inbound.Port)
 	}
 
-	needRestart := false
-	s.xrayApi.Init(p.GetAPIPort())
-	if s.xrayApi.DelInbound(tag) == nil {
-		logger.Debug("Old inbound deleted by api:", tag)
+	// 中文注释: 入站在 Xray 中的配置没有变化时（例如只修改了备注、到期时间），不必动正在运行的 Xray；
+	// 有变化时由调用方通过 XrayService.ApplyXrayConfig 只替换这一个入站，其他入站的连接不受影响
+	needRestart := oldEnable != oldInbound.Enable || !oldXrayInbound.Equals(oldInbound.GenXrayInboundConfig())
+	if needRestart {
+		logger.Debug("Inbound changed in Xray:", tag)
 	}
-	if inbound.Enable {
-		inboundJson, err2 := json.MarshalIndent(oldInbound.GenXrayInboundConfig(), "", "  ")
-		if err2 != nil {
-			logger.Debug("Unable to marshal updated inbound config:", err2)
-			needRestart = true
-		} else {
-			err2 = s.xrayApi.AddInbound(inboundJson)
-			if err2 == nil {
-				logger.Debug("Updated inbound added by api:", oldInbound.Tag)
-			} else {
-				logger.Debug("Unable to update inbound by api:", err2)
-				needRestart = true
-			}
-		}
-	}
-	s.xrayApi.Close()
 
 	return inbound, needRestart, tx.Save(oldInbound).Error
 }
@@ -601,7 +607,7 @@ func (s *InboundService) AddInboundClient(data *model.Inbound) (bool, error) {
 			if client.Password == "" {
 				return false, common.NewError("empty client ID")
 			}
-		case "shadowsocks":
+		case "shadowsocks", "wireguard":
 			if client.Email == "" {
 				return false, common.NewError("empty client ID")
 			}
@@ -629,6 +635,12 @@ func (s *InboundService) AddInboundClient(data *model.Inbound) (bool, error) {
 	}
 
 	oldInbound.Settings = string(newSettings)
+	if oldInbound.Protocol == model.WireGuard {
+		err = s.fillWireguardSettings(oldInbound)
+		if err != nil {
+			return false, err
+		}
+	}
 
 	db := database.GetDB()
 	tx := db.Begin()
@@ -642,10 +654,14 @@ func (s *InboundService) AddInboundClient(data *model.Inbound) (bool, error) {
 	}()
 
 	needRestart := false
-	s.xrayApi.Init(p.GetAPIPort())
+	xrayApi, apiErr := getXrayAPI()
 	for _, client := range clients {
 		if len(client.Email) > 0 {
 			s.AddClientStat(tx, data.Id, &client)
+			// 中文注释: 路由策略编译在 Xray 的路由配置中，无法通过 API 添加，需要重启。
+			if client.Enable && hasClientRouting(&client) {
+				needRestart = true
+			}
 			if client.Enable {
 				cipher := ""
 				if oldInbound.Protocol == "shadowsocks" {
@@ -664,7 +680,16 @@ func (s *InboundService) AddInboundClient(data *model.Inbound) (bool, error) {
 					// Xray-core 会将这个值作为 level，然后去 policy 中寻找对应的限速策略。
 					"level": client.SpeedLimit,
 				}
-				err1 := s.xrayApi.AddUser(string(oldInbound.Protocol), oldInbound.Tag, clientMap)
+				// 中文注释: 运行中的配置里没有这个限速档位时，只能通过重启生成新的 policy level。
+				if !isPolicyLevelLoaded(client.SpeedLimit) {
+					logger.Debug("Speed limit level not loaded, restart needed:", client.SpeedLimit)
+					needRestart = true
+					continue
+				}
+				err1 := apiErr
+				if err1 == nil {
+					err1 = xrayApi.AddUser(string(oldInbound.Protocol), oldInbound.Tag, clientMap)
+				}
 
 				if err1 == nil {
 					logger.Debug("Client added by api:", client.Email)
@@ -677,7 +702,6 @@ func (s *InboundService) AddInboundClient(data *model.Inbound) (bool, error) {
 			needRestart = true
 		}
 	}
-	s.xrayApi.Close()
 
 	return needRestart, tx.Save(oldInbound).Error
 }
@@ -751,8 +775,10 @@ func (s *InboundService) DelInboundClient(inboundId int, clientId string) (bool,
 			return false, err
 		}
 		if needApiDel && notDepleted {
-			s.xrayApi.Init(p.GetAPIPort())
-			err1 := s.xrayApi.RemoveUser(oldInbound.Tag, email)
+			xrayApi, err1 := getXrayAPI()
+			if err1 == nil {
+				err1 = xrayApi.RemoveUser(oldInbound.Tag, email)
+			}
 			if err1 == nil {
 				logger.Debug("Client deleted by api:", email)
 				needRestart = false
@@ -764,7 +790,6 @@ func (s *InboundService) DelInboundClient(inboundId int, clientId string) (bool,
 					needRestart = true
 				}
 			}
-			s.xrayApi.Close()
 		}
 	}
 	return needRestart, db.Save(oldInbound).Error
@@ -794,6 +819,30 @@ func (s *InboundService) UpdateInboundClient(data *model.Inbound, clientId strin
 		return false, err
 	}
 
+	// 中文注释：WireGuard 用户未提交密钥或地址时沿用原有值
+	if oldInbound.Protocol == model.WireGuard && len(clients) > 0 {
+		newMap, _ := interfaceClients[0].(map[string]any)
+		for _, oldClient := range oldClients {
+			if oldClient.ID != clientId || newMap == nil {
+				continue
+			}
+			if clients[0].PrivateKey == "" && clients[0].PublicKey == "" {
+				newMap["privateKey"] = oldClient.PrivateKey
+				newMap["publicKey"] = oldClient.PublicKey
+			}
+			if clients[0].PreSharedKey == "" && oldClient.PreSharedKey != "" {
+				newMap["preSharedKey"] = oldClient.PreSharedKey
+			}
+			if len(clients[0].AllowedIPs) == 0 {
+				newMap["allowedIPs"] = oldClient.AllowedIPs
+			}
+			if clients[0].ID == "" {
+				newMap["id"] = oldClient.ID
+				clients[0].ID = oldClient.ID
+			}
+		}
+	}
+
 	oldEmail := ""
 	newClientId := ""
 	clientIndex := -1
@@ -872,6 +921,12 @@ func (s *InboundService) UpdateInboundClient(data *model.Inbound, clientId strin
 	}
 
 	oldInbound.Settings = string(newSettings)
+	if oldInbound.Protocol == model.WireGuard {
+		err = s.fillWireguardSettings(oldInbound)
+		if err != nil {
+			return false, err
+		}
+	}
 	db := database.GetDB()
 	tx := db.Begin()
 
@@ -907,10 +962,19 @@ func (s *InboundService) UpdateInboundClient(data *model.Inbound, clientId strin
 		}
 	}
 	needRestart := false
+	// 中文注释: 路由策略按 email 匹配，策略或 email 变更后都需要重启 Xray。
+	if routingPolicyChanged(&oldClients[clientIndex], &clients[0]) ||
+		(oldEmail != clients[0].Email && hasClientRouting(&clients[0])) {
+		needRestart = true
+	}
 	if len(oldEmail) > 0 {
-		s.xrayApi.Init(p.GetAPIPort())
-		if oldClients[clientIndex].Enable {
-			err1 := s.xrayApi.RemoveUser(oldInbound.Tag, oldEmail)
+		xrayApi, apiErr := getXrayAPI()
+		if apiErr != nil {
+			logger.Debug("Unable to edit client by api:", apiErr)
+			needRestart = true
+		}
+		if oldClients[clientIndex].Enable && apiErr == nil {
+			err1 := xrayApi.RemoveUser(oldInbound.Tag, oldEmail)
 			if err1 == nil {
 				logger.Debug("Old client deleted by api:", oldEmail)
 			} else {
@@ -922,7 +986,7 @@ func (s *InboundService) UpdateInboundClient(data *model.Inbound, clientId strin
 				}
 			}
 		}
-		if clients[0].Enable {
+		if clients[0].Enable && apiErr == nil {
 			cipher := ""
 			if oldInbound.Protocol == "shadowsocks" {
 				cipher = oldSettings["method"].(string)
@@ -939,16 +1003,21 @@ func (s *InboundService) UpdateInboundClient(data *model.Inbound, clientId strin
 
 				"level": clients[0].SpeedLimit,
 			}
-			err1 := s.xrayApi.AddUser(string(oldInbound.Protocol), oldInbound.Tag, clientMap)
+			// 中文注释: 限速档位变更后，用户以新的 level 重新添加；档位未加载时才需要重启。
+			if isPolicyLevelLoaded(clients[0].SpeedLimit) {
+				err1 := xrayApi.AddUser(string(oldInbound.Protocol), oldInbound.Tag, clientMap)
 
-			if err1 == nil {
-				logger.Debug("Client edited by api:", clients[0].Email)
+				if err1 == nil {
+					logger.Debug("Client edited by api:", clients[0].Email)
+				} else {
+					logger.Debug("Error in adding client by api:", err1)
+					needRestart = true
+				}
 			} else {
-				logger.Debug("Error in adding client by api:", err1)
+				logger.Debug("Speed limit level not loaded, restart needed:", clients[0].SpeedLimit)
 				needRestart = true
 			}
 		}
-		s.xrayApi.Close()
 	} else {
 		logger.Debug("Client old email not found")
 		needRestart = true
@@ -997,6 +1066,14 @@ func (s *InboundService) AddTraffic(inboundTraffics []*xray.Traffic, clientTraff
 	} else if count > 0 {
 		logger.Debugf("%v inbounds disabled", count)
 	}
+
+	throttled, err := s.throttleDepletedClients(tx)
+	if err != nil {
+		logger.Warning("Error in throttling depleted clients:", err)
+	} else if len(throttled) > 0 {
+		logger.Debugf("%v clients throttled", len(throttled))
+		go s.notifyThrottledClients(throttled)
+	}
 	return nil, (needRestart0 || needRestart1 || needRestart2)
 }
 
@@ -1223,17 +1300,16 @@ func (s *InboundService) autoRenewClients(tx *gorm.DB) (bool, int64, error) {
 		return false, 0, err
 	}
 	if p != nil {
-		err1 = s.xrayApi.Init(p.GetAPIPort())
-		if err1 != nil {
+		xrayApi, apiErr := getXrayAPI()
+		if apiErr != nil {
 			return true, int64(len(traffics)), nil
 		}
 		for _, clientToAdd := range clientsToAdd {
-			err1 = s.xrayApi.AddUser(clientToAdd.protocol, clientToAdd.tag, clientToAdd.client)
+			err1 = xrayApi.AddUser(clientToAdd.protocol, clientToAdd.tag, clientToAdd.client)
 			if err1 != nil {
 				needRestart = true
 			}
 		}
-		s.xrayApi.Close()
 	}
 	return needRestart, int64(len(traffics)), nil
 }
@@ -1251,9 +1327,12 @@ func (s *InboundService) disableInvalidInbounds(tx *gorm.DB) (bool, int64, error
 		if err != nil {
 			return false, 0, err
 		}
-		s.xrayApi.Init(p.GetAPIPort())
+		xrayApi, apiErr := getXrayAPI()
 		for _, tag := range tags {
-			err1 := s.xrayApi.DelInbound(tag)
+			err1 := apiErr
+			if err1 == nil {
+				err1 = xrayApi.DelInbound(tag)
+			}
 			if err1 == nil {
 				logger.Debug("Inbound disabled by api:", tag)
 			} else {
@@ -1261,7 +1340,6 @@ func (s *InboundService) disableInvalidInbounds(tx *gorm.DB) (bool, int64, error
 				needRestart = true
 			}
 		}
-		s.xrayApi.Close()
 	}
 
 	result := tx.Model(model.Inbound{}).
@@ -1276,23 +1354,49 @@ func (s *InboundService) disableInvalidClients(tx *gorm.DB) (bool, int64, error)
 	now := time.Now().Unix() * 1000
 	needRestart := false
 
+	// 中文注释: 降速档位迟迟没有被限速后端执行的公平使用客户端，按流量用尽处理。
+	var throttled []string
+	err := tx.Model(xray.ClientTraffic{}).
+		Where("enable = ? AND throttled = ? AND fair_use > 0", true, true).
+		Pluck("email", &throttled).Error
+	if err != nil {
+		return false, 0, err
+	}
+	unenforced := unenforcedFairUse(throttled, time.Now())
+	if len(unenforced) > 0 {
+		logger.Warning("fair-use speed not applied by the speed limit backend, disabling:", unenforced)
+	}
+	depleted := func(prefix string) (string, []any) {
+		condition := "((" + depletedCondition(prefix) + ") OR (" + prefix + "expiry_time > 0 AND " + prefix + "expiry_time <= ?)"
+		args := []any{now}
+		if len(unenforced) > 0 {
+			condition += " OR " + prefix + "email IN ?"
+			args = append(args, unenforced)
+		}
+		return condition + ") AND " + prefix + "enable = ?", append(args, true)
+	}
+
 	if p != nil {
 		var results []struct {
 			Tag   string
 			Email string
 		}
 
+		condition, args := depleted("client_traffics.")
 		err := tx.Table("inbounds").
 			Select("inbounds.tag, client_traffics.email").
 			Joins("JOIN client_traffics ON inbounds.id = client_traffics.inbound_id").
-			Where("((client_traffics.total > 0 AND client_traffics.up + client_traffics.down >= client_traffics.total) OR (client_traffics.expiry_time > 0 AND client_traffics.expiry_time <= ?)) AND client_traffics.enable = ?", now, true).
+			Where(condition, args...).
 			Scan(&results).Error
 		if err != nil {
 			return false, 0, err
 		}
-		s.xrayApi.Init(p.GetAPIPort())
+		xrayApi, apiErr := getXrayAPI()
 		for _, result := range results {
-			err1 := s.xrayApi.RemoveUser(result.Tag, result.Email)
+			err1 := apiErr
+			if err1 == nil {
+				err1 = xrayApi.RemoveUser(result.Tag, result.Email)
+			}
 			if err1 == nil {
 				logger.Debug("Client disabled by api:", result.Email)
 			} else {
@@ -1308,16 +1412,79 @@ func (s *InboundService) disableInvalidClients(tx *gorm.DB) (bool, int64, error)
 				}
 			}
 		}
-		s.xrayApi.Close()
 	}
+	condition, args := depleted("")
 	result := tx.Model(xray.ClientTraffic{}).
-		Where("((total > 0 and up + down >= total) or (expiry_time > 0 and expiry_time <= ?)) and enable = ?", now, true).
+		Where(condition, args...).
 		Update("enable", false)
-	err := result.Error
+	err = result.Error
 	count := result.RowsAffected
 	return needRestart, count, err
 }
 
+// depletedCondition is the SQL condition for clients that are cut off for
+// their traffic. Clients with a fair-use speed are only cut off at their hard
+// cap, the quota merely throttles them, as long as the speed limit backend
+// applies the throttle (see unenforcedFairUse).
+func depletedCondition(prefix string) string {
+	used := prefix + "up + " + prefix + "down"
+	return fmt.Sprintf("(%[1]stotal > 0 AND %[2]s >= %[1]stotal AND %[1]sfair_use = 0) OR (%[1]sfair_use > 0 AND %[1]shard_cap > 0 AND %[2]s >= %[1]shard_cap)", prefix, used)
+}
+
+// throttleDepletedClients moves clients with a fair-use speed that used up
+// their quota to the fair-use tier, and releases the ones whose usage was reset
+// or whose quota was raised. The speed limit backend applies the new tier.
+func (s *InboundService) throttleDepletedClients(tx *gorm.DB) ([]xray.ClientTraffic, error) {
+	var throttled []xray.ClientTraffic
+	err := tx.Model(xray.ClientTraffic{}).
+		Where("enable = ? AND throttled = ? AND fair_use > 0 AND total > 0 AND up + down >= total", true, false).
+		Find(&throttled).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(throttled) > 0 {
+		ids := make([]int, 0, len(throttled))
+		for _, traffic := range throttled {
+			ids = append(ids, traffic.Id)
+		}
+		err = tx.Model(xray.ClientTraffic{}).Where("id IN ?", ids).Update("throttled", true).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tx.Model(xray.ClientTraffic{}).
+		Where("throttled = ? AND (fair_use = 0 OR total = 0 OR up + down < total)", true).
+		Update("throttled", false).Error
+	if err != nil {
+		return nil, err
+	}
+	return throttled, nil
+}
+
+// notifyThrottledClients tells the admins, the webhook and the client itself
+// that a client was moved to its fair-use tier.
+func (s *InboundService) notifyThrottledClients(traffics []xray.ClientTraffic) {
+	tgBot := &Tgbot{}
+	for _, traffic := range traffics {
+		msg := fmt.Sprintf("🐢 用户 %s 的流量已用尽（%s / %s），已降速至 %d KB/s，直到本周期结束。",
+			traffic.Email, common.FormatTraffic(traffic.Up+traffic.Down), common.FormatTraffic(traffic.Total), traffic.FairUse)
+		notifyAdmins("client.throttled", msg, map[string]any{
+			"email":   traffic.Email,
+			"used":    traffic.Up + traffic.Down,
+			"total":   traffic.Total,
+			"speed":   traffic.FairUse,
+			"hardCap": traffic.HardCap,
+		})
+		if !tgBot.IsRunning() {
+			continue
+		}
+		_, client, err := s.GetClientByEmail(traffic.Email)
+		if err == nil && client != nil && client.TgID > 0 {
+			go tgBot.SendMsgToTgbot(client.TgID, msg)
+		}
+	}
+}
+
 func (s *InboundService) GetInboundTags() (string, error) {
 	db := database.GetDB()
 	var inboundTags []string
@@ -1351,6 +1518,8 @@ func (s *InboundService) AddClientStat(tx *gorm.DB, inboundId int, client *model
 	clientTraffic.Up = 0
 	clientTraffic.Down = 0
 	clientTraffic.Reset = client.Reset
+	clientTraffic.FairUse = client.FairUseSpeed
+	clientTraffic.HardCap = client.HardCap
 	result := tx.Create(&clientTraffic)
 	err := result.Error
 	return err
@@ -1365,6 +1534,8 @@ func (s *InboundService) UpdateClientStat(tx *gorm.DB, inboundId int, email stri
 			"total":       client.TotalGB,
 			"expiry_time": client.ExpiryTime,
 			"reset":       client.Reset,
+			"fair_use":    client.FairUseSpeed,
+			"hard_cap":    client.HardCap,
 		})
 	err := result.Error
 	return err
@@ -1647,6 +1818,79 @@ func (s *InboundService) ResetClientIpLimitByEmail(clientEmail string, count int
 	return needRestart, err
 }
 
+func (s *InboundService) SetClientCommentByEmail(clientEmail string, comment string) (bool, error) {
+	return s.updateClientByEmail(clientEmail, func(client map[string]any) {
+		client["comment"] = comment
+	})
+}
+
+func (s *InboundService) SetClientDeviceLimitByEmail(clientEmail string, limit int) (bool, error) {
+	return s.updateClientByEmail(clientEmail, func(client map[string]any) {
+		client["deviceLimit"] = limit
+	})
+}
+
+// updateClientByEmail changes the settings of the client with the email by
+// update and saves its inbound.
+func (s *InboundService) updateClientByEmail(clientEmail string, update func(client map[string]any)) (bool, error) {
+	_, inbound, err := s.GetClientInboundByEmail(clientEmail)
+	if err != nil {
+		return false, err
+	}
+	if inbound == nil {
+		return false, common.NewError("Inbound Not Found For Email:", clientEmail)
+	}
+
+	oldClients, err := s.GetClients(inbound)
+	if err != nil {
+		return false, err
+	}
+
+	clientId := ""
+
+	for _, oldClient := range oldClients {
+		if oldClient.Email == clientEmail {
+			switch inbound.Protocol {
+			case "trojan":
+				clientId = oldClient.Password
+			case "shadowsocks":
+				clientId = oldClient.Email
+			default:
+				clientId = oldClient.ID
+			}
+			break
+		}
+	}
+
+	if len(clientId) == 0 {
+		return false, common.NewError("Client Not Found For Email:", clientEmail)
+	}
+
+	var settings map[string]any
+	err = json.Unmarshal([]byte(inbound.Settings), &settings)
+	if err != nil {
+		return false, err
+	}
+	clients := settings["clients"].([]any)
+	var newClients []any
+	for client_index := range clients {
+		c := clients[client_index].(map[string]any)
+		if c["email"] == clientEmail {
+			update(c)
+			c["updated_at"] = time.Now().Unix() * 1000
+			newClients = append(newClients, any(c))
+		}
+	}
+	settings["clients"] = newClients
+	modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	inbound.Settings = string(modifiedSettings)
+	needRestart, err := s.UpdateInboundClient(inbound, clientId)
+	return needRestart, err
+}
+
 func (s *InboundService) ResetClientExpiryTimeByEmail(clientEmail string, expiry_time int64) (bool, error) {
 	_, inbound, err := s.GetClientInboundByEmail(clientEmail)
 	if err != nil {
@@ -1801,7 +2045,6 @@ func (s *InboundService) ResetClientTraffic(id int, clientEmail string) (bool, e
 		}
 		for _, client := range clients {
 			if client.Email == clientEmail && client.Enable {
-				s.xrayApi.Init(p.GetAPIPort())
 				cipher := ""
 				if string(inbound.Protocol) == "shadowsocks" {
 					var oldSettings map[string]any
@@ -1811,13 +2054,20 @@ func (s *InboundService) ResetClientTraffic(id int, clientEmail string) (bool, e
 					}
 					cipher = oldSettings["method"].(string)
 				}
-				err1 := s.xrayApi.AddUser(string(inbound.Protocol), inbound.Tag, map[string]any{
+				xrayApi, err1 := getXrayAPI()
+				if err1 != nil {
+					logger.Debug("Error in enabling client by api:", err1)
+					needRestart = true
+					break
+				}
+				err1 = xrayApi.AddUser(string(inbound.Protocol), inbound.Tag, map[string]any{
 					"email":    client.Email,
 					"id":       client.ID,
 					"security": client.Security,
 					"flow":     client.Flow,
 					"password": client.Password,
 					"cipher":   cipher,
+					"level":    client.SpeedLimit,
 				})
 				if err1 == nil {
 					logger.Debug("Client enabled due to reset traffic:", clientEmail)
@@ -1825,7 +2075,6 @@ func (s *InboundService) ResetClientTraffic(id int, clientEmail string) (bool, e
 					logger.Debug("Error in enabling client by api:", err1)
 					needRestart = true
 				}
-				s.xrayApi.Close()
 				break
 			}
 		}
@@ -2112,7 +2361,7 @@ func (s *InboundService) ClearClientIps(clientEmail string) error {
 	if err != nil {
 		return err
 	}
-	return nil
+	return db.Where("client_email = ?", clientEmail).Delete(model.ClientIpGeo{}).Error
 }
 
 func (s *InboundService) SearchInbounds(query string) ([]*model.Inbound, error) {
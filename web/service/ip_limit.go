@@ -0,0 +1,350 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+)
+
+// IP limit backends, how the IPs of clients over their IP limit are blocked.
+const (
+	// IPLimitBackendXray blocks the IPs with an Xray routing rule.
+	IPLimitBackendXray = "xray"
+	// IPLimitBackendNftables blocks the IPs with an nftables set.
+	IPLimitBackendNftables = "nftables"
+	// IPLimitBackendFail2ban leaves blocking to the 3x-ipl fail2ban jail,
+	// which reads the IP limit log.
+	IPLimitBackendFail2ban = "fail2ban"
+)
+
+const (
+	// An IP is banned when it is over the limit twice within ipLimitFindTime,
+	// like the maxretry and findtime of the fail2ban jail.
+	ipLimitMaxRetry = 2
+	ipLimitFindTime = 32 * time.Second
+	ipLimitRuleTag  = "iplimit-blocklist"
+)
+
+// IPBan is an IP blocked for being over the IP limit of a client.
+type IPBan struct {
+	Ip        string `json:"ip"`
+	Email     string `json:"email"`
+	BannedAt  int64  `json:"bannedAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// IPBlocker blocks IPs. Apply receives the complete blocklist every time and
+// must replace whatever it applied before.
+type IPBlocker interface {
+	Name() string
+	Apply(ips []string) error
+	Clear() error
+}
+
+// ipBlocklist holds the banned IPs and pushes them to a blocker when they
+// change.
+type ipBlocklist struct {
+	lock    sync.Mutex
+	bans    map[string]*IPBan
+	hits    map[string][]time.Time
+	blocker IPBlocker
+	// key identifies the settings the blocker was created with.
+	key string
+	// applied is the blocklist the blocker has, empty when it has to be
+	// applied again.
+	applied string
+	dirty   bool
+}
+
+var ipLimitBlocklist = newIPBlocklist()
+
+func newIPBlocklist() *ipBlocklist {
+	return &ipBlocklist{
+		bans: map[string]*IPBan{},
+		hits: map[string][]time.Time{},
+	}
+}
+
+// hit records an IP over the limit and bans it once it was over the limit
+// often enough. It returns the ban when a new one was made.
+func (b *ipBlocklist) hit(email string, ip string, duration time.Duration, now time.Time) *IPBan {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if ban, ok := b.bans[ip]; ok && now.Unix() < ban.ExpiresAt {
+		return nil
+	}
+	hits := []time.Time{now}
+	for _, t := range b.hits[ip] {
+		if now.Sub(t) < ipLimitFindTime {
+			hits = append(hits, t)
+		}
+	}
+	if len(hits) < ipLimitMaxRetry {
+		b.hits[ip] = hits
+		return nil
+	}
+	delete(b.hits, ip)
+
+	ban := &IPBan{
+		Ip:        ip,
+		Email:     email,
+		BannedAt:  now.Unix(),
+		ExpiresAt: now.Add(duration).Unix(),
+	}
+	b.bans[ip] = ban
+	b.dirty = true
+	return ban
+}
+
+// remove unbans an IP and reports whether it was banned.
+func (b *ipBlocklist) remove(ip string) (*IPBan, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	ban, ok := b.bans[ip]
+	if ok {
+		delete(b.bans, ip)
+		b.dirty = true
+	}
+	return ban, ok
+}
+
+// prune removes the expired bans and returns them.
+func (b *ipBlocklist) prune(now time.Time) []*IPBan {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var expired []*IPBan
+	for ip, ban := range b.bans {
+		if now.Unix() >= ban.ExpiresAt {
+			expired = append(expired, ban)
+			delete(b.bans, ip)
+			b.dirty = true
+		}
+	}
+	for ip, hits := range b.hits {
+		if len(hits) == 0 || now.Sub(hits[0]) >= ipLimitFindTime {
+			delete(b.hits, ip)
+		}
+	}
+	return expired
+}
+
+func (b *ipBlocklist) list() []*IPBan {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	bans := make([]*IPBan, 0, len(b.bans))
+	for _, ban := range b.bans {
+		copied := *ban
+		bans = append(bans, &copied)
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		if bans[i].BannedAt != bans[j].BannedAt {
+			return bans[i].BannedAt > bans[j].BannedAt
+		}
+		return bans[i].Ip < bans[j].Ip
+	})
+	return bans
+}
+
+// sync applies the blocklist when it changed since it was last applied, or
+// always when force is set.
+func (b *ipBlocklist) sync(force bool) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.blocker == nil {
+		return nil
+	}
+	ips := make([]string, 0, len(b.bans))
+	for ip := range b.bans {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	key := strings.Join(ips, ",")
+	if !force && !b.dirty && key == b.applied {
+		return nil
+	}
+	if err := b.blocker.Apply(ips); err != nil {
+		// Try again on the next run.
+		b.dirty = true
+		return err
+	}
+	b.applied = key
+	b.dirty = false
+	return nil
+}
+
+// setBlocker replaces the blocker, clearing the previous one.
+func (b *ipBlocklist) setBlocker(blocker IPBlocker, key string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.blocker != nil {
+		if err := b.blocker.Clear(); err != nil {
+			logger.Warning("clear IP blocklist failed:", err)
+		}
+	}
+	b.blocker = blocker
+	b.key = key
+	b.applied = ""
+	b.dirty = true
+}
+
+// IPLimitService enforces the IP limit of clients without fail2ban. IPs over
+// the limit are banned for a while and blocked by the configured backend.
+type IPLimitService struct {
+	settingService SettingService
+	xrayService    XrayService
+}
+
+var (
+	ipLimitLastGeneration uint64
+	ipLimitErr            string
+)
+
+// IsInProcess reports whether the IP limit is enforced by the panel itself
+// instead of by fail2ban.
+func (s *IPLimitService) IsInProcess() bool {
+	backend, err := s.settingService.GetIPLimitBackend()
+	return err == nil && backend != IPLimitBackendFail2ban
+}
+
+// Ban records that a client used an IP over its IP limit. The IP is banned
+// once it was over the limit twice within a short while.
+func (s *IPLimitService) Ban(email string, ip string) {
+	minutes, err := s.settingService.GetIPLimitBanMinutes()
+	if err != nil || minutes <= 0 {
+		minutes = 30
+	}
+	duration := time.Duration(minutes) * time.Minute
+	ban := ipLimitBlocklist.hit(email, ip, duration, time.Now())
+	if ban == nil {
+		return
+	}
+	logger.Infof("[LimitIP] banned %s of %s for %d minutes", ip, email, minutes)
+	writeIPLimitBannedLog(fmt.Sprintf("BAN   [Email] = %s [IP] = %s banned for %d seconds.", email, ip, int(duration.Seconds())))
+}
+
+// Unban lifts the ban of an IP by hand.
+func (s *IPLimitService) Unban(ip string) error {
+	ban, ok := ipLimitBlocklist.remove(ip)
+	if !ok {
+		return common.NewError("IP is not banned:", ip)
+	}
+	writeIPLimitBannedLog(fmt.Sprintf("UNBAN   [Email] = %s [IP] = %s unbanned.", ban.Email, ban.Ip))
+	return s.Enforce()
+}
+
+func (s *IPLimitService) GetBans() []*IPBan {
+	return ipLimitBlocklist.list()
+}
+
+// Enforce lifts the expired bans and pushes the blocklist to the backend. The
+// blocklist is applied again when Xray restarted or its rules were replaced,
+// as that drops the rule.
+func (s *IPLimitService) Enforce() error {
+	for _, ban := range ipLimitBlocklist.prune(time.Now()) {
+		writeIPLimitBannedLog(fmt.Sprintf("UNBAN   [Email] = %s [IP] = %s unbanned.", ban.Email, ban.Ip))
+	}
+
+	err := s.updateBlocker()
+	if err == nil {
+		generation := s.xrayService.GetXrayGeneration()
+		force := generation != ipLimitLastGeneration
+		ipLimitLastGeneration = generation
+		err = ipLimitBlocklist.sync(force)
+	}
+	// Report a failure once instead of on every run.
+	if err != nil {
+		if err.Error() != ipLimitErr {
+			ipLimitErr = err.Error()
+			logger.Warning("apply IP blocklist failed:", err)
+		}
+		return err
+	}
+	ipLimitErr = ""
+	return nil
+}
+
+// updateBlocker creates the configured backend when the settings changed.
+func (s *IPLimitService) updateBlocker() error {
+	backend, err := s.settingService.GetIPLimitBackend()
+	if err != nil {
+		return err
+	}
+	ipLimitBlocklist.lock.Lock()
+	same := ipLimitBlocklist.key == backend && ipLimitBlocklist.blocker != nil
+	ipLimitBlocklist.lock.Unlock()
+	if same {
+		return nil
+	}
+
+	switch backend {
+	case IPLimitBackendXray:
+		ipLimitBlocklist.setBlocker(&xrayIPBlocker{}, backend)
+	case IPLimitBackendNftables:
+		ipLimitBlocklist.setBlocker(newNftIPBlocker(), backend)
+	case IPLimitBackendFail2ban:
+		ipLimitBlocklist.setBlocker(nil, backend)
+	default:
+		return common.NewError("unknown IP limit backend:", backend)
+	}
+	return nil
+}
+
+// writeIPLimitBannedLog appends a line in the format of the fail2ban action,
+// so that the banned log reads the same with either.
+func writeIPLimitBannedLog(line string) {
+	file, err := os.OpenFile(xray.GetIPLimitBannedLogPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		logger.Warning("open IP limit banned log failed:", err)
+		return
+	}
+	defer file.Close()
+	fmt.Fprintf(file, "%s   %s\n", time.Now().Format("2006/01/02 15:04:05"), line)
+}
+
+// xrayIPBlocker routes the banned IPs to the blackhole outbound with a single
+// routing rule.
+type xrayIPBlocker struct{}
+
+func (b *xrayIPBlocker) Name() string {
+	return IPLimitBackendXray
+}
+
+func (b *xrayIPBlocker) Apply(ips []string) error {
+	xrayApi, err := getXrayAPI()
+	if err != nil {
+		if len(ips) == 0 {
+			return nil
+		}
+		return err
+	}
+
+	err = xrayApi.RemoveRule(ipLimitRuleTag)
+	if err != nil || len(ips) == 0 {
+		return err
+	}
+	blackhole, err := blackholeOutboundTag()
+	if err != nil {
+		return err
+	}
+	rule, _ := json.Marshal(map[string]any{
+		"type":        "field",
+		"ruleTag":     ipLimitRuleTag,
+		"source":      ips,
+		"outboundTag": blackhole,
+	})
+	// Appended rules only see traffic that no earlier rule matched.
+	return xrayApi.AddRule(rule, true)
+}
+
+func (b *xrayIPBlocker) Clear() error {
+	return b.Apply(nil)
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"net"
+	"os/exec"
+	"strings"
+
+	"x-ui/util/common"
+)
+
+const nftTable = "inet xpanel"
+
+// nftIPBlocker drops the packets of the banned IPs with an nftables table of
+// its own. The table is replaced in a single transaction on every change.
+type nftIPBlocker struct {
+	// run feeds one script to nft; replaced to record scripts instead.
+	run func(script string) error
+}
+
+func newNftIPBlocker() *nftIPBlocker {
+	return &nftIPBlocker{run: runNft}
+}
+
+func runNft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return common.NewErrorf("nft: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (b *nftIPBlocker) Name() string {
+	return IPLimitBackendNftables
+}
+
+// Script returns the nft script that replaces the table with the given
+// blocklist. Creating the table first makes deleting it never fail.
+func (b *nftIPBlocker) Script(ips []string) string {
+	var v4, v6 []string
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			continue
+		}
+		if parsed.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(b.clearScript())
+	sb.WriteString("table " + nftTable + " {\n")
+	sb.WriteString(nftSet("iplimit4", "ipv4_addr", v4))
+	sb.WriteString(nftSet("iplimit6", "ipv6_addr", v6))
+	sb.WriteString("\tchain input {\n")
+	sb.WriteString("\t\ttype filter hook input priority -10; policy accept;\n")
+	sb.WriteString("\t\tip saddr @iplimit4 drop\n")
+	sb.WriteString("\t\tip6 saddr @iplimit6 drop\n")
+	sb.WriteString("\t}\n")
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+func (b *nftIPBlocker) clearScript() string {
+	return "table " + nftTable + " {}\ndelete table " + nftTable + "\n"
+}
+
+func nftSet(name string, addrType string, ips []string) string {
+	set := "\tset " + name + " {\n\t\ttype " + addrType + ";\n"
+	if len(ips) > 0 {
+		set += "\t\telements = { " + strings.Join(ips, ", ") + " }\n"
+	}
+	return set + "\t}\n"
+}
+
+func (b *nftIPBlocker) Apply(ips []string) error {
+	if len(ips) == 0 {
+		return b.Clear()
+	}
+	return b.run(b.Script(ips))
+}
+
+func (b *nftIPBlocker) Clear() error {
+	return b.run(b.clearScript())
+}
@@ -0,0 +1,152 @@
+package service
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordingBlocker records the blocklists it is given instead of blocking
+// them. fail makes Apply fail.
+type recordingBlocker struct {
+	applied [][]string
+	cleared int
+	fail    bool
+}
+
+func (b *recordingBlocker) Name() string {
+	return "recording"
+}
+
+func (b *recordingBlocker) Apply(ips []string) error {
+	if b.fail {
+		return errors.New("failed")
+	}
+	b.applied = append(b.applied, ips)
+	return nil
+}
+
+func (b *recordingBlocker) Clear() error {
+	b.cleared++
+	return nil
+}
+
+func TestIPBlocklistBansOnSecondHit(t *testing.T) {
+	list := newIPBlocklist()
+	blocker := &recordingBlocker{}
+	list.setBlocker(blocker, "recording")
+	now := time.Now()
+
+	if ban := list.hit("a", "1.2.3.4", time.Minute, now); ban != nil {
+		t.Fatal("banned on the first hit")
+	}
+	if ban := list.hit("a", "1.2.3.4", time.Minute, now.Add(time.Second)); ban == nil {
+		t.Fatal("not banned on the second hit")
+	}
+	if ban := list.hit("a", "1.2.3.4", time.Minute, now.Add(2*time.Second)); ban != nil {
+		t.Fatal("banned an IP that is banned already")
+	}
+	if err := list.sync(false); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"1.2.3.4"}}
+	if !reflect.DeepEqual(blocker.applied, want) {
+		t.Fatalf("applied %q, want %q", blocker.applied, want)
+	}
+}
+
+func TestIPBlocklistHitsExpire(t *testing.T) {
+	list := newIPBlocklist()
+	now := time.Now()
+	list.hit("a", "1.2.3.4", time.Minute, now)
+	if ban := list.hit("a", "1.2.3.4", time.Minute, now.Add(ipLimitFindTime)); ban != nil {
+		t.Fatal("banned on hits further apart than the find time")
+	}
+}
+
+func TestIPBlocklistAppliesOnlyChanges(t *testing.T) {
+	list := newIPBlocklist()
+	blocker := &recordingBlocker{}
+	list.setBlocker(blocker, "recording")
+	now := time.Now()
+	list.hit("a", "5.6.7.8", time.Minute, now)
+	list.hit("a", "5.6.7.8", time.Minute, now)
+	list.hit("b", "1.2.3.4", 2*time.Minute, now)
+	list.hit("b", "1.2.3.4", 2*time.Minute, now)
+
+	list.sync(false)
+	list.sync(false)
+	if len(blocker.applied) != 1 {
+		t.Fatalf("applied %d times, want once", len(blocker.applied))
+	}
+	// Xray restarted and lost the rule.
+	list.sync(true)
+	if len(blocker.applied) != 2 {
+		t.Fatal("a forced sync did not apply the blocklist again")
+	}
+
+	expired := list.prune(now.Add(time.Minute))
+	if len(expired) != 1 || expired[0].Ip != "5.6.7.8" {
+		t.Fatalf("pruned %v, want 5.6.7.8", expired)
+	}
+	list.sync(false)
+	if _, ok := list.remove("1.2.3.4"); !ok {
+		t.Fatal("remove did not find the ban")
+	}
+	list.sync(false)
+	want := [][]string{{"1.2.3.4", "5.6.7.8"}, {"1.2.3.4", "5.6.7.8"}, {"1.2.3.4"}, {}}
+	if !reflect.DeepEqual(blocker.applied, want) {
+		t.Fatalf("applied %q, want %q", blocker.applied, want)
+	}
+}
+
+func TestIPBlocklistRetriesFailedApply(t *testing.T) {
+	list := newIPBlocklist()
+	blocker := &recordingBlocker{fail: true}
+	list.setBlocker(blocker, "recording")
+	now := time.Now()
+	list.hit("a", "1.2.3.4", time.Minute, now)
+	list.hit("a", "1.2.3.4", time.Minute, now)
+
+	if err := list.sync(false); err == nil {
+		t.Fatal("a failed apply was not reported")
+	}
+	blocker.fail = false
+	if err := list.sync(false); err != nil {
+		t.Fatal(err)
+	}
+	if len(blocker.applied) != 1 {
+		t.Fatal("the failed apply was not tried again")
+	}
+}
+
+func TestIPBlocklistClearsReplacedBlocker(t *testing.T) {
+	list := newIPBlocklist()
+	first := &recordingBlocker{}
+	second := &recordingBlocker{}
+	list.setBlocker(first, "first")
+	now := time.Now()
+	list.hit("a", "1.2.3.4", time.Minute, now)
+	list.hit("a", "1.2.3.4", time.Minute, now)
+	list.sync(false)
+
+	list.setBlocker(second, "second")
+	if first.cleared != 1 {
+		t.Fatal("the replaced blocker was not cleared")
+	}
+	list.sync(false)
+	want := [][]string{{"1.2.3.4"}}
+	if !reflect.DeepEqual(second.applied, want) {
+		t.Fatalf("new blocker applied %q, want %q", second.applied, want)
+	}
+
+	// Without a blocker, as with fail2ban, nothing is applied.
+	list.setBlocker(nil, IPLimitBackendFail2ban)
+	if err := list.sync(true); err != nil {
+		t.Fatal(err)
+	}
+	if second.cleared != 1 || len(second.applied) != 1 {
+		t.Fatal("the fail2ban backend used the previous blocker")
+	}
+}
@@ -68,10 +68,52 @@ var defaultValueMap = map[string]string{
 	"subJsonNoises":               "",
 	"subJsonMux":                  "",
 	"subJsonRules":                "",
+	"subSignEnable":               "false",
+	"subSignSecret":               random.Seq(32),
+	"subSignTTL":                  "720",
+	"subAccessLog":                "true",
+	"subAccessLogDays":            "30",
+	"subRateLimit":                "0",
+	"subIpRateLimit":              "0",
+	"subRateLimitAction":          "429",
+	"subTrustedProxies":           "127.0.0.1,::1",
+	"subShareIpThreshold":         "10",
+	"subShareCountryThreshold":    "3",
+	"subAnnounce":                 "",
+	"subRemarkTemplate":           "",
+	"subCountry":                  "",
 	"datepicker":                  "gregorian",
+	"speedLimitLevels":            "512,1024,2048,5120,10240,20480,51200",
+	"speedLimitBackend":           "off",
+	"speedLimitInterface":         "",
+	"speedLimitDryRun":            "false",
+	"ipLimitBackend":              "xray",
+	"ipLimitBanMinutes":           "30",
+	"geoipMmdbPath":               "",
+	"sharingDetect":               "false",
+	"sharingMaxSubnets":           "4",
+	"sharingMaxAsns":              "3",
+	"sharingNotifyScore":          "50",
+	"sharingTagScore":             "70",
+	"sharingLimitScore":           "0",
+	"sharingDeviceLimit":          "2",
+	"routingPlans":                "{}",
+	"xrayCoreMode":                "binary",
+	"xrayCrashLoopCount":          "5",
+	"xrayCrashLoopMinutes":        "10",
+	"xrayCoreDownloadUrl":         "https://github.com/XTLS/Xray-core/releases/download",
+	"xrayCoreReleasesUrl":         "https://api.github.com/repos/XTLS/Xray-core/releases",
+	"xrayCoreVerifyChecksum":      "true",
+	"xrayCorePinned":              "",
+	"accessStats":                 "false",
+	"accessStatsDays":             "7",
+	"accessStatsPrivacy":          "false",
+	"accessStatsCategories":       "category-ads-all,google,youtube,netflix,openai,telegram,facebook,twitter,tiktok,apple,microsoft,cn,geolocation-!cn",
 	"warp":                        "",
 	"externalTrafficInformEnable": "false",
 	"externalTrafficInformURI":    "",
+	"webhookUrl":                  "",
+	"webhookSecret":               "",
 	"v2boardEnable":               "false",
 	"v2boardUrl":                  "",
 	"v2boardToken":                "",
@@ -248,7 +290,16 @@ func (s *SettingService) setInt(key string, value int) error {
 	return s.setString(key, strconv.Itoa(value))
 }
 
+// GetXrayConfigTemplate returns the latest saved version of the template, or
+// the embedded one when none was saved yet.
 func (s *SettingService) GetXrayConfigTemplate() (string, error) {
+	version, err := getLatestXrayTemplateVersion()
+	if err == nil {
+		return version.Template, nil
+	}
+	if !database.IsNotFound(err) {
+		return "", err
+	}
 	return s.getString("xrayTemplateConfig")
 }
 
@@ -509,10 +560,212 @@ func (s *SettingService) GetSubJsonRules() (string, error) {
 	return s.getString("subJsonRules")
 }
 
+func (s *SettingService) GetSubSignEnable() (bool, error) {
+	return s.getBool("subSignEnable")
+}
+
+func (s *SettingService) GetSubSignSecret() ([]byte, error) {
+	secret, err := s.getString("subSignSecret")
+	if secret == defaultValueMap["subSignSecret"] {
+		err := s.saveSetting("subSignSecret", secret)
+		if err != nil {
+			logger.Warning("save sub sign secret failed:", err)
+		}
+	}
+	return []byte(secret), err
+}
+
+func (s *SettingService) GetSubSignTTL() (int, error) {
+	return s.getInt("subSignTTL")
+}
+
+func (s *SettingService) GetSubAccessLog() (bool, error) {
+	return s.getBool("subAccessLog")
+}
+
+func (s *SettingService) GetSubAccessLogDays() (int, error) {
+	return s.getInt("subAccessLogDays")
+}
+
+func (s *SettingService) GetSubRateLimit() (int, error) {
+	return s.getInt("subRateLimit")
+}
+
+func (s *SettingService) GetSubIpRateLimit() (int, error) {
+	return s.getInt("subIpRateLimit")
+}
+
+func (s *SettingService) GetSubRateLimitAction() (string, error) {
+	return s.getString("subRateLimitAction")
+}
+
+// GetSubTrustedProxies returns the IPs and CIDRs, comma separated, whose
+// X-Forwarded-For and X-Real-IP headers are believed by the subscription
+// server.
+func (s *SettingService) GetSubTrustedProxies() (string, error) {
+	return s.getString("subTrustedProxies")
+}
+
+func (s *SettingService) GetSubShareIpThreshold() (int, error) {
+	return s.getInt("subShareIpThreshold")
+}
+
+func (s *SettingService) GetSubShareCountryThreshold() (int, error) {
+	return s.getInt("subShareCountryThreshold")
+}
+
+func (s *SettingService) GetSubAnnounce() (string, error) {
+	return s.getString("subAnnounce")
+}
+
+func (s *SettingService) GetSubRemarkTemplate() (string, error) {
+	return s.getString("subRemarkTemplate")
+}
+
+func (s *SettingService) GetSubCountry() (string, error) {
+	return s.getString("subCountry")
+}
+
 func (s *SettingService) GetDatepicker() (string, error) {
 	return s.getString("datepicker")
 }
 
+// GetSpeedLimitLevels returns the speed limits (KB/s) that always get a policy
+// level, so that clients can be moved between them without restarting Xray.
+func (s *SettingService) GetSpeedLimitLevels() ([]int, error) {
+	str, err := s.getString("speedLimitLevels")
+	if err != nil {
+		return nil, err
+	}
+	return parseSpeedLimitLevels(str)
+}
+
+func (s *SettingService) GetSpeedLimitBackend() (string, error) {
+	return s.getString("speedLimitBackend")
+}
+
+func (s *SettingService) GetSpeedLimitInterface() (string, error) {
+	return s.getString("speedLimitInterface")
+}
+
+func (s *SettingService) GetSpeedLimitDryRun() (bool, error) {
+	return s.getBool("speedLimitDryRun")
+}
+
+func (s *SettingService) GetIPLimitBackend() (string, error) {
+	return s.getString("ipLimitBackend")
+}
+
+func (s *SettingService) GetIPLimitBanMinutes() (int, error) {
+	return s.getInt("ipLimitBanMinutes")
+}
+
+// GetGeoipMmdbPath returns the MMDB files used to resolve client IPs, comma
+// separated, for example a country and an ASN database.
+func (s *SettingService) GetGeoipMmdbPath() (string, error) {
+	return s.getString("geoipMmdbPath")
+}
+
+func (s *SettingService) GetSharingDetect() (bool, error) {
+	return s.getBool("sharingDetect")
+}
+
+func (s *SettingService) GetSharingMaxSubnets() (int, error) {
+	return s.getInt("sharingMaxSubnets")
+}
+
+func (s *SettingService) GetSharingMaxAsns() (int, error) {
+	return s.getInt("sharingMaxAsns")
+}
+
+// GetSharingNotifyScore, GetSharingTagScore and GetSharingLimitScore return
+// the sharing scores at which a client is reported, tagged or limited to
+// GetSharingDeviceLimit devices. 0 turns the action off.
+func (s *SettingService) GetSharingNotifyScore() (int, error) {
+	return s.getInt("sharingNotifyScore")
+}
+
+func (s *SettingService) GetSharingTagScore() (int, error) {
+	return s.getInt("sharingTagScore")
+}
+
+func (s *SettingService) GetSharingLimitScore() (int, error) {
+	return s.getInt("sharingLimitScore")
+}
+
+func (s *SettingService) GetSharingDeviceLimit() (int, error) {
+	return s.getInt("sharingDeviceLimit")
+}
+
+// GetRoutingPlans returns the routing plans clients can be put on, as JSON.
+func (s *SettingService) GetRoutingPlans() (string, error) {
+	return s.getString("routingPlans")
+}
+
+// GetXrayCoreMode returns how Xray is run: "binary" runs the Xray binary,
+// "embedded" runs xray-core inside the panel.
+func (s *SettingService) GetXrayCoreMode() (string, error) {
+	return s.getString("xrayCoreMode")
+}
+
+// GetXrayCrashLoopCount returns after how many crashes within the crash loop
+// window Xray is no longer restarted.
+func (s *SettingService) GetXrayCrashLoopCount() (int, error) {
+	return s.getInt("xrayCrashLoopCount")
+}
+
+func (s *SettingService) GetXrayCrashLoopMinutes() (int, error) {
+	return s.getInt("xrayCrashLoopMinutes")
+}
+
+// GetXrayCoreDownloadUrl returns where Xray releases are downloaded from, as
+// <url>/<version>/Xray-<os>-<arch>.zip.
+func (s *SettingService) GetXrayCoreDownloadUrl() (string, error) {
+	return s.getString("xrayCoreDownloadUrl")
+}
+
+// GetXrayCoreReleasesUrl returns where the Xray versions are listed, in the
+// format of the GitHub releases API.
+func (s *SettingService) GetXrayCoreReleasesUrl() (string, error) {
+	return s.getString("xrayCoreReleasesUrl")
+}
+
+func (s *SettingService) GetXrayCoreVerifyChecksum() (bool, error) {
+	return s.getBool("xrayCoreVerifyChecksum")
+}
+
+// GetXrayCorePinned returns the Xray version that may not be switched away
+// from, or "".
+func (s *SettingService) GetXrayCorePinned() (string, error) {
+	return s.getString("xrayCorePinned")
+}
+
+func (s *SettingService) SetXrayCorePinned(version string) error {
+	return s.setString("xrayCorePinned", version)
+}
+
+// GetAccessStats returns whether the access log of Xray is read into the
+// per-client destination statistics.
+func (s *SettingService) GetAccessStats() (bool, error) {
+	return s.getBool("accessStats")
+}
+
+func (s *SettingService) GetAccessStatsDays() (int, error) {
+	return s.getInt("accessStatsDays")
+}
+
+// GetAccessStatsPrivacy returns whether only the categories of the domains
+// are stored instead of the domains and IPs.
+func (s *SettingService) GetAccessStatsPrivacy() (bool, error) {
+	return s.getBool("accessStatsPrivacy")
+}
+
+// GetAccessStatsCategories returns the geosite codes domains are put in with
+// the privacy switch on, comma separated, the first match winning.
+func (s *SettingService) GetAccessStatsCategories() (string, error) {
+	return s.getString("accessStatsCategories")
+}
+
 func (s *SettingService) GetWarp() (string, error) {
 	return s.getString("warp")
 }
@@ -533,6 +786,14 @@ func (s *SettingService) GetExternalTrafficInformURI() (string, error) {
 	return s.getString("externalTrafficInformURI")
 }
 
+func (s *SettingService) GetWebhookUrl() (string, error) {
+	return s.getString("webhookUrl")
+}
+
+func (s *SettingService) GetWebhookSecret() (string, error) {
+	return s.getString("webhookSecret")
+}
+
 func (s *SettingService) GetV2boardEnable() (bool, error) {
 	return s.getBool("v2boardEnable")
 }
@@ -646,3 +907,20 @@ func (s *SettingService) GetDefaultSettings(host string) (any, error) {
 
 	return result, nil
 }
+
+// parseSpeedLimitLevels parses a comma separated list of speed limits.
+func parseSpeedLimitLevels(str string) ([]int, error) {
+	var levels []int
+	for _, field := range strings.Split(str, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		level, err := strconv.Atoi(field)
+		if err != nil || level <= 0 {
+			return nil, common.NewError("invalid speed limit level:", field)
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
@@ -0,0 +1,387 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+)
+
+const (
+	// sharingWindow is how far back the signals of a client are looked at.
+	sharingWindow = 24 * time.Hour
+	// sharingTravelTime is the least time it takes to get from one country to
+	// another. Showing up in another country sooner is impossible travel.
+	sharingTravelTime = time.Hour
+	// sharingTag is added to the comment of a tagged client.
+	sharingTag = "#sharing"
+)
+
+// sharingSample is the countries a client was online from at a time. A new
+// sample is only taken when they change; no countries means offline.
+type sharingSample struct {
+	time      time.Time
+	countries []string
+}
+
+var (
+	sharingLock    sync.Mutex
+	sharingSamples = map[string][]*sharingSample{}
+)
+
+// SharingService scores how likely it is that clients share their account,
+// from the IPs they were online from and the IPs their subscription was
+// fetched from, and acts on the scores.
+type SharingService struct {
+	inboundService InboundService
+	settingService SettingService
+	geoIPService   GeoIPService
+	xrayService    XrayService
+}
+
+// IsEnabled reports whether the sharing detection is turned on.
+func (s *SharingService) IsEnabled() bool {
+	enabled, err := s.settingService.GetSharingDetect()
+	return err == nil && enabled
+}
+
+// ObserveOnline records the countries the online clients are in right now.
+// online maps the emails of all online clients to their IPs.
+func (s *SharingService) ObserveOnline(online map[string][]string) {
+	if !s.IsEnabled() {
+		return
+	}
+	countries := make(map[string][]string, len(online))
+	for email, ips := range online {
+		seen := map[string]bool{}
+		for _, ip := range ips {
+			country := s.geoIPService.Lookup(ip).Country
+			if country != "" && !seen[country] {
+				seen[country] = true
+				countries[email] = append(countries[email], country)
+			}
+		}
+		sort.Strings(countries[email])
+	}
+
+	now := time.Now()
+	sharingLock.Lock()
+	defer sharingLock.Unlock()
+	for email, samples := range sharingSamples {
+		last := samples[len(samples)-1]
+		if len(last.countries) == 0 && now.Sub(last.time) > sharingWindow {
+			delete(sharingSamples, email)
+			continue
+		}
+		if _, ok := countries[email]; !ok {
+			countries[email] = nil
+		}
+	}
+	for email, current := range countries {
+		samples := sharingSamples[email]
+		if len(samples) > 0 && strings.Join(samples[len(samples)-1].countries, ",") == strings.Join(current, ",") {
+			continue
+		}
+		if len(samples) == 0 && len(current) == 0 {
+			continue
+		}
+		// Drop what is out of the window, keeping the sample in effect then.
+		first := 0
+		for first+1 < len(samples) && now.Sub(samples[first+1].time) > sharingWindow {
+			first++
+		}
+		samples = append(samples[first:], &sharingSample{time: now, countries: current})
+		if len(current) == 0 && len(samples) == 1 {
+			delete(sharingSamples, email)
+			continue
+		}
+		sharingSamples[email] = samples
+	}
+}
+
+// onlineSignals returns the most countries a client was online from at once
+// and how often it showed up in another country too soon.
+func onlineSignals(email string, since time.Time) (simultaneous int, travels int) {
+	sharingLock.Lock()
+	defer sharingLock.Unlock()
+	samples := sharingSamples[email]
+	var prev []string
+	var prevEnd time.Time
+	for i, sample := range samples {
+		if i > 0 && len(samples[i-1].countries) > 0 {
+			prev, prevEnd = samples[i-1].countries, sample.time
+		}
+		if sample.time.Before(since) || len(sample.countries) == 0 {
+			continue
+		}
+		simultaneous = max(simultaneous, len(sample.countries))
+		if prev != nil && disjoint(prev, sample.countries) && sample.time.Sub(prevEnd) < sharingTravelTime {
+			travels++
+		}
+	}
+	return simultaneous, travels
+}
+
+func disjoint(a []string, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// subnetOf returns the /24 of an IPv4 or the /48 of an IPv6 address.
+func subnetOf(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// Score works out the sharing score of a client from the last day.
+func (s *SharingService) Score(email string, subId string) (*model.SharingScore, error) {
+	maxSubnets, err := s.settingService.GetSharingMaxSubnets()
+	if err != nil {
+		return nil, err
+	}
+	maxAsns, err := s.settingService.GetSharingMaxAsns()
+	if err != nil {
+		return nil, err
+	}
+
+	since := time.Now().Add(-sharingWindow)
+	db := database.GetDB()
+	var ips []*model.ClientIpGeo
+	err = db.Model(model.ClientIpGeo{}).Where("client_email = ? AND last_seen >= ?", email, since.Unix()).Find(&ips).Error
+	if err != nil {
+		return nil, err
+	}
+	subnets := map[string]bool{}
+	asns := map[uint]bool{}
+	countries := map[string]bool{}
+	for _, ip := range ips {
+		subnets[subnetOf(ip.Ip)] = true
+		if ip.Asn > 0 {
+			asns[ip.Asn] = true
+		}
+		if ip.Country != "" {
+			countries[ip.Country] = true
+		}
+	}
+
+	if subId != "" {
+		var fetches []*model.SubAccessLog
+		err = db.Model(model.SubAccessLog{}).
+			Where("sub_id = ? AND time >= ? AND status = ?", subId, since.UnixMilli(), 200).
+			Find(&fetches).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, fetch := range fetches {
+			subnets[subnetOf(fetch.Ip)] = true
+			info := s.geoIPService.Lookup(fetch.Ip)
+			if info.Asn > 0 {
+				asns[info.Asn] = true
+			}
+			country := strings.ToUpper(fetch.Country)
+			if country == "" || country == "XX" || country == "T1" {
+				country = info.Country
+			}
+			if country != "" {
+				countries[country] = true
+			}
+		}
+	}
+	delete(subnets, "")
+
+	score := &model.SharingScore{
+		Email:     email,
+		Subnets:   len(subnets),
+		Asns:      len(asns),
+		Countries: len(countries),
+		UpdatedAt: time.Now().Unix(),
+	}
+	score.Simultaneous, score.Travels = onlineSignals(email, since)
+
+	var reasons []string
+	if score.Subnets > maxSubnets {
+		score.Score += 10 * (score.Subnets - maxSubnets)
+		reasons = append(reasons, fmt.Sprintf("%d networks", score.Subnets))
+	}
+	if score.Asns > maxAsns {
+		score.Score += 15 * (score.Asns - maxAsns)
+		reasons = append(reasons, fmt.Sprintf("%d ASNs", score.Asns))
+	}
+	if score.Countries > 2 {
+		score.Score += 10 * (score.Countries - 2)
+		reasons = append(reasons, fmt.Sprintf("%d countries", score.Countries))
+	}
+	if score.Simultaneous > 1 {
+		score.Score += 40 * (score.Simultaneous - 1)
+		reasons = append(reasons, fmt.Sprintf("online from %d countries at once", score.Simultaneous))
+	}
+	if score.Travels > 0 {
+		score.Score += 30 * score.Travels
+		reasons = append(reasons, fmt.Sprintf("%d impossible travels", score.Travels))
+	}
+	score.Score = min(score.Score, 100)
+	score.Reasons = strings.Join(reasons, ", ")
+	return score, nil
+}
+
+// Detect scores all enabled clients and takes the actions their scores call
+// for. Each action is only taken once, notifications once a day.
+func (s *SharingService) Detect() error {
+	if enabled, err := s.settingService.GetSharingDetect(); err != nil || !enabled {
+		return err
+	}
+	inbounds, err := s.inboundService.GetAllInbounds()
+	if err != nil {
+		return err
+	}
+	for _, inbound := range inbounds {
+		if !inbound.Enable {
+			continue
+		}
+		clients, err := s.inboundService.GetClients(inbound)
+		if err != nil {
+			continue
+		}
+		for _, client := range clients {
+			if !client.Enable || client.Email == "" {
+				continue
+			}
+			score, err := s.Score(client.Email, client.SubID)
+			if err != nil {
+				logger.Warning("sharing score failed for", client.Email, err)
+				continue
+			}
+			if err := s.act(inbound, &client, score); err != nil {
+				logger.Warning("sharing detection failed for", client.Email, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *SharingService) act(inbound *model.Inbound, client *model.Client, score *model.SharingScore) error {
+	old, err := s.GetScore(client.Email)
+	if err == nil {
+		score.Id = old.Id
+		score.NotifiedAt, score.Tagged, score.Limited = old.NotifiedAt, old.Tagged, old.Limited
+	} else if score.Score == 0 {
+		return nil
+	}
+
+	notifyScore, _ := s.settingService.GetSharingNotifyScore()
+	tagScore, _ := s.settingService.GetSharingTagScore()
+	limitScore, _ := s.settingService.GetSharingLimitScore()
+	deviceLimit, _ := s.settingService.GetSharingDeviceLimit()
+
+	var actions []string
+	if tagScore > 0 && score.Score >= tagScore && !score.Tagged {
+		if !strings.Contains(client.Comment, sharingTag) {
+			comment := strings.TrimSpace(client.Comment + " " + sharingTag)
+			needRestart, err := s.inboundService.SetClientCommentByEmail(client.Email, comment)
+			if err != nil {
+				return err
+			}
+			if needRestart {
+				s.xrayService.SetToNeedRestart()
+			}
+		}
+		score.Tagged = true
+		actions = append(actions, "已标记 "+sharingTag)
+	}
+	if limitScore > 0 && score.Score >= limitScore && !score.Limited && deviceLimit > 0 {
+		if current := GetDeviceLimitPolicy(inbound, client).Limit; current == 0 || current > deviceLimit {
+			needRestart, err := s.inboundService.SetClientDeviceLimitByEmail(client.Email, deviceLimit)
+			if err != nil {
+				return err
+			}
+			if needRestart {
+				s.xrayService.SetToNeedRestart()
+			}
+			actions = append(actions, fmt.Sprintf("设备限制已设为 %d", deviceLimit))
+		}
+		score.Limited = true
+	}
+	now := time.Now()
+	if notifyScore > 0 && score.Score >= notifyScore && now.Sub(time.Unix(score.NotifiedAt, 0)) > sharingWindow {
+		score.NotifiedAt = now.Unix()
+		s.notify(score, actions)
+	}
+
+	db := database.GetDB()
+	return db.Save(score).Error
+}
+
+func (s *SharingService) notify(score *model.SharingScore, actions []string) {
+	action := "仅提醒"
+	if len(actions) > 0 {
+		action = strings.Join(actions, "，")
+	}
+	msg := fmt.Sprintf(
+		"<b>〔X-Panel面板〕疑似共享账号提醒</b>\n\n"+
+			"  ------------------------------------\n"+
+			"  👤 用户 Email：%s\n"+
+			"  📊 共享评分：%d\n"+
+			"  🌐 网段 / ASN / 国家：%d / %d / %d\n"+
+			"  🌍 同时在线国家数：%d\n"+
+			"  ✈️ 不可能的行程：%d 次\n"+
+			"  ------------------------------------\n\n"+
+			"<b><i>⚠ %s</i></b>",
+		score.Email, score.Score, score.Subnets, score.Asns, score.Countries,
+		score.Simultaneous, score.Travels, action,
+	)
+	notifyAdmins("client.sharing", msg, score)
+}
+
+func (s *SharingService) GetScore(email string) (*model.SharingScore, error) {
+	db := database.GetDB()
+	score := &model.SharingScore{}
+	err := db.Model(model.SharingScore{}).Where("email = ?", email).First(score).Error
+	if err != nil {
+		return nil, err
+	}
+	return score, nil
+}
+
+// GetScores lists the clients with a sharing score, the highest first.
+func (s *SharingService) GetScores() ([]*model.SharingScore, error) {
+	db := database.GetDB()
+	var scores []*model.SharingScore
+	err := db.Model(model.SharingScore{}).Where("score > 0").Order("score desc, updated_at desc").Find(&scores).Error
+	if err != nil {
+		return nil, err
+	}
+	return scores, nil
+}
+
+// Reset forgets the score of a client, so that its actions can be taken
+// again. The tag and the device limit are left for the admin to undo.
+func (s *SharingService) Reset(email string) error {
+	db := database.GetDB()
+	result := db.Where("email = ?", email).Delete(model.SharingScore{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return common.NewError("no sharing score for", email)
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package service
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+)
+
+const (
+	SpeedLimitBackendOff = "off"
+	SpeedLimitBackendTc  = "tc"
+)
+
+// ClientSpeedLimit is the effective bandwidth limit of one client, together
+// with what the backends need to find its traffic.
+type ClientSpeedLimit struct {
+	Email string   `json:"email"`
+	Tag   string   `json:"tag"`
+	Port  int      `json:"port"`
+	Ips   []string `json:"ips"`
+	Up    int      `json:"up"`    // KB/s
+	Down  int      `json:"down"`  // KB/s
+	Burst int      `json:"burst"` // KB
+}
+
+// SpeedLimiter enforces client bandwidth limits. Apply receives the complete
+// set of limits every time and must replace whatever it applied before.
+type SpeedLimiter interface {
+	Name() string
+	Apply(limits []*ClientSpeedLimit) error
+	Clear() error
+}
+
+// fairUseGrace is how long a throttled client may go without its fair-use
+// tier being applied before it is cut off instead.
+const fairUseGrace = 2 * time.Minute
+
+var (
+	speedLimiterLock sync.Mutex
+	speedLimiter     SpeedLimiter
+	speedLimiterKey  string
+	speedLimiterErr  string
+
+	// speedLimitEnforced are the emails whose limits the backend really
+	// applied on its last run; fairUsePending is since when a throttled
+	// client waits for that.
+	enforcedLock       sync.Mutex
+	speedLimitEnforced = map[string]bool{}
+	fairUsePending     = map[string]time.Time{}
+)
+
+type SpeedLimitService struct {
+	inboundService InboundService
+	settingService SettingService
+}
+
+// effectiveSpeedLimit resolves the limits of a client: its own upload/download
+// limits first, then the single speed limit, then the inbound default.
+func effectiveSpeedLimit(inbound *model.Inbound, client *model.Client) (up int, down int, burst int) {
+	up, down, burst = client.UpLimit, client.DownLimit, client.Burst
+	if up <= 0 && down <= 0 && client.SpeedLimit > 0 {
+		up, down = client.SpeedLimit, client.SpeedLimit
+	}
+	if up <= 0 && down <= 0 {
+		up, down = inbound.UpLimit, inbound.DownLimit
+	}
+	if burst <= 0 {
+		burst = inbound.Burst
+	}
+	return max(up, 0), max(down, 0), max(burst, 0)
+}
+
+// throttleSpeed lowers a limit to the fair-use speed; 0 means unlimited.
+func throttleSpeed(limit int, speed int) int {
+	if limit == 0 || speed < limit {
+		return speed
+	}
+	return limit
+}
+
+// GetSpeedLimits returns the limits of every enabled client that has one,
+// with the client IPs recorded from the access log.
+func (s *SpeedLimitService) GetSpeedLimits() ([]*ClientSpeedLimit, error) {
+	inbounds, err := s.inboundService.GetAllInbounds()
+	if err != nil {
+		return nil, err
+	}
+	// 中文注释: 流量用尽的公平使用客户端被降到对应的低速档位。
+	var throttled []xray.ClientTraffic
+	db := database.GetDB()
+	err = db.Model(xray.ClientTraffic{}).Where("throttled = ? AND fair_use > 0", true).Find(&throttled).Error
+	if err != nil {
+		return nil, err
+	}
+	fairUse := make(map[string]int, len(throttled))
+	for _, traffic := range throttled {
+		fairUse[traffic.Email] = traffic.FairUse
+	}
+
+	var limits []*ClientSpeedLimit
+	for _, inbound := range inbounds {
+		if !inbound.Enable || inbound.Protocol == model.WireGuard {
+			continue
+		}
+		clients, err := s.inboundService.GetClients(inbound)
+		if err != nil {
+			continue
+		}
+		for i := range clients {
+			client := &clients[i]
+			if !client.Enable || client.Email == "" {
+				continue
+			}
+			up, down, burst := effectiveSpeedLimit(inbound, client)
+			if speed, ok := fairUse[client.Email]; ok {
+				up, down = throttleSpeed(up, speed), throttleSpeed(down, speed)
+			}
+			if up == 0 && down == 0 {
+				continue
+			}
+			limits = append(limits, &ClientSpeedLimit{
+				Email: client.Email,
+				Tag:   inbound.Tag,
+				Port:  inbound.Port,
+				Ips:   s.getClientIps(client.Email),
+				Up:    up,
+				Down:  down,
+				Burst: burst,
+			})
+		}
+	}
+	sort.Slice(limits, func(i, j int) bool {
+		if limits[i].Port != limits[j].Port {
+			return limits[i].Port < limits[j].Port
+		}
+		return limits[i].Email < limits[j].Email
+	})
+	return limits, nil
+}
+
+func (s *SpeedLimitService) getClientIps(email string) []string {
+	db := database.GetDB()
+	record := &model.InboundClientIps{}
+	err := db.Model(model.InboundClientIps{}).Where("client_email = ?", email).First(record).Error
+	if err != nil || record.Ips == "" {
+		return nil
+	}
+	var ips []string
+	if json.Unmarshal([]byte(record.Ips), &ips) != nil {
+		return nil
+	}
+	return ips
+}
+
+// getSpeedLimiter returns the configured backend, creating a new one when the
+// settings changed. The previous backend is cleared before it is replaced.
+func (s *SpeedLimitService) getSpeedLimiter() (SpeedLimiter, error) {
+	backend, err := s.settingService.GetSpeedLimitBackend()
+	if err != nil {
+		return nil, err
+	}
+	iface, err := s.settingService.GetSpeedLimitInterface()
+	if err != nil {
+		return nil, err
+	}
+	dryRun, err := s.settingService.GetSpeedLimitDryRun()
+	if err != nil {
+		return nil, err
+	}
+	if backend == SpeedLimitBackendTc && iface == "" {
+		iface = defaultRouteInterface()
+	}
+
+	key := backend + "|" + iface
+	if dryRun {
+		key += "|dry"
+	}
+	if speedLimiter != nil && key == speedLimiterKey {
+		return speedLimiter, nil
+	}
+	if speedLimiter != nil {
+		if err := speedLimiter.Clear(); err != nil {
+			logger.Warning("clear speed limits failed:", err)
+		}
+	}
+
+	speedLimiterKey = key
+	switch backend {
+	case SpeedLimitBackendOff, "":
+		speedLimiter = nil
+	case SpeedLimitBackendTc:
+		if iface == "" {
+			speedLimiter = nil
+			return nil, common.NewError("no network interface found for speed limits")
+		}
+		speedLimiter = newTcLimiter(iface, dryRun)
+	default:
+		speedLimiter = nil
+		return nil, common.NewError("unknown speed limit backend:", backend)
+	}
+	return speedLimiter, nil
+}
+
+// ApplySpeedLimits pushes the current client limits to the configured backend.
+func (s *SpeedLimitService) ApplySpeedLimits() error {
+	speedLimiterLock.Lock()
+	defer speedLimiterLock.Unlock()
+
+	enforced := map[string]bool{}
+	limiter, err := s.getSpeedLimiter()
+	if err == nil && limiter != nil {
+		var limits []*ClientSpeedLimit
+		limits, err = s.GetSpeedLimits()
+		if err == nil {
+			err = limiter.Apply(limits)
+		}
+		if tc, ok := limiter.(*tcLimiter); ok && err == nil && !tc.dryRun {
+			for _, limit := range limitsWithIps(limits) {
+				enforced[limit.Email] = true
+			}
+		}
+	}
+	enforcedLock.Lock()
+	speedLimitEnforced = enforced
+	enforcedLock.Unlock()
+	// Report a failure once instead of on every run.
+	if err != nil {
+		if err.Error() != speedLimiterErr {
+			speedLimiterErr = err.Error()
+			logger.Warning("apply speed limits failed:", err)
+		}
+		return err
+	}
+	speedLimiterErr = ""
+	return nil
+}
+
+// unenforcedFairUse returns which of the throttled clients went longer than
+// fairUseGrace without a backend applying their fair-use tier, e.g. because
+// the backend is off, in dry run or failing, or their IPs are not known. They
+// are cut off like any client that used up its traffic.
+func unenforcedFairUse(throttled []string, now time.Time) []string {
+	enforcedLock.Lock()
+	defer enforcedLock.Unlock()
+	pending := make(map[string]time.Time, len(throttled))
+	var cut []string
+	for _, email := range throttled {
+		if speedLimitEnforced[email] {
+			continue
+		}
+		since, ok := fairUsePending[email]
+		if !ok {
+			since = now
+		}
+		if now.Sub(since) >= fairUseGrace {
+			cut = append(cut, email)
+			continue
+		}
+		pending[email] = since
+	}
+	fairUsePending = pending
+	return cut
+}
+
+// GetSpeedLimitPlan returns the commands the configured backend would run for
+// the current limits, without running them.
+func (s *SpeedLimitService) GetSpeedLimitPlan() ([]string, error) {
+	speedLimiterLock.Lock()
+	defer speedLimiterLock.Unlock()
+
+	limiter, err := s.getSpeedLimiter()
+	if err != nil {
+		return nil, err
+	}
+	tc, ok := limiter.(*tcLimiter)
+	if !ok {
+		return []string{}, nil
+	}
+	limits, err := s.GetSpeedLimits()
+	if err != nil {
+		return nil, err
+	}
+	return tc.PlanStrings(limits), nil
+}
@@ -0,0 +1,280 @@
+package service
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"x-ui/logger"
+	"x-ui/util/common"
+)
+
+const (
+	// The filters of the panel are told from those of others by their
+	// priorities, one per protocol, and its policers by their indices, which
+	// start at tcPoliceIndex. Nothing else on the interface is touched.
+	tcPrioIPv4    = "49101"
+	tcPrioIPv6    = "49102"
+	tcPoliceIndex = 49100
+)
+
+// tcLimiter limits client traffic with Linux tc on one interface. It only
+// adds a clsact qdisc, which sits next to whatever root qdisc the interface
+// has, and polices downloads on egress and uploads on ingress, matched by
+// client IP and inbound port. Each direction of a client has one policer,
+// shared between its IPs.
+type tcLimiter struct {
+	iface  string
+	dryRun bool
+	// run executes one command; replaced to record commands instead.
+	run      func(args []string) error
+	lastPlan string
+
+	// policers is how many policers the applied plan created. applied is
+	// set while filters of the panel are in place, ownsQdisc when the clsact
+	// qdisc was added by the panel and not there before.
+	policers  int
+	applied   bool
+	ownsQdisc bool
+}
+
+func newTcLimiter(iface string, dryRun bool) *tcLimiter {
+	return &tcLimiter{
+		iface:  iface,
+		dryRun: dryRun,
+		run:    runTc,
+	}
+}
+
+func runTc(args []string) error {
+	out, err := exec.Command("tc", args...).CombinedOutput()
+	if err != nil {
+		return common.NewErrorf("tc %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (l *tcLimiter) Name() string {
+	return SpeedLimitBackendTc
+}
+
+// limitsWithIps drops the limits of clients with no known IP, which can not
+// be matched.
+func limitsWithIps(limits []*ClientSpeedLimit) []*ClientSpeedLimit {
+	var result []*ClientSpeedLimit
+	for _, limit := range limits {
+		if len(limit.Ips) > 0 && (limit.Up > 0 || limit.Down > 0) {
+			result = append(result, limit)
+		}
+	}
+	return result
+}
+
+// Plan returns the tc commands (without the leading "tc") that replace the
+// filters of the panel with the given limits. With no limits it is empty.
+func (l *tcLimiter) Plan(limits []*ClientSpeedLimit) [][]string {
+	plan, _ := l.plan(limits)
+	return plan
+}
+
+// plan returns the commands and how many policers they create.
+func (l *tcLimiter) plan(limits []*ClientSpeedLimit) ([][]string, int) {
+	limits = limitsWithIps(limits)
+	if len(limits) == 0 {
+		return [][]string{}, 0
+	}
+	dev := []string{"dev", l.iface}
+	plan := l.removeFiltersPlan()
+	plan = append(plan, concat([]string{"qdisc", "add"}, dev, []string{"clsact"}))
+
+	policers := 0
+	for _, limit := range limits {
+		port := strconv.Itoa(limit.Port)
+		for _, dir := range []struct {
+			hook  string
+			rate  int
+			burst int
+			host  string
+			port  string
+		}{
+			{"egress", limit.Down, downBurst(limit), "dst", "sport"},
+			{"ingress", limit.Up, upBurst(limit), "src", "dport"},
+		} {
+			if dir.rate <= 0 {
+				continue
+			}
+			index := strconv.Itoa(tcPoliceIndex + policers)
+			policers++
+			// replace also takes over a policer left behind by an earlier run.
+			plan = append(plan, []string{"actions", "replace", "action", "police",
+				"rate", kbps(dir.rate), "burst", strconv.Itoa(dir.burst) + "kb", "drop", "index", index})
+			for _, ip := range limit.Ips {
+				addr := net.ParseIP(ip)
+				if addr == nil {
+					continue
+				}
+				// Each filter priority holds a single protocol.
+				proto, prio, match, host := "ip", tcPrioIPv4, "ip", ip+"/32"
+				if addr.To4() == nil {
+					proto, prio, match, host = "ipv6", tcPrioIPv6, "ip6", ip+"/128"
+				}
+				plan = append(plan, concat([]string{"filter", "add"}, dev, []string{dir.hook,
+					"protocol", proto, "prio", prio, "u32",
+					"match", match, dir.host, host, "match", match, dir.port, port, "0xffff",
+					"action", "police", "index", index}))
+			}
+		}
+	}
+	return plan, policers
+}
+
+// removeFiltersPlan deletes the filters of the panel, and only those.
+func (l *tcLimiter) removeFiltersPlan() [][]string {
+	var plan [][]string
+	for _, hook := range []string{"egress", "ingress"} {
+		plan = append(plan,
+			[]string{"filter", "del", "dev", l.iface, hook, "protocol", "ip", "prio", tcPrioIPv4},
+			[]string{"filter", "del", "dev", l.iface, hook, "protocol", "ipv6", "prio", tcPrioIPv6},
+		)
+	}
+	return plan
+}
+
+// removePolicersPlan deletes the policers of the panel from the given one on.
+func (l *tcLimiter) removePolicersPlan(from int) [][]string {
+	var plan [][]string
+	for i := from; i < l.policers; i++ {
+		plan = append(plan, []string{"actions", "del", "action", "police", "index", strconv.Itoa(tcPoliceIndex + i)})
+	}
+	return plan
+}
+
+// clearPlan removes everything the panel added to the interface.
+func (l *tcLimiter) clearPlan() [][]string {
+	plan := append(l.removeFiltersPlan(), l.removePolicersPlan(0)...)
+	if l.ownsQdisc {
+		plan = append(plan, []string{"qdisc", "del", "dev", l.iface, "clsact"})
+	}
+	return plan
+}
+
+// PlanStrings returns the plan as shell command lines.
+func (l *tcLimiter) PlanStrings(limits []*ClientSpeedLimit) []string {
+	return planStrings(l.Plan(limits))
+}
+
+func planStrings(plan [][]string) []string {
+	lines := make([]string, 0, len(plan))
+	for _, args := range plan {
+		lines = append(lines, "tc "+strings.Join(args, " "))
+	}
+	return lines
+}
+
+func (l *tcLimiter) Apply(limits []*ClientSpeedLimit) error {
+	if len(limitsWithIps(limits)) == 0 {
+		// Nothing to limit: leave the interface alone, only taking back
+		// what the panel added before.
+		if !l.applied {
+			return nil
+		}
+		return l.Clear()
+	}
+
+	plan, policers := l.plan(limits)
+	key := strings.Join(planStrings(plan), "\n")
+	if key == l.lastPlan {
+		return nil
+	}
+	if l.dryRun {
+		logger.Info("speed limit dry run, tc plan:\n" + key)
+		l.lastPlan = key
+		return nil
+	}
+	if err := l.execute(plan); err != nil {
+		// Try again on the next run.
+		l.lastPlan = ""
+		return err
+	}
+	// Policers no longer used are left over from a larger plan.
+	l.execute(l.removePolicersPlan(policers))
+	l.policers = policers
+	l.applied = true
+	l.lastPlan = key
+	return nil
+}
+
+func (l *tcLimiter) Clear() error {
+	l.lastPlan = ""
+	if l.dryRun || !l.applied {
+		return nil
+	}
+	err := l.execute(l.clearPlan())
+	l.policers, l.applied, l.ownsQdisc = 0, false, false
+	return err
+}
+
+// execute runs a plan. Deleting what does not exist fails, that is fine, and
+// so is adding the clsact qdisc when it is already there.
+func (l *tcLimiter) execute(plan [][]string) error {
+	for _, args := range plan {
+		err := l.run(args)
+		switch {
+		case args[0] == "qdisc" && args[1] == "add":
+			if err == nil {
+				l.ownsQdisc = true
+			}
+		case args[1] == "del":
+		case err != nil:
+			return err
+		}
+	}
+	return nil
+}
+
+func kbps(kb int) string {
+	return strconv.Itoa(kb) + "kbps"
+}
+
+// upBurst and downBurst default to 100ms worth of traffic, at least 16 KB.
+func upBurst(limit *ClientSpeedLimit) int {
+	if limit.Burst > 0 {
+		return limit.Burst
+	}
+	return max(limit.Up/10, 16)
+}
+
+func downBurst(limit *ClientSpeedLimit) int {
+	if limit.Burst > 0 {
+		return limit.Burst
+	}
+	return max(limit.Down/10, 16)
+}
+
+func concat(parts ...[]string) []string {
+	var result []string
+	for _, part := range parts {
+		result = append(result, part...)
+	}
+	return result
+}
+
+// defaultRouteInterface returns the interface of the IPv4 default route.
+func defaultRouteInterface() string {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[1] == "00000000" {
+			return fields[0]
+		}
+	}
+	return ""
+}
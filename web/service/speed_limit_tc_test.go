@@ -0,0 +1,173 @@
+package service
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// recordTc returns a limiter that records the commands it runs instead of
+// running them. fail makes the commands starting with it fail.
+func recordTc(fail string) (*tcLimiter, *[]string) {
+	var ran []string
+	l := newTcLimiter("eth0", false)
+	l.run = func(args []string) error {
+		line := "tc " + strings.Join(args, " ")
+		ran = append(ran, line)
+		if fail != "" && strings.HasPrefix(line, fail) {
+			return errors.New("failed")
+		}
+		return nil
+	}
+	return l, &ran
+}
+
+func TestTcPlanWithoutLimitsIsEmpty(t *testing.T) {
+	l, _ := recordTc("")
+	if plan := l.PlanStrings(nil); len(plan) != 0 {
+		t.Fatalf("plan without limits = %q, want none", plan)
+	}
+	// A client without a known IP can not be matched.
+	noIps := []*ClientSpeedLimit{{Email: "a", Port: 443, Up: 100, Down: 100}}
+	if plan := l.PlanStrings(noIps); len(plan) != 0 {
+		t.Fatalf("plan without IPs = %q, want none", plan)
+	}
+}
+
+func TestTcPlanStrings(t *testing.T) {
+	l, _ := recordTc("")
+	limits := []*ClientSpeedLimit{
+		{Email: "a", Port: 443, Ips: []string{"1.2.3.4", "2001:db8::1"}, Up: 1250, Down: 6250},
+		{Email: "b", Port: 8443, Ips: []string{"5.6.7.8"}, Down: 500, Burst: 64},
+	}
+	want := []string{
+		"tc filter del dev eth0 egress protocol ip prio 49101",
+		"tc filter del dev eth0 egress protocol ipv6 prio 49102",
+		"tc filter del dev eth0 ingress protocol ip prio 49101",
+		"tc filter del dev eth0 ingress protocol ipv6 prio 49102",
+		"tc qdisc add dev eth0 clsact",
+		"tc actions replace action police rate 6250kbps burst 625kb drop index 49100",
+		"tc filter add dev eth0 egress protocol ip prio 49101 u32 match ip dst 1.2.3.4/32 match ip sport 443 0xffff action police index 49100",
+		"tc filter add dev eth0 egress protocol ipv6 prio 49102 u32 match ip6 dst 2001:db8::1/128 match ip6 sport 443 0xffff action police index 49100",
+		"tc actions replace action police rate 1250kbps burst 125kb drop index 49101",
+		"tc filter add dev eth0 ingress protocol ip prio 49101 u32 match ip src 1.2.3.4/32 match ip dport 443 0xffff action police index 49101",
+		"tc filter add dev eth0 ingress protocol ipv6 prio 49102 u32 match ip6 src 2001:db8::1/128 match ip6 dport 443 0xffff action police index 49101",
+		"tc actions replace action police rate 500kbps burst 64kb drop index 49102",
+		"tc filter add dev eth0 egress protocol ip prio 49101 u32 match ip dst 5.6.7.8/32 match ip sport 8443 0xffff action police index 49102",
+	}
+	if got := l.PlanStrings(limits); !reflect.DeepEqual(got, want) {
+		t.Fatalf("plan =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	for _, line := range want {
+		if strings.Contains(line, " root") || strings.Contains(line, "qdisc del") {
+			t.Fatalf("plan touches qdiscs of others: %s", line)
+		}
+	}
+}
+
+func TestTcApplyWithoutLimitsDoesNothing(t *testing.T) {
+	l, ran := recordTc("")
+	if err := l.Apply(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(*ran) != 0 {
+		t.Fatalf("ran %q, want nothing", *ran)
+	}
+	if err := l.Clear(); err != nil || len(*ran) != 0 {
+		t.Fatalf("clear ran %q (%v), want nothing", *ran, err)
+	}
+}
+
+func TestTcApplyThenRemoveLimits(t *testing.T) {
+	l, ran := recordTc("")
+	limits := []*ClientSpeedLimit{{Email: "a", Port: 443, Ips: []string{"1.2.3.4"}, Up: 100, Down: 200}}
+	if err := l.Apply(limits); err != nil {
+		t.Fatal(err)
+	}
+	// The same limits are not applied again.
+	*ran = nil
+	if err := l.Apply(limits); err != nil || len(*ran) != 0 {
+		t.Fatalf("second apply ran %q (%v), want nothing", *ran, err)
+	}
+
+	if err := l.Apply(nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"tc filter del dev eth0 egress protocol ip prio 49101",
+		"tc filter del dev eth0 egress protocol ipv6 prio 49102",
+		"tc filter del dev eth0 ingress protocol ip prio 49101",
+		"tc filter del dev eth0 ingress protocol ipv6 prio 49102",
+		"tc actions del action police index 49100",
+		"tc actions del action police index 49101",
+		"tc qdisc del dev eth0 clsact",
+	}
+	if !reflect.DeepEqual(*ran, want) {
+		t.Fatalf("removing the limits ran\n%s\nwant\n%s", strings.Join(*ran, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestTcKeepsExistingClsact(t *testing.T) {
+	l, ran := recordTc("tc qdisc add")
+	limits := []*ClientSpeedLimit{{Email: "a", Port: 443, Ips: []string{"1.2.3.4"}, Down: 200}}
+	if err := l.Apply(limits); err != nil {
+		t.Fatalf("an existing clsact qdisc failed the apply: %v", err)
+	}
+	*ran = nil
+	if err := l.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range *ran {
+		if strings.HasPrefix(line, "tc qdisc del") {
+			t.Fatalf("removed a clsact qdisc the panel did not add: %s", line)
+		}
+	}
+}
+
+func TestTcRemovesUnusedPolicers(t *testing.T) {
+	l, ran := recordTc("")
+	two := []*ClientSpeedLimit{
+		{Email: "a", Port: 443, Ips: []string{"1.2.3.4"}, Down: 200},
+		{Email: "b", Port: 443, Ips: []string{"5.6.7.8"}, Down: 200},
+	}
+	if err := l.Apply(two); err != nil {
+		t.Fatal(err)
+	}
+	*ran = nil
+	if err := l.Apply(two[:1]); err != nil {
+		t.Fatal(err)
+	}
+	last := (*ran)[len(*ran)-1]
+	if last != "tc actions del action police index 49101" {
+		t.Fatalf("last command = %q, want the unused policer deleted", last)
+	}
+}
+
+func TestTcFailureIsRetried(t *testing.T) {
+	l, ran := recordTc("tc filter add")
+	limits := []*ClientSpeedLimit{{Email: "a", Port: 443, Ips: []string{"1.2.3.4"}, Down: 200}}
+	if err := l.Apply(limits); err == nil {
+		t.Fatal("a failing filter was not reported")
+	}
+	*ran = nil
+	l.Apply(limits)
+	if len(*ran) == 0 {
+		t.Fatal("the failed plan was not tried again")
+	}
+}
+
+func TestTcDryRunRunsNothing(t *testing.T) {
+	l, ran := recordTc("")
+	l.dryRun = true
+	limits := []*ClientSpeedLimit{{Email: "a", Port: 443, Ips: []string{"1.2.3.4"}, Up: 100}}
+	if err := l.Apply(limits); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*ran) != 0 {
+		t.Fatalf("dry run ran %q", *ran)
+	}
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUnenforcedFairUse(t *testing.T) {
+	// Every step runs after the one before, on the state it left.
+	steps := []struct {
+		name      string
+		at        time.Duration
+		throttled []string
+		enforced  []string
+		want      []string
+	}{
+		{name: "grace starts", at: 0, throttled: []string{"a", "b"}, enforced: []string{"b"}},
+		{name: "within the grace", at: time.Minute, throttled: []string{"a", "b"}},
+		{name: "grace over", at: fairUseGrace, throttled: []string{"a", "b", "c"}, enforced: []string{"b"}, want: []string{"a"}},
+		{name: "cut clients start over", at: fairUseGrace + time.Second, throttled: []string{"a", "c"}},
+		{name: "enforced clients are dropped", at: fairUseGrace + time.Minute, throttled: []string{"a", "c"}, enforced: []string{"c"}},
+		{name: "dropped clients start over", at: 2*fairUseGrace + time.Second, throttled: []string{"a", "c"}, want: []string{"a"}},
+		{name: "c within its new grace", at: 3 * fairUseGrace, throttled: []string{"c"}},
+		{name: "new grace of c over", at: 4 * fairUseGrace, throttled: []string{"c"}, want: []string{"c"}},
+	}
+
+	enforcedLock.Lock()
+	oldEnforced, oldPending := speedLimitEnforced, fairUsePending
+	fairUsePending = map[string]time.Time{}
+	enforcedLock.Unlock()
+	t.Cleanup(func() {
+		enforcedLock.Lock()
+		speedLimitEnforced, fairUsePending = oldEnforced, oldPending
+		enforcedLock.Unlock()
+	})
+
+	start := time.Now()
+	for _, step := range steps {
+		enforced := map[string]bool{}
+		for _, email := range step.enforced {
+			enforced[email] = true
+		}
+		enforcedLock.Lock()
+		speedLimitEnforced = enforced
+		enforcedLock.Unlock()
+
+		got := unenforcedFairUse(step.throttled, start.Add(step.at))
+		if !reflect.DeepEqual(got, step.want) {
+			t.Fatalf("%s: cut %q, want %q", step.name, got, step.want)
+		}
+	}
+}
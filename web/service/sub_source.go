@@ -0,0 +1,324 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+)
+
+const (
+	SubSourceFormatLinks = "links"
+	SubSourceFormatJson  = "json"
+)
+
+type SubSourceService struct{}
+
+func (s *SubSourceService) GetSubSources() ([]*model.SubSource, error) {
+	db := database.GetDB()
+	var sources []*model.SubSource
+	err := db.Model(model.SubSource{}).Find(&sources).Error
+	if err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+func (s *SubSourceService) GetSubSource(id int) (*model.SubSource, error) {
+	db := database.GetDB()
+	source := &model.SubSource{}
+	err := db.Model(model.SubSource{}).First(source, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+func (s *SubSourceService) AddSubSource(source *model.SubSource) error {
+	err := s.checkSubSource(source)
+	if err != nil {
+		return err
+	}
+	source.Id = 0
+	db := database.GetDB()
+	return db.Create(source).Error
+}
+
+func (s *SubSourceService) UpdateSubSource(source *model.SubSource) error {
+	err := s.checkSubSource(source)
+	if err != nil {
+		return err
+	}
+	oldSource, err := s.GetSubSource(source.Id)
+	if err != nil {
+		return err
+	}
+	if oldSource.Url != source.Url || oldSource.Prefix != source.Prefix {
+		// A new URL invalidates the cache, and so does a new prefix, which is
+		// put into the links when they are fetched.
+		oldSource.ETag = ""
+		oldSource.LastFetch = 0
+	}
+	oldSource.Name = source.Name
+	oldSource.Url = source.Url
+	oldSource.SubId = source.SubId
+	oldSource.Prefix = source.Prefix
+	oldSource.Interval = source.Interval
+	oldSource.Enable = source.Enable
+
+	db := database.GetDB()
+	return db.Save(oldSource).Error
+}
+
+func (s *SubSourceService) DelSubSource(id int) error {
+	db := database.GetDB()
+	return db.Delete(model.SubSource{}, id).Error
+}
+
+func (s *SubSourceService) checkSubSource(source *model.SubSource) error {
+	u, err := url.Parse(source.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return common.NewError("invalid sub source url:", source.Url)
+	}
+	if source.Interval <= 0 {
+		source.Interval = 60
+	}
+	return nil
+}
+
+// RefreshSubSources fetches every enabled source whose interval has elapsed.
+func (s *SubSourceService) RefreshSubSources() {
+	sources, err := s.GetSubSources()
+	if err != nil {
+		logger.Warning("get sub sources failed:", err)
+		return
+	}
+	now := time.Now()
+	for _, source := range sources {
+		if !source.Enable {
+			continue
+		}
+		next := time.UnixMilli(source.LastFetch).Add(time.Duration(source.Interval) * time.Minute)
+		if source.LastFetch > 0 && now.Before(next) {
+			continue
+		}
+		err = s.FetchSubSource(source)
+		if err != nil {
+			logger.Warningf("fetch sub source %s failed: %v", source.Name, err)
+		}
+	}
+}
+
+// FetchSubSource downloads a source, honouring its cached ETag, and stores the
+// parsed and renamed nodes.
+func (s *SubSourceService) FetchSubSource(source *model.SubSource) error {
+	db := database.GetDB()
+	source.LastFetch = time.Now().UnixMilli()
+
+	body, etag, err := s.download(source.Url, source.ETag)
+	if err == nil && body != nil {
+		var format, nodes string
+		var count int
+		format, nodes, count, err = s.parseSubSource(body, source.Prefix)
+		if err == nil {
+			source.Format = format
+			source.Nodes = nodes
+			source.NodeCount = count
+			source.ETag = etag
+		}
+	}
+	if err != nil {
+		source.LastError = err.Error()
+	} else {
+		source.LastError = ""
+	}
+
+	saveErr := db.Save(source).Error
+	if saveErr != nil {
+		return saveErr
+	}
+	return err
+}
+
+// download returns a nil body when the server answers 304 Not Modified.
+func (s *SubSourceService) download(rawUrl string, etag string) ([]byte, string, error) {
+	req, err := http.NewRequest(http.MethodGet, rawUrl, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("User-Agent", "X-Panel")
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, etag, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return nil, "", err
+	}
+	return body, resp.Header.Get("ETag"), nil
+}
+
+func (s *SubSourceService) parseSubSource(body []byte, prefix string) (string, string, int, error) {
+	content := strings.TrimSpace(string(body))
+	if strings.HasPrefix(content, "[") || strings.HasPrefix(content, "{") {
+		nodes, err := s.parseJsonNodes(content, prefix)
+		if err != nil {
+			return "", "", 0, err
+		}
+		data, err := json.Marshal(nodes)
+		if err != nil {
+			return "", "", 0, err
+		}
+		return SubSourceFormatJson, string(data), len(nodes), nil
+	}
+
+	if decoded, ok := decodeBase64(content); ok && strings.Contains(decoded, "://") {
+		content = decoded
+	}
+	var links []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.Contains(line, "://") {
+			continue
+		}
+		links = append(links, renameLink(line, prefix))
+	}
+	if len(links) == 0 {
+		return "", "", 0, common.NewError("no nodes found")
+	}
+	return SubSourceFormatLinks, strings.Join(links, "\n"), len(links), nil
+}
+
+func (s *SubSourceService) parseJsonNodes(content string, prefix string) ([]map[string]any, error) {
+	var configs []map[string]any
+	if strings.HasPrefix(content, "{") {
+		var config map[string]any
+		err := json.Unmarshal([]byte(content), &config)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, config)
+	} else {
+		err := json.Unmarshal([]byte(content), &configs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var nodes []map[string]any
+	for _, config := range configs {
+		if _, ok := config["outbounds"]; !ok {
+			continue
+		}
+		remarks, _ := config["remarks"].(string)
+		config["remarks"] = prefix + remarks
+		nodes = append(nodes, config)
+	}
+	if len(nodes) == 0 {
+		return nil, common.NewError("no nodes found")
+	}
+	return nodes, nil
+}
+
+// GetLinks returns the cached share links for subId.
+func (s *SubSourceService) GetLinks(subId string) []string {
+	var links []string
+	for _, source := range s.getCachedSources(subId, SubSourceFormatLinks) {
+		links = append(links, strings.Split(source.Nodes, "\n")...)
+	}
+	return links
+}
+
+// GetJsonConfigs returns the cached Xray client configs for subId.
+func (s *SubSourceService) GetJsonConfigs(subId string) []json.RawMessage {
+	var configs []json.RawMessage
+	for _, source := range s.getCachedSources(subId, SubSourceFormatJson) {
+		var nodes []json.RawMessage
+		err := json.Unmarshal([]byte(source.Nodes), &nodes)
+		if err != nil {
+			logger.Warningf("sub source %s has invalid cache: %v", source.Name, err)
+			continue
+		}
+		configs = append(configs, nodes...)
+	}
+	return configs
+}
+
+func (s *SubSourceService) getCachedSources(subId string, format string) []*model.SubSource {
+	db := database.GetDB()
+	var sources []*model.SubSource
+	err := db.Model(model.SubSource{}).
+		Where("enable = ? AND format = ? AND nodes != ''", true, format).
+		Where("sub_id = '' OR sub_id = ?", subId).
+		Find(&sources).Error
+	if err != nil {
+		logger.Warning("get sub sources failed:", err)
+		return nil
+	}
+	return sources
+}
+
+func decodeBase64(content string) (string, bool) {
+	content = strings.Join(strings.Fields(content), "")
+	encodings := []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding}
+	for _, encoding := range encodings {
+		decoded, err := encoding.DecodeString(content)
+		if err == nil {
+			return string(decoded), true
+		}
+	}
+	return "", false
+}
+
+// renameLink prefixes the remark of a share link. vmess links carry the
+// remark in their base64 JSON body, every other scheme in the URL fragment.
+func renameLink(link string, prefix string) string {
+	if prefix == "" {
+		return link
+	}
+	if body, ok := strings.CutPrefix(link, "vmess://"); ok {
+		decoded, ok := decodeBase64(body)
+		if !ok {
+			return link
+		}
+		var obj map[string]any
+		if json.Unmarshal([]byte(decoded), &obj) != nil {
+			return link
+		}
+		ps, _ := obj["ps"].(string)
+		obj["ps"] = prefix + ps
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return link
+		}
+		return "vmess://" + base64.StdEncoding.EncodeToString(data)
+	}
+
+	base, fragment, _ := strings.Cut(link, "#")
+	remark, err := url.PathUnescape(fragment)
+	if err != nil {
+		remark = fragment
+	}
+	return base + "#" + url.PathEscape(prefix+remark)
+}
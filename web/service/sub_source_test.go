@@ -0,0 +1,209 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"x-ui/database"
+	"x-ui/database/model"
+)
+
+// initTestDB opens a database of its own for the test.
+func initTestDB(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XUI_BIN_FOLDER", dir)
+	t.Setenv("XUI_LOG_FOLDER", dir)
+	if err := database.InitDB(dir + "/x-ui.db"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.CloseDB() })
+}
+
+// subSourceServer serves body with etag, and 304 Not Modified to requests
+// that already have it. status other than 200 is served instead of body.
+func subSourceServer(t *testing.T, body string, etag string, status int) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		if etag != "" && r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func addTestSubSource(t *testing.T, rawUrl string, prefix string) *model.SubSource {
+	t.Helper()
+	s := &SubSourceService{}
+	source := &model.SubSource{Name: "test", Url: rawUrl, Prefix: prefix, Enable: true}
+	if err := s.AddSubSource(source); err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+func TestFetchSubSourceReusesCacheOnNotModified(t *testing.T) {
+	initTestDB(t)
+	server, requests := subSourceServer(t, "trojan://pw@a.example:443#one\n", `"v1"`, http.StatusOK)
+	source := addTestSubSource(t, server.URL, "")
+	s := &SubSourceService{}
+
+	if err := s.FetchSubSource(source); err != nil {
+		t.Fatal(err)
+	}
+	if source.ETag != `"v1"` || source.NodeCount != 1 {
+		t.Fatalf("first fetch: etag %q, %d nodes", source.ETag, source.NodeCount)
+	}
+	if err := s.FetchSubSource(source); err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() != 2 {
+		t.Fatalf("%d requests, want 2", requests.Load())
+	}
+	saved, err := s.GetSubSource(source.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Nodes != "trojan://pw@a.example:443#one" || saved.ETag != `"v1"` || saved.LastError != "" {
+		t.Fatalf("after 304: nodes %q, etag %q, error %q", saved.Nodes, saved.ETag, saved.LastError)
+	}
+}
+
+func TestFetchSubSourceKeepsNodesOnError(t *testing.T) {
+	initTestDB(t)
+	good, _ := subSourceServer(t, "trojan://pw@a.example:443#one", "", http.StatusOK)
+	bad, _ := subSourceServer(t, "", "", http.StatusBadGateway)
+	source := addTestSubSource(t, good.URL, "")
+	s := &SubSourceService{}
+	if err := s.FetchSubSource(source); err != nil {
+		t.Fatal(err)
+	}
+
+	source.Url = bad.URL
+	if err := s.FetchSubSource(source); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Fatalf("error = %v, want the status reported", err)
+	}
+	saved, err := s.GetSubSource(source.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Nodes != "trojan://pw@a.example:443#one" || saved.LastError == "" {
+		t.Fatalf("after a failed fetch: nodes %q, error %q", saved.Nodes, saved.LastError)
+	}
+}
+
+func TestParseSubSource(t *testing.T) {
+	plain := "vless://id@a.example:443?type=tcp#one\r\n\r\ntrojan://pw@b.example:443#two%20x\n"
+	vmess := "vmess://" + base64.StdEncoding.EncodeToString([]byte(`{"add":"c.example","ps":"three"}`))
+	tests := []struct {
+		name   string
+		body   string
+		prefix string
+		format string
+		nodes  []string
+	}{
+		{
+			name:   "plain list",
+			body:   plain,
+			format: SubSourceFormatLinks,
+			nodes:  []string{"vless://id@a.example:443?type=tcp#one", "trojan://pw@b.example:443#two x"},
+		},
+		{
+			name:   "base64 list",
+			body:   base64.StdEncoding.EncodeToString([]byte(plain)),
+			format: SubSourceFormatLinks,
+			nodes:  []string{"vless://id@a.example:443?type=tcp#one", "trojan://pw@b.example:443#two x"},
+		},
+		{
+			name:   "prefixed",
+			body:   plain,
+			prefix: "[up] ",
+			format: SubSourceFormatLinks,
+			nodes:  []string{"vless://id@a.example:443?type=tcp#[up] one", "trojan://pw@b.example:443#[up] two x"},
+		},
+		{
+			name:   "json",
+			body:   `[{"remarks":"one","outbounds":[]},{"remarks":"no outbounds"}]`,
+			prefix: "up-",
+			format: SubSourceFormatJson,
+			nodes:  []string{"up-one"},
+		},
+		{
+			name:   "vmess",
+			body:   vmess,
+			prefix: "up-",
+			format: SubSourceFormatLinks,
+			nodes:  []string{"up-three"},
+		},
+	}
+	s := &SubSourceService{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			format, nodes, count, err := s.parseSubSource([]byte(test.body), test.prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != test.format || count != len(test.nodes) {
+				t.Fatalf("format %q with %d nodes, want %q with %d", format, count, test.format, len(test.nodes))
+			}
+			got := subSourceRemarks(t, format, nodes)
+			if strings.Join(got, "\n") != strings.Join(test.nodes, "\n") {
+				t.Fatalf("nodes %q, want %q", got, test.nodes)
+			}
+		})
+	}
+
+	if _, _, _, err := s.parseSubSource([]byte("nothing here"), ""); err == nil {
+		t.Fatal("a body without nodes was accepted")
+	}
+}
+
+// subSourceRemarks returns the parsed links, with the remarks unescaped, or
+// the remarks of the json and vmess nodes.
+func subSourceRemarks(t *testing.T, format string, nodes string) []string {
+	t.Helper()
+	var remarks []string
+	if format == SubSourceFormatJson {
+		var configs []map[string]any
+		if err := json.Unmarshal([]byte(nodes), &configs); err != nil {
+			t.Fatal(err)
+		}
+		for _, config := range configs {
+			remarks = append(remarks, config["remarks"].(string))
+		}
+		return remarks
+	}
+	for _, link := range strings.Split(nodes, "\n") {
+		if body, ok := strings.CutPrefix(link, "vmess://"); ok {
+			decoded, _ := decodeBase64(body)
+			var obj map[string]any
+			if err := json.Unmarshal([]byte(decoded), &obj); err != nil {
+				t.Fatal(err)
+			}
+			remarks = append(remarks, obj["ps"].(string))
+			continue
+		}
+		base, fragment, _ := strings.Cut(link, "#")
+		remark, err := url.PathUnescape(fragment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		remarks = append(remarks, base+"#"+remark)
+	}
+	return remarks
+}
@@ -0,0 +1,333 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/util/random"
+
+	"gorm.io/gorm"
+)
+
+type SubscriptionService struct {
+	settingService SettingService
+}
+
+// RotateSubId replaces oldSubId with newSubId on every client of every inbound.
+// When graceMinutes is positive the old ID keeps resolving to the new one until
+// the grace period ends; otherwise the old ID stops working immediately.
+// An empty newSubId generates a random one. The new ID is returned.
+func (s *SubscriptionService) RotateSubId(oldSubId string, newSubId string, graceMinutes int) (string, error) {
+	if oldSubId == "" {
+		return "", common.NewError("subId is empty")
+	}
+	if newSubId == "" {
+		newSubId = random.NumLowerSeq(16)
+	}
+	if newSubId == oldSubId {
+		return "", common.NewError("new subId is the same as the old one")
+	}
+	if graceMinutes < 0 {
+		graceMinutes = 0
+	}
+
+	db := database.GetDB()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		inbounds, err := s.getInboundsBySubId(tx, newSubId)
+		if err != nil {
+			return err
+		}
+		if len(inbounds) > 0 {
+			return common.NewError("subId already in use:", newSubId)
+		}
+
+		inbounds, err = s.getInboundsBySubId(tx, oldSubId)
+		if err != nil {
+			return err
+		}
+		if len(inbounds) == 0 {
+			return common.NewError("subId not found:", oldSubId)
+		}
+
+		now := time.Now()
+		for _, inbound := range inbounds {
+			var settings map[string]any
+			err = json.Unmarshal([]byte(inbound.Settings), &settings)
+			if err != nil {
+				return err
+			}
+			clients, ok := settings["clients"].([]any)
+			if !ok {
+				continue
+			}
+			for _, client := range clients {
+				c, ok := client.(map[string]any)
+				if !ok {
+					continue
+				}
+				if c["subId"] == oldSubId {
+					c["subId"] = newSubId
+					c["updated_at"] = now.Unix() * 1000
+				}
+			}
+			settings["clients"] = clients
+			modifiedSettings, err := json.MarshalIndent(settings, "", "  ")
+			if err != nil {
+				return err
+			}
+			err = tx.Model(model.Inbound{}).Where("id = ?", inbound.Id).Update("settings", string(modifiedSettings)).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		// The new ID must never be shadowed by a stale alias.
+		err = tx.Where("old_sub_id = ?", newSubId).Delete(model.SubIdRotation{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("expiry_time > 0 AND expiry_time < ?", now.UnixMilli()).Delete(model.SubIdRotation{}).Error
+		if err != nil {
+			return err
+		}
+
+		if graceMinutes == 0 {
+			return tx.Where("new_sub_id = ?", oldSubId).Delete(model.SubIdRotation{}).Error
+		}
+
+		// Aliases of the old ID follow it to the new one.
+		err = tx.Model(model.SubIdRotation{}).Where("new_sub_id = ?", oldSubId).Update("new_sub_id", newSubId).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&model.SubIdRotation{
+			OldSubId:   oldSubId,
+			NewSubId:   newSubId,
+			ExpiryTime: now.Add(time.Duration(graceMinutes) * time.Minute).UnixMilli(),
+			CreatedAt:  now.UnixMilli(),
+		}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	logger.Infof("subId %s rotated to %s (grace %d min)", oldSubId, newSubId, graceMinutes)
+	return newSubId, nil
+}
+
+// RevokeSubId invalidates subId immediately by rotating it to a random ID.
+func (s *SubscriptionService) RevokeSubId(subId string) (string, error) {
+	return s.RotateSubId(subId, "", 0)
+}
+
+// ResolveSubId returns the current subId for a rotated one that is still in
+// its grace period, or subId itself.
+func (s *SubscriptionService) ResolveSubId(subId string) string {
+	db := database.GetDB()
+	rotation := &model.SubIdRotation{}
+	err := db.Model(model.SubIdRotation{}).Where("old_sub_id = ?", subId).First(rotation).Error
+	if err != nil {
+		return subId
+	}
+	if rotation.ExpiryTime > 0 && rotation.ExpiryTime < time.Now().UnixMilli() {
+		db.Delete(rotation)
+		return subId
+	}
+	return rotation.NewSubId
+}
+
+func (s *SubscriptionService) GetSubIdRotations() ([]*model.SubIdRotation, error) {
+	db := database.GetDB()
+	var rotations []*model.SubIdRotation
+	err := db.Model(model.SubIdRotation{}).Where("expiry_time = 0 OR expiry_time >= ?", time.Now().UnixMilli()).Find(&rotations).Error
+	if err != nil {
+		return nil, err
+	}
+	return rotations, nil
+}
+
+// SignSubId returns the expiry (unix seconds) and signature for a subscription
+// link valid for ttlHours. A non-positive ttlHours uses the configured lifetime.
+func (s *SubscriptionService) SignSubId(subId string, ttlHours int) (int64, string, error) {
+	if ttlHours <= 0 {
+		ttl, err := s.settingService.GetSubSignTTL()
+		if err != nil {
+			return 0, "", err
+		}
+		ttlHours = ttl
+	}
+	secret, err := s.settingService.GetSubSignSecret()
+	if err != nil {
+		return 0, "", err
+	}
+	exp := time.Now().Add(time.Duration(ttlHours) * time.Hour).Unix()
+	return exp, s.sign(secret, subId, exp), nil
+}
+
+// VerifySubSignature checks the exp and sig query values of a signed link.
+func (s *SubscriptionService) VerifySubSignature(subId string, exp string, sig string) bool {
+	if exp == "" || sig == "" {
+		return false
+	}
+	expiry, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || expiry < time.Now().Unix() {
+		return false
+	}
+	secret, err := s.settingService.GetSubSignSecret()
+	if err != nil {
+		logger.Warning("get sub sign secret failed:", err)
+		return false
+	}
+	expected := s.sign(secret, subId, expiry)
+	return hmac.Equal([]byte(expected), []byte(sig))
+}
+
+func (s *SubscriptionService) sign(secret []byte, subId string, exp int64) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(subId + ":" + strconv.FormatInt(exp, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *SubscriptionService) getInboundsBySubId(tx *gorm.DB, subId string) ([]*model.Inbound, error) {
+	var inbounds []*model.Inbound
+	err := tx.Model(model.Inbound{}).Where(`id in (
+		SELECT DISTINCT inbounds.id
+		FROM inbounds,
+			JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client
+		WHERE JSON_EXTRACT(client.value, '$.subId') = ?
+	)`, subId).Find(&inbounds).Error
+	if err != nil {
+		return nil, err
+	}
+	return inbounds, nil
+}
+
+const (
+	subAccessLogQueueSize = 1024
+	subAccessLogBatchSize = 100
+)
+
+var (
+	subAccessLogOnce  sync.Once
+	subAccessLogQueue chan *model.SubAccessLog
+)
+
+// LogSubAccess queues an entry of the subscription access log. The entries are
+// written in batches by one writer, so that a burst of requests does not wait
+// for the database; when the queue is full the entry is dropped.
+func (s *SubscriptionService) LogSubAccess(entry *model.SubAccessLog) {
+	if entry.Time == 0 {
+		entry.Time = time.Now().UnixMilli()
+	}
+	subAccessLogOnce.Do(func() {
+		subAccessLogQueue = make(chan *model.SubAccessLog, subAccessLogQueueSize)
+		go writeSubAccessLogs(subAccessLogQueue)
+	})
+	select {
+	case subAccessLogQueue <- entry:
+	default:
+		logger.Warning("sub access log queue is full, entry dropped")
+	}
+}
+
+// writeSubAccessLogs saves the queued entries, together with those queued
+// while the last batch was saved. The country of the client is resolved here
+// as well, to keep the lookup off the request.
+func writeSubAccessLogs(queue <-chan *model.SubAccessLog) {
+	geoIPService := GeoIPService{}
+	for entry := range queue {
+		batch := []*model.SubAccessLog{entry}
+	collect:
+		for len(batch) < subAccessLogBatchSize {
+			select {
+			case entry := <-queue:
+				batch = append(batch, entry)
+			default:
+				break collect
+			}
+		}
+		for _, entry := range batch {
+			entry.Country = geoIPService.Lookup(entry.Ip).Country
+		}
+		db := database.GetDB()
+		if err := db.Create(batch).Error; err != nil {
+			logger.Warning("save sub access log failed:", err)
+		}
+	}
+}
+
+// GetSubAccessLogs returns the newest access log entries, optionally filtered
+// by subId and ip.
+func (s *SubscriptionService) GetSubAccessLogs(subId string, ip string, limit int) ([]*model.SubAccessLog, error) {
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	db := database.GetDB()
+	query := db.Model(model.SubAccessLog{})
+	if subId != "" {
+		query = query.Where("sub_id = ?", subId)
+	}
+	if ip != "" {
+		query = query.Where("ip = ?", ip)
+	}
+	var logs []*model.SubAccessLog
+	err := query.Order("id desc").Limit(limit).Find(&logs).Error
+	if err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+type SharedSubId struct {
+	SubId     string `json:"subId"`
+	Ips       int    `json:"ips"`
+	Countries int    `json:"countries"`
+	Fetches   int    `json:"fetches"`
+	LastFetch int64  `json:"lastFetch"`
+}
+
+// GetSharedSubIds lists subIds fetched from at least the configured number of
+// distinct IPs or countries during the last 24 hours.
+func (s *SubscriptionService) GetSharedSubIds() ([]*SharedSubId, error) {
+	ipThreshold, err := s.settingService.GetSubShareIpThreshold()
+	if err != nil {
+		return nil, err
+	}
+	countryThreshold, err := s.settingService.GetSubShareCountryThreshold()
+	if err != nil {
+		return nil, err
+	}
+	db := database.GetDB()
+	var shared []*SharedSubId
+	err = db.Model(model.SubAccessLog{}).
+		Select("sub_id, COUNT(DISTINCT ip) AS ips, COUNT(DISTINCT NULLIF(country, '')) AS countries, COUNT(*) AS fetches, MAX(time) AS last_fetch").
+		Where("time > ? AND status = ?", time.Now().Add(-24*time.Hour).UnixMilli(), 200).
+		Group("sub_id").
+		Having("COUNT(DISTINCT ip) >= ? OR COUNT(DISTINCT NULLIF(country, '')) >= ?", ipThreshold, countryThreshold).
+		Order("ips desc").
+		Scan(&shared).Error
+	if err != nil {
+		return nil, err
+	}
+	return shared, nil
+}
+
+func (s *SubscriptionService) ClearSubAccessLogs() error {
+	days, err := s.settingService.GetSubAccessLogDays()
+	if err != nil {
+		return err
+	}
+	if days <= 0 {
+		return nil
+	}
+	db := database.GetDB()
+	return db.Where("time < ?", time.Now().AddDate(0, 0, -days).UnixMilli()).Delete(model.SubAccessLog{}).Error
+}
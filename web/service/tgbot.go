@@ -12,6 +12,7 @@ import (
 	"encoding/xml"  // 【新增】: 用于直接解析 RSS XML 响应体
 	"errors"
 	"fmt"
+	"html"
 	"io/ioutil" // 〔中文注释〕: 新增，用于读取 HTTP API 响应体。
 	"math/big"
 	rng "math/rand" // 用于随机排列
@@ -117,6 +118,13 @@ type Tgbot struct {
 	serverService  *ServerService
 	xrayService    *XrayService
 	lastStatus     *Status
+
+	subscriptionService SubscriptionService
+	deviceLimitService  DeviceLimitService
+	ipLimitService      IPLimitService
+	geoIPService        GeoIPService
+	sharingService      SharingService
+	accessStatsService  AccessStatsService
 }
 
 // 【新增方法】: 用于从外部注入 ServerService 实例
@@ -229,6 +237,14 @@ func (t *Tgbot) Start(i18nFS embed.FS) error {
 			{Command: "oneclick", Description: "🚀 一键配置节点 (有可选项)"},
 			{Command: "subconverter", Description: "🔄 检测或安装订阅转换"},
 			{Command: "restartX", Description: "♻️ 重启〔X-Panel 面板〕"},
+			{Command: "rotatesub", Description: "🔁 轮换订阅ID <subId> [宽限分钟]"},
+			{Command: "revokesub", Description: "⛔ 吊销订阅ID <subId>"},
+			{Command: "devicebans", Description: "🚫 查看设备超限封禁 [unban <email>]"},
+			{Command: "sharing", Description: "🕵️ 查看疑似共享账号 [email]"},
+			{Command: "crashes", Description: "💥 查看 Xray 崩溃记录"},
+			{Command: "xraylog", Description: "🪵 Xray 日志级别 [debug [分钟]|reset|级别|access on/off]"},
+			{Command: "topdest", Description: "🎯 访问最多的目标 [email] [小时]"},
+			{Command: "whohit", Description: "🔎 查询谁访问了某个目标 <域名/IP> [小时]"},
 		},
 	})
 	if err != nil {
@@ -604,6 +620,106 @@ func (t *Tgbot) answerCommand(message *telego.Message, chatId int64, isAdmin boo
 		} else {
 			handleUnknownCommand()
 		}
+	// 〔中文注释〕: 处理 /rotatesub 指令，轮换订阅ID，可选宽限期内旧ID仍可用
+	case "rotatesub":
+		onlyMessage = true
+		if isAdmin {
+			if len(commandArgs) == 0 {
+				msg += "用法：/rotatesub <subId> [宽限分钟]"
+				break
+			}
+			grace := 0
+			if len(commandArgs) > 1 {
+				grace, _ = strconv.Atoi(commandArgs[1])
+			}
+			newSubId, err := t.subscriptionService.RotateSubId(commandArgs[0], "", grace)
+			if err != nil {
+				msg += "❌ 轮换订阅ID失败：" + err.Error()
+			} else {
+				msg += fmt.Sprintf("✅ 订阅ID已轮换\r\n旧ID：%s\r\n新ID：%s\r\n宽限期：%d 分钟", commandArgs[0], newSubId, grace)
+			}
+		} else {
+			handleUnknownCommand()
+		}
+
+	// 〔中文注释〕: 处理 /revokesub 指令，立即吊销订阅ID
+	case "revokesub":
+		onlyMessage = true
+		if isAdmin {
+			if len(commandArgs) == 0 {
+				msg += "用法：/revokesub <subId>"
+				break
+			}
+			newSubId, err := t.subscriptionService.RevokeSubId(commandArgs[0])
+			if err != nil {
+				msg += "❌ 吊销订阅ID失败：" + err.Error()
+			} else {
+				msg += fmt.Sprintf("✅ 订阅ID %s 已吊销\r\n新ID：%s", commandArgs[0], newSubId)
+			}
+		} else {
+			handleUnknownCommand()
+		}
+	// 〔中文注释〕: 处理 /devicebans 指令，列出因设备超限被封禁的用户，或手动解封
+	case "devicebans":
+		onlyMessage = true
+		if isAdmin {
+			if len(commandArgs) >= 2 && commandArgs[0] == "unban" {
+				err := t.deviceLimitService.Unban(commandArgs[1])
+				if err != nil {
+					msg += "❌ 解封失败：" + err.Error()
+				} else {
+					msg += fmt.Sprintf("✅ 用户 %s 已解封", commandArgs[1])
+				}
+				break
+			}
+			msg += t.getDeviceBans()
+		} else {
+			handleUnknownCommand()
+		}
+	// 〔中文注释〕: 处理 /sharing 指令，列出共享评分最高的用户，或查看某个用户的实时评分
+	case "sharing":
+		onlyMessage = true
+		if isAdmin {
+			if len(commandArgs) > 0 {
+				msg += t.getSharingScore(commandArgs[0])
+				break
+			}
+			msg += t.getSharingScores()
+		} else {
+			handleUnknownCommand()
+		}
+	// 〔中文注释〕: 处理 /crashes 指令，查看 Xray 最近的崩溃记录和自动重启状态
+	case "crashes":
+		onlyMessage = true
+		if isAdmin {
+			msg += t.getXrayCrashes()
+		} else {
+			handleUnknownCommand()
+		}
+	// 〔中文注释〕: 处理 /xraylog 指令，查看或临时修改 Xray 日志级别，debug 默认 15 分钟后自动恢复
+	case "xraylog":
+		onlyMessage = true
+		if isAdmin {
+			msg += t.setXrayLog(commandArgs)
+		} else {
+			handleUnknownCommand()
+		}
+	// 〔中文注释〕: 处理 /topdest 指令，查看全部用户或指定用户访问最多的目标
+	case "topdest":
+		onlyMessage = true
+		if isAdmin {
+			msg += t.getTopDestinations(commandArgs)
+		} else {
+			handleUnknownCommand()
+		}
+	// 〔中文注释〕: 处理 /whohit 指令，查询哪些用户访问过某个目标，用于处理机房的滥用投诉
+	case "whohit":
+		onlyMessage = true
+		if isAdmin {
+			msg += t.getDestinationClients(commandArgs)
+		} else {
+			handleUnknownCommand()
+		}
 	default:
 		handleUnknownCommand()
 	}
@@ -613,6 +729,245 @@ func (t *Tgbot) answerCommand(message *telego.Message, chatId int64, isAdmin boo
 	}
 }
 
+// getXrayCrashes 〔中文注释〕: 生成 Xray 崩溃记录的消息文本，只显示最近 5 次。
+func (t *Tgbot) getXrayCrashes() string {
+	crashes, err := t.xrayService.GetXrayCrashes(5)
+	if err != nil {
+		return "❌ 读取崩溃记录失败：" + err.Error()
+	}
+	msg := ""
+	if crashes.Halted {
+		msg += "⛔ Xray 反复崩溃，已停止自动重启，请手动重启\r\n\r\n"
+	} else if crashes.RestartAt > 0 {
+		msg += "⏳ 将于 " + time.Unix(crashes.RestartAt, 0).Format("2006-01-02 15:04:05") + " 自动重启\r\n\r\n"
+	}
+	if len(crashes.Crashes) == 0 {
+		return msg + "✅ 没有 Xray 崩溃记录"
+	}
+	msg += fmt.Sprintf("💥 Xray 崩溃记录（近期 %d 次）\r\n", crashes.RecentCrashes)
+	for _, crash := range crashes.Crashes {
+		lines := strings.Split(crash.LogLines, "\n")
+		if len(lines) > 3 {
+			lines = lines[len(lines)-3:]
+		}
+		msg += fmt.Sprintf("\r\n⏰ %s（运行 %s）\r\n❌ %s\r\n🔑 %s\r\n<pre>%s</pre>\r\n",
+			time.Unix(crash.CreatedAt, 0).Format("2006-01-02 15:04:05"),
+			(time.Duration(crash.Uptime) * time.Second).String(),
+			html.EscapeString(crash.ExitError),
+			shortHash(crash.ConfigHash),
+			html.EscapeString(strings.Join(lines, "\n")))
+	}
+	return msg
+}
+
+// setXrayLog 〔中文注释〕: 按参数修改 Xray 日志设置，并返回当前日志状态的消息文本。
+func (t *Tgbot) setXrayLog(args []string) string {
+	var err error
+	// 〔中文注释〕: 二进制模式下修改日志会重启 Xray，需要在指令末尾加上 confirm 确认
+	restart := len(args) > 0 && args[len(args)-1] == "confirm"
+	if restart {
+		args = args[:len(args)-1]
+	}
+	if len(args) > 0 {
+		switch args[0] {
+		case "debug":
+			minutes := 0
+			if len(args) > 1 {
+				minutes, _ = strconv.Atoi(args[1])
+			}
+			err = t.xrayService.DebugXray(minutes)
+		case "reset":
+			err = t.xrayService.ResetXrayLog(restart)
+		case "access":
+			if len(args) < 2 {
+				return "用法：/xraylog access on|off"
+			}
+			err = t.xrayService.SetXrayLogOverride("", args[1], 0, restart)
+		default:
+			err = t.xrayService.SetXrayLogOverride(args[0], "", 0, restart)
+		}
+	}
+
+	msg := ""
+	if err != nil {
+		msg += "❌ 修改失败：" + err.Error() + "\r\n\r\n"
+	}
+	status := t.xrayService.GetXrayLogStatus()
+	access := status.Access
+	if access == "" {
+		access = "console"
+	}
+	msg += fmt.Sprintf("🪵 Xray 日志级别：%s\r\n📄 访问日志：%s\r\n", status.Level, access)
+	if status.Override != nil {
+		if status.Override.Until > 0 {
+			msg += "⏳ 临时设置，将于 " + time.Unix(status.Override.Until, 0).Format("2006-01-02 15:04:05") + " 自动恢复\r\n"
+		} else {
+			msg += "📌 运行时设置，/xraylog reset 恢复模板设置\r\n"
+		}
+	}
+	if !status.InPlace {
+		msg += "ℹ️ 二进制模式下修改日志设置会重启 Xray，请在指令末尾加上 confirm 确认；临时的 debug 日志仅支持内置核心\r\n"
+	}
+	msg += "\r\n用法：/xraylog debug [分钟] | reset | debug/info/warning/error/none | access on/off [confirm]"
+	return msg
+}
+
+// getTopDestinations 〔中文注释〕: 生成访问最多的目标的消息文本。参数可以是 email 和小时数，顺序不限。
+func (t *Tgbot) getTopDestinations(args []string) string {
+	email := ""
+	hours := 24
+	for _, arg := range args {
+		if n, err := strconv.Atoi(arg); err == nil && n > 0 {
+			hours = n
+		} else {
+			email = arg
+		}
+	}
+	destinations, err := t.accessStatsService.GetTopDestinations(email, hours, 10)
+	if err != nil {
+		return "❌ 读取访问统计失败：" + err.Error()
+	}
+	who := "全部用户"
+	if email != "" {
+		who = html.EscapeString(email)
+	}
+	if len(destinations) == 0 {
+		return fmt.Sprintf("ℹ️ %s 近 %d 小时没有访问统计，请确认已开启目标统计和 Xray 访问日志", who, hours)
+	}
+	msg := fmt.Sprintf("🎯 %s 近 %d 小时访问最多的目标\r\n", who, hours)
+	for i, destination := range destinations {
+		msg += fmt.Sprintf("\r\n%d. %s\r\n   ✅ %d  ⛔ %d  👤 %d  ➡️ %s\r\n",
+			i+1,
+			html.EscapeString(destination.Destination),
+			destination.Accepted,
+			destination.Rejected,
+			destination.Clients,
+			html.EscapeString(destination.Outbounds))
+	}
+	return msg
+}
+
+// getDestinationClients 〔中文注释〕: 生成访问过某个目标的用户列表的消息文本，域名包含其子域名。
+func (t *Tgbot) getDestinationClients(args []string) string {
+	if len(args) == 0 {
+		return "用法：/whohit <域名/IP> [小时]"
+	}
+	hours := 24
+	if len(args) > 1 {
+		if n, err := strconv.Atoi(args[1]); err == nil && n > 0 {
+			hours = n
+		}
+	}
+	clients, err := t.accessStatsService.GetDestinationClients(args[0], hours)
+	if err != nil {
+		return "❌ 读取访问统计失败：" + err.Error()
+	}
+	destination := html.EscapeString(args[0])
+	if len(clients) == 0 {
+		return fmt.Sprintf("✅ 近 %d 小时没有用户访问过 %s", hours, destination)
+	}
+	msg := fmt.Sprintf("🔎 近 %d 小时访问过 %s 的用户：%d 个\r\n", hours, destination, len(clients))
+	for _, client := range clients {
+		email := client.Email
+		if email == "" {
+			email = "（未知用户）"
+		}
+		msg += fmt.Sprintf("\r\n👤 %s\r\n   ✅ %d  ⛔ %d  ➡️ %s\r\n   🎯 %s\r\n   ⏰ %s ~ %s\r\n",
+			html.EscapeString(email),
+			client.Accepted,
+			client.Rejected,
+			html.EscapeString(client.Outbounds),
+			html.EscapeString(client.Destinations),
+			time.Unix(client.FirstHour, 0).Format("2006-01-02 15:00"),
+			time.Unix(client.LastHour, 0).Add(time.Hour).Format("2006-01-02 15:00"))
+	}
+	return msg
+}
+
+// getDeviceBans 〔中文注释〕: 生成设备超限封禁列表的消息文本。
+func (t *Tgbot) getDeviceBans() string {
+	bans, err := t.deviceLimitService.GetBans()
+	if err != nil {
+		return "❌ 读取封禁记录失败：" + err.Error()
+	}
+	if len(bans) == 0 {
+		return "✅ 当前没有因设备超限被封禁的用户"
+	}
+	msg := fmt.Sprintf("🚫 设备超限封禁：%d 个用户\r\n", len(bans))
+	for _, ban := range bans {
+		var ips []string
+		json.Unmarshal([]byte(ban.Ips), &ips)
+		msg += fmt.Sprintf("\r\n👤 %s\r\n⏰ %s\r\n📝 %s (%s)\r\n🌐 %s\r\n",
+			ban.Email,
+			time.Unix(ban.BannedAt, 0).Format("2006-01-02 15:04:05"),
+			ban.Reason,
+			ban.Strategy,
+			strings.Join(ips, ", "))
+		if ban.ExpiresAt > 0 {
+			msg += "⌛ 到期：" + time.Unix(ban.ExpiresAt, 0).Format("2006-01-02 15:04:05") + "\r\n"
+		}
+	}
+	msg += "\r\n用法：/devicebans unban <email>"
+	return msg
+}
+
+// getIPBans 〔中文注释〕: 列出面板自行执行的 IP 限制中当前被屏蔽的 IP。
+func (t *Tgbot) getIPBans() string {
+	if !t.ipLimitService.IsInProcess() {
+		return ""
+	}
+	bans := t.ipLimitService.GetBans()
+	if len(bans) == 0 {
+		return "✅ 当前没有因 IP 超限被屏蔽的 IP"
+	}
+	msg := fmt.Sprintf("🚫 IP 超限屏蔽：%d 个 IP\r\n", len(bans))
+	for _, ban := range bans {
+		msg += fmt.Sprintf("\r\n🌐 %s\r\n👤 %s\r\n⌛ 到期：%s\r\n",
+			ban.Ip,
+			ban.Email,
+			time.Unix(ban.ExpiresAt, 0).Format("2006-01-02 15:04:05"))
+	}
+	return msg
+}
+
+// getSharingScores 〔中文注释〕: 生成共享评分最高的前 20 个用户的消息文本。
+func (t *Tgbot) getSharingScores() string {
+	scores, err := t.sharingService.GetScores()
+	if err != nil {
+		return "❌ 读取共享评分失败：" + err.Error()
+	}
+	if len(scores) == 0 {
+		return "✅ 当前没有疑似共享账号的用户"
+	}
+	msg := fmt.Sprintf("🕵️ 疑似共享账号：%d 个用户\r\n", len(scores))
+	for i, score := range scores {
+		if i == 20 {
+			break
+		}
+		msg += fmt.Sprintf("\r\n👤 %s  📊 %d\r\n📝 %s\r\n", score.Email, score.Score, score.Reasons)
+	}
+	msg += "\r\n用法：/sharing <email>"
+	return msg
+}
+
+// getSharingScore 〔中文注释〕: 实时计算某个用户的共享评分。
+func (t *Tgbot) getSharingScore(email string) string {
+	_, client, err := t.inboundService.GetClientByEmail(email)
+	if err != nil || client == nil {
+		return t.I18nBot("tgbot.noResult")
+	}
+	score, err := t.sharingService.Score(email, client.SubID)
+	if err != nil {
+		return "❌ 计算共享评分失败：" + err.Error()
+	}
+	msg := fmt.Sprintf("👤 %s\r\n📊 共享评分：%d\r\n🌐 网段 / ASN / 国家：%d / %d / %d\r\n🌍 同时在线国家数：%d\r\n✈️ 不可能的行程：%d 次\r\n",
+		email, score.Score, score.Subnets, score.Asns, score.Countries, score.Simultaneous, score.Travels)
+	if score.Reasons != "" {
+		msg += "📝 " + score.Reasons + "\r\n"
+	}
+	return msg
+}
+
 // Helper function to send the message based on onlyMessage flag.
 func (t *Tgbot) sendResponse(chatId int64, msg string, onlyMessage, isAdmin bool) {
 	if onlyMessage {
@@ -2926,6 +3281,10 @@ func (t *Tgbot) searchClientIps(chatId int64, email string, messageID ...int) {
 	output := ""
 	output += t.I18nBot("tgbot.messages.email", "Email=="+email)
 	output += t.I18nBot("tgbot.messages.ips", "IPs=="+ips)
+	// 〔中文注释〕: 附上这个用户的 IP 出现过的国家/地区，便于发现跨地区共享账号。
+	if geo, err := t.geoIPService.GetClientGeo(email); err == nil && len(geo.Countries) > 0 {
+		output += t.I18nBot("tgbot.messages.countries", "Countries=="+FormatCountries(geo.Countries))
+	}
 	output += t.I18nBot("tgbot.messages.refreshedOn", "Time=="+time.Now().Format("2006-01-02 15:04:05"))
 
 	inlineKeyboard := tu.InlineKeyboard(
@@ -3429,6 +3788,11 @@ func (t *Tgbot) sendBanLogs(chatId int64, dt bool) {
 		t.SendMsgToTgbot(chatId, output)
 	}
 
+	// 〔中文注释〕: 面板自行屏蔽 IP 时，先发送当前仍在生效的屏蔽列表。
+	if msg := t.getIPBans(); msg != "" {
+		t.SendMsgToTgbot(chatId, msg)
+	}
+
 	file, err := os.Open(xray.GetIPLimitBannedPrevLogPath())
 	if err == nil {
 		// Check if the file is non-empty before attempting to upload
@@ -3660,7 +4024,7 @@ func (t *Tgbot) randomString(length int, charset string) string {
 
 func (t *Tgbot) handleCallbackQuery(ctx *th.Context, cq telego.CallbackQuery) error {
 	// 1) 确保 Message 可访问 —— 注意必须调用 cq.Message.Message() 而不是直接访问 .Message
-	if cq.Message == nil || cq.Message.Message == nil {
+	if cq.Message == nil || cq.Message.Message() == nil {
 		_ = ctx.Bot().AnswerCallbackQuery(ctx, tu.CallbackQuery(cq.ID).WithText("消息对象不存在"))
 		return nil
 	}
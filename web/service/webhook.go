@@ -0,0 +1,91 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	"x-ui/logger"
+	"x-ui/util/common"
+)
+
+// WebhookEvent is the JSON body posted to the configured webhook URL.
+type WebhookEvent struct {
+	Event string `json:"event"`
+	Host  string `json:"host"`
+	Time  int64  `json:"time"`
+	Data  any    `json:"data"`
+}
+
+type WebhookService struct {
+	settingService SettingService
+}
+
+// Send posts an event to the webhook URL in the background. Nothing is sent
+// when no URL is configured.
+func (s *WebhookService) Send(event string, data any) {
+	url, err := s.settingService.GetWebhookUrl()
+	if err != nil || url == "" {
+		return
+	}
+	go func() {
+		err := s.post(url, event, data)
+		if err != nil {
+			logger.Warningf("send webhook %s failed: %v", event, err)
+		}
+	}()
+}
+
+func (s *WebhookService) post(url string, event string, data any) error {
+	host, _ := os.Hostname()
+	body, err := json.Marshal(&WebhookEvent{
+		Event: event,
+		Host:  host,
+		Time:  time.Now().Unix(),
+		Data:  data,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "X-Panel")
+	req.Header.Set("X-Panel-Event", event)
+
+	// The signature lets the receiver check that the event came from this panel.
+	secret, err := s.settingService.GetWebhookSecret()
+	if err == nil && secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set("X-Panel-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return common.NewError("unexpected status", resp.Status)
+	}
+	return nil
+}
+
+// notifyAdmins sends msg to the bot admins and event with data to the webhook.
+func notifyAdmins(event string, msg string, data any) {
+	tgBot := &Tgbot{}
+	if tgBot.IsRunning() {
+		go tgBot.SendMsgToTgbotAdmins(msg)
+	}
+	webhookService := &WebhookService{}
+	webhookService.Send(event, data)
+}
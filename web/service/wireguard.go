@@ -0,0 +1,199 @@
+package service
+
+import (
+	"encoding/json"
+	"net/netip"
+	"strings"
+
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/util/crypto"
+	"x-ui/util/json_util"
+	"x-ui/xray"
+)
+
+const defaultWireguardAddressPool = "10.0.0.0/24"
+
+// fillWireguardSettings gives every client of a wireguard inbound a keypair and
+// a tunnel address from the inbound's addressPool. The client id is the public
+// key, so that the generic client lookups keep working.
+func (s *InboundService) fillWireguardSettings(inbound *model.Inbound) error {
+	var settings map[string]any
+	err := json.Unmarshal([]byte(inbound.Settings), &settings)
+	if err != nil {
+		return err
+	}
+	clients, _ := settings["clients"].([]any)
+	if len(clients) == 0 {
+		return nil
+	}
+
+	poolStr, _ := settings["addressPool"].(string)
+	if poolStr == "" {
+		poolStr = defaultWireguardAddressPool
+		settings["addressPool"] = poolStr
+	}
+	pool, err := netip.ParsePrefix(poolStr)
+	if err != nil {
+		return common.NewError("invalid wireguard address pool:", poolStr)
+	}
+	pool = pool.Masked()
+
+	// The first host address belongs to the server side of the tunnel.
+	used := map[netip.Addr]bool{pool.Addr().Next(): true}
+	peers, _ := settings["peers"].([]any)
+	for _, entry := range append(peers, clients...) {
+		e, _ := entry.(map[string]any)
+		ips, _ := e["allowedIPs"].([]any)
+		for _, ip := range ips {
+			ipStr, ok := ip.(string)
+			if !ok {
+				return common.NewError("invalid wireguard allowedIPs:", ip)
+			}
+			if prefix, err := netip.ParsePrefix(ipStr); err == nil {
+				used[prefix.Addr()] = true
+			}
+		}
+	}
+
+	for _, client := range clients {
+		c, ok := client.(map[string]any)
+		if !ok {
+			continue
+		}
+		privateKey, _ := c["privateKey"].(string)
+		publicKey, _ := c["publicKey"].(string)
+		switch {
+		case privateKey == "" && publicKey == "":
+			privateKey, publicKey, err = crypto.GenerateWireguardKeypair()
+			if err != nil {
+				return err
+			}
+		case publicKey == "":
+			publicKey, err = crypto.WireguardPublicKey(privateKey)
+			if err != nil {
+				return common.NewError("invalid wireguard private key:", c["email"])
+			}
+		}
+		c["privateKey"] = privateKey
+		c["publicKey"] = publicKey
+		c["id"] = publicKey
+
+		if ips, _ := c["allowedIPs"].([]any); len(ips) > 0 {
+			continue
+		}
+		addr := pool.Addr().Next()
+		for ; pool.Contains(addr); addr = addr.Next() {
+			if !used[addr] {
+				break
+			}
+		}
+		// Skip the broadcast address of IPv4 pools.
+		if !pool.Contains(addr) || (addr.Is4() && !pool.Contains(addr.Next())) {
+			return common.NewError("wireguard address pool is exhausted:", poolStr)
+		}
+		used[addr] = true
+		c["allowedIPs"] = []any{netip.PrefixFrom(addr, addr.BitLen()).String()}
+	}
+
+	newSettings, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	inbound.Settings = string(newSettings)
+	return nil
+}
+
+type wireguardAccount struct {
+	inboundTag string
+	email      string
+	addresses  []string
+}
+
+// wireguardAccounts lists the enabled clients of a wireguard inbound so that
+// their traffic can be counted through dedicated outbounds.
+func (s *XrayService) wireguardAccounts(inbound *model.Inbound, enabled func(email string) bool) []wireguardAccount {
+	clients, err := s.inboundService.GetClients(inbound)
+	if err != nil {
+		return nil
+	}
+	var accounts []wireguardAccount
+	for _, client := range clients {
+		if !client.Enable || client.Email == "" || len(client.AllowedIPs) == 0 || !enabled(client.Email) {
+			continue
+		}
+		accounts = append(accounts, wireguardAccount{
+			inboundTag: inbound.Tag,
+			email:      client.Email,
+			addresses:  client.AllowedIPs,
+		})
+	}
+	return accounts
+}
+
+// addWireguardAccounting routes the traffic of each wireguard client that would
+// leave through the default outbound to a copy of it tagged after the client.
+// Xray has no per-user stats for wireguard, the outbound stats of these copies
+// are booked as client traffic instead. Traffic matched by other routing rules
+// is not counted.
+func (s *XrayService) addWireguardAccounting(xrayConfig *xray.Config, accounts []wireguardAccount) {
+	if len(accounts) == 0 {
+		return
+	}
+	var outbounds []map[string]any
+	if err := json.Unmarshal(xrayConfig.OutboundConfigs, &outbounds); err != nil || len(outbounds) == 0 {
+		logger.Warning("wireguard accounting skipped: no default outbound")
+		return
+	}
+	routing := map[string]any{}
+	if len(xrayConfig.RouterConfig) > 0 {
+		if err := json.Unmarshal(xrayConfig.RouterConfig, &routing); err != nil {
+			logger.Warning("wireguard accounting skipped:", err)
+			return
+		}
+	}
+	rules, _ := routing["rules"].([]any)
+
+	defaultOutbound, _ := json.Marshal(outbounds[0])
+	for _, account := range accounts {
+		tag := xray.WireguardPeerTagPrefix + account.email
+		outbound := map[string]any{}
+		json.Unmarshal(defaultOutbound, &outbound)
+		outbound["tag"] = tag
+		outbounds = append(outbounds, outbound)
+
+		rules = append(rules, map[string]any{
+			"type":        "field",
+			"inboundTag":  []string{account.inboundTag},
+			"source":      account.addresses,
+			"outboundTag": tag,
+		})
+	}
+	routing["rules"] = rules
+
+	newOutbounds, err := json.Marshal(outbounds)
+	if err != nil {
+		return
+	}
+	newRouting, err := json.Marshal(routing)
+	if err != nil {
+		return
+	}
+	xrayConfig.OutboundConfigs = json_util.RawMessage(newOutbounds)
+	xrayConfig.RouterConfig = json_util.RawMessage(newRouting)
+}
+
+// WireguardServerPublicKey returns the public key of a wireguard inbound.
+func WireguardServerPublicKey(inbound *model.Inbound) (string, error) {
+	var settings map[string]any
+	err := json.Unmarshal([]byte(inbound.Settings), &settings)
+	if err != nil {
+		return "", err
+	}
+	secretKey, _ := settings["secretKey"].(string)
+	if strings.TrimSpace(secretKey) == "" {
+		return "", common.NewError("wireguard inbound has no secret key")
+	}
+	return crypto.WireguardPublicKey(secretKey)
+}
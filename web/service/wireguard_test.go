@@ -0,0 +1,84 @@
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"x-ui/database/model"
+)
+
+func TestFillWireguardSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings string
+		// want are the allowedIPs of the clients, empty when it fails.
+		want [][]string
+	}{
+		{
+			name:     "default pool",
+			settings: `{"clients":[{"email":"a"},{"email":"b"}]}`,
+			want:     [][]string{{"10.0.0.2/32"}, {"10.0.0.3/32"}},
+		},
+		{
+			name:     "used addresses are skipped",
+			settings: `{"addressPool":"10.1.0.0/24","peers":[{"allowedIPs":["10.1.0.2/32"]}],"clients":[{"email":"a","allowedIPs":["10.1.0.4/32"]},{"email":"b"},{"email":"c"}]}`,
+			want:     [][]string{{"10.1.0.4/32"}, {"10.1.0.3/32"}, {"10.1.0.5/32"}},
+		},
+		{
+			name:     "ipv6 pool",
+			settings: `{"addressPool":"fd00::/120","clients":[{"email":"a"}]}`,
+			want:     [][]string{{"fd00::2/128"}},
+		},
+		{
+			name:     "exhausted pool",
+			settings: `{"addressPool":"10.2.0.0/30","clients":[{"email":"a"},{"email":"b"}]}`,
+		},
+		{
+			name:     "allowedIPs that are not strings",
+			settings: `{"clients":[{"email":"a","allowedIPs":[1]}]}`,
+		},
+		{
+			name:     "invalid pool",
+			settings: `{"addressPool":"10.0.0.0","clients":[{"email":"a"}]}`,
+		},
+	}
+	s := &InboundService{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inbound := &model.Inbound{Protocol: model.WireGuard, Settings: test.settings}
+			err := s.fillWireguardSettings(inbound)
+			if test.want == nil {
+				if err == nil {
+					t.Fatal("the settings were accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var settings struct {
+				Clients []struct {
+					Id         string   `json:"id"`
+					PrivateKey string   `json:"privateKey"`
+					PublicKey  string   `json:"publicKey"`
+					AllowedIPs []string `json:"allowedIPs"`
+				} `json:"clients"`
+			}
+			if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+				t.Fatal(err)
+			}
+			var got [][]string
+			for _, client := range settings.Clients {
+				if client.PrivateKey == "" || client.PublicKey == "" || client.Id != client.PublicKey {
+					t.Fatalf("client without its keys: %+v", client)
+				}
+				got = append(got, client.AllowedIPs)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("allowedIPs %q, want %q", got, test.want)
+			}
+		})
+	}
+}
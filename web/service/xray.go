@@ -3,34 +3,68 @@ package service
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"html"
+	"os"
 	"runtime"
 	"sync"
     "strconv"
+	"time"
 
+	"x-ui/database/model"
 	"x-ui/logger"
+	"x-ui/util/common"
 	"x-ui/xray"
 	json_util "x-ui/util/json_util"
 
 	"go.uber.org/atomic"
 )
 
+// xrayHealthWindow is how long Xray has to stay up with a new config for it
+// to become the known-good one. Exiting sooner rolls back to the last one.
+const xrayHealthWindow = 10 * time.Second
+
 var (
 	p                 *xray.Process
 	lock              sync.Mutex
 	isNeedXrayRestart atomic.Bool // Indicates that restart was requested for Xray
 	isManuallyStopped atomic.Bool // Indicates that Xray was stopped manually from the panel
 	result            string
+
+	xrayConfigErr   atomic.Error // Why the last config was refused or rolled back
+	healthChecks    atomic.Int32 // Number of new Xray processes still in their health window
+	knownGoodConfig *xray.Config
+	rejectedConfig  *xray.Config // The config that was rolled back from, not retried on its own
+	xrayGeneration  atomic.Uint64 // Counts the configs Xray was started with or changed to through the API
+	xrayAPIClient   xray.APIClient // The API connection shared by the whole panel
 )
 
 type XrayService struct {
-	inboundService InboundService
-	settingService SettingService
-	xrayAPI        xray.XrayAPI
+	inboundService     InboundService
+	settingService     SettingService
+	xrayHistoryService XrayHistoryService
+}
+
+// GetXrayAPI returns the connection to the API of the running Xray that the
+// whole panel shares. It must not be closed.
+func (s *XrayService) GetXrayAPI() (*xray.XrayAPI, error) {
+	return getXrayAPI()
 }
 
-// SetXrayAPI 用于从外部注入 XrayAPI 实例
-func (s *XrayService) SetXrayAPI(api xray.XrayAPI) {
-    s.xrayAPI = api
+func getXrayAPI() (*xray.XrayAPI, error) {
+	if p == nil || !p.IsRunning() {
+		return nil, common.NewError("xray is not running")
+	}
+	return xrayAPIClient.Get(p.GetAPIPort())
+}
+
+// GetXrayAPIStatus returns the health of the shared API connection and the
+// metrics of the calls made through it.
+func (s *XrayService) GetXrayAPIStatus() map[string]any {
+	return map[string]any{
+		"health": xrayAPIClient.Health(),
+		"calls":  xray.GetAPICallStats(),
+	}
 }
 
 // IsXrayRunning 检查 Xray 是否正在运行
@@ -50,15 +84,34 @@ func (s *XrayService) GetApiPort() int {
 	return p.GetAPIPort()
 }
 
+// GetXrayUptime returns how many seconds the running Xray process has been up.
+func (s *XrayService) GetXrayUptime() uint64 {
+	if p == nil {
+		return 0
+	}
+	return p.GetUptime()
+}
 
+// GetXrayGeneration returns a number that changes whenever Xray is started or
+// its inbounds or rules are replaced through the API. Users and rules the
+// panel added at runtime have to be added again then.
+func (s *XrayService) GetXrayGeneration() uint64 {
+	return xrayGeneration.Load()
+}
+
+// GetXrayErr returns why the last config was refused or rolled back, else the
+// error Xray exited with.
 func (s *XrayService) GetXrayErr() error {
+	if err := xrayConfigErr.Load(); err != nil {
+		return err
+	}
 	if p == nil {
 		return nil
 	}
 
 	err := p.GetErr()
 
-	if runtime.GOOS == "windows" && err.Error() == "exit status 1" {
+	if runtime.GOOS == "windows" && err != nil && err.Error() == "exit status 1" {
 		// exit status 1 on Windows means that Xray process was killed
 		// as we kill process to stop in on Windows, this is not an error
 		return nil
@@ -68,6 +121,9 @@ func (s *XrayService) GetXrayErr() error {
 }
 
 func (s *XrayService) GetXrayResult() string {
+	if err := xrayConfigErr.Load(); err != nil {
+		return err.Error()
+	}
 	if result != "" {
 		return result
 	}
@@ -105,7 +161,23 @@ func (s *XrayService) GetXrayConfig() (*xray.Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	return s.buildXrayConfig(templateConfig)
+}
 
+// TestXrayTemplate checks the config generated from a template the way
+// RestartXray does, without touching the running Xray.
+func (s *XrayService) TestXrayTemplate(templateConfig string) error {
+	xrayConfig, err := s.buildXrayConfig(templateConfig)
+	if err != nil {
+		return err
+	}
+	if s.isEmbeddedMode() {
+		return xray.TestEmbeddedConfig(xrayConfig)
+	}
+	return xray.TestConfig(xrayConfig)
+}
+
+func (s *XrayService) buildXrayConfig(templateConfig string) (*xray.Config, error) {
 	xrayConfig := &xray.Config{}
 	if err := json.Unmarshal([]byte(templateConfig), xrayConfig); err != nil {
 		return nil, err
@@ -136,6 +208,16 @@ func (s *XrayService) GetXrayConfig() (*xray.Config, error) {
 		}
 	}
 
+	// 中文注释: 预置的限速阶梯始终生成对应的 level，
+	// 这样客户端在这些档位之间切换时只需通过 API 重新添加用户，无需重启 Xray。
+	ladder, err := s.settingService.GetSpeedLimitLevels()
+	if err != nil {
+		logger.Warning("无法解析预置限速阶梯:", err)
+	}
+	for _, speed := range ladder {
+		uniqueSpeeds[speed] = true
+	}
+
 	// =================================================================
 	// 中文注释: 动态限速核心逻辑 - 第二步: 根据收集到的限速值，动态生成 Policy Levels
 	// =================================================================
@@ -186,17 +268,19 @@ func (s *XrayService) GetXrayConfig() (*xray.Config, error) {
 	policyLevels["0"] = level0
 
 	// 4. 遍历所有收集到的限速值，为每个独立的限速值创建对应的 level
+	// 〔中文注释〕: uplinkOnly/downlinkOnly 在 Xray 中是超时时间而不是速率，
+	// 因此这些 level 只用于给用户分组，策略与 level 0 相同；真正的带宽限制由限速后端（SpeedLimitService）执行。
 	for speed := range uniqueSpeeds {
 		// 为每个速率创建一个 level，level 的名字就是速率的字符串形式
 		// 例如，速率 1024 KB/s 对应 level "1024"
 		policyLevels[strconv.Itoa(speed)] = map[string]interface{}{
-			"downlinkOnly": speed,
-			"uplinkOnly":   speed,
 			"handshake":         4,
 			"connIdle":          300,
+			"uplinkOnly":        0,
+			"downlinkOnly":      0,
 			"statsUserUplink":   true,
 			"statsUserDownlink": true,
-			"statsUserOnline": true,
+			"statsUserOnline":   true,
 		}
 	}
 
@@ -222,6 +306,7 @@ func (s *XrayService) GetXrayConfig() (*xray.Config, error) {
     // 触发一次空调用以处理可能的残留任务	
     s.inboundService.AddTraffic(nil, nil) 
 	
+	var wireguardAccounts []wireguardAccount
 	for _, inbound := range inbounds {
 		if !inbound.Enable {
 			continue
@@ -251,8 +336,23 @@ func (s *XrayService) GetXrayConfig() (*xray.Config, error) {
 			continue
 		}
 
+		// 〔中文注释〕: WireGuard 入站的用户以 peers 形式下发，并为每个用户挂载独立的计量出站
+		if inbound.Protocol == model.WireGuard {
+			clientStats := inbound.ClientStats
+			enabled := func(email string) bool {
+				for _, stat := range clientStats {
+					if stat.Email == email {
+						return stat.Enable
+					}
+				}
+				return true
+			}
+			inboundConfig.Settings = json_util.RawMessage(model.GenWireguardSettings(inbound.Settings, enabled))
+			wireguardAccounts = append(wireguardAccounts, s.wireguardAccounts(inbound, enabled)...)
+		}
+
 		originalClients, ok := settings["clients"].([]interface{})
-		if ok {
+		if ok && inbound.Protocol != model.WireGuard {
 			clientStats := inbound.ClientStats
 
 			var xrayClients []interface{}
@@ -396,9 +496,43 @@ func (s *XrayService) GetXrayConfig() (*xray.Config, error) {
 		xrayConfig.InboundConfigs = append(xrayConfig.InboundConfigs, *inboundConfig)
 	}
 
+	s.addWireguardAccounting(xrayConfig, wireguardAccounts)
+
+	// 〔中文注释〕: 将客户端及其路由套餐的路由策略编译为按用户 (email) 匹配的路由规则
+	s.addClientRouting(xrayConfig, inbounds)
+
+	// 〔中文注释〕: 设备限制的 drop 策略通过 RoutingService 动态添加路由规则，旧模板里需要补上该服务
+	ensureApiService(xrayConfig, "RoutingService")
+
+	// 〔中文注释〕: 运行时临时设置的日志级别和访问日志（如限时调试模式）覆盖模板中的设置
+	applyXrayLogOverride(xrayConfig)
+
 	return xrayConfig, nil
 }
 
+// ensureApiService enables a gRPC service in the api section of the config.
+func ensureApiService(xrayConfig *xray.Config, name string) {
+	if len(xrayConfig.API) == 0 {
+		return
+	}
+	api := map[string]any{}
+	if err := json.Unmarshal(xrayConfig.API, &api); err != nil {
+		return
+	}
+	services, _ := api["services"].([]any)
+	for _, service := range services {
+		if service == name {
+			return
+		}
+	}
+	api["services"] = append(services, name)
+	newApi, err := json.Marshal(api)
+	if err != nil {
+		return
+	}
+	xrayConfig.API = json_util.RawMessage(newApi)
+}
+
 
 func (s *XrayService) GetXrayTraffic() ([]*xray.Traffic, []*xray.ClientTraffic, error) {
 	if !s.IsXrayRunning() {
@@ -406,11 +540,13 @@ func (s *XrayService) GetXrayTraffic() ([]*xray.Traffic, []*xray.ClientTraffic,
 		logger.Debug("Attempted to fetch Xray traffic, but Xray is not running:", err)
 		return nil, nil, err
 	}
-	apiPort := p.GetAPIPort()
-	s.xrayAPI.Init(apiPort)
-	defer s.xrayAPI.Close()
+	xrayApi, err := getXrayAPI()
+	if err != nil {
+		logger.Debug("Failed to connect to Xray API:", err)
+		return nil, nil, err
+	}
 
-	traffic, clientTraffic, err := s.xrayAPI.GetTraffic(true)
+	traffic, clientTraffic, err := xrayApi.GetTraffic(true)
 	if err != nil {
 		logger.Debug("Failed to fetch Xray traffic:", err)
 		return nil, nil, err
@@ -422,6 +558,12 @@ func (s *XrayService) RestartXray(isForce bool) error {
 	lock.Lock()
 	defer lock.Unlock()
 	logger.Debug("restart Xray, force:", isForce)
+	// 中文注释: 崩溃循环后只允许手动重启，手动重启会重新开始统计崩溃次数
+	if isForce {
+		crashLoopHalted.Store(false)
+	} else if crashLoopHalted.Load() && !s.IsXrayRunning() {
+		return common.NewError("xray crashed too often and is only restarted manually")
+	}
 	isManuallyStopped.Store(false)
 
 	xrayConfig, err := s.GetXrayConfig()
@@ -438,35 +580,226 @@ func (s *XrayService) RestartXray(isForce bool) error {
     }
 
 
+	// 中文注释: 刚被回滚的配置不会被自动重试，继续使用最后一次正常运行的配置，直到配置变化或手动重启
+	if !isForce && rejectedConfig != nil && rejectedConfig.Equals(xrayConfig) {
+		if goodConfig := s.getKnownGoodConfig(); goodConfig != nil {
+			xrayConfig = goodConfig
+		}
+	}
+
+	embedded := s.isEmbeddedMode()
 	if s.IsXrayRunning() {
-		if !isForce && p.GetConfig().Equals(xrayConfig) && !isNeedXrayRestart.Load() {
+		if !isForce && p.GetConfig().Equals(xrayConfig) && p.IsEmbedded() == embedded && !isNeedXrayRestart.Load() {
 			logger.Debug("It does not need to restart Xray")
 			return nil
 		}
+	}
+
+	// 中文注释: 替换前先校验新配置，校验失败时保留正在运行的 Xray；
+	// 没有在运行时，使用最后一次正常运行的配置启动
+	testConfig := xray.TestConfig
+	if embedded {
+		testConfig = xray.TestEmbeddedConfig
+	}
+	if err := testConfig(xrayConfig); err != nil {
+		xrayConfigErr.Store(err)
+		logger.Error("refused to restart Xray:", err)
+		s.notifyXrayConfigErr("xray.configInvalid", "新配置校验失败，未重启 Xray", err)
+		if !s.IsXrayRunning() {
+			if goodConfig := s.getKnownGoodConfig(); goodConfig != nil {
+				s.startXray(goodConfig, false)
+			}
+		}
+		return err
+	}
+
+	// 中文注释: 只有入站或路由规则变化时，通过 API 原地替换，不断开其他入站的连接
+	if s.IsXrayRunning() && !isForce && p.IsEmbedded() == embedded && healthChecks.Load() == 0 {
+		if s.hotApplyXray(xrayConfig) {
+			return nil
+		}
+	}
+
+	if s.IsXrayRunning() {
 		p.Stop()
 	}
+	return s.startXray(xrayConfig, true)
+}
 
-	p = xray.NewProcess(xrayConfig)
+// startXray starts Xray with a config. With check, the config becomes the
+// known-good one once Xray stayed up through the health window, and Xray is
+// rolled back when it exits sooner.
+func (s *XrayService) startXray(xrayConfig *xray.Config, check bool) error {
+	if s.isEmbeddedMode() {
+		p = xray.NewEmbeddedProcess(xrayConfig)
+	} else {
+		p = xray.NewProcess(xrayConfig)
+	}
 	result = ""
-	err = p.Start()
+	err := p.Start()
 	if err != nil {
 		return err
 	}
-
+	xrayGeneration.Inc()
+	if check {
+		healthChecks.Inc()
+		go s.checkXrayHealth(p, xrayConfig)
+	}
 	return nil
 }
 
+func (s *XrayService) checkXrayHealth(started *xray.Process, xrayConfig *xray.Config) {
+	defer healthChecks.Dec()
+	for deadline := time.Now().Add(xrayHealthWindow); time.Now().Before(deadline); {
+		time.Sleep(500 * time.Millisecond)
+		if !started.IsRunning() {
+			break
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	// Restarted or stopped in the meantime.
+	if p != started || isManuallyStopped.Load() {
+		return
+	}
+	if started.IsRunning() {
+		s.saveKnownGoodConfig(xrayConfig)
+		rejectedConfig = nil
+		xrayConfigErr.Store(nil)
+		if err := s.xrayHistoryService.RecordApplied(xrayConfig); err != nil {
+			logger.Warning("record applied Xray config failed:", err)
+		}
+		return
+	}
+	s.rollbackXray(started, xrayConfig)
+}
+
+// rollbackXray starts the known-good config after Xray exited right after
+// starting with a new one.
+func (s *XrayService) rollbackXray(failed *xray.Process, failedConfig *xray.Config) {
+	rejectedConfig = failedConfig
+	reason := failed.GetResult()
+	goodConfig := s.getKnownGoodConfig()
+	if goodConfig == nil || goodConfig.Equals(failedConfig) {
+		err := common.NewErrorf("Xray exited within %v of starting: %s; there is no known-good config to roll back to", xrayHealthWindow, reason)
+		xrayConfigErr.Store(err)
+		logger.Error(err)
+		s.notifyXrayConfigErr("xray.rollbackFailed", "Xray 启动后立即退出，没有可回滚的配置", err)
+		return
+	}
+
+	// 中文注释: 没有回滚时由崩溃监控记录
+	saveXrayCrash(failed, 0, false)
+	err := common.NewErrorf("Xray exited within %v of starting: %s; rolled back to the last known-good config", xrayHealthWindow, reason)
+	if startErr := s.startXray(goodConfig, false); startErr != nil {
+		err = common.NewErrorf("Xray exited within %v of starting: %s; rolling back failed: %v", xrayHealthWindow, reason, startErr)
+	}
+	xrayConfigErr.Store(err)
+	logger.Error(err)
+	s.notifyXrayConfigErr("xray.rollback", "Xray 启动后立即退出，已回滚到最后一次正常运行的配置", err)
+}
+
+// isEmbeddedMode reports whether xray-core runs inside the panel.
+func (s *XrayService) isEmbeddedMode() bool {
+	mode, err := s.settingService.GetXrayCoreMode()
+	return err == nil && mode == "embedded"
+}
+
+func (s *XrayService) notifyXrayConfigErr(event string, action string, err error) {
+	msg := fmt.Sprintf(
+		"<b>〔X-Panel面板〕Xray 配置异常</b>\n\n"+
+			"  ------------------------------------\n"+
+			"  ❌ %s\n"+
+			"  ------------------------------------\n\n"+
+			"<b><i>⚠ %s</i></b>",
+		html.EscapeString(err.Error()), action,
+	)
+	notifyAdmins(event, msg, map[string]any{
+		"error": err.Error(),
+	})
+}
+
+// getKnownGoodConfig returns the last config Xray ran fine with, also from
+// before the panel restarted, or nil.
+func (s *XrayService) getKnownGoodConfig() *xray.Config {
+	if knownGoodConfig != nil {
+		return knownGoodConfig
+	}
+	data, err := os.ReadFile(xray.GetKnownGoodConfigPath())
+	if err != nil {
+		return nil
+	}
+	goodConfig := &xray.Config{}
+	if err := json.Unmarshal(data, goodConfig); err != nil {
+		logger.Warning("read known-good Xray config failed:", err)
+		return nil
+	}
+	knownGoodConfig = goodConfig
+	return knownGoodConfig
+}
+
+func (s *XrayService) saveKnownGoodConfig(xrayConfig *xray.Config) {
+	if knownGoodConfig != nil && knownGoodConfig.Equals(xrayConfig) {
+		return
+	}
+	knownGoodConfig = xrayConfig
+	data, err := json.MarshalIndent(xrayConfig, "", "  ")
+	if err == nil {
+		err = os.WriteFile(xray.GetKnownGoodConfigPath(), data, 0o600)
+	}
+	if err != nil {
+		logger.Warning("save known-good Xray config failed:", err)
+	}
+}
+
 func (s *XrayService) StopXray() error {
 	lock.Lock()
 	defer lock.Unlock()
 	isManuallyStopped.Store(true)
 	logger.Debug("Attempting to stop Xray...")
 	if s.IsXrayRunning() {
+		defer xrayAPIClient.Close()
 		return p.Stop()
 	}
 	return errors.New("xray is not running")
 }
 
+// isPolicyLevelLoaded reports whether the running Xray config has a policy
+// level for the given speed limit, so that a user can be added at this level
+// through the API.
+func isPolicyLevelLoaded(level int) bool {
+	if level <= 0 {
+		return true
+	}
+	if p == nil || p.GetConfig() == nil {
+		return false
+	}
+	var policy struct {
+		Levels map[string]any `json:"levels"`
+	}
+	if err := json.Unmarshal(p.GetConfig().Policy, &policy); err != nil {
+		return false
+	}
+	_, ok := policy.Levels[strconv.Itoa(level)]
+	return ok
+}
+
+// ApplyXrayConfig brings the running Xray in line with the database right
+// away when only inbounds or routing rules changed, replacing just those
+// through the API. Anything else is left to a restart.
+func (s *XrayService) ApplyXrayConfig() {
+	lock.Lock()
+	defer lock.Unlock()
+	if s.IsXrayRunning() && healthChecks.Load() == 0 && p.IsEmbedded() == s.isEmbeddedMode() {
+		xrayConfig, err := s.GetXrayConfig()
+		if err == nil && (p.GetConfig().Equals(xrayConfig) || s.hotApplyXray(xrayConfig)) {
+			return
+		}
+	}
+	isNeedXrayRestart.Store(true)
+}
+
 func (s *XrayService) SetToNeedRestart() {
 	isNeedXrayRestart.Store(true)
 }
@@ -475,7 +808,8 @@ func (s *XrayService) IsNeedRestartAndSetFalse() bool {
 	return isNeedXrayRestart.CompareAndSwap(true, false)
 }
 
-// Check if Xray is not running and wasn't stopped manually, i.e. crashed
+// Check if Xray is not running and wasn't stopped manually, i.e. crashed.
+// Exiting within the health window is left to the rollback.
 func (s *XrayService) DidXrayCrash() bool {
-	return !s.IsXrayRunning() && !isManuallyStopped.Load()
+	return !s.IsXrayRunning() && !isManuallyStopped.Load() && healthChecks.Load() == 0
 }
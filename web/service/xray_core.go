@@ -0,0 +1,381 @@
+package service
+
+import (
+	"archive/zip"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+)
+
+// XrayCore is an installed version of the Xray binary.
+type XrayCore struct {
+	Version     string `json:"version"`
+	Active      bool   `json:"active"`
+	Pinned      bool   `json:"pinned"`
+	InstalledAt int64  `json:"installedAt"`
+	Size        int64  `json:"size"`
+}
+
+var (
+	xrayCoreLock sync.Mutex
+	// xrayCoreVersionRegex keeps the version usable as a directory name.
+	xrayCoreVersionRegex = regexp.MustCompile(`^v\d+(\.\d+)*(-[0-9A-Za-z.]+)?$`)
+)
+
+func checkXrayCoreVersion(version string) error {
+	if !xrayCoreVersionRegex.MatchString(version) {
+		return common.NewError("Xray version is not valid:", version)
+	}
+	return nil
+}
+
+// GetXrayCores returns the installed versions of Xray, newest first.
+func (s *ServerService) GetXrayCores() ([]*XrayCore, error) {
+	entries, err := os.ReadDir(xray.GetCoresFolderPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	active := "v" + xray.GetBinaryVersion(xray.GetBinaryPath())
+	pinned, _ := s.settingService.GetXrayCorePinned()
+
+	cores := make([]*XrayCore, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() || checkXrayCoreVersion(entry.Name()) != nil {
+			continue
+		}
+		info, err := os.Stat(xray.GetCoreBinaryPath(entry.Name()))
+		if err != nil {
+			continue
+		}
+		cores = append(cores, &XrayCore{
+			Version:     entry.Name(),
+			Active:      entry.Name() == active,
+			Pinned:      entry.Name() == pinned,
+			InstalledAt: info.ModTime().Unix(),
+			Size:        info.Size(),
+		})
+	}
+	sort.Slice(cores, func(i, j int) bool { return cores[i].InstalledAt > cores[j].InstalledAt })
+	return cores, nil
+}
+
+// InstallXrayCore downloads a version of Xray next to the installed ones,
+// verifying its checksum unless that is turned off. It is not made active.
+func (s *ServerService) InstallXrayCore(version string) error {
+	if err := checkXrayCoreVersion(version); err != nil {
+		return err
+	}
+	zipFileName, err := s.downloadXrayCore(version)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(zipFileName)
+
+	reader, err := zip.OpenReader(zipFileName)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	zipName := "xray"
+	if runtime.GOOS == "windows" {
+		zipName = "xray.exe"
+	}
+	binaryPath := xray.GetCoreBinaryPath(version)
+	if err := os.MkdirAll(filepath.Dir(binaryPath), 0o755); err != nil {
+		return err
+	}
+	zipFile, err := reader.Open(zipName)
+	if err != nil {
+		return err
+	}
+	defer zipFile.Close()
+	if err := writeFileAtomic(binaryPath, zipFile); err != nil {
+		return err
+	}
+
+	if got := xray.GetBinaryVersion(binaryPath); "v"+got != version {
+		os.RemoveAll(filepath.Dir(binaryPath))
+		return common.NewErrorf("downloaded Xray reports version %s instead of %s", got, version)
+	}
+	// The active binary is listed next to it, so that it can be switched back to.
+	if active := "v" + xray.GetBinaryVersion(xray.GetBinaryPath()); checkXrayCoreVersion(active) == nil {
+		if err := keepXrayCore(active); err != nil {
+			logger.Warning("keep active Xray failed:", err)
+		}
+	}
+	logger.Info("Xray", version, "installed")
+	return nil
+}
+
+// downloadXrayCore downloads the release zip of a version from the
+// configured source to a temporary file and returns its name.
+func (s *ServerService) downloadXrayCore(version string) (string, error) {
+	osName := runtime.GOOS
+	arch := runtime.GOARCH
+
+	switch osName {
+	case "darwin":
+		osName = "macos"
+	case "windows":
+		osName = "windows"
+	}
+
+	switch arch {
+	case "amd64":
+		arch = "64"
+	case "arm64":
+		arch = "arm64-v8a"
+	case "armv7":
+		arch = "arm32-v7a"
+	case "armv6":
+		arch = "arm32-v6"
+	case "armv5":
+		arch = "arm32-v5"
+	case "386":
+		arch = "32"
+	case "s390x":
+		arch = "s390x"
+	}
+
+	baseUrl, err := s.settingService.GetXrayCoreDownloadUrl()
+	if err != nil {
+		return "", err
+	}
+	fileName := fmt.Sprintf("Xray-%s-%s.zip", osName, arch)
+	url := fmt.Sprintf("%s/%s/%s", strings.TrimRight(baseUrl, "/"), version, fileName)
+
+	if err := os.MkdirAll(xray.GetCoresFolderPath(), 0o755); err != nil {
+		return "", err
+	}
+	file, err := os.CreateTemp(xray.GetCoresFolderPath(), "download-*.zip")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	client := &http.Client{Timeout: 10 * time.Minute}
+	resp, err := client.Get(url)
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		os.Remove(file.Name())
+		return "", common.NewErrorf("download %s: %s", url, resp.Status)
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), resp.Body); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	verify, err := s.settingService.GetXrayCoreVerifyChecksum()
+	if err == nil && verify {
+		expected, err := fetchXrayCoreChecksum(client, url+".dgst")
+		if err != nil {
+			os.Remove(file.Name())
+			return "", err
+		}
+		if got := hex.EncodeToString(hash.Sum(nil)); got != expected {
+			os.Remove(file.Name())
+			return "", common.NewErrorf("checksum of %s does not match: got %s, expected %s", fileName, got, expected)
+		}
+	}
+	return file.Name(), nil
+}
+
+// fetchXrayCoreChecksum reads the SHA-256 from the .dgst file Xray publishes
+// next to every release zip.
+func fetchXrayCoreChecksum(client *http.Client, url string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", common.NewErrorf("download checksum %s: %s", url, resp.Status)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), "=")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "SHA2-256") {
+			return strings.ToLower(strings.TrimSpace(value)), nil
+		}
+	}
+	return "", common.NewError("no SHA2-256 checksum in", url)
+}
+
+// SwitchXrayCore makes an installed version the active one. It is checked
+// against the current config first and restarted with it; when it does not
+// stay up, the previous version is put back.
+func (s *ServerService) SwitchXrayCore(version string) error {
+	xrayCoreLock.Lock()
+	defer xrayCoreLock.Unlock()
+
+	if err := checkXrayCoreVersion(version); err != nil {
+		return err
+	}
+	if pinned, _ := s.settingService.GetXrayCorePinned(); pinned != "" && pinned != version {
+		return common.NewErrorf("Xray %s is pinned, unpin it to switch to %s", pinned, version)
+	}
+	if s.xrayService.isEmbeddedMode() {
+		return common.NewError("the embedded Xray core can not be switched")
+	}
+	binaryPath := xray.GetCoreBinaryPath(version)
+	if _, err := os.Stat(binaryPath); err != nil {
+		return common.NewErrorf("Xray %s is not installed", version)
+	}
+
+	xrayConfig, err := s.xrayService.GetXrayConfig()
+	if err != nil {
+		return err
+	}
+	if err := xray.TestConfigWithBinary(binaryPath, xrayConfig); err != nil {
+		return common.NewErrorf("Xray %s refused the current config: %v", version, err)
+	}
+
+	// The active binary is kept, so that it can be switched back to.
+	previous := ""
+	if _, err := os.Stat(xray.GetBinaryPath()); err == nil {
+		previous = "v" + xray.GetBinaryVersion(xray.GetBinaryPath())
+		if previous == version {
+			return nil
+		}
+		if checkXrayCoreVersion(previous) == nil {
+			if err := keepXrayCore(previous); err != nil {
+				return err
+			}
+		} else {
+			previous = ""
+		}
+	}
+
+	if err := copyXrayCore(binaryPath, xray.GetBinaryPath()); err != nil {
+		return err
+	}
+	err = s.xrayService.RestartXray(true)
+	if err == nil {
+		err = s.waitXrayHealthy()
+	}
+	if err == nil {
+		logger.Info("switched Xray to", version)
+		return nil
+	}
+
+	if previous == "" {
+		return common.NewErrorf("Xray %s did not start: %v", version, err)
+	}
+	logger.Warningf("Xray %s did not start, switching back to %s: %v", version, previous, err)
+	if restoreErr := copyXrayCore(xray.GetCoreBinaryPath(previous), xray.GetBinaryPath()); restoreErr != nil {
+		return common.NewErrorf("Xray %s did not start: %v; switching back to %s failed: %v", version, err, previous, restoreErr)
+	}
+	if restartErr := s.xrayService.RestartXray(true); restartErr != nil {
+		return common.NewErrorf("Xray %s did not start: %v; %s did not start either: %v", version, err, previous, restartErr)
+	}
+	return common.NewErrorf("Xray %s did not start, switched back to %s: %v", version, previous, err)
+}
+
+// waitXrayHealthy waits for the health window of a restart to pass and
+// reports whether Xray stayed up with the new config.
+func (s *ServerService) waitXrayHealthy() error {
+	time.Sleep(500 * time.Millisecond)
+	for healthChecks.Load() > 0 {
+		time.Sleep(500 * time.Millisecond)
+	}
+	if !s.xrayService.IsXrayRunning() {
+		return common.NewError(s.xrayService.GetXrayResult())
+	}
+	if err := s.xrayService.GetXrayErr(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// keepXrayCore copies the active binary into the directory of its version,
+// when it was installed before versions were kept.
+func keepXrayCore(version string) error {
+	if _, err := os.Stat(xray.GetCoreBinaryPath(version)); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(xray.GetCoreBinaryPath(version)), 0o755); err != nil {
+		return err
+	}
+	return copyXrayCore(xray.GetBinaryPath(), xray.GetCoreBinaryPath(version))
+}
+
+func copyXrayCore(from string, to string) error {
+	file, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return writeFileAtomic(to, file)
+}
+
+// writeFileAtomic replaces an executable by renaming a new file over it, which
+// also works while the old one is running.
+func writeFileAtomic(name string, content io.Reader) error {
+	file, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = io.Copy(file, content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), name)
+}
+
+// PinXrayCore keeps Xray on an installed version: switching to another one is
+// refused until it is unpinned with an empty version.
+func (s *ServerService) PinXrayCore(version string) error {
+	if version != "" {
+		if err := checkXrayCoreVersion(version); err != nil {
+			return err
+		}
+		if _, err := os.Stat(xray.GetCoreBinaryPath(version)); err != nil {
+			return common.NewErrorf("Xray %s is not installed", version)
+		}
+	}
+	return s.settingService.SetXrayCorePinned(version)
+}
+
+// DeleteXrayCore removes an installed version that is neither active nor
+// pinned.
+func (s *ServerService) DeleteXrayCore(version string) error {
+	if err := checkXrayCoreVersion(version); err != nil {
+		return err
+	}
+	if pinned, _ := s.settingService.GetXrayCorePinned(); pinned == version {
+		return common.NewErrorf("Xray %s is pinned", version)
+	}
+	if "v"+xray.GetBinaryVersion(xray.GetBinaryPath()) == version {
+		return common.NewErrorf("Xray %s is active", version)
+	}
+	return os.RemoveAll(filepath.Dir(xray.GetCoreBinaryPath(version)))
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"x-ui/xray"
+)
+
+// xrayReleaseServer serves every release zip with zip as its content and the
+// .dgst file next to it with checksum, or 404 when checksum is empty.
+func xrayReleaseServer(t *testing.T, zip string, checksum string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, ".zip"):
+			w.Write([]byte(zip))
+		case strings.HasSuffix(r.URL.Path, ".zip.dgst") && checksum != "":
+			w.Write([]byte("MD5= 0123\nSHA2-256= " + checksum + "\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDownloadXrayCoreChecksum(t *testing.T) {
+	sum := sha256.Sum256([]byte("release"))
+	good := hex.EncodeToString(sum[:])
+	tests := []struct {
+		name     string
+		checksum string
+		verify   string
+		ok       bool
+	}{
+		{name: "matching checksum", checksum: strings.ToUpper(good), verify: "true", ok: true},
+		{name: "other checksum", checksum: strings.Repeat("0", 64), verify: "true"},
+		{name: "no checksum", verify: "true"},
+		{name: "not verified", checksum: strings.Repeat("0", 64), verify: "false", ok: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			initTestDB(t)
+			server := xrayReleaseServer(t, "release", test.checksum)
+			settings := &SettingService{}
+			if err := settings.setString("xrayCoreDownloadUrl", server.URL+"/releases/"); err != nil {
+				t.Fatal(err)
+			}
+			if err := settings.setString("xrayCoreVerifyChecksum", test.verify); err != nil {
+				t.Fatal(err)
+			}
+
+			s := &ServerService{}
+			name, err := s.downloadXrayCore("v1.2.3")
+			if !test.ok {
+				if err == nil {
+					t.Fatal("the download was accepted")
+				}
+				if left, _ := filepath.Glob(filepath.Join(xray.GetCoresFolderPath(), "download-*")); len(left) > 0 {
+					t.Fatalf("the download was left behind: %q", left)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := os.ReadFile(name); string(data) != "release" {
+				t.Fatalf("downloaded %q", data)
+			}
+		})
+	}
+}
+
+func TestXrayCorePinning(t *testing.T) {
+	initTestDB(t)
+	s := &ServerService{}
+	if err := s.PinXrayCore("v1.2.3"); err == nil {
+		t.Fatal("pinned a version that is not installed")
+	}
+
+	binaryPath := xray.GetCoreBinaryPath("v1.2.3")
+	if err := os.MkdirAll(filepath.Dir(binaryPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(binaryPath, nil, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PinXrayCore("v1.2.3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SwitchXrayCore("v1.2.4"); err == nil || !strings.Contains(err.Error(), "pinned") {
+		t.Fatalf("switching away from the pinned version: %v", err)
+	}
+	if err := s.DeleteXrayCore("v1.2.3"); err == nil {
+		t.Fatal("deleted the pinned version")
+	}
+	if _, err := os.Stat(binaryPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.PinXrayCore(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteXrayCore("v1.2.3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(binaryPath); !os.IsNotExist(err) {
+		t.Fatalf("the unpinned version was not deleted: %v", err)
+	}
+}
+
+func TestCheckXrayCoreVersion(t *testing.T) {
+	for version, ok := range map[string]bool{
+		"v1.8.4":         true,
+		"v25.10.15":      true,
+		"v1.8.4-beta.1":  true,
+		"1.8.4":          false,
+		"v1.8.4/../../x": false,
+		"":               false,
+	} {
+		if err := checkXrayCoreVersion(version); (err == nil) != ok {
+			t.Errorf("version %q: %v", version, err)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+	"x-ui/xray"
+)
+
+// XrayTemplateChange is one difference between two versions of the template.
+// Path is a JSON pointer; Op is add, remove or replace.
+type XrayTemplateChange struct {
+	Path string `json:"path"`
+	Op   string `json:"op"`
+	Old  any    `json:"old,omitempty"`
+	New  any    `json:"new,omitempty"`
+}
+
+// XrayHistoryService keeps every saved version of the Xray config template.
+// Version 0 stands for the template the panel comes with.
+type XrayHistoryService struct{}
+
+var xrayTemplateSeedLock sync.Mutex
+
+// getLatestXrayTemplateVersion returns the version of the template in use.
+func getLatestXrayTemplateVersion() (*model.XrayTemplateVersion, error) {
+	db := database.GetDB()
+	version := &model.XrayTemplateVersion{}
+	err := db.Model(model.XrayTemplateVersion{}).Order("id desc").First(version).Error
+	if database.IsNotFound(err) {
+		return seedXrayTemplateVersion()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// seedXrayTemplateVersion records the embedded template, the one in use before
+// the history existed, as the first version. A template saved in the settings
+// back then was never used, so it is not taken over.
+func seedXrayTemplateVersion() (*model.XrayTemplateVersion, error) {
+	xrayTemplateSeedLock.Lock()
+	defer xrayTemplateSeedLock.Unlock()
+
+	db := database.GetDB()
+	version := &model.XrayTemplateVersion{}
+	err := db.Model(model.XrayTemplateVersion{}).Order("id desc").First(version).Error
+	if !database.IsNotFound(err) {
+		if err != nil {
+			return nil, err
+		}
+		return version, nil
+	}
+	version = &model.XrayTemplateVersion{
+		Template:  xrayTemplateConfig,
+		Comment:   "default",
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := db.Create(version).Error; err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// AddVersion saves a template as the newest version. Nothing is saved when it
+// is the same as the one in use, which is returned instead.
+func (s *XrayHistoryService) AddVersion(template string, author string, comment string) (*model.XrayTemplateVersion, error) {
+	latest, err := getLatestXrayTemplateVersion()
+	if err != nil && !database.IsNotFound(err) {
+		return nil, err
+	}
+	current := xrayTemplateConfig
+	if latest != nil {
+		current = latest.Template
+	}
+	if same, _ := sameJSON(current, template); same && latest != nil {
+		return latest, nil
+	}
+
+	version := &model.XrayTemplateVersion{
+		Template:  template,
+		Author:    author,
+		Comment:   comment,
+		CreatedAt: time.Now().Unix(),
+	}
+	db := database.GetDB()
+	if err := db.Create(version).Error; err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// GetVersions lists the versions without their templates, the newest first.
+func (s *XrayHistoryService) GetVersions() ([]*model.XrayTemplateVersion, error) {
+	if _, err := getLatestXrayTemplateVersion(); err != nil && !database.IsNotFound(err) {
+		return nil, err
+	}
+	db := database.GetDB()
+	var versions []*model.XrayTemplateVersion
+	err := db.Model(model.XrayTemplateVersion{}).Omit("template").Order("id desc").Find(&versions).Error
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+func (s *XrayHistoryService) GetVersion(id int) (*model.XrayTemplateVersion, error) {
+	if id == 0 {
+		return &model.XrayTemplateVersion{Template: xrayTemplateConfig, Comment: "default"}, nil
+	}
+	db := database.GetDB()
+	version := &model.XrayTemplateVersion{}
+	err := db.Model(model.XrayTemplateVersion{}).Where("id = ?", id).First(version).Error
+	if err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// Diff returns what changed from one version to another.
+func (s *XrayHistoryService) Diff(fromId int, toId int) ([]*XrayTemplateChange, error) {
+	from, err := s.GetVersion(fromId)
+	if err != nil {
+		return nil, err
+	}
+	to, err := s.GetVersion(toId)
+	if err != nil {
+		return nil, err
+	}
+	var a, b any
+	if err := json.Unmarshal([]byte(from.Template), &a); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(to.Template), &b); err != nil {
+		return nil, err
+	}
+	changes := []*XrayTemplateChange{}
+	diffJSON("", a, b, &changes)
+	return changes, nil
+}
+
+// diffJSON compares two decoded JSON values. Objects are compared by key and
+// arrays by item, see diffArray.
+func diffJSON(path string, a any, b any, changes *[]*XrayTemplateChange) {
+	switch a := a.(type) {
+	case map[string]any:
+		if b, ok := b.(map[string]any); ok {
+			keys := make([]string, 0, len(a)+len(b))
+			for key := range a {
+				keys = append(keys, key)
+			}
+			for key := range b {
+				if _, ok := a[key]; !ok {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				diffMember(path+"/"+jsonPointerEscape(key), a, b, key, changes)
+			}
+			return
+		}
+	case []any:
+		if b, ok := b.([]any); ok {
+			diffArray(path, a, b, changes)
+			return
+		}
+	}
+	if !reflect.DeepEqual(a, b) {
+		*changes = append(*changes, &XrayTemplateChange{Path: path, Op: "replace", Old: a, New: b})
+	}
+}
+
+// arrayItemKeys are the members that name the items of an array, like the
+// tags of inbounds, outbounds and routing rules.
+var arrayItemKeys = []string{"tag", "ruleTag"}
+
+// diffArray compares two arrays so that adding or moving one item does not
+// report the items after it as changed. Items named by one of arrayItemKeys
+// are matched by name, others by content, and what is left between two
+// matched items by position. Added and changed items have their path in b,
+// removed ones in a.
+func diffArray(path string, a []any, b []any, changes *[]*XrayTemplateChange) {
+	itemPath := func(i int) string {
+		return path + "/" + strconv.Itoa(i)
+	}
+	if key := arrayItemKey(a, b); key != "" {
+		names := make(map[string]int, len(b))
+		for j, item := range b {
+			names[item.(map[string]any)[key].(string)] = j
+		}
+		inA := make(map[string]bool, len(a))
+		for i, item := range a {
+			name := item.(map[string]any)[key].(string)
+			inA[name] = true
+			if j, ok := names[name]; ok {
+				diffJSON(itemPath(j), item, b[j], changes)
+			} else {
+				*changes = append(*changes, &XrayTemplateChange{Path: itemPath(i), Op: "remove", Old: item})
+			}
+		}
+		for j, item := range b {
+			if !inA[item.(map[string]any)[key].(string)] {
+				*changes = append(*changes, &XrayTemplateChange{Path: itemPath(j), Op: "add", New: item})
+			}
+		}
+		return
+	}
+
+	// Longest common subsequence of the equal items.
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if reflect.DeepEqual(a[i], b[j]) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	gap := func(fromA, toA, fromB, toB int) {
+		for k := 0; fromA+k < toA || fromB+k < toB; k++ {
+			i, j := fromA+k, fromB+k
+			switch {
+			case i >= toA:
+				*changes = append(*changes, &XrayTemplateChange{Path: itemPath(j), Op: "add", New: b[j]})
+			case j >= toB:
+				*changes = append(*changes, &XrayTemplateChange{Path: itemPath(i), Op: "remove", Old: a[i]})
+			default:
+				diffJSON(itemPath(j), a[i], b[j], changes)
+			}
+		}
+	}
+	i, j, lastA, lastB := 0, 0, 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case reflect.DeepEqual(a[i], b[j]):
+			gap(lastA, i, lastB, j)
+			i, j = i+1, j+1
+			lastA, lastB = i, j
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	gap(lastA, len(a), lastB, len(b))
+}
+
+// arrayItemKey returns the member of arrayItemKeys that names every item of
+// both arrays, each name used once; or "" when there is none.
+func arrayItemKey(a []any, b []any) string {
+	if len(a) == 0 || len(b) == 0 {
+		return ""
+	}
+	for _, key := range arrayItemKeys {
+		if uniqueItemNames(a, key) && uniqueItemNames(b, key) {
+			return key
+		}
+	}
+	return ""
+}
+
+func uniqueItemNames(items []any, key string) bool {
+	seen := make(map[string]bool, len(items))
+	for _, item := range items {
+		object, ok := item.(map[string]any)
+		if !ok {
+			return false
+		}
+		name, ok := object[key].(string)
+		if !ok || name == "" || seen[name] {
+			return false
+		}
+		seen[name] = true
+	}
+	return true
+}
+
+func diffMember(path string, a map[string]any, b map[string]any, key string, changes *[]*XrayTemplateChange) {
+	oldValue, inA := a[key]
+	newValue, inB := b[key]
+	switch {
+	case !inA:
+		*changes = append(*changes, &XrayTemplateChange{Path: path, Op: "add", New: newValue})
+	case !inB:
+		*changes = append(*changes, &XrayTemplateChange{Path: path, Op: "remove", Old: oldValue})
+	default:
+		diffJSON(path, oldValue, newValue, changes)
+	}
+}
+
+func jsonPointerEscape(key string) string {
+	escaped := ""
+	for _, r := range key {
+		switch r {
+		case '~':
+			escaped += "~0"
+		case '/':
+			escaped += "~1"
+		default:
+			escaped += string(r)
+		}
+	}
+	return escaped
+}
+
+func sameJSON(a string, b string) (bool, error) {
+	var x, y any
+	if err := json.Unmarshal([]byte(a), &x); err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal([]byte(b), &y); err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(x, y), nil
+}
+
+// Rollback makes an earlier version the one in use again, as a new version,
+// so that the rollback itself can be undone.
+func (s *XrayHistoryService) Rollback(id int, author string) (*model.XrayTemplateVersion, error) {
+	version, err := s.GetVersion(id)
+	if err != nil {
+		return nil, err
+	}
+	latest, err := getLatestXrayTemplateVersion()
+	if err == nil {
+		if same, _ := sameJSON(latest.Template, version.Template); same {
+			return nil, common.NewErrorf("version %d is already in use", id)
+		}
+	}
+	return s.AddVersion(version.Template, author, fmt.Sprintf("rollback to #%d", id))
+}
+
+// SetPinned marks a version as known-good. Only one version is pinned.
+func (s *XrayHistoryService) SetPinned(id int, pinned bool) error {
+	db := database.GetDB()
+	tx := db.Begin()
+	var err error
+	defer func() {
+		if err == nil {
+			tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}()
+	if pinned {
+		err = tx.Model(model.XrayTemplateVersion{}).Where("pinned = ?", true).Update("pinned", false).Error
+		if err != nil {
+			return err
+		}
+	}
+	result := tx.Model(model.XrayTemplateVersion{}).Where("id = ?", id).Update("pinned", pinned)
+	err = result.Error
+	if err == nil && result.RowsAffected == 0 {
+		err = common.NewErrorf("version %d does not exist", id)
+	}
+	return err
+}
+
+// RecordApplied stores the hash of the config Xray runs with on the version
+// of the template in use.
+func (s *XrayHistoryService) RecordApplied(xrayConfig *xray.Config) error {
+	latest, err := getLatestXrayTemplateVersion()
+	if database.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	hash := xrayConfigHash(xrayConfig)
+	if latest.ConfigHash == hash {
+		return nil
+	}
+	db := database.GetDB()
+	return db.Model(latest).Updates(map[string]any{
+		"config_hash": hash,
+		"applied_at":  time.Now().Unix(),
+	}).Error
+}
+
+// xrayConfigHash returns the SHA-256 of a generated config.
+func xrayConfigHash(xrayConfig *xray.Config) string {
+	data, _ := json.Marshal(xrayConfig)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
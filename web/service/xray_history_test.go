@@ -0,0 +1,75 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestDiffJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		from string
+		to   string
+		// want is every change as "op path".
+		want []string
+	}{
+		{
+			name: "member changed",
+			from: `{"log":{"loglevel":"warning"},"dns":{}}`,
+			to:   `{"log":{"loglevel":"debug"},"api":{}}`,
+			want: []string{"add /api", "remove /dns", "replace /log/loglevel"},
+		},
+		{
+			name: "rule inserted at the top",
+			from: `{"rules":[{"outboundTag":"a"},{"outboundTag":"b"}]}`,
+			to:   `{"rules":[{"outboundTag":"new"},{"outboundTag":"a"},{"outboundTag":"b"}]}`,
+			want: []string{"add /rules/0"},
+		},
+		{
+			name: "rule removed from the middle",
+			from: `{"rules":[{"outboundTag":"a"},{"outboundTag":"b"},{"outboundTag":"c"}]}`,
+			to:   `{"rules":[{"outboundTag":"a"},{"outboundTag":"c"}]}`,
+			want: []string{"remove /rules/1"},
+		},
+		{
+			name: "rule changed in place",
+			from: `{"rules":[{"outboundTag":"a"},{"outboundTag":"b"},{"outboundTag":"c"}]}`,
+			to:   `{"rules":[{"outboundTag":"a"},{"outboundTag":"x"},{"outboundTag":"c"}]}`,
+			want: []string{"replace /rules/1/outboundTag"},
+		},
+		{
+			name: "outbounds matched by tag",
+			from: `{"outbounds":[{"tag":"direct","protocol":"freedom"},{"tag":"blocked","protocol":"blackhole"}]}`,
+			to:   `{"outbounds":[{"tag":"blocked","protocol":"blackhole"},{"tag":"proxy","protocol":"vless"},{"tag":"direct","protocol":"freedom","settings":{}}]}`,
+			want: []string{"add /outbounds/2/settings", "add /outbounds/1"},
+		},
+		{
+			name: "tags that are not unique",
+			from: `{"outbounds":[{"tag":"a","v":1},{"tag":"a","v":2}]}`,
+			to:   `{"outbounds":[{"tag":"a","v":1},{"tag":"a","v":3}]}`,
+			want: []string{"replace /outbounds/1/v"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var from, to any
+			if err := json.Unmarshal([]byte(test.from), &from); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(test.to), &to); err != nil {
+				t.Fatal(err)
+			}
+			var changes []*XrayTemplateChange
+			diffJSON("", from, to, &changes)
+			var got []string
+			for _, change := range changes {
+				got = append(got, fmt.Sprintf("%s %s", change.Op, change.Path))
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("changes %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+)
+
+// hotApplyXray changes the running Xray to a new config through the API, so
+// that only the connections of the changed inbounds are cut. It returns false
+// when the change takes a restart: anything but the inbounds, the routing
+// rules and, for the embedded core, the log level and access log changed, or
+// the API failed part way.
+func (s *XrayService) hotApplyXray(newConfig *xray.Config) bool {
+	oldConfig := p.GetConfig()
+	a, b := *oldConfig, *newConfig
+	a.InboundConfigs, b.InboundConfigs = nil, nil
+	a.RouterConfig, b.RouterConfig = nil, nil
+	a.LogConfig, b.LogConfig = nil, nil
+	if !a.Equals(&b) {
+		return false
+	}
+	rulesChanged, ok := routingRulesChanged(oldConfig.RouterConfig, newConfig.RouterConfig)
+	if !ok {
+		return false
+	}
+	// The binary reads its log settings only when it starts.
+	logChanged, ok := jsonKeysChanged(oldConfig.LogConfig, newConfig.LogConfig, "loglevel", "access")
+	if !ok || (logChanged && !p.IsEmbedded()) {
+		return false
+	}
+	removed, added, ok := inboundChanges(oldConfig.InboundConfigs, newConfig.InboundConfigs)
+	if !ok {
+		return false
+	}
+	if len(removed) == 0 && len(added) == 0 && !rulesChanged && !logChanged {
+		return false
+	}
+
+	xrayApi, err := getXrayAPI()
+	if err != nil {
+		return false
+	}
+
+	// A changed inbound is removed and added again. When it can not be added,
+	// its old config goes back and the rest is left to a restart.
+	for tag := range removed {
+		if err := xrayApi.DelInbound(tag); err != nil {
+			return hotApplyFailed(common.NewErrorf("remove inbound %s: %v", tag, err))
+		}
+	}
+	for tag, newInbound := range added {
+		if err := addInboundConfig(xrayApi, newInbound); err != nil {
+			if oldInbound, ok := removed[tag]; ok {
+				if restoreErr := addInboundConfig(xrayApi, oldInbound); restoreErr != nil {
+					logger.Warningf("restore inbound %s failed: %v", tag, restoreErr)
+				}
+			}
+			return hotApplyFailed(common.NewErrorf("add inbound %s: %v", tag, err))
+		}
+	}
+	if rulesChanged {
+		if err := xrayApi.ReplaceRules(newConfig.RouterConfig); err != nil {
+			return hotApplyFailed(common.NewErrorf("replace routing rules: %v", err))
+		}
+	}
+
+	if logChanged {
+		if err := p.SetEmbeddedLog(newConfig.LogConfig); err != nil {
+			return hotApplyFailed(common.NewErrorf("change log: %v", err))
+		}
+	}
+
+	if err := p.SetConfig(newConfig); err != nil {
+		logger.Warning("write hot-applied Xray config failed:", err)
+	}
+	// The users and rules the panel changed at runtime are gone with the
+	// replaced inbounds and rules, as after a restart.
+	if len(removed) > 0 || len(added) > 0 || rulesChanged {
+		xrayGeneration.Inc()
+	}
+	s.saveKnownGoodConfig(newConfig)
+	rejectedConfig = nil
+	xrayConfigErr.Store(nil)
+	if err := s.xrayHistoryService.RecordApplied(newConfig); err != nil {
+		logger.Warning("record applied Xray config failed:", err)
+	}
+	logger.Infof("Xray config applied through the API: %d inbounds removed, %d added, routing rules changed: %v, log changed: %v",
+		len(removed), len(added), rulesChanged, logChanged)
+	return true
+}
+
+func hotApplyFailed(err error) bool {
+	logger.Warning("apply Xray config through the API failed, restarting instead:", err)
+	return false
+}
+
+func addInboundConfig(xrayApi *xray.XrayAPI, inbound *xray.InboundConfig) error {
+	data, err := json.Marshal(inbound)
+	if err != nil {
+		return err
+	}
+	return xrayApi.AddInbound(data)
+}
+
+// inboundChanges returns the inbounds to remove and to add by tag, a changed
+// inbound being in both. It returns false when the change can not be made
+// through the API.
+func inboundChanges(oldInbounds []xray.InboundConfig, newInbounds []xray.InboundConfig) (map[string]*xray.InboundConfig, map[string]*xray.InboundConfig, bool) {
+	oldByTag, ok := inboundsByTag(oldInbounds)
+	if !ok {
+		return nil, nil, false
+	}
+	newByTag, ok := inboundsByTag(newInbounds)
+	if !ok {
+		return nil, nil, false
+	}
+	removed := map[string]*xray.InboundConfig{}
+	added := map[string]*xray.InboundConfig{}
+	for tag, oldInbound := range oldByTag {
+		newInbound, ok := newByTag[tag]
+		if ok && oldInbound.Equals(newInbound) {
+			continue
+		}
+		// The panel talks to Xray through the api inbound.
+		if tag == "api" {
+			return nil, nil, false
+		}
+		removed[tag] = oldInbound
+		if ok {
+			added[tag] = newInbound
+		}
+	}
+	for tag, newInbound := range newByTag {
+		if _, ok := oldByTag[tag]; !ok {
+			if tag == "api" {
+				return nil, nil, false
+			}
+			added[tag] = newInbound
+		}
+	}
+	return removed, added, true
+}
+
+// inboundsByTag returns false when a tag is empty or used twice, as such
+// inbounds can not be told apart.
+func inboundsByTag(inbounds []xray.InboundConfig) (map[string]*xray.InboundConfig, bool) {
+	byTag := make(map[string]*xray.InboundConfig, len(inbounds))
+	for i := range inbounds {
+		tag := inbounds[i].Tag
+		if _, ok := byTag[tag]; ok || tag == "" {
+			return nil, false
+		}
+		byTag[tag] = &inbounds[i]
+	}
+	return byTag, true
+}
+
+// routingRulesChanged reports whether the rules or balancers of the routing
+// changed. It returns false for ok when anything else changed, which Xray
+// only reads when it starts.
+func routingRulesChanged(oldRouting []byte, newRouting []byte) (changed bool, ok bool) {
+	return jsonKeysChanged(oldRouting, newRouting, "rules", "balancers")
+}
+
+// jsonKeysChanged reports whether two JSON objects differ. It returns false
+// for ok when they differ in other than the given keys.
+func jsonKeysChanged(oldData []byte, newData []byte, keys ...string) (changed bool, ok bool) {
+	if bytes.Equal(oldData, newData) {
+		return false, true
+	}
+	var a, b map[string]any
+	if json.Unmarshal(oldData, &a) != nil || json.Unmarshal(newData, &b) != nil || a == nil || b == nil {
+		return false, false
+	}
+	if reflect.DeepEqual(a, b) {
+		return false, true
+	}
+	for _, key := range keys {
+		delete(a, key)
+		delete(b, key)
+	}
+	if !reflect.DeepEqual(a, b) {
+		return false, false
+	}
+	return true, true
+}
@@ -0,0 +1,247 @@
+package service
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+)
+
+// xrayDebugMinutes is how long the debug log stays on by default.
+const xrayDebugMinutes = 15
+
+var xrayLogLevels = map[string]bool{
+	"debug":   true,
+	"info":    true,
+	"warning": true,
+	"error":   true,
+	"none":    true,
+}
+
+// XrayLogOverride is a log level or access log set at runtime over those of
+// the template, until it reverts at Until; 0 is never. It is not saved, so a
+// restart of the panel reverts it too.
+type XrayLogOverride struct {
+	Level  string `json:"level,omitempty"`
+	Access string `json:"access,omitempty"`
+	Until  int64  `json:"until"`
+}
+
+// XrayLogStatus is the log of the running Xray. InPlace is set when it can be
+// changed without restarting Xray, which the embedded core can.
+type XrayLogStatus struct {
+	Level    string           `json:"level"`
+	Access   string           `json:"access"`
+	InPlace  bool             `json:"inPlace"`
+	Override *XrayLogOverride `json:"override"`
+}
+
+var (
+	logOverrideLock  sync.Mutex
+	logOverride      *XrayLogOverride
+	logOverrideTimer *time.Timer
+)
+
+// applyXrayLogOverride puts the log settings set at runtime into a config
+// generated from the template.
+func applyXrayLogOverride(xrayConfig *xray.Config) {
+	logOverrideLock.Lock()
+	override := logOverride
+	logOverrideLock.Unlock()
+	if override == nil {
+		return
+	}
+	settings := map[string]any{}
+	json.Unmarshal(xrayConfig.LogConfig, &settings)
+	if settings == nil {
+		settings = map[string]any{}
+	}
+	if override.Level != "" {
+		settings["loglevel"] = override.Level
+	}
+	if override.Access != "" {
+		settings["access"] = override.Access
+	}
+	if data, err := json.Marshal(settings); err == nil {
+		xrayConfig.LogConfig = data
+	}
+}
+
+// SetXrayLogOverride sets the log level and turns the access log "on" or
+// "off" until it reverts after the given minutes, 0 for never. Empty values
+// keep those of the template. The embedded core changes its log in place. The
+// binary has to be restarted, which restart confirms; a change of the binary
+// can not revert by itself, as that would restart it again.
+func (s *XrayService) SetXrayLogOverride(level string, access string, minutes int, restart bool) error {
+	if level != "" && !xrayLogLevels[level] {
+		return common.NewError("log level is not valid:", level)
+	}
+	if minutes < 0 {
+		return common.NewError("duration is not valid:", minutes)
+	}
+	if level == "" && access == "" {
+		logOverrideLock.Lock()
+		unchanged := logOverride == nil
+		logOverrideLock.Unlock()
+		if unchanged {
+			return nil
+		}
+	}
+	if !s.isLogInPlace() {
+		if minutes > 0 {
+			return common.NewError("a log change that reverts by itself needs the embedded Xray core, set it without a duration instead")
+		}
+		if s.IsXrayRunning() && !restart {
+			return common.NewError("changing the log of the Xray binary restarts Xray, confirm to go ahead")
+		}
+	}
+
+	var override *XrayLogOverride
+	if level != "" || access != "" {
+		override = &XrayLogOverride{Level: level}
+		switch access {
+		case "":
+		case "on":
+			override.Access = s.accessLogPath()
+		case "off":
+			override.Access = "none"
+		default:
+			return common.NewError("access log switch is not valid:", access)
+		}
+		if minutes > 0 {
+			override.Until = time.Now().Add(time.Duration(minutes) * time.Minute).Unix()
+		}
+	}
+
+	logOverrideLock.Lock()
+	logOverride = override
+	if logOverrideTimer != nil {
+		logOverrideTimer.Stop()
+		logOverrideTimer = nil
+	}
+	if override != nil && minutes > 0 {
+		logOverrideTimer = time.AfterFunc(time.Duration(minutes)*time.Minute, func() {
+			s.expireXrayLogOverride(override)
+		})
+	}
+	logOverrideLock.Unlock()
+
+	logger.Infof("Xray log set at runtime: %+v", override)
+	return s.applyXrayLog()
+}
+
+// DebugXray turns on the debug log for some minutes, which only the embedded
+// core can.
+func (s *XrayService) DebugXray(minutes int) error {
+	if minutes <= 0 {
+		minutes = xrayDebugMinutes
+	}
+	return s.SetXrayLogOverride("debug", "", minutes, false)
+}
+
+// ResetXrayLog goes back to the log of the template. restart confirms that the
+// binary is restarted for it.
+func (s *XrayService) ResetXrayLog(restart bool) error {
+	return s.SetXrayLogOverride("", "", 0, restart)
+}
+
+func (s *XrayService) expireXrayLogOverride(override *XrayLogOverride) {
+	logOverrideLock.Lock()
+	if logOverride != override {
+		logOverrideLock.Unlock()
+		return
+	}
+	logOverride = nil
+	logOverrideTimer = nil
+	logOverrideLock.Unlock()
+
+	logger.Info("Xray log set at runtime expired, going back to the template")
+	if err := s.applyXrayLog(); err != nil {
+		logger.Warning("revert Xray log failed:", err)
+	}
+}
+
+// applyXrayLog brings the running Xray to the log settings. A stopped Xray
+// takes them when it starts.
+func (s *XrayService) applyXrayLog() error {
+	if !s.IsXrayRunning() {
+		return nil
+	}
+	return s.RestartXray(false)
+}
+
+// accessLogPath returns where the access log goes when it is turned on: the
+// path of the template, else the default one.
+func (s *XrayService) accessLogPath() string {
+	template, err := s.settingService.GetXrayConfigTemplate()
+	if err == nil {
+		var config struct {
+			Log struct {
+				Access string `json:"access"`
+			} `json:"log"`
+		}
+		if json.Unmarshal([]byte(template), &config) == nil &&
+			config.Log.Access != "" && config.Log.Access != "none" {
+			return config.Log.Access
+		}
+	}
+	return "./access.log"
+}
+
+// isLogInPlace reports whether the log of Xray can be changed without
+// restarting it: the running core is the embedded one, or a stopped Xray
+// will start as it.
+func (s *XrayService) isLogInPlace() bool {
+	if s.IsXrayRunning() {
+		return p.IsEmbedded()
+	}
+	return s.isEmbeddedMode()
+}
+
+// GetXrayLogStatus returns the log of the running Xray and what was set at
+// runtime.
+func (s *XrayService) GetXrayLogStatus() *XrayLogStatus {
+	status := &XrayLogStatus{Level: "warning", Access: "none"}
+	var xrayConfig *xray.Config
+	if s.IsXrayRunning() {
+		xrayConfig = p.GetConfig()
+	} else {
+		xrayConfig, _ = s.GetXrayConfig()
+	}
+	status.InPlace = s.isLogInPlace()
+	if xrayConfig != nil {
+		var settings struct {
+			Access   string `json:"access"`
+			LogLevel string `json:"loglevel"`
+		}
+		// Without a log section, there is no access log; an empty path is
+		// the console.
+		if len(xrayConfig.LogConfig) > 0 && json.Unmarshal(xrayConfig.LogConfig, &settings) == nil {
+			if settings.LogLevel != "" {
+				status.Level = settings.LogLevel
+			}
+			status.Access = settings.Access
+		}
+	}
+
+	logOverrideLock.Lock()
+	defer logOverrideLock.Unlock()
+	if logOverride != nil {
+		override := *logOverride
+		status.Override = &override
+	}
+	return status
+}
+
+// RestartXrayLogger opens the log files of Xray again, e.g. after they were
+// rotated.
+func (s *XrayService) RestartXrayLogger() error {
+	xrayApi, err := getXrayAPI()
+	if err != nil {
+		return err
+	}
+	return xrayApi.RestartLogger()
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"x-ui/xray"
+)
+
+// resetXrayLogOverride drops what a test set at runtime.
+func resetXrayLogOverride(t *testing.T) {
+	t.Cleanup(func() {
+		logOverrideLock.Lock()
+		defer logOverrideLock.Unlock()
+		if logOverrideTimer != nil {
+			logOverrideTimer.Stop()
+		}
+		logOverride, logOverrideTimer = nil, nil
+	})
+}
+
+func TestSetXrayLogOverride(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		level   string
+		access  string
+		minutes int
+		ok      bool
+		// log is the log section of a config generated afterwards.
+		log string
+	}{
+		{name: "level", mode: "binary", level: "debug", ok: true, log: `{"access":"none","loglevel":"debug"}`},
+		{name: "access log on", mode: "binary", access: "on", ok: true, log: `{"access":"./access.log","loglevel":"warning"}`},
+		{name: "timed on the binary", mode: "binary", level: "debug", minutes: 5},
+		{name: "timed on the embedded core", mode: "embedded", level: "info", access: "off", minutes: 5, ok: true, log: `{"access":"none","loglevel":"info"}`},
+		{name: "unknown level", mode: "embedded", level: "verbose"},
+		{name: "unknown access switch", mode: "embedded", access: "maybe"},
+		{name: "negative duration", mode: "embedded", level: "debug", minutes: -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			initTestDB(t)
+			resetXrayLogOverride(t)
+			settings := &SettingService{}
+			if err := settings.setString("xrayCoreMode", test.mode); err != nil {
+				t.Fatal(err)
+			}
+
+			s := &XrayService{}
+			err := s.SetXrayLogOverride(test.level, test.access, test.minutes, false)
+			status := s.GetXrayLogStatus()
+			if !test.ok {
+				if err == nil {
+					t.Fatal("the log change was accepted")
+				}
+				if status.Override != nil {
+					t.Fatalf("a refused change was set: %+v", status.Override)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.Override == nil || (status.Override.Until != 0) != (test.minutes > 0) {
+				t.Fatalf("override %+v after a change for %d minutes", status.Override, test.minutes)
+			}
+
+			xrayConfig := &xray.Config{LogConfig: []byte(`{"access":"none","loglevel":"warning"}`)}
+			applyXrayLogOverride(xrayConfig)
+			var got, want any
+			json.Unmarshal(xrayConfig.LogConfig, &got)
+			json.Unmarshal([]byte(test.log), &want)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("log %s, want %s", xrayConfig.LogConfig, test.log)
+			}
+
+			if err := s.ResetXrayLog(false); err != nil {
+				t.Fatal(err)
+			}
+			if status := s.GetXrayLogStatus(); status.Override != nil {
+				t.Fatalf("reset kept %+v", status.Override)
+			}
+		})
+	}
+}
+
+func TestExpireXrayLogOverride(t *testing.T) {
+	initTestDB(t)
+	resetXrayLogOverride(t)
+	settings := &SettingService{}
+	if err := settings.setString("xrayCoreMode", "embedded"); err != nil {
+		t.Fatal(err)
+	}
+	s := &XrayService{}
+	if err := s.SetXrayLogOverride("debug", "", 5, false); err != nil {
+		t.Fatal(err)
+	}
+	first := s.GetXrayLogStatus().Override
+	logOverrideLock.Lock()
+	expiring := logOverride
+	logOverrideLock.Unlock()
+
+	// A newer change is not reverted by the timer of the one it replaced.
+	if err := s.SetXrayLogOverride("info", "", 5, false); err != nil {
+		t.Fatal(err)
+	}
+	s.expireXrayLogOverride(expiring)
+	if status := s.GetXrayLogStatus(); status.Override == nil || status.Override.Level != "info" {
+		t.Fatalf("override %+v after %+v expired, want the newer one kept", status.Override, first)
+	}
+
+	logOverrideLock.Lock()
+	expiring = logOverride
+	logOverrideLock.Unlock()
+	s.expireXrayLogOverride(expiring)
+	if status := s.GetXrayLogStatus(); status.Override != nil {
+		t.Fatalf("override %+v kept after it expired", status.Override)
+	}
+}
@@ -0,0 +1,333 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+
+	"github.com/xtls/xray-core/common/uuid"
+)
+
+// ReconcileReport is what a reconciliation of the users in Xray with the
+// database found and fixed. Users are given as "tag/email".
+type ReconcileReport struct {
+	Time     int64 `json:"time"`
+	Inbounds int   `json:"inbounds"`
+	Users    int   `json:"users"`
+	// Missing are enabled in the database but not in Xray, Extra are in Xray
+	// but not enabled in the database, Changed are in Xray with another
+	// credential than in the database. Updated are the changed users that
+	// were added again with the credential of the database.
+	Missing []string `json:"missing"`
+	Extra   []string `json:"extra"`
+	Changed []string `json:"changed"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Updated []string `json:"updated"`
+	Failed  []string `json:"failed"`
+	// NeedRestart is set when the drift takes a restart of Xray to fix.
+	NeedRestart bool `json:"needRestart"`
+}
+
+// HasDrift reports whether Xray did not match the database.
+func (r *ReconcileReport) HasDrift() bool {
+	return len(r.Missing) > 0 || len(r.Extra) > 0 || len(r.Changed) > 0 || r.NeedRestart
+}
+
+var (
+	reconcileLock sync.Mutex
+	lastReconcile *ReconcileReport
+	// reconcileSeen is the drift of the last run. Drift is only fixed when it
+	// is seen twice in a row, so that changes the panel is still making are
+	// left alone.
+	reconcileSeen = map[string]bool{}
+)
+
+// XrayReconcileService compares the users of the running Xray with the
+// enabled clients in the database and fixes the difference through the API.
+type XrayReconcileService struct {
+	inboundService     InboundService
+	xrayService        XrayService
+	deviceLimitService DeviceLimitService
+}
+
+type reconcileUser struct {
+	protocol string
+	client   map[string]any
+	level    int
+	// credential is the id or password Xray should have, swapped is set while
+	// the device limit swapped it out.
+	credential string
+	swapped    bool
+}
+
+// reconcilable are the protocols whose users Xray can list and change.
+var reconcilable = map[model.Protocol]bool{
+	model.VMESS:       true,
+	model.VLESS:       true,
+	model.Trojan:      true,
+	model.Shadowsocks: true,
+}
+
+func (s *XrayReconcileService) GetLastReport() *ReconcileReport {
+	reconcileLock.Lock()
+	defer reconcileLock.Unlock()
+	return lastReconcile
+}
+
+// Reconcile lists the users of every inbound in Xray, compares them with the
+// database and fixes the drift that was also there on the last run.
+func (s *XrayReconcileService) Reconcile() (*ReconcileReport, error) {
+	reconcileLock.Lock()
+	defer reconcileLock.Unlock()
+
+	if !s.xrayService.IsXrayRunning() || healthChecks.Load() > 0 {
+		return nil, common.NewError("xray is not running")
+	}
+	expected, err := s.expectedUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	xrayApi, err := getXrayAPI()
+	if err != nil {
+		return nil, err
+	}
+	report, seen := reconcileUsers(xrayApi, expected, reconcileSeen)
+	reconcileSeen = seen
+
+	if report.NeedRestart {
+		s.xrayService.SetToNeedRestart()
+	}
+	if len(report.Added) > 0 || len(report.Removed) > 0 || len(report.Updated) > 0 || report.NeedRestart {
+		s.notify(report)
+	}
+	lastReconcile = report
+	return report, nil
+}
+
+// reconcileAPI is the part of the Xray API the reconciliation uses.
+type reconcileAPI interface {
+	GetInboundUsers(tag string) (map[string]string, error)
+	AddUser(protocol string, tag string, user map[string]any) error
+	RemoveUser(tag string, email string) error
+}
+
+// reconcileUsers compares the users in Xray with the expected ones and fixes
+// the drift that is also in lastSeen, the drift of the last run. It returns
+// the report and the drift seen now.
+func reconcileUsers(xrayApi reconcileAPI, expected map[string]map[string]*reconcileUser, lastSeen map[string]bool) (*ReconcileReport, map[string]bool) {
+	report := &ReconcileReport{Time: time.Now().Unix()}
+	seen := map[string]bool{}
+
+	tags := make([]string, 0, len(expected))
+	for tag := range expected {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		users := expected[tag]
+		liveUsers, err := xrayApi.GetInboundUsers(tag)
+		if err != nil {
+			// The inbound itself is missing, only a restart adds it.
+			report.Failed = append(report.Failed, tag+": "+err.Error())
+			seen["inbound:"+tag] = true
+			if lastSeen["inbound:"+tag] {
+				report.NeedRestart = true
+			}
+			continue
+		}
+		report.Inbounds++
+		report.Users += len(liveUsers)
+
+		for email, credential := range liveUsers {
+			if user, ok := users[email]; ok {
+				if !user.swapped && credential != "" && credential != user.credential {
+					fixChanged(xrayApi, tag, email, user, report, lastSeen, seen)
+				}
+				continue
+			}
+			if email == "" {
+				continue
+			}
+			key := tag + "/" + email
+			report.Extra = append(report.Extra, key)
+			seen["extra:"+key] = true
+			if !lastSeen["extra:"+key] {
+				continue
+			}
+			if err := xrayApi.RemoveUser(tag, email); err != nil {
+				report.Failed = append(report.Failed, key+": "+err.Error())
+			} else {
+				report.Removed = append(report.Removed, key)
+			}
+		}
+		for email, user := range users {
+			// The device limit puts swapped users back itself.
+			if _, ok := liveUsers[email]; ok || user.swapped {
+				continue
+			}
+			key := tag + "/" + email
+			report.Missing = append(report.Missing, key)
+			seen["missing:"+key] = true
+			if !lastSeen["missing:"+key] {
+				continue
+			}
+			if !isPolicyLevelLoaded(user.level) {
+				report.NeedRestart = true
+				continue
+			}
+			if err := xrayApi.AddUser(user.protocol, tag, user.client); err != nil {
+				report.Failed = append(report.Failed, key+": "+err.Error())
+			} else {
+				report.Added = append(report.Added, key)
+			}
+		}
+	}
+	sort.Strings(report.Missing)
+	sort.Strings(report.Extra)
+	sort.Strings(report.Changed)
+	return report, seen
+}
+
+// fixChanged adds a user whose credential in Xray is not the one of the
+// database again, when that was also seen on the last run.
+func fixChanged(xrayApi reconcileAPI, tag string, email string, user *reconcileUser, report *ReconcileReport, lastSeen map[string]bool, seen map[string]bool) {
+	key := tag + "/" + email
+	report.Changed = append(report.Changed, key)
+	seen["changed:"+key] = true
+	if !lastSeen["changed:"+key] {
+		return
+	}
+	if !isPolicyLevelLoaded(user.level) {
+		report.NeedRestart = true
+		return
+	}
+	if err := xrayApi.RemoveUser(tag, email); err != nil {
+		report.Failed = append(report.Failed, key+": "+err.Error())
+		return
+	}
+	if err := xrayApi.AddUser(user.protocol, tag, user.client); err != nil {
+		report.Failed = append(report.Failed, key+": "+err.Error())
+		return
+	}
+	report.Updated = append(report.Updated, key)
+}
+
+// expectedUsers returns the users Xray should have per inbound tag: the
+// enabled clients of the enabled inbounds, without those the device limit
+// took out of Xray for now. Clients whose credential the device limit swapped
+// out are expected with any credential.
+func (s *XrayReconcileService) expectedUsers() (map[string]map[string]*reconcileUser, error) {
+	inbounds, err := s.inboundService.GetAllInbounds()
+	if err != nil {
+		return nil, err
+	}
+	bans, err := s.deviceLimitService.GetBans()
+	if err != nil {
+		return nil, err
+	}
+	banned := map[string]bool{}
+	swapped := map[string]bool{}
+	for _, ban := range bans {
+		switch ban.Strategy {
+		case DeviceLimitDisable:
+			banned[ban.Tag+"/"+ban.Email] = true
+		case DeviceLimitSwap, "":
+			swapped[ban.Tag+"/"+ban.Email] = true
+		}
+	}
+
+	expected := map[string]map[string]*reconcileUser{}
+	for _, inbound := range inbounds {
+		if !inbound.Enable || !reconcilable[inbound.Protocol] {
+			continue
+		}
+		clients, err := s.inboundService.GetClients(inbound)
+		if err != nil {
+			continue
+		}
+		disabled := map[string]bool{}
+		for _, stat := range inbound.ClientStats {
+			if !stat.Enable {
+				disabled[stat.Email] = true
+			}
+		}
+		cipher := ""
+		if inbound.Protocol == model.Shadowsocks {
+			var settings map[string]any
+			json.Unmarshal([]byte(inbound.Settings), &settings)
+			cipher, _ = settings["method"].(string)
+		}
+
+		users := map[string]*reconcileUser{}
+		for _, client := range clients {
+			if !client.Enable || client.Email == "" || disabled[client.Email] || banned[inbound.Tag+"/"+client.Email] {
+				continue
+			}
+			flow := client.Flow
+			if flow == "xtls-rprx-vision-udp443" {
+				flow = "xtls-rprx-vision"
+			}
+			credential := client.Password
+			if inbound.Protocol == model.VMESS || inbound.Protocol == model.VLESS {
+				// Xray turns ids that are not UUIDs into one.
+				credential = client.ID
+				if id, err := uuid.ParseString(client.ID); err == nil {
+					credential = id.String()
+				}
+			}
+			users[client.Email] = &reconcileUser{
+				protocol:   string(inbound.Protocol),
+				level:      client.SpeedLimit,
+				credential: credential,
+				swapped:    swapped[inbound.Tag+"/"+client.Email],
+				client: map[string]any{
+					"email":    client.Email,
+					"id":       client.ID,
+					"security": client.Security,
+					"flow":     flow,
+					"password": client.Password,
+					"cipher":   cipher,
+					"level":    client.SpeedLimit,
+				},
+			}
+		}
+		expected[inbound.Tag] = users
+	}
+	return expected, nil
+}
+
+func (s *XrayReconcileService) notify(report *ReconcileReport) {
+	logger.Warningf("Xray users drifted from the database: added %v, removed %v, updated %v, failed %v",
+		report.Added, report.Removed, report.Updated, report.Failed)
+	lines := func(items []string) string {
+		if len(items) == 0 {
+			return "-"
+		}
+		if len(items) > 10 {
+			items = append(items[:10:10], fmt.Sprintf("... (%d)", len(items)))
+		}
+		return html.EscapeString(strings.Join(items, ", "))
+	}
+	msg := fmt.Sprintf(
+		"<b>〔X-Panel面板〕Xray 用户与数据库不一致</b>\n\n"+
+			"  ------------------------------------\n"+
+			"  ➕ 已补充用户：%s\n"+
+			"  ➖ 已移除用户：%s\n"+
+			"  🔁 已更新凭据：%s\n"+
+			"  ❌ 处理失败：%s\n"+
+			"  ------------------------------------\n\n"+
+			"<b><i>⚠ 已通过 API 自动修复</i></b>",
+		lines(report.Added), lines(report.Removed), lines(report.Updated), lines(report.Failed),
+	)
+	notifyAdmins("xray.drift", msg, report)
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// fakeXrayUsers stands in for the users of a running Xray, per inbound tag
+// and email with their credential. An inbound that is not there fails.
+type fakeXrayUsers map[string]map[string]string
+
+func (f fakeXrayUsers) GetInboundUsers(tag string) (map[string]string, error) {
+	users, ok := f[tag]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	copied := make(map[string]string, len(users))
+	for email, credential := range users {
+		copied[email] = credential
+	}
+	return copied, nil
+}
+
+func (f fakeXrayUsers) AddUser(protocol string, tag string, user map[string]any) error {
+	if _, ok := f[tag]; !ok {
+		return errors.New("not found")
+	}
+	email := user["email"].(string)
+	if _, ok := f[tag][email]; ok {
+		return errors.New("already exists")
+	}
+	f[tag][email] = user["password"].(string)
+	return nil
+}
+
+func (f fakeXrayUsers) RemoveUser(tag string, email string) error {
+	if _, ok := f[tag][email]; !ok {
+		return errors.New("not found")
+	}
+	delete(f[tag], email)
+	return nil
+}
+
+func trojanUser(password string) *reconcileUser {
+	return &reconcileUser{
+		protocol:   "trojan",
+		credential: password,
+		client:     map[string]any{"password": password},
+	}
+}
+
+func TestReconcileUsers(t *testing.T) {
+	swapped := trojanUser("a")
+	swapped.swapped = true
+	leveled := trojanUser("a")
+	leveled.level = 5
+
+	tests := []struct {
+		name     string
+		live     fakeXrayUsers
+		expected map[string]*reconcileUser
+		// first and second are the reports of two runs in a row on the same
+		// drift, as "missing", "extra", "changed", then the fixes.
+		first  [6][]string
+		second [6][]string
+		after  map[string]string
+		// restart is whether the second run asks for a restart.
+		restart bool
+	}{
+		{
+			name:     "in sync",
+			live:     fakeXrayUsers{"in": {"a": "a"}},
+			expected: map[string]*reconcileUser{"a": trojanUser("a")},
+			after:    map[string]string{"a": "a"},
+		},
+		{
+			name:     "missing user is added",
+			live:     fakeXrayUsers{"in": {}},
+			expected: map[string]*reconcileUser{"a": trojanUser("a")},
+			first:    [6][]string{{"in/a"}},
+			second:   [6][]string{{"in/a"}, nil, nil, {"in/a"}},
+			after:    map[string]string{"a": "a"},
+		},
+		{
+			name:     "extra user is removed",
+			live:     fakeXrayUsers{"in": {"a": "a", "b": "b"}},
+			expected: map[string]*reconcileUser{"a": trojanUser("a")},
+			first:    [6][]string{nil, {"in/b"}},
+			second:   [6][]string{nil, {"in/b"}, nil, nil, {"in/b"}},
+			after:    map[string]string{"a": "a"},
+		},
+		{
+			name:     "changed user is added again",
+			live:     fakeXrayUsers{"in": {"a": "old"}},
+			expected: map[string]*reconcileUser{"a": trojanUser("a")},
+			first:    [6][]string{nil, nil, {"in/a"}},
+			second:   [6][]string{nil, nil, {"in/a"}, nil, nil, {"in/a"}},
+			after:    map[string]string{"a": "a"},
+		},
+		{
+			name:     "unknown credential is not compared",
+			live:     fakeXrayUsers{"in": {"a": ""}},
+			expected: map[string]*reconcileUser{"a": trojanUser("a")},
+			after:    map[string]string{"a": ""},
+		},
+		{
+			name:     "swapped user keeps its credential",
+			live:     fakeXrayUsers{"in": {"a": "swap"}},
+			expected: map[string]*reconcileUser{"a": swapped},
+			after:    map[string]string{"a": "swap"},
+		},
+		{
+			name:     "swapped user out of Xray is left to the device limit",
+			live:     fakeXrayUsers{"in": {}},
+			expected: map[string]*reconcileUser{"a": swapped},
+			after:    map[string]string{},
+		},
+		{
+			name:     "user of an unloaded level takes a restart",
+			live:     fakeXrayUsers{"in": {}},
+			expected: map[string]*reconcileUser{"a": leveled},
+			first:    [6][]string{{"in/a"}},
+			second:   [6][]string{{"in/a"}},
+			after:    map[string]string{},
+			restart:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expected := map[string]map[string]*reconcileUser{"in": test.expected}
+			for email, user := range test.expected {
+				user.client["email"] = email
+			}
+
+			report, seen := reconcileUsers(test.live, expected, map[string]bool{})
+			if got := reportLists(report); !reflect.DeepEqual(got, test.first) {
+				t.Fatalf("first run reported %q, want %q", got, test.first)
+			}
+			if report.NeedRestart {
+				t.Fatal("first run asked for a restart")
+			}
+			if len(report.Added)+len(report.Removed)+len(report.Updated) > 0 {
+				t.Fatal("first run fixed the drift")
+			}
+
+			report, _ = reconcileUsers(test.live, expected, seen)
+			if got := reportLists(report); !reflect.DeepEqual(got, test.second) {
+				t.Fatalf("second run reported %q, want %q", got, test.second)
+			}
+			if report.NeedRestart != test.restart {
+				t.Fatalf("second run restart = %v, want %v", report.NeedRestart, test.restart)
+			}
+			if !reflect.DeepEqual(test.live["in"], test.after) {
+				t.Fatalf("users in Xray %q, want %q", test.live["in"], test.after)
+			}
+		})
+	}
+}
+
+func TestReconcileUsersMissingInbound(t *testing.T) {
+	expected := map[string]map[string]*reconcileUser{"gone": {}}
+	report, seen := reconcileUsers(fakeXrayUsers{}, expected, map[string]bool{})
+	if report.NeedRestart || len(report.Failed) != 1 {
+		t.Fatalf("first run: restart %v, failed %q", report.NeedRestart, report.Failed)
+	}
+	report, _ = reconcileUsers(fakeXrayUsers{}, expected, seen)
+	if !report.NeedRestart {
+		t.Fatal("an inbound missing twice did not ask for a restart")
+	}
+}
+
+// reportLists returns the missing, extra and changed users of a report, then
+// the added, removed and updated ones, each sorted and nil when empty.
+func reportLists(report *ReconcileReport) [6][]string {
+	lists := [6][]string{report.Missing, report.Extra, report.Changed, report.Added, report.Removed, report.Updated}
+	for i, list := range lists {
+		if len(list) == 0 {
+			lists[i] = nil
+			continue
+		}
+		sort.Strings(list)
+	}
+	return lists
+}
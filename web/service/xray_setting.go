@@ -10,13 +10,17 @@ import (
 
 type XraySettingService struct {
 	SettingService
+	xrayHistoryService XrayHistoryService
 }
 
-func (s *XraySettingService) SaveXraySetting(newXraySettings string) error {
+// SaveXraySetting saves the template as a new version in the history, which
+// makes it the one in use.
+func (s *XraySettingService) SaveXraySetting(newXraySettings string, author string, comment string) error {
 	if err := s.CheckXrayConfig(newXraySettings); err != nil {
 		return err
 	}
-	return s.SettingService.saveSetting("xrayTemplateConfig", newXraySettings)
+	_, err := s.xrayHistoryService.AddVersion(newXraySettings, author, comment)
+	return err
 }
 
 func (s *XraySettingService) CheckXrayConfig(XrayTemplateConfig string) error {
@@ -0,0 +1,218 @@
+package service
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+
+	"go.uber.org/atomic"
+)
+
+const (
+	// The first restart after a crash waits crashRestartBaseDelay, every
+	// further one twice as long, up to crashRestartMaxDelay.
+	crashRestartBaseDelay = 2 * time.Second
+	crashRestartMaxDelay  = 5 * time.Minute
+	// After Xray ran this long, the next crash is restarted without delay
+	// again.
+	xrayStableUptime = 5 * time.Minute
+	// maxXrayCrashes is how many crash reports are kept.
+	maxXrayCrashes = 200
+)
+
+var (
+	supervisorLock sync.Mutex
+	// supervised is the process whose crash was recorded last.
+	supervised      *xray.Process
+	crashTimes      []time.Time
+	restartAttempts int
+	restartAt       time.Time
+	// crashLoopHalted is set when Xray crashed too often to be restarted
+	// again. Only a manual restart starts it.
+	crashLoopHalted atomic.Bool
+)
+
+// XrayCrashes is the state of the supervisor with the latest crash reports.
+type XrayCrashes struct {
+	Halted bool `json:"halted"`
+	// RestartAt is when the crashed Xray is restarted, or 0.
+	RestartAt     int64              `json:"restartAt"`
+	RecentCrashes int                `json:"recentCrashes"`
+	Crashes       []*model.XrayCrash `json:"crashes"`
+}
+
+// SuperviseXray restarts Xray when it crashed, waiting longer after every
+// crash. When it crashed the configured number of times within the crash loop
+// window, it is left stopped and the admins are alerted.
+func (s *XrayService) SuperviseXray() {
+	if !supervisorLock.TryLock() {
+		return
+	}
+	defer supervisorLock.Unlock()
+
+	if !s.DidXrayCrash() {
+		if restartAttempts > 0 && s.IsXrayRunning() && time.Duration(p.GetUptime())*time.Second >= xrayStableUptime {
+			restartAttempts = 0
+		}
+		return
+	}
+	if crashLoopHalted.Load() {
+		return
+	}
+
+	crashed := p
+	if crashed != supervised {
+		supervised = crashed
+		s.handleCrash(crashed)
+		return
+	}
+	if time.Now().Before(restartAt) {
+		return
+	}
+	if err := s.RestartXray(false); err != nil {
+		logger.Error("Restart xray failed:", err)
+	}
+	// Nothing was started, e.g. the config was refused: try again later.
+	if p == crashed {
+		restartAt = time.Now().Add(nextRestartDelay())
+	}
+}
+
+func nextRestartDelay() time.Duration {
+	delay := crashRestartBaseDelay << min(restartAttempts, 16)
+	restartAttempts++
+	return min(delay, crashRestartMaxDelay)
+}
+
+func (s *XrayService) handleCrash(crashed *xray.Process) {
+	count, err := s.settingService.GetXrayCrashLoopCount()
+	if err != nil || count < 2 {
+		count = 5
+	}
+	minutes, err := s.settingService.GetXrayCrashLoopMinutes()
+	if err != nil || minutes <= 0 {
+		minutes = 10
+	}
+
+	now := time.Now()
+	if recordCrash(now, time.Duration(minutes)*time.Minute) >= count {
+		crash := saveXrayCrash(crashed, 0, true)
+		crashTimes = nil
+		restartAttempts = 0
+		crashLoopHalted.Store(true)
+		err := common.NewErrorf("Xray crashed %d times within %d minutes and is no longer restarted: %s", count, minutes, crashReason(crashed))
+		xrayConfigErr.Store(err)
+		logger.Error(err)
+		s.notifyCrashLoop(count, minutes, crash)
+		return
+	}
+
+	delay := nextRestartDelay()
+	restartAt = now.Add(delay)
+	saveXrayCrash(crashed, int(delay.Seconds()), false)
+	logger.Warningf("Xray crashed (%d within %d minutes), restarting in %v: %s", len(crashTimes), minutes, delay, crashReason(crashed))
+}
+
+// recordCrash adds a crash at now to the crashes within the window before it
+// and returns how many there are.
+func recordCrash(now time.Time, window time.Duration) int {
+	recent := crashTimes[:0]
+	for _, t := range crashTimes {
+		if t.After(now.Add(-window)) {
+			recent = append(recent, t)
+		}
+	}
+	crashTimes = append(recent, now)
+	return len(crashTimes)
+}
+
+func crashReason(crashed *xray.Process) string {
+	if reason := crashed.GetResult(); reason != "" {
+		return reason
+	}
+	return "exited"
+}
+
+// saveXrayCrash stores the report of a crash, dropping the oldest beyond
+// maxXrayCrashes.
+func saveXrayCrash(crashed *xray.Process, restartDelay int, crashLoop bool) *model.XrayCrash {
+	crash := &model.XrayCrash{
+		CreatedAt:    time.Now().Unix(),
+		Version:      crashed.GetVersion(),
+		Embedded:     crashed.IsEmbedded(),
+		Uptime:       crashed.GetUptime(),
+		ExitError:    crashReason(crashed),
+		LogLines:     strings.Join(crashed.GetRecentLogs(), "\n"),
+		RestartDelay: restartDelay,
+		CrashLoop:    crashLoop,
+	}
+	if crashed.GetConfig() != nil {
+		crash.ConfigHash = xrayConfigHash(crashed.GetConfig())
+	}
+	db := database.GetDB()
+	if err := db.Create(crash).Error; err != nil {
+		logger.Warning("save Xray crash report failed:", err)
+		return crash
+	}
+	db.Where("id <= ?", crash.Id-maxXrayCrashes).Delete(&model.XrayCrash{})
+	return crash
+}
+
+// GetXrayCrashes returns the state of the supervisor and the latest crash
+// reports, newest first.
+func (s *XrayService) GetXrayCrashes(limit int) (*XrayCrashes, error) {
+	if limit <= 0 || limit > maxXrayCrashes {
+		limit = maxXrayCrashes
+	}
+	crashes := make([]*model.XrayCrash, 0)
+	err := database.GetDB().Model(model.XrayCrash{}).Order("id desc").Limit(limit).Find(&crashes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	supervisorLock.Lock()
+	defer supervisorLock.Unlock()
+	result := &XrayCrashes{
+		Halted:        crashLoopHalted.Load(),
+		RecentCrashes: len(crashTimes),
+		Crashes:       crashes,
+	}
+	if !result.Halted && s.DidXrayCrash() && p == supervised {
+		result.RestartAt = restartAt.Unix()
+	}
+	return result, nil
+}
+
+func (s *XrayService) notifyCrashLoop(count int, minutes int, crash *model.XrayCrash) {
+	lastLines := crash.LogLines
+	if lines := strings.Split(lastLines, "\n"); len(lines) > 5 {
+		lastLines = strings.Join(lines[len(lines)-5:], "\n")
+	}
+	msg := fmt.Sprintf(
+		"<b>〔X-Panel面板〕Xray 反复崩溃，已停止自动重启</b>\n\n"+
+			"  ------------------------------------\n"+
+			"  💥 %d 分钟内崩溃 %d 次\n"+
+			"  ❌ %s\n"+
+			"  🔑 配置：%s\n"+
+			"  ------------------------------------\n"+
+			"<pre>%s</pre>\n\n"+
+			"<b><i>⚠ 请检查配置或内核版本后手动重启 Xray</i></b>",
+		minutes, count, html.EscapeString(crash.ExitError), shortHash(crash.ConfigHash), html.EscapeString(lastLines),
+	)
+	notifyAdmins("xray.crashLoop", msg, crash)
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordCrash(t *testing.T) {
+	oldTimes := crashTimes
+	t.Cleanup(func() { crashTimes = oldTimes })
+	crashTimes = nil
+
+	start := time.Now()
+	window := 10 * time.Minute
+	steps := []struct {
+		at   time.Duration
+		want int
+	}{
+		{at: 0, want: 1},
+		{at: time.Minute, want: 2},
+		{at: 9 * time.Minute, want: 3},
+		// The first crash is out of the window now.
+		{at: 10 * time.Minute, want: 3},
+		{at: 11 * time.Minute, want: 3},
+		{at: 30 * time.Minute, want: 1},
+	}
+	for _, step := range steps {
+		if got := recordCrash(start.Add(step.at), window); got != step.want {
+			t.Fatalf("crash after %v: %d within the window, want %d", step.at, got, step.want)
+		}
+	}
+}
+
+func TestNextRestartDelay(t *testing.T) {
+	oldAttempts := restartAttempts
+	t.Cleanup(func() { restartAttempts = oldAttempts })
+	restartAttempts = 0
+
+	want := crashRestartBaseDelay
+	for i := 0; i < 20; i++ {
+		if got := nextRestartDelay(); got != want {
+			t.Fatalf("restart %d waits %v, want %v", i+1, got, want)
+		}
+		want = min(want*2, crashRestartMaxDelay)
+	}
+	if want != crashRestartMaxDelay {
+		t.Fatalf("the delay did not reach its maximum: %v", want)
+	}
+}
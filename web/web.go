@@ -316,6 +316,27 @@ func (s *Server) startTask() {
 	// check client ips from log file every day
 	s.cron.AddJob("@daily", job.NewClearLogsJob())
 
+	// Drop subscription access logs past their retention every day
+	s.cron.AddJob("@daily", job.NewClearSubAccessLogJob())
+
+	// Count the destinations of the clients from the access log every 1 minute
+	s.cron.AddJob("@every 1m", job.NewAccessStatsJob())
+
+	// Drop destination statistics past their retention every day
+	s.cron.AddJob("@daily", job.NewClearAccessStatsJob())
+
+	// Score clients for account sharing every 5 minutes
+	s.cron.AddJob("@every 5m", job.NewSharingDetectJob())
+
+	// Reconcile the users of Xray with the database every minute
+	s.cron.AddJob("@every 1m", job.NewXrayReconcileJob())
+
+	// Apply client bandwidth limits for the current client IPs every 30 sec
+	s.cron.AddJob("@every 30s", job.NewSpeedLimitJob())
+
+	// Refresh upstream subscription sources that are due every 1 minute
+	s.cron.AddJob("@every 1m", job.NewSubSourceJob())
+
 	// Sync v2board users every 1 minute
 	s.cron.AddJob("@every 1m", job.NewV2boardSyncJob())
 
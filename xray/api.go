@@ -5,13 +5,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"regexp"
+	"strings"
 	"time"
 	"math"
 
 	"x-ui/logger"
 	"x-ui/util/common"
 
+	logService "github.com/xtls/xray-core/app/log/command"
 	"github.com/xtls/xray-core/app/proxyman/command"
+	routerService "github.com/xtls/xray-core/app/router/command"
 	statsService "github.com/xtls/xray-core/app/stats/command"
 	"github.com/xtls/xray-core/common/protocol"
 	"github.com/xtls/xray-core/common/serial"
@@ -22,23 +25,38 @@ import (
 	"github.com/xtls/xray-core/proxy/vless"
 	"github.com/xtls/xray-core/proxy/vmess"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
+// WireguardPeerTagPrefix marks the outbounds that count the traffic of a
+// wireguard client; their stats are reported as traffic of that client.
+const WireguardPeerTagPrefix = "wgpeer-"
+
 type XrayAPI struct {
 	HandlerServiceClient *command.HandlerServiceClient
 	StatsServiceClient   *statsService.StatsServiceClient
+	RoutingServiceClient *routerService.RoutingServiceClient
+	LoggerServiceClient  *logService.LoggerServiceClient
 	grpcClient           *grpc.ClientConn
 	isConnected          bool
 }
 
 func (x *XrayAPI) Init(apiPort int) error {
-	if apiPort <= 0 || apiPort > math.MaxUint16 {
-		return fmt.Errorf("invalid Xray API port: %d", apiPort)
+	var conn *grpc.ClientConn
+	var err error
+	// The embedded core has no API port.
+	if listener := embeddedAPIListener(); listener != nil {
+		conn, err = dialEmbeddedAPI(listener)
+	} else {
+		if apiPort <= 0 || apiPort > math.MaxUint16 {
+			return fmt.Errorf("invalid Xray API port: %d", apiPort)
+		}
+		addr := fmt.Sprintf("127.0.0.1:%d", apiPort)
+		opts := append(apiDialOptions(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		conn, err = grpc.NewClient(addr, opts...)
 	}
-
-	addr := fmt.Sprintf("127.0.0.1:%d", apiPort)
-	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
 		return fmt.Errorf("failed to connect to Xray API: %w", err)
 	}
@@ -48,19 +66,23 @@ func (x *XrayAPI) Init(apiPort int) error {
 
 	hsClient := command.NewHandlerServiceClient(conn)
 	ssClient := statsService.NewStatsServiceClient(conn)
+	rsClient := routerService.NewRoutingServiceClient(conn)
+	lsClient := logService.NewLoggerServiceClient(conn)
 
 	x.HandlerServiceClient = &hsClient
 	x.StatsServiceClient = &ssClient
+	x.RoutingServiceClient = &rsClient
+	x.LoggerServiceClient = &lsClient
 
 	return nil
 }
 
+// Close closes the connection. The service clients are kept, as others may
+// still hold the shared instance; their calls fail with an error from then on.
 func (x *XrayAPI) Close() {
 	if x.grpcClient != nil {
 		x.grpcClient.Close()
 	}
-	x.HandlerServiceClient = nil
-	x.StatsServiceClient = nil
 	x.isConnected = false
 }
 
@@ -80,14 +102,18 @@ func (x *XrayAPI) AddInbound(inbound []byte) error {
 	}
 	inboundConfig := command.AddInboundRequest{Inbound: config}
 
-	_, err = client.AddInbound(context.Background(), &inboundConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), apiCallTimeout)
+	defer cancel()
+	_, err = client.AddInbound(ctx, &inboundConfig)
 
 	return err
 }
 
 func (x *XrayAPI) DelInbound(tag string) error {
 	client := *x.HandlerServiceClient
-	_, err := client.RemoveInbound(context.Background(), &command.RemoveInboundRequest{
+	ctx, cancel := context.WithTimeout(context.Background(), apiCallTimeout)
+	defer cancel()
+	_, err := client.RemoveInbound(ctx, &command.RemoveInboundRequest{
 		Tag: tag,
 	})
 	return err
@@ -135,6 +161,8 @@ func (x *XrayAPI) AddUser(Protocol string, inboundTag string, user map[string]an
 				Email: user["email"].(string),
 			})
 		}
+	case "wireguard":
+		return common.NewError("wireguard peers can not be added by api")
 	default:
 		return nil
 	}
@@ -152,6 +180,7 @@ func (x *XrayAPI) AddUser(Protocol string, inboundTag string, user map[string]an
 		Tag: inboundTag,
 		Operation: serial.ToTypedMessage(&command.AddUserOperation{
 			User: &protocol.User{
+				Level:   userLevel(user),
 				Email:   user["email"].(string),
 				Account: account,
 			},
@@ -167,6 +196,25 @@ func (x *XrayAPI) AddUser(Protocol string, inboundTag string, user map[string]an
 	return nil
 }
 
+// userLevel returns the policy level of a user. Speed-limited clients use their
+// speed limit as level; callers pass it as "level", raw client settings carry
+// it as "speedLimit".
+func userLevel(user map[string]any) uint32 {
+	for _, key := range []string{"level", "speedLimit"} {
+		switch v := user[key].(type) {
+		case int:
+			if v > 0 {
+				return uint32(v)
+			}
+		case float64:
+			if v > 0 {
+				return uint32(v)
+			}
+		}
+	}
+	return 0
+}
+
 func (x *XrayAPI) RemoveUser(inboundTag, email string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -185,6 +233,125 @@ func (x *XrayAPI) RemoveUser(inboundTag, email string) error {
 	return nil
 }
 
+// GetInboundUsers returns the users an inbound has right now, their emails
+// mapped to their credentials: the id of vmess and vless users, the password
+// of trojan and shadowsocks users. The credential is empty when the account
+// is of another kind.
+func (x *XrayAPI) GetInboundUsers(inboundTag string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := (*x.HandlerServiceClient).GetInboundUsers(ctx, &command.GetInboundUserRequest{Tag: inboundTag})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get inbound users: %w", err)
+	}
+	users := make(map[string]string, len(resp.Users))
+	for _, user := range resp.Users {
+		credential := ""
+		if user.Account != nil {
+			if account, err := user.Account.GetInstance(); err == nil {
+				switch account := account.(type) {
+				case *vmess.Account:
+					credential = account.Id
+				case *vless.Account:
+					credential = account.Id
+				case *trojan.Account:
+					credential = account.Password
+				case *shadowsocks.Account:
+					credential = account.Password
+				case *shadowsocks_2022.Account:
+					credential = account.Key
+				}
+			}
+		}
+		users[user.Email] = credential
+	}
+	return users, nil
+}
+
+// AddRule adds a routing rule given in the JSON form of the config file. The
+// rule needs a ruleTag to be removed again. With shouldAppend false, the rule
+// replaces all existing rules.
+func (x *XrayAPI) AddRule(rule []byte, shouldAppend bool) error {
+	if x.RoutingServiceClient == nil {
+		return common.NewError("xray api is not initialized")
+	}
+	routerConfig := &conf.RouterConfig{RuleList: []json.RawMessage{rule}}
+	config, err := routerConfig.Build()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err = (*x.RoutingServiceClient).AddRule(ctx, &routerService.AddRuleRequest{
+		Config:       serial.ToTypedMessage(config),
+		ShouldAppend: shouldAppend,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add rule: %w", err)
+	}
+	return nil
+}
+
+// ReplaceRules replaces all routing rules and balancers with those of a routing
+// config given in the JSON form of the config file. Its other settings are
+// left as Xray started with them.
+func (x *XrayAPI) ReplaceRules(routing []byte) error {
+	if x.RoutingServiceClient == nil {
+		return common.NewError("xray api is not initialized")
+	}
+	routerConfig := &conf.RouterConfig{}
+	if err := json.Unmarshal(routing, routerConfig); err != nil {
+		return err
+	}
+	config, err := routerConfig.Build()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err = (*x.RoutingServiceClient).AddRule(ctx, &routerService.AddRuleRequest{
+		Config:       serial.ToTypedMessage(config),
+		ShouldAppend: false,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to replace rules: %w", err)
+	}
+	return nil
+}
+
+// RestartLogger closes and opens the log files of Xray again, e.g. after they
+// were rotated. The log settings stay as Xray started with them.
+func (x *XrayAPI) RestartLogger() error {
+	if x.LoggerServiceClient == nil {
+		return common.NewError("xray api is not initialized")
+	}
+	_, err := (*x.LoggerServiceClient).RestartLogger(context.Background(), &logService.RestartLoggerRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to restart logger: %w", err)
+	}
+	return nil
+}
+
+func (x *XrayAPI) RemoveRule(ruleTag string) error {
+	if x.RoutingServiceClient == nil {
+		return common.NewError("xray api is not initialized")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_, err := (*x.RoutingServiceClient).RemoveRule(ctx, &routerService.RemoveRuleRequest{RuleTag: ruleTag})
+	if err != nil {
+		return fmt.Errorf("failed to remove rule: %w", err)
+	}
+	return nil
+}
+
 func (x *XrayAPI) GetTraffic(reset bool) ([]*Traffic, []*ClientTraffic, error) {
 	if x.grpcClient == nil {
 		return nil, nil, common.NewError("xray api is not initialized")
@@ -211,6 +378,10 @@ func (x *XrayAPI) GetTraffic(reset bool) ([]*Traffic, []*ClientTraffic, error) {
 
 	for _, stat := range resp.GetStat() {
 		if matches := trafficRegex.FindStringSubmatch(stat.Name); len(matches) == 4 {
+			if email, ok := strings.CutPrefix(matches[2], WireguardPeerTagPrefix); ok && matches[1] == "outbound" {
+				processClientTraffic([]string{matches[0], email, matches[3]}, stat.Value, emailTrafficMap)
+				continue
+			}
 			processTraffic(matches, stat.Value, tagTrafficMap)
 		} else if matches := clientTrafficRegex.FindStringSubmatch(stat.Name); len(matches) == 3 {
 			processClientTraffic(matches, stat.Value, emailTrafficMap)
@@ -219,6 +390,54 @@ func (x *XrayAPI) GetTraffic(reset bool) ([]*Traffic, []*ClientTraffic, error) {
 	return mapToSlice(tagTrafficMap), mapToSlice(emailTrafficMap), nil
 }
 
+// GetStatsOnline returns how many IPs of a user are online. A user that has
+// not been online since Xray started is reported as 0.
+func (x *XrayAPI) GetStatsOnline(email string) (int64, error) {
+	if x.grpcClient == nil || x.StatsServiceClient == nil {
+		return 0, common.NewError("xray api is not initialized")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	resp, err := (*x.StatsServiceClient).GetStatsOnline(ctx, &statsService.GetStatsRequest{Name: onlineStatName(email)})
+	if status.Code(err) == codes.NotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return resp.GetStat().GetValue(), nil
+}
+
+// GetStatsOnlineIpList returns the online IPs of a user, each with the unix
+// time it was last seen.
+func (x *XrayAPI) GetStatsOnlineIpList(email string) (map[string]int64, error) {
+	if x.grpcClient == nil || x.StatsServiceClient == nil {
+		return nil, common.NewError("xray api is not initialized")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	resp, err := (*x.StatsServiceClient).GetStatsOnlineIpList(ctx, &statsService.GetStatsRequest{Name: onlineStatName(email)})
+	if status.Code(err) == codes.NotFound {
+		return map[string]int64{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ips := resp.GetIps()
+	if ips == nil {
+		ips = map[string]int64{}
+	}
+	return ips, nil
+}
+
+func onlineStatName(email string) string {
+	return "user>>>" + email + ">>>online"
+}
+
 func processTraffic(matches []string, value int64, trafficMap map[string]*Traffic) {
 	isInbound := matches[1] == "inbound"
 	tag := matches[2]
@@ -0,0 +1,195 @@
+package xray
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/connectivity"
+)
+
+// apiCallTimeout is how long a call to the API may take when the caller set
+// no deadline of its own.
+const apiCallTimeout = 5 * time.Second
+
+// APICallStats are the metrics of one method of the API.
+type APICallStats struct {
+	Method     string  `json:"method"`
+	Calls      uint64  `json:"calls"`
+	Errors     uint64  `json:"errors"`
+	AvgMillis  float64 `json:"avgMillis"`
+	MaxMillis  float64 `json:"maxMillis"`
+	LastCallAt int64   `json:"lastCallAt"`
+	LastError  string  `json:"lastError"`
+
+	totalMillis float64
+}
+
+// APIHealth is the state of the shared connection to the API.
+type APIHealth struct {
+	Connected   bool   `json:"connected"`
+	Target      string `json:"target"`
+	State       string `json:"state"`
+	Connects    int    `json:"connects"`
+	LastSuccess int64  `json:"lastSuccess"`
+	LastError   string `json:"lastError"`
+	LastErrorAt int64  `json:"lastErrorAt"`
+}
+
+var (
+	apiStatsLock   sync.Mutex
+	apiStats       = map[string]*APICallStats{}
+	apiLastSuccess time.Time
+	apiLastError   string
+	apiLastErrorAt time.Time
+)
+
+// observeAPICall records the metrics of every call to the API, and gives the
+// calls without a deadline the default timeout.
+func observeAPICall(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, apiCallTimeout)
+		defer cancel()
+	}
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	millis := float64(time.Since(start).Microseconds()) / 1000
+
+	apiStatsLock.Lock()
+	defer apiStatsLock.Unlock()
+	name := path.Base(method)
+	stats, ok := apiStats[name]
+	if !ok {
+		stats = &APICallStats{Method: name}
+		apiStats[name] = stats
+	}
+	stats.Calls++
+	stats.totalMillis += millis
+	stats.AvgMillis = stats.totalMillis / float64(stats.Calls)
+	stats.MaxMillis = max(stats.MaxMillis, millis)
+	stats.LastCallAt = start.Unix()
+	if err != nil {
+		stats.Errors++
+		stats.LastError = err.Error()
+		apiLastError = err.Error()
+		apiLastErrorAt = time.Now()
+	} else {
+		apiLastSuccess = time.Now()
+	}
+	return err
+}
+
+// GetAPICallStats returns the metrics of the API methods called so far.
+func GetAPICallStats() []*APICallStats {
+	apiStatsLock.Lock()
+	defer apiStatsLock.Unlock()
+	list := make([]*APICallStats, 0, len(apiStats))
+	for _, stats := range apiStats {
+		copied := *stats
+		list = append(list, &copied)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Method < list[j].Method })
+	return list
+}
+
+// apiDialOptions are used for every connection to the API. Xray restarts
+// quickly, so reconnecting does not back off for long.
+func apiDialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithUnaryInterceptor(observeAPICall),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           backoff.Config{BaseDelay: 100 * time.Millisecond, Multiplier: 1.6, Jitter: 0.2, MaxDelay: 2 * time.Second},
+			MinConnectTimeout: 2 * time.Second,
+		}),
+	}
+}
+
+// apiTarget names what Init connects to for a port, so that a change can be
+// told.
+func apiTarget(apiPort int) string {
+	if listener := embeddedAPIListener(); listener != nil {
+		return fmt.Sprintf("embedded:%p", listener)
+	}
+	return fmt.Sprintf("127.0.0.1:%d", apiPort)
+}
+
+// APIClient is one connection to the API of the running Xray, shared by all
+// callers and safe for concurrent use. It connects again when the API port
+// changes; when Xray restarts on the same port, gRPC reconnects by itself.
+type APIClient struct {
+	mu       sync.Mutex
+	api      *XrayAPI
+	target   string
+	connects int
+}
+
+// Get returns the connection for the API port of the running Xray. It must
+// not be closed by the caller.
+func (c *APIClient) Get(apiPort int) (*XrayAPI, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	target := apiTarget(apiPort)
+	if c.api != nil && c.target == target {
+		if c.api.grpcClient.GetState() == connectivity.TransientFailure {
+			c.api.grpcClient.ResetConnectBackoff()
+		}
+		return c.api, nil
+	}
+	if c.api != nil {
+		c.api.Close()
+		c.api = nil
+	}
+	api := &XrayAPI{}
+	if err := api.Init(apiPort); err != nil {
+		apiStatsLock.Lock()
+		apiLastError = err.Error()
+		apiLastErrorAt = time.Now()
+		apiStatsLock.Unlock()
+		return nil, err
+	}
+	c.api, c.target = api, target
+	c.connects++
+	return api, nil
+}
+
+// Close drops the connection, after Xray stopped.
+func (c *APIClient) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.api != nil {
+		c.api.Close()
+		c.api = nil
+		c.target = ""
+	}
+}
+
+func (c *APIClient) Health() *APIHealth {
+	c.mu.Lock()
+	// The embedded target names the connection; only the kind is of interest.
+	target, _, _ := strings.Cut(c.target, ":0x")
+	health := &APIHealth{Target: target, Connects: c.connects, State: "Closed"}
+	if c.api != nil {
+		state := c.api.grpcClient.GetState()
+		health.State = state.String()
+		health.Connected = state == connectivity.Ready
+	}
+	c.mu.Unlock()
+
+	apiStatsLock.Lock()
+	defer apiStatsLock.Unlock()
+	if !apiLastSuccess.IsZero() {
+		health.LastSuccess = apiLastSuccess.Unix()
+	}
+	if !apiLastErrorAt.IsZero() {
+		health.LastError = apiLastError
+		health.LastErrorAt = apiLastErrorAt.Unix()
+	}
+	return health
+}
@@ -0,0 +1,65 @@
+package xray
+
+import (
+	"testing"
+)
+
+func TestAPIClientReconnectsOnPortChange(t *testing.T) {
+	client := &APIClient{}
+	defer client.Close()
+
+	first, err := client.Get(10085)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := client.Get(10085)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != first {
+		t.Fatal("the same port connected again")
+	}
+
+	second, err := client.Get(10086)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Fatal("a new port kept the old connection")
+	}
+	if health := client.Health(); health.Connects != 2 || health.Target != "127.0.0.1:10086" {
+		t.Fatalf("health %+v, want 2 connects to the new port", health)
+	}
+
+	// Callers may still hold the old connection; it fails instead of
+	// panicking.
+	if err := first.RemoveUser("in", "a"); err == nil {
+		t.Fatal("a closed connection removed a user")
+	}
+	if _, err := first.GetInboundUsers("in"); err == nil {
+		t.Fatal("a closed connection listed users")
+	}
+
+	client.Close()
+	if err := second.RemoveUser("in", "a"); err == nil {
+		t.Fatal("a closed connection removed a user")
+	}
+	third, err := client.Get(10086)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == second {
+		t.Fatal("a closed client returned the closed connection")
+	}
+}
+
+func TestAPIClientRejectsInvalidPort(t *testing.T) {
+	client := &APIClient{}
+	defer client.Close()
+	if _, err := client.Get(0); err == nil {
+		t.Fatal("connected to port 0")
+	}
+	if health := client.Health(); health.LastError == "" {
+		t.Fatal("the failed connect was not reported")
+	}
+}
@@ -12,4 +12,7 @@ type ClientTraffic struct {
 	Total      int64  `json:"total" form:"total"`
 	Reset      int    `json:"reset" form:"reset" gorm:"default:0"`
 	LastOnline int64  `json:"lastOnline" form:"lastOnline" gorm:"default:0"`
+	FairUse    int    `json:"fairUse" form:"fairUse" gorm:"default:0"`
+	HardCap    int64  `json:"hardCap" form:"hardCap" gorm:"default:0"`
+	Throttled  bool   `json:"throttled" form:"throttled" gorm:"default:false"`
 }
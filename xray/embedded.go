@@ -0,0 +1,203 @@
+package xray
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"x-ui/config"
+	"x-ui/util/common"
+
+	applog "github.com/xtls/xray-core/app/log"
+	logCommand "github.com/xtls/xray-core/app/log/command"
+	handlerCommand "github.com/xtls/xray-core/app/proxyman/command"
+	routerCommand "github.com/xtls/xray-core/app/router/command"
+	statsCommand "github.com/xtls/xray-core/app/stats/command"
+	xlog "github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/infra/conf/serial"
+	_ "github.com/xtls/xray-core/main/distro/all"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// In embedded mode xray-core runs inside the panel. There is no API inbound;
+// the gRPC services of the API are served over an in-memory connection, so
+// XrayAPI keeps working the same without a port.
+
+var (
+	embeddedLock      sync.Mutex
+	embeddedListener  *bufconn.Listener
+	embeddedLogWriter *LogWriter
+)
+
+func init() {
+	// The console log of the embedded core goes where the log of the binary
+	// goes, instead of to the stdout of the panel.
+	applog.RegisterHandlerCreator(applog.LogType_Console, func(applog.LogType, applog.HandlerCreatorOptions) (xlog.Handler, error) {
+		return xlog.NewLogger(func() xlog.Writer { return &embeddedLog{} }), nil
+	})
+}
+
+type embeddedLog struct{}
+
+func (w *embeddedLog) Write(s string) error {
+	embeddedLock.Lock()
+	writer := embeddedLogWriter
+	embeddedLock.Unlock()
+	if writer != nil {
+		writer.Write([]byte(time.Now().Format("2006/01/02 15:04:05.000000") + " " + s))
+	}
+	return nil
+}
+
+func (w *embeddedLog) Close() error {
+	return nil
+}
+
+// NewEmbeddedProcess returns a process that runs xray-core in the panel
+// instead of running the binary.
+func NewEmbeddedProcess(xrayConfig *Config) *Process {
+	p := &Process{newProcess(xrayConfig)}
+	p.embedded = true
+	runtime.SetFinalizer(p, stopProcess)
+	return p
+}
+
+// embeddedAPIListener returns the in-memory connection to the API of the
+// embedded core, nil when it is not running.
+func embeddedAPIListener() *bufconn.Listener {
+	embeddedLock.Lock()
+	defer embeddedLock.Unlock()
+	return embeddedListener
+}
+
+func dialEmbeddedAPI(listener *bufconn.Listener) (*grpc.ClientConn, error) {
+	opts := append(apiDialOptions(),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	return grpc.NewClient("passthrough:///embedded", opts...)
+}
+
+// buildCoreConfig turns the config into the one of xray-core the way the
+// binary reads it, without the API inbound.
+func buildCoreConfig(xrayConfig *Config) (*core.Config, error) {
+	setAssetLocation()
+	data, err := json.Marshal(xrayConfig)
+	if err != nil {
+		return nil, common.NewErrorf("Failed to generate XRAY configuration files: %v", err)
+	}
+	jsonConfig, err := serial.DecodeJSONConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	inbounds := jsonConfig.InboundConfigs[:0]
+	for _, inbound := range jsonConfig.InboundConfigs {
+		if inbound.Tag != "api" {
+			inbounds = append(inbounds, inbound)
+		}
+	}
+	jsonConfig.InboundConfigs = inbounds
+	return jsonConfig.Build()
+}
+
+// setAssetLocation points xray-core to the geo files in the bin folder, which
+// the binary finds next to itself.
+func setAssetLocation() {
+	if _, ok := os.LookupEnv("XRAY_LOCATION_ASSET"); ok {
+		return
+	}
+	if _, ok := os.LookupEnv("xray.location.asset"); ok {
+		return
+	}
+	if dir, err := filepath.Abs(config.GetBinFolderPath()); err == nil {
+		os.Setenv("XRAY_LOCATION_ASSET", dir)
+	}
+}
+
+// TestEmbeddedConfig checks a config the way "xray -test" does, with the
+// embedded core.
+func TestEmbeddedConfig(xrayConfig *Config) error {
+	coreConfig, err := buildCoreConfig(xrayConfig)
+	if err != nil {
+		return common.NewError("invalid Xray config:", err)
+	}
+	instance, err := core.New(coreConfig)
+	restoreEmbeddedLogHandler()
+	if err != nil {
+		return common.NewError("invalid Xray config:", err)
+	}
+	instance.Close()
+	return nil
+}
+
+func (p *process) startEmbedded() error {
+	coreConfig, err := buildCoreConfig(p.config)
+	if err != nil {
+		return err
+	}
+	instance, err := core.New(coreConfig)
+	if err != nil {
+		return err
+	}
+	installEmbeddedLogHandler(instance, p.config.LogConfig)
+
+	server := grpc.NewServer()
+	for _, serviceConfig := range []any{
+		&handlerCommand.Config{},
+		&statsCommand.Config{},
+		&routerCommand.Config{},
+		&logCommand.Config{},
+	} {
+		service, err := core.CreateObject(instance, serviceConfig)
+		if err != nil {
+			instance.Close()
+			return err
+		}
+		service.(interface{ Register(*grpc.Server) }).Register(server)
+	}
+
+	embeddedLock.Lock()
+	embeddedLogWriter = p.logWriter
+	embeddedLock.Unlock()
+	if err := instance.Start(); err != nil {
+		instance.Close()
+		return err
+	}
+
+	listener := bufconn.Listen(1 << 20)
+	go server.Serve(listener)
+	embeddedLock.Lock()
+	embeddedListener = listener
+	embeddedLock.Unlock()
+
+	p.instance = instance
+	p.apiServer = server
+	p.version = core.Version()
+	p.refreshAPIPort()
+	return nil
+}
+
+func (p *process) stopEmbedded() error {
+	embeddedLock.Lock()
+	embeddedListener = nil
+	if embeddedLogs != nil {
+		embeddedLogs.close()
+		embeddedLogs = nil
+	}
+	embeddedLock.Unlock()
+	p.apiServer.Stop()
+	err := p.instance.Close()
+	p.instance = nil
+	return err
+}
@@ -0,0 +1,204 @@
+package xray
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"x-ui/util/common"
+	"x-ui/util/json_util"
+
+	applog "github.com/xtls/xray-core/app/log"
+	xlog "github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/core"
+)
+
+// The logger of xray-core reads its settings only when it starts. In embedded
+// mode embeddedLogHandler sits in front of it, so that the log level and the
+// access log can be changed while the core runs: messages the logger of the
+// core would drop are written by loggers of its own.
+
+var embeddedLogs *embeddedLogHandler
+
+// logSettings is the log section of the config, the way the core reads it.
+type logSettings struct {
+	level  xlog.Severity
+	error  string
+	access string
+	dnsLog bool
+}
+
+func parseLogSettings(logConfig json_util.RawMessage) logSettings {
+	var raw struct {
+		Access   string `json:"access"`
+		Error    string `json:"error"`
+		LogLevel string `json:"loglevel"`
+		DNSLog   bool   `json:"dnsLog"`
+	}
+	if len(logConfig) == 0 || json.Unmarshal(logConfig, &raw) != nil {
+		// The core logs warnings to the console without a log section.
+		return logSettings{level: xlog.Severity_Warning, access: "none"}
+	}
+	settings := logSettings{error: raw.Error, access: raw.Access, dnsLog: raw.DNSLog}
+	switch strings.ToLower(raw.LogLevel) {
+	case "debug":
+		settings.level = xlog.Severity_Debug
+	case "info":
+		settings.level = xlog.Severity_Info
+	case "error":
+		settings.level = xlog.Severity_Error
+	case "none":
+		settings.level = xlog.Severity_Unknown
+		settings.error = "none"
+		settings.access = "none"
+	default:
+		settings.level = xlog.Severity_Warning
+	}
+	if settings.error == "none" {
+		settings.level = xlog.Severity_Unknown
+	}
+	return settings
+}
+
+// newLogOutput returns a logger writing where a log path of the config
+// points: "" is the console, "none" nothing.
+func newLogOutput(path string) (xlog.Handler, error) {
+	switch path {
+	case "none":
+		return nil, nil
+	case "":
+		return xlog.NewLogger(func() xlog.Writer { return &embeddedLog{} }), nil
+	}
+	creator, err := xlog.CreateFileLogWriter(path)
+	if err != nil {
+		return nil, err
+	}
+	return xlog.NewLogger(creator), nil
+}
+
+type embeddedLogHandler struct {
+	mu   sync.RWMutex
+	core xlog.Handler
+	// started is what the logger of the core uses, current what is wanted.
+	started logSettings
+	current logSettings
+
+	errorLog  xlog.Handler
+	accessLog xlog.Handler
+}
+
+func newEmbeddedLogHandler(core xlog.Handler, logConfig json_util.RawMessage) *embeddedLogHandler {
+	settings := parseLogSettings(logConfig)
+	return &embeddedLogHandler{core: core, started: settings, current: settings}
+}
+
+func (h *embeddedLogHandler) Handle(msg xlog.Message) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	switch m := msg.(type) {
+	case *xlog.GeneralMessage:
+		if m.Severity > h.current.level {
+			return
+		}
+		if m.Severity > h.started.level {
+			if h.errorLog != nil {
+				h.errorLog.Handle(msg)
+			}
+			return
+		}
+	case *xlog.AccessMessage, *xlog.DNSLog:
+		if h.current.access == h.started.access {
+			break
+		}
+		if _, ok := msg.(*xlog.DNSLog); ok && !h.current.dnsLog {
+			return
+		}
+		if h.accessLog != nil {
+			h.accessLog.Handle(msg)
+		}
+		return
+	}
+	h.core.Handle(msg)
+}
+
+// set changes the log to a new log section. Only the log level and the access
+// log may differ from the one the core started with.
+func (h *embeddedLogHandler) set(logConfig json_util.RawMessage) error {
+	settings := parseLogSettings(logConfig)
+	var errorLog, accessLog xlog.Handler
+	var err error
+	if settings.level > h.started.level {
+		if errorLog, err = newLogOutput(settings.error); err != nil {
+			return err
+		}
+	}
+	if settings.access != h.started.access {
+		if accessLog, err = newLogOutput(settings.access); err != nil {
+			closeLogOutput(errorLog)
+			return err
+		}
+	}
+
+	h.mu.Lock()
+	oldErrorLog, oldAccessLog := h.errorLog, h.accessLog
+	h.current, h.errorLog, h.accessLog = settings, errorLog, accessLog
+	h.mu.Unlock()
+	closeLogOutput(oldErrorLog)
+	closeLogOutput(oldAccessLog)
+	return nil
+}
+
+func (h *embeddedLogHandler) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	closeLogOutput(h.errorLog)
+	closeLogOutput(h.accessLog)
+	h.errorLog, h.accessLog = nil, nil
+}
+
+func closeLogOutput(handler xlog.Handler) {
+	if closer, ok := handler.(interface{ Close() error }); ok {
+		closer.Close()
+	}
+}
+
+// installEmbeddedLogHandler puts the handler in front of the logger of a new
+// core.
+func installEmbeddedLogHandler(instance *core.Instance, logConfig json_util.RawMessage) {
+	coreLog, ok := instance.GetFeature((*applog.Instance)(nil)).(*applog.Instance)
+	if !ok {
+		return
+	}
+	handler := newEmbeddedLogHandler(coreLog, logConfig)
+	embeddedLock.Lock()
+	embeddedLogs = handler
+	embeddedLock.Unlock()
+	xlog.RegisterHandler(handler)
+}
+
+// restoreEmbeddedLogHandler puts the handler of the running core back, after
+// another core was created e.g. to test a config, which takes over the log.
+func restoreEmbeddedLogHandler() {
+	embeddedLock.Lock()
+	handler := embeddedLogs
+	embeddedLock.Unlock()
+	if handler != nil {
+		xlog.RegisterHandler(handler)
+	}
+}
+
+// SetEmbeddedLog changes the log level and the access log of the running
+// embedded core to those of a log section.
+func (p *Process) SetEmbeddedLog(logConfig json_util.RawMessage) error {
+	if !p.embedded || !p.IsRunning() {
+		return common.NewError("xray is not running embedded")
+	}
+	embeddedLock.Lock()
+	handler := embeddedLogs
+	embeddedLock.Unlock()
+	if handler == nil {
+		return common.NewError("the log of the embedded core can not be changed")
+	}
+	return handler.set(logConfig)
+}
@@ -3,6 +3,7 @@ package xray
 import (
 	"regexp"
 	"strings"
+	"sync"
 
 	"x-ui/logger"
 )
@@ -11,8 +12,35 @@ func NewLogWriter() *LogWriter {
 	return &LogWriter{}
 }
 
+// recentLogLines is how many of the last lines of Xray are kept for crash
+// reports.
+const recentLogLines = 50
+
 type LogWriter struct {
 	lastLine string
+
+	mu     sync.Mutex
+	recent []string
+}
+
+// RecentLines returns the last lines Xray wrote, oldest first.
+func (lw *LogWriter) RecentLines() []string {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return append([]string(nil), lw.recent...)
+}
+
+func (lw *LogWriter) remember(message string) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	for line := range strings.SplitSeq(message, "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lw.recent = append(lw.recent, line)
+		}
+	}
+	if over := len(lw.recent) - recentLogLines; over > 0 {
+		lw.recent = append(lw.recent[:0], lw.recent[over:]...)
+	}
 }
 
 func (lw *LogWriter) Write(m []byte) (n int, err error) {
@@ -20,6 +48,7 @@ func (lw *LogWriter) Write(m []byte) (n int, err error) {
 
 	// Convert the data to a string
 	message := strings.TrimSpace(string(m))
+	lw.remember(message)
 
 	// Check if the message contains a crash
 	if crashRegex.MatchString(message) {
@@ -2,6 +2,7 @@ package xray
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -16,6 +18,9 @@ import (
 	"x-ui/config"
 	"x-ui/logger"
 	"x-ui/util/common"
+
+	"github.com/xtls/xray-core/core"
+	"google.golang.org/grpc"
 )
 
 func GetBinaryName() string {
@@ -26,10 +31,40 @@ func GetBinaryPath() string {
 	return config.GetBinFolderPath() + "/" + GetBinaryName()
 }
 
+// GetCoresFolderPath returns where the installed versions of the Xray binary
+// are kept, each in a directory named after its version. The active one is
+// copied to GetBinaryPath.
+func GetCoresFolderPath() string {
+	return config.GetBinFolderPath() + "/cores"
+}
+
+func GetCoreBinaryPath(version string) string {
+	return GetCoresFolderPath() + "/" + version + "/" + GetBinaryName()
+}
+
+// GetBinaryVersion returns the version an Xray binary reports, or "Unknown".
+func GetBinaryVersion(binaryPath string) string {
+	data, err := exec.Command(binaryPath, "-version").Output()
+	if err != nil {
+		return "Unknown"
+	}
+	datas := bytes.Split(data, []byte(" "))
+	if len(datas) <= 1 {
+		return "Unknown"
+	}
+	return string(datas[1])
+}
+
 func GetConfigPath() string {
 	return config.GetBinFolderPath() + "/config.json"
 }
 
+// GetKnownGoodConfigPath returns where the last config Xray ran fine with is
+// kept, to roll back to after a bad one.
+func GetKnownGoodConfigPath() string {
+	return config.GetBinFolderPath() + "/config.good.json"
+}
+
 func GetGeositePath() string {
 	return config.GetBinFolderPath() + "/geosite.dat"
 }
@@ -82,6 +117,47 @@ func GetAccessLogPath() (string, error) {
 	return "", err
 }
 
+// TestConfig checks a config with "xray -test" without touching the running
+// Xray. Without the binary the config can not be checked, which is an error.
+func TestConfig(xrayConfig *Config) error {
+	if _, err := os.Stat(GetBinaryPath()); err != nil {
+		return common.NewErrorf("can not check the Xray config without the Xray binary: %v", err)
+	}
+	return TestConfigWithBinary(GetBinaryPath(), xrayConfig)
+}
+
+// TestConfigWithBinary checks a config with the given Xray binary, e.g. a
+// version that is about to be switched to.
+func TestConfigWithBinary(binaryPath string, xrayConfig *Config) error {
+	data, err := json.MarshalIndent(xrayConfig, "", "  ")
+	if err != nil {
+		return common.NewErrorf("Failed to generate XRAY configuration files: %v", err)
+	}
+	file, err := os.CreateTemp(config.GetBinFolderPath(), "config.test-*.json")
+	if err != nil {
+		return common.NewErrorf("Failed to write configuration file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(data)
+	file.Close()
+	if err != nil {
+		return common.NewErrorf("Failed to write configuration file: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, binaryPath, "-test", "-c", file.Name()).CombinedOutput()
+	if err != nil {
+		// The reason is on the last lines, after the version banner.
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		if len(lines) > 3 {
+			lines = lines[len(lines)-3:]
+		}
+		return common.NewErrorf("invalid Xray config: %v: %s", err, strings.Join(lines, "\n"))
+	}
+	return nil
+}
+
 func stopProcess(p *Process) {
 	p.Stop()
 }
@@ -99,6 +175,11 @@ func NewProcess(xrayConfig *Config) *Process {
 type process struct {
 	cmd *exec.Cmd
 
+	// embedded runs xray-core in the panel, see NewEmbeddedProcess.
+	embedded  bool
+	instance  *core.Instance
+	apiServer *grpc.Server
+
 	version string
 	apiPort int
 
@@ -121,6 +202,9 @@ func newProcess(config *Config) *process {
 }
 
 func (p *process) IsRunning() bool {
+	if p.embedded {
+		return p.instance != nil
+	}
 	if p.cmd == nil || p.cmd.Process == nil {
 		return false
 	}
@@ -141,10 +225,19 @@ func (p *process) GetResult() string {
 	return p.logWriter.lastLine
 }
 
+// GetRecentLogs returns the last lines Xray wrote.
+func (p *process) GetRecentLogs() []string {
+	return p.logWriter.RecentLines()
+}
+
 func (p *process) GetVersion() string {
 	return p.version
 }
 
+func (p *process) IsEmbedded() bool {
+	return p.embedded
+}
+
 func (p *Process) GetAPIPort() int {
 	return p.apiPort
 }
@@ -153,6 +246,25 @@ func (p *Process) GetConfig() *Config {
 	return p.config
 }
 
+// SetConfig records a config that was applied to the running Xray through the
+// API, and writes it to the config file so that it matches.
+func (p *Process) SetConfig(xrayConfig *Config) error {
+	p.config = xrayConfig
+	return writeConfig(xrayConfig)
+}
+
+func writeConfig(xrayConfig *Config) error {
+	data, err := json.MarshalIndent(xrayConfig, "", "  ")
+	if err != nil {
+		return common.NewErrorf("Failed to generate XRAY configuration files: %v", err)
+	}
+	err = os.WriteFile(GetConfigPath(), data, fs.ModePerm)
+	if err != nil {
+		return common.NewErrorf("Failed to write configuration file: %v", err)
+	}
+	return nil
+}
+
 func (p *Process) GetOnlineClients() []string {
 	p.mutex.RLock()
 	defer p.mutex.RUnlock()
@@ -181,18 +293,7 @@ func (p *process) refreshAPIPort() {
 }
 
 func (p *process) refreshVersion() {
-	cmd := exec.Command(GetBinaryPath(), "-version")
-	data, err := cmd.Output()
-	if err != nil {
-		p.version = "Unknown"
-	} else {
-		datas := bytes.Split(data, []byte(" "))
-		if len(datas) <= 1 {
-			p.version = "Unknown"
-		} else {
-			p.version = string(datas[1])
-		}
-	}
+	p.version = GetBinaryVersion(GetBinaryPath())
 }
 
 func (p *process) Start() (err error) {
@@ -207,20 +308,21 @@ func (p *process) Start() (err error) {
 		}
 	}()
 
-	data, err := json.MarshalIndent(p.config, "", "  ")
-	if err != nil {
-		return common.NewErrorf("Failed to generate XRAY configuration files: %v", err)
-	}
-
 	err = os.MkdirAll(config.GetLogFolder(), 0o770)
 	if err != nil {
 		logger.Warningf("Failed to create log folder: %s", err)
 	}
 
-	configPath := GetConfigPath()
-	err = os.WriteFile(configPath, data, fs.ModePerm)
+	// The embedded core does not read it, but the access log path is looked
+	// up in it.
+	err = writeConfig(p.config)
 	if err != nil {
-		return common.NewErrorf("Failed to write configuration file: %v", err)
+		return err
+	}
+	configPath := GetConfigPath()
+
+	if p.embedded {
+		return p.startEmbedded()
 	}
 
 	cmd := exec.Command(GetBinaryPath(), "-c", configPath)
@@ -248,6 +350,10 @@ func (p *process) Stop() error {
 		return errors.New("xray is not running")
 	}
 
+	if p.embedded {
+		return p.stopEmbedded()
+	}
+
 	if runtime.GOOS == "windows" {
 		return p.cmd.Process.Kill()
 	} else {